@@ -0,0 +1,301 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package backfill exports the delegation of a range of historical blocks.
+// Blocks are fetched in parallel from any BlockSource and written in height
+// order as JSON lines or CSV rows.  Progress is saved to a checkpoint file
+// along with the size of the output, so an interrupted backfill resumes
+// where it stopped without duplicating rows.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+const (
+	// DefaultWorkers is the number of blocks fetched concurrently when
+	// Config.Workers is zero.
+	DefaultWorkers = 8
+
+	// DefaultCheckpointInterval is the number of blocks between saved
+	// checkpoints when Config.CheckpointInterval is zero.
+	DefaultCheckpointInterval = 1000
+)
+
+// ErrReorg is returned when the blocks of the source no longer link to the
+// exported ones, because the chain reorganized since the checkpoint or
+// during the backfill.
+var ErrReorg = errors.New("chain reorganized below the exported blocks")
+
+// Config configures an Exporter.
+type Config struct {
+	// Source is the chain to export.
+	Source blocksource.BlockSource
+
+	// From and To are the first and last height to export.
+	From, To int64
+
+	// Workers is the number of blocks fetched concurrently.  Rows are
+	// still written in height order.
+	Workers int
+
+	// Policy decides the delegation of every block.
+	Policy lightmirror.PowerPolicy
+
+	// All exports a row for every block, not only delegated ones.
+	All bool
+
+	// Format is the output format.
+	Format Format
+
+	// Checkpoint, when set, makes the backfill resumable.
+	Checkpoint *CheckpointFile
+
+	// CheckpointInterval is the number of blocks between saves of the
+	// checkpoint.
+	CheckpointInterval int
+
+	// Logf, when set, receives progress messages.
+	Logf func(format string, args ...interface{})
+}
+
+// Exporter exports rows from a BlockSource.
+type Exporter struct {
+	cfg Config
+	cp  Checkpoint
+}
+
+// New creates an Exporter and loads its checkpoint.
+func New(cfg Config) (*Exporter, error) {
+	if cfg.Source == nil {
+		return nil, errors.New("backfill: no block source")
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.CheckpointInterval <= 0 {
+		cfg.CheckpointInterval = DefaultCheckpointInterval
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = func(string, ...interface{}) {}
+	}
+
+	e := &Exporter{cfg: cfg, cp: Checkpoint{Next: cfg.From}}
+	if cfg.Checkpoint != nil {
+		cp, err := cfg.Checkpoint.Load()
+		if err != nil {
+			return nil, fmt.Errorf("backfill: load checkpoint: %v", err)
+		}
+		if cp != nil && cp.Next > cfg.From {
+			e.cp = *cp
+		}
+	}
+	return e, nil
+}
+
+// Checkpoint returns the progress of the backfill.  The output passed to Run
+// must hold exactly Offset bytes, as OpenOutput ensures.
+func (e *Exporter) Checkpoint() Checkpoint {
+	return e.cp
+}
+
+// result is a fetched block.
+type result struct {
+	height int64
+	prev   chainhash.Hash
+	row    *Row
+	err    error
+}
+
+// Run exports the remaining blocks to out.  Progress is saved on return, also
+// when ctx is cancelled or a block cannot be fetched, so a later Run
+// resumes after the last written row.
+func (e *Exporter) Run(ctx context.Context, out io.Writer) (err error) {
+	start := e.cp.Next
+	if start > e.cfg.To {
+		return nil
+	}
+	if start > e.cfg.From {
+		hash, err := e.cfg.Source.BlockHash(ctx, start-1)
+		if err != nil {
+			return err
+		}
+		if *hash != e.cp.Hash {
+			return fmt.Errorf("%w: block %v at height %d, checkpoint has %v",
+				ErrReorg, hash, start-1, e.cp.Hash)
+		}
+	}
+
+	counter := &countingWriter{w: out}
+	w, err := newRowWriter(counter, e.cfg.Format, e.cp.Offset == 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if saveErr := e.save(w, counter); err == nil {
+			err = saveErr
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// The window bounds how far fetching runs ahead of writing.
+	window := make(chan struct{}, 4*e.cfg.Workers)
+	heights := make(chan int64)
+	results := make(chan *result)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(heights)
+		for height := start; height <= e.cfg.To; height++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case heights <- height:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < e.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for height := range heights {
+				r := e.fetch(ctx, height)
+				select {
+				case results <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	pending := make(map[int64]*result)
+	for e.cp.Next <= e.cfg.To {
+		select {
+		case r := <-results:
+			pending[r.height] = r
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		for r := pending[e.cp.Next]; r != nil; r = pending[e.cp.Next] {
+			delete(pending, r.height)
+			if err := e.write(w, r); err != nil {
+				return err
+			}
+			<-window
+
+			if (e.cp.Next-start)%int64(e.cfg.CheckpointInterval) == 0 {
+				if err := e.save(w, counter); err != nil {
+					return err
+				}
+				e.cfg.Logf("exported up to height %d, %d rows", e.cp.Next-1, e.cp.Rows)
+			}
+		}
+	}
+	return nil
+}
+
+// write writes the row of r and advances the checkpoint.
+func (e *Exporter) write(w rowWriter, r *result) error {
+	if r.err != nil {
+		return fmt.Errorf("height %d: %w", r.height, r.err)
+	}
+	if e.cp.Next > e.cfg.From && r.prev != e.cp.Hash {
+		return fmt.Errorf("%w: block %v at height %d does not extend %v",
+			ErrReorg, r.row.Hash, r.height, e.cp.Hash)
+	}
+	if e.cfg.All || r.row.Delegated {
+		if err := w.write(r.row); err != nil {
+			return err
+		}
+		e.cp.Rows++
+	}
+	e.cp.Next = r.height + 1
+	e.cp.Hash = r.row.Hash
+	return nil
+}
+
+// save flushes the written rows and saves the checkpoint.
+func (e *Exporter) save(w rowWriter, counter *countingWriter) error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	e.cp.Offset += counter.n
+	counter.n = 0
+	if e.cfg.Checkpoint == nil {
+		return nil
+	}
+	return e.cfg.Checkpoint.Save(&e.cp)
+}
+
+// fetch builds the row of the block at height.
+func (e *Exporter) fetch(ctx context.Context, height int64) *result {
+	r := &result{height: height}
+	hash, err := e.cfg.Source.BlockHash(ctx, height)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	light, err := e.cfg.Source.Mirror(ctx, hash)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if err := light.CheckMerkle(); err != nil {
+		r.err = err
+		return r
+	}
+
+	r.prev = light.BtcHeader.PrevBlock
+	r.row = &Row{
+		Height:    height,
+		Hash:      *hash,
+		Timestamp: light.BtcHeader.Timestamp,
+	}
+	if len(light.CoinBaseTx.TxOut) > 0 {
+		r.row.PayoutAddress, r.row.PayoutType = light.GetCoinbaseAddress()
+	}
+	m, err := lightmirror.ValidatePowerMarkers(&light.CoinBaseTx, e.cfg.Policy)
+	switch {
+	case err != nil:
+		// Core does not credit a delegation the policy rejects.
+		e.cfg.Logf("block %v at height %d: %v", hash, height, err)
+	case m != nil:
+		r.row.Delegated = true
+		r.row.Candidate, r.row.Reward = m.Candidate, m.Reward
+		r.row.MarkerVersion = m.Version
+	}
+	return r
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/chaingen"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// repeated returns the address made of 20 times b.
+func repeated(b byte) common.Address {
+	return common.BytesToAddress(bytes.Repeat([]byte{b}, common.AddressLength))
+}
+
+// testChain mines a chain of n blocks, counting the genesis block, each with
+// a few transactions.  Every third block delegates and block 10 carries two
+// markers.
+func testChain(n int) *chaingen.Chain {
+	c := chaingen.New(nil)
+	for height := int64(1); height < int64(n); height++ {
+		tmpl := &chaingen.Template{
+			Payout:    chaingen.P2PKH(repeated(0x22)),
+			Timestamp: time.Unix(1700000000+height*600, 0),
+		}
+		if height%2 == 1 {
+			tmpl.Payout = chaingen.P2WPKH(repeated(0x33))
+		}
+		if height%3 == 0 {
+			tmpl.Markers = append(tmpl.Markers, chaingen.CoreMarker(repeated(byte(height)), repeated(0xee)))
+		}
+		if height == 10 {
+			tmpl.Markers = append(tmpl.Markers, chaingen.CoreMarker(repeated(0xaa), repeated(0xbb)),
+				chaingen.CoreMarker(repeated(0xcc), repeated(0xdd)))
+		}
+		for i := 0; i < int(height%4); i++ {
+			tmpl.Transactions = append(tmpl.Transactions, chaingen.Spend(wire.OutPoint{Index: uint32(i)},
+				wire.NewTxOut(height, []byte{txscript.OP_TRUE})))
+		}
+		c.Mine(tmpl)
+	}
+	return c
+}
+
+// slowSource delays blocks so that they complete out of order, and fails
+// from height failAt on when set.
+type slowSource struct {
+	*blocksource.MemorySource
+	failAt int64
+}
+
+func (s *slowSource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	if s.failAt > 0 && height >= s.failAt {
+		return nil, errors.New("source unavailable")
+	}
+	time.Sleep(time.Duration(7-height%7) * time.Millisecond)
+	return s.MemorySource.BlockHash(ctx, height)
+}
+
+func TestExport(t *testing.T) {
+	c := testChain(40)
+
+	var buf bytes.Buffer
+	e, err := New(Config{
+		Source:  &slowSource{MemorySource: c.Source()},
+		From:    5,
+		To:      30,
+		Workers: 4,
+		Policy:  lightmirror.PowerPolicyStrict,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Run(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []int64{6, 9, 12, 15, 18, 21, 24, 27, 30}
+	if len(lines) != len(want) {
+		t.Fatalf("%d rows, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatal(err)
+		}
+		height := want[i]
+		if row["height"] != float64(height) {
+			t.Errorf("row %d: height %v, want %d", i, row["height"], height)
+		}
+		if row["hash"] != c.Block(height).BlockHash().String() {
+			t.Errorf("row %d: hash %v", i, row["hash"])
+		}
+		candidate := repeated(byte(height))
+		if row["candidate"] != candidate.Hex() || row["marker_version"] != float64(1) {
+			t.Errorf("row %d: candidate %v, version %v", i, row["candidate"], row["marker_version"])
+		}
+		payout := "0x2222222222222222222222222222222222222222"
+		payoutType := float64(lightmirror.PUBKEYHASH)
+		if height%2 == 1 {
+			payout = "0x3333333333333333333333333333333333333333"
+			payoutType = float64(lightmirror.WITNESS_V0_KEYHASH)
+		}
+		if row["payout_address"] != payout || row["payout_type"] != payoutType {
+			t.Errorf("row %d: payout %v of type %v", i, row["payout_address"], row["payout_type"])
+		}
+	}
+	if cp := e.Checkpoint(); cp.Next != 31 || cp.Rows != 9 || cp.Offset != int64(buf.Len()) ||
+		cp.Hash != c.Block(30).BlockHash() {
+		t.Errorf("checkpoint %+v", cp)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	c := testChain(12)
+	var buf bytes.Buffer
+	e, err := New(Config{
+		Source: c.Source(),
+		From:   8,
+		To:     11,
+		All:    true,
+		Format: FormatCSV,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Run(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		columns,
+		{"8", c.Block(8).BlockHash().String(), "2023-11-14T23:33:20Z",
+			"0x2222222222222222222222222222222222222222", "2", "", "", ""},
+		{"9", c.Block(9).BlockHash().String(), "2023-11-14T23:43:20Z",
+			"0x3333333333333333333333333333333333333333", "7",
+			"0x0909090909090909090909090909090909090909",
+			"0xEeeeeEeeeEeEeeEeEeEeeEEEeeeeEeeeeeeeEEeE", "1"},
+		// The first marker delegates under PowerPolicyFirst.
+		{"10", c.Block(10).BlockHash().String(), "2023-11-14T23:53:20Z",
+			"0x2222222222222222222222222222222222222222", "2",
+			"0xaAaAaAaaAaAaAaaAaAAAAAAAAaaaAaAaAaaAaaAa",
+			"0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB", "1"},
+		{"11", c.Block(11).BlockHash().String(), "2023-11-15T00:03:20Z",
+			"0x3333333333333333333333333333333333333333", "7", "", "", ""},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("%d records, want %d", len(records), len(want))
+	}
+	for i := range want {
+		if strings.Join(records[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("record %d:\ngot  %v\nwant %v", i, records[i], want[i])
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	c := testChain(60)
+	source := c.Source()
+
+	// The reference export runs in one go.
+	var want bytes.Buffer
+	e, err := New(Config{Source: source, From: 2, To: 55, All: true, Format: FormatCSV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Run(context.Background(), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.csv")
+	checkpoint := NewCheckpointFile(filepath.Join(dir, "checkpoint.json"))
+	run := func(source blocksource.BlockSource) error {
+		t.Helper()
+		e, err := New(Config{
+			Source:             source,
+			From:               2,
+			To:                 55,
+			All:                true,
+			Format:             FormatCSV,
+			Workers:            3,
+			Checkpoint:         checkpoint,
+			CheckpointInterval: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp := e.Checkpoint()
+		f, err := OpenOutput(out, &cp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return e.Run(context.Background(), f)
+	}
+
+	if err := run(&slowSource{MemorySource: source, failAt: 23}); err == nil {
+		t.Fatal("expected failure")
+	}
+	cp, err := checkpoint.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Next != 23 {
+		t.Errorf("checkpoint at height %d, want 23", cp.Next)
+	}
+
+	// Garbage written after the checkpoint is cut off when resuming.
+	f, err := os.OpenFile(out, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("23,partial row")
+	f.Close()
+
+	if err := run(source); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("resumed export differs:\n%s\nwant\n%s", got, want.Bytes())
+	}
+	if err := run(source); err != nil {
+		t.Fatalf("rerun of a finished backfill: %v", err)
+	}
+
+	// A reorganization below the checkpoint is detected.
+	cp.Next = 40
+	cp.Offset = 0
+	cp.Hash = c.Block(39).BlockHash()
+	if err := checkpoint.Save(cp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Fork(37, 23, &chaingen.Template{Tag: []byte("fork")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(source); !errors.Is(err, ErrReorg) {
+		t.Errorf("reorganized chain: got %v, want %v", err, ErrReorg)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	c := testChain(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var buf bytes.Buffer
+	e, err := New(Config{
+		Source: c.Source(),
+		To:     99,
+		All:    true,
+		Logf: func(format string, args ...interface{}) {
+			cancel()
+		},
+		CheckpointInterval: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Run(ctx, &buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	cp := e.Checkpoint()
+	if cp.Next < 10 || cp.Next > 99 || cp.Offset != int64(buf.Len()) ||
+		cp.Rows != int64(strings.Count(buf.String(), "\n")) {
+		t.Errorf("checkpoint %+v after %d bytes", cp, buf.Len())
+	}
+}
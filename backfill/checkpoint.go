@@ -0,0 +1,141 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backfill
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Checkpoint is how far a backfill got.  Every height below Next was
+// exported, Hash being the hash of the block at Next-1, and the output held
+// Offset bytes at that point.  Rows is the number of rows written so far.
+type Checkpoint struct {
+	Next   int64
+	Hash   chainhash.Hash
+	Offset int64
+	Rows   int64
+}
+
+type jsonCheckpoint struct {
+	Next   int64  `json:"next"`
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Rows   int64  `json:"rows"`
+}
+
+// MarshalJSON encodes the checkpoint with the hash in its usual hex form.
+func (cp *Checkpoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonCheckpoint{
+		Next:   cp.Next,
+		Hash:   cp.Hash.String(),
+		Offset: cp.Offset,
+		Rows:   cp.Rows,
+	})
+}
+
+// UnmarshalJSON decodes a checkpoint written by MarshalJSON.
+func (cp *Checkpoint) UnmarshalJSON(data []byte) error {
+	var in jsonCheckpoint
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	cp.Next, cp.Offset, cp.Rows = in.Next, in.Offset, in.Rows
+	return chainhash.Decode(&cp.Hash, in.Hash)
+}
+
+// CheckpointFile keeps a checkpoint in a JSON file.  Saves are atomic like
+// those of relayer.FileStore.
+type CheckpointFile struct {
+	path string
+}
+
+// NewCheckpointFile returns a CheckpointFile that reads and writes path.
+func NewCheckpointFile(path string) *CheckpointFile {
+	return &CheckpointFile{path: path}
+}
+
+// Load reads the checkpoint.  A missing file yields nil.
+func (f *CheckpointFile) Load() (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Save atomically replaces the checkpoint.
+func (f *CheckpointFile) Save(cp *Checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// OpenOutput opens the output file at path for a backfill resuming at cp,
+// which may be nil to start afresh.  Rows written after the checkpoint was
+// saved are cut off so that none is exported twice.
+func OpenOutput(path string, cp *Checkpoint) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var offset int64
+	if cp != nil {
+		offset = cp.Offset
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() < offset {
+		f.Close()
+		return nil, fmt.Errorf("%s holds %d bytes, checkpoint expects %d",
+			path, info.Size(), offset)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backfill
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestCheckpointFile(t *testing.T) {
+	dir := t.TempDir()
+	f := NewCheckpointFile(filepath.Join(dir, "checkpoint.json"))
+
+	cp, err := f.Load()
+	if err != nil || cp != nil {
+		t.Fatalf("missing file: got %+v, %v", cp, err)
+	}
+
+	want := &Checkpoint{Next: 812345, Hash: chainhash.Hash{0xab, 0xcd}, Offset: 4096, Rows: 77}
+	if err := f.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	cp, err = f.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cp != *want {
+		t.Errorf("got %+v, want %+v", cp, want)
+	}
+}
+
+func TestOpenOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenOutput(path, &Checkpoint{Offset: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("xy")
+	f.Close()
+	if got, _ := os.ReadFile(path); string(got) != "0123xy" {
+		t.Errorf("resumed output %q, want %q", got, "0123xy")
+	}
+
+	if _, err := OpenOutput(path, &Checkpoint{Offset: 7}); err == nil {
+		t.Errorf("output shorter than the checkpoint accepted")
+	}
+
+	f, err = OpenOutput(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got, _ := os.ReadFile(path); len(got) != 0 {
+		t.Errorf("fresh output holds %q", got)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backfill
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Row is an exported block.
+type Row struct {
+	Height    int64
+	Hash      chainhash.Hash
+	Timestamp time.Time
+
+	// PayoutAddress is the address paid by the first coinbase output when
+	// PayoutType is lightmirror.PUBKEYHASH or WITNESS_V0_KEYHASH.
+	PayoutAddress common.Address
+	PayoutType    int
+
+	// Delegated reports whether the block delegates its power to
+	// Candidate, with MarkerVersion the version of the marker.
+	Delegated     bool
+	Candidate     common.Address
+	Reward        common.Address
+	MarkerVersion byte
+}
+
+// columns are the names of the fields of a row, in CSV order.
+var columns = []string{
+	"height",
+	"hash",
+	"timestamp",
+	"payout_address",
+	"payout_type",
+	"candidate",
+	"reward",
+	"marker_version",
+}
+
+// fields returns the row formatted as the values of columns.  Addresses
+// are empty when not set.
+func (r *Row) fields() []string {
+	f := []string{
+		strconv.FormatInt(r.Height, 10),
+		r.Hash.String(),
+		r.Timestamp.UTC().Format(time.RFC3339),
+		"",
+		strconv.Itoa(r.PayoutType),
+		"",
+		"",
+		"",
+	}
+	if r.PayoutType != lightmirror.NOT_SUPPORT {
+		f[3] = r.PayoutAddress.Hex()
+	}
+	if r.Delegated {
+		f[5] = r.Candidate.Hex()
+		f[6] = r.Reward.Hex()
+		f[7] = strconv.Itoa(int(r.MarkerVersion))
+	}
+	return f
+}
+
+// jsonRow is the JSON form of a Row.
+type jsonRow struct {
+	Height        int64  `json:"height"`
+	Hash          string `json:"hash"`
+	Timestamp     string `json:"timestamp"`
+	PayoutAddress string `json:"payout_address,omitempty"`
+	PayoutType    int    `json:"payout_type"`
+	Candidate     string `json:"candidate,omitempty"`
+	Reward        string `json:"reward,omitempty"`
+	MarkerVersion *byte  `json:"marker_version,omitempty"`
+}
+
+// MarshalJSON encodes the row with the fields of the CSV format.
+func (r *Row) MarshalJSON() ([]byte, error) {
+	f := r.fields()
+	out := jsonRow{
+		Height:        r.Height,
+		Hash:          f[1],
+		Timestamp:     f[2],
+		PayoutAddress: f[3],
+		PayoutType:    r.PayoutType,
+		Candidate:     f[5],
+		Reward:        f[6],
+	}
+	if r.Delegated {
+		version := r.MarkerVersion
+		out.MarkerVersion = &version
+	}
+	return json.Marshal(&out)
+}
+
+// Format is an output format.
+type Format int
+
+const (
+	// FormatJSONL writes a JSON object per line.
+	FormatJSONL Format = iota
+
+	// FormatCSV writes comma separated values after a header line.
+	FormatCSV
+)
+
+// ParseFormat returns the format called name, jsonl or csv.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "jsonl":
+		return FormatJSONL, nil
+	case "csv":
+		return FormatCSV, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", name)
+}
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatJSONL:
+		return "jsonl"
+	case FormatCSV:
+		return "csv"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// rowWriter buffers rows in a format.
+type rowWriter interface {
+	write(r *Row) error
+	flush() error
+}
+
+// newRowWriter returns a writer of rows to w.  Header requests the CSV
+// header line, which is only written at the start of the output.
+func newRowWriter(w io.Writer, format Format, header bool) (rowWriter, error) {
+	switch format {
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+
+	case FormatCSV:
+		cw := &csvWriter{w: csv.NewWriter(w)}
+		if header {
+			if err := cw.w.Write(columns); err != nil {
+				return nil, err
+			}
+		}
+		return cw, nil
+	}
+	return nil, fmt.Errorf("unknown format %v", format)
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) write(r *Row) error {
+	return w.enc.Encode(r)
+}
+
+func (w *jsonlWriter) flush() error {
+	return w.w.Flush()
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvWriter) write(r *Row) error {
+	return w.w.Write(r.fields())
+}
+
+func (w *csvWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
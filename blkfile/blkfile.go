@@ -0,0 +1,147 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package blkfile reads mirrors out of the blocks/blk*.dat files of a Bitcoin
+// Core data directory, without a running node.
+//
+// Block files are a sequence of records, each made of the network magic, the
+// little endian length of the block and the serialized block.  Bitcoin Core
+// preallocates files, so a file may end with zeros, and since version 28 it
+// obfuscates them by XORing every byte with the 8 byte key of blocks/xor.dat,
+// starting at the beginning of the file.  Blocks are stored in the order they
+// were received, which is not the chain order; Index reconstructs the best
+// chain from the headers.
+package blkfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// xorKeySize is the size of the obfuscation key of blocks/xor.dat.
+const xorKeySize = 8
+
+var (
+	// ErrBadMagic is returned when a record does not start with the
+	// network magic.
+	ErrBadMagic = errors.New("bad network magic")
+
+	// ErrBadLength is returned when the length of a record cannot be the
+	// length of a block.
+	ErrBadLength = errors.New("bad block length")
+
+	// ErrTruncated is returned when a file ends in the middle of a record,
+	// as it does when the node crashed while writing.
+	ErrTruncated = errors.New("truncated block record")
+
+	// ErrBadXORKey is returned when blocks/xor.dat is not a valid key.
+	ErrBadXORKey = errors.New("bad obfuscation key")
+)
+
+// ReadXORKey returns the obfuscation key of the blocks directory dir, or nil
+// when its files are not obfuscated.
+func ReadXORKey(dir string) ([]byte, error) {
+	key, err := os.ReadFile(filepath.Join(dir, "xor.dat"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != xorKeySize {
+		return nil, fmt.Errorf("%w: %d bytes, want %d", ErrBadXORKey,
+			len(key), xorKeySize)
+	}
+	for _, b := range key {
+		if b != 0 {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// xorAt deobfuscates b, read at offset off of its file, in place.
+func xorAt(b []byte, key []byte, off int64) {
+	if len(key) == 0 {
+		return
+	}
+	k := int(off % int64(len(key)))
+	for i := range b {
+		b[i] ^= key[k]
+		if k++; k == len(key) {
+			k = 0
+		}
+	}
+}
+
+// Reader iterates the blocks of a block file in file order.
+type Reader struct {
+	r   io.Reader
+	net wire.BitcoinNet
+	key []byte
+	off int64
+}
+
+// NewReader returns a reader of the block file r for the network net, whose
+// bytes are obfuscated with key unless it is empty.
+func NewReader(r io.Reader, net wire.BitcoinNet, key []byte) *Reader {
+	return &Reader{r: r, net: net, key: key}
+}
+
+// read fills b with the next deobfuscated bytes of the file.
+func (r *Reader) read(b []byte) error {
+	n, err := io.ReadFull(r.r, b)
+	xorAt(b[:n], r.key, r.off)
+	r.off += int64(n)
+	return err
+}
+
+// Next returns the next serialized block and its offset in the file.  It
+// returns io.EOF at the end of the file, including the zeros preallocated by
+// Bitcoin Core.
+func (r *Reader) Next() ([]byte, int64, error) {
+	start := r.off
+	var prefix [8]byte
+	err := r.read(prefix[:])
+	switch {
+	case err == io.EOF:
+		return nil, 0, io.EOF
+	case err == io.ErrUnexpectedEOF:
+		return nil, 0, fmt.Errorf("%w: record prefix at offset %d", ErrTruncated, start)
+	case err != nil:
+		return nil, 0, err
+	}
+
+	magic := wire.BitcoinNet(binary.LittleEndian.Uint32(prefix[:4]))
+	switch {
+	case magic == 0:
+		return nil, 0, io.EOF
+	case magic != r.net:
+		return nil, 0, fmt.Errorf("%w: %v at offset %d, want %v", ErrBadMagic,
+			magic, start, r.net)
+	}
+	size := binary.LittleEndian.Uint32(prefix[4:])
+	if size < wire.MaxBlockHeaderPayload || size > wire.MaxBlockPayload {
+		return nil, 0, fmt.Errorf("%w: %d bytes at offset %d", ErrBadLength,
+			size, start)
+	}
+
+	offset := r.off
+	block := make([]byte, size)
+	err = r.read(block)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("%w: block of %d bytes at offset %d",
+			ErrTruncated, size, offset)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return block, offset, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blkfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/chaingen"
+)
+
+var testParams = &chaincfg.RegressionNetParams
+
+// blkFile returns the content of a block file holding blocks, followed by
+// padding zeros and obfuscated with key.
+func blkFile(t *testing.T, key []byte, padding int, blocks ...*wire.MsgBlock) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		var prefix [8]byte
+		binary.LittleEndian.PutUint32(prefix[:4], uint32(testParams.Net))
+		binary.LittleEndian.PutUint32(prefix[4:], uint32(block.SerializeSize()))
+		buf.Write(prefix[:])
+		if err := block.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Write(make([]byte, padding))
+	b := buf.Bytes()
+	xorAt(b, key, 0)
+	return b
+}
+
+// writeBlkFile writes block file n of dir.
+func writeBlkFile(t *testing.T, dir string, n int, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, fileName(n)), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	c := chaingen.New(testParams)
+	genesis, a, b := c.Block(0), c.Mine(nil), c.Mine(nil)
+	key := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+
+	for _, key := range [][]byte{nil, key} {
+		file := blkFile(t, key, 4096, genesis, a, b)
+		r := NewReader(bytes.NewReader(file), testParams.Net, key)
+		offset := int64(8)
+		for i, want := range []*wire.MsgBlock{genesis, a, b} {
+			raw, off, err := r.Next()
+			if err != nil {
+				t.Fatalf("block %d: %v", i, err)
+			}
+			if off != offset {
+				t.Errorf("block %d at offset %d, want %d", i, off, offset)
+			}
+			var block wire.MsgBlock
+			if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+				t.Fatal(err)
+			}
+			if block.BlockHash() != want.BlockHash() {
+				t.Errorf("block %d: got %v, want %v", i, block.BlockHash(), want.BlockHash())
+			}
+			offset += int64(len(raw)) + 8
+		}
+		if _, _, err := r.Next(); err != io.EOF {
+			t.Errorf("padding: got %v, want %v", err, io.EOF)
+		}
+	}
+
+	file := blkFile(t, nil, 0, genesis, a)
+	tests := []struct {
+		name string
+		file []byte
+		want error
+	}{
+		{"truncated block", file[:len(file)-1], ErrTruncated},
+		{"truncated prefix", file[:genesis.SerializeSize()+8+5], ErrTruncated},
+		{"wrong network", blkFile(t, nil, 0, genesis)[4:], ErrBadMagic},
+		{"short length", append([]byte{0xfa, 0xbf, 0xb5, 0xda, 79, 0, 0, 0}, make([]byte, 79)...), ErrBadLength},
+		{"long length", []byte{0xfa, 0xbf, 0xb5, 0xda, 0xff, 0xff, 0xff, 0xff}, ErrBadLength},
+	}
+	for _, test := range tests {
+		r := NewReader(bytes.NewReader(test.file), testParams.Net, nil)
+		var err error
+		for err == nil {
+			_, _, err = r.Next()
+		}
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestReadXORKey(t *testing.T) {
+	dir := t.TempDir()
+	if key, err := ReadXORKey(dir); key != nil || err != nil {
+		t.Errorf("no xor.dat: got %x, %v", key, err)
+	}
+
+	path := filepath.Join(dir, "xor.dat")
+	os.WriteFile(path, make([]byte, xorKeySize), 0644)
+	if key, err := ReadXORKey(dir); key != nil || err != nil {
+		t.Errorf("zero key: got %x, %v", key, err)
+	}
+	os.WriteFile(path, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0644)
+	if key, err := ReadXORKey(dir); len(key) != xorKeySize || err != nil {
+		t.Errorf("key: got %x, %v", key, err)
+	}
+	os.WriteFile(path, []byte{1, 2, 3}, 0644)
+	if _, err := ReadXORKey(dir); !errors.Is(err, ErrBadXORKey) {
+		t.Errorf("short key: got %v, want %v", err, ErrBadXORKey)
+	}
+}
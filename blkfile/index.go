@@ -0,0 +1,388 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blkfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+var (
+	// ErrNoBlocks is returned when the block files hold no valid block.
+	ErrNoBlocks = errors.New("no blocks found")
+
+	// ErrUnknownHeight is returned when the best chain does not start at
+	// the genesis block and its first block does not encode its height.
+	ErrUnknownHeight = errors.New("cannot determine the height of the first block")
+)
+
+// location is where a block is stored.
+type location struct {
+	file   int
+	offset int64
+	size   int
+}
+
+// node is an indexed block.
+type node struct {
+	header wire.BlockHeader
+	loc    location
+	parent *node
+
+	// work is the work of the chain ending at the block, down to the
+	// first indexed ancestor.
+	work *big.Int
+}
+
+// Index is a BlockSource over the blocks of a Bitcoin Core blocks directory.
+// OpenIndex reads every block file once to index the headers; blocks are read
+// again from disk when their mirror is requested.
+//
+// The best chain is the indexed chain with the most work, the first one found
+// in file order on ties as Bitcoin Core does.  It starts at the genesis block,
+// or for a pruned node at its oldest block, whose height is then read from its
+// coinbase (BIP34).
+type Index struct {
+	dir    string
+	params *chaincfg.Params
+	key    []byte
+
+	nodes   map[chainhash.Hash]*node
+	chain   []*node
+	base    int64
+	skipped int
+
+	mu    sync.Mutex
+	files map[int]*os.File
+}
+
+// Ensure Index implements the BlockSource interface.
+var _ blocksource.BlockSource = (*Index)(nil)
+
+// OpenIndex indexes the blk*.dat files of the blocks directory dir, holding
+// blocks of the network described by params.  Blocks whose proof of work is
+// invalid are skipped, as are records truncated at the end of a file.
+func OpenIndex(dir string, params *chaincfg.Params) (*Index, error) {
+	key, err := ReadXORKey(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := blockFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &Index{
+		dir:    dir,
+		params: params,
+		key:    key,
+		nodes:  make(map[chainhash.Hash]*node),
+		files:  make(map[int]*os.File),
+	}
+	var order []*node
+	for _, file := range files {
+		nodes, err := x.indexFile(file)
+		if err != nil {
+			return nil, err
+		}
+		order = append(order, nodes...)
+	}
+	if len(order) == 0 {
+		return nil, ErrNoBlocks
+	}
+
+	// Link the blocks now that they are all known, since children are
+	// often stored before their parent.
+	var tip *node
+	for _, n := range order {
+		chainWork(n, x.nodes)
+		if tip == nil || n.work.Cmp(tip.work) > 0 {
+			tip = n
+		}
+	}
+	for n := tip; n != nil; n = n.parent {
+		x.chain = append(x.chain, n)
+	}
+	for i, j := 0, len(x.chain)-1; i < j; i, j = i+1, j-1 {
+		x.chain[i], x.chain[j] = x.chain[j], x.chain[i]
+	}
+
+	if first := x.chain[0]; first.header.BlockHash() != *params.GenesisHash {
+		height, err := x.firstHeight(first)
+		if err != nil {
+			x.Close()
+			return nil, err
+		}
+		x.base = height
+	}
+	return x, nil
+}
+
+// firstHeight returns the height of first, the oldest block of a pruned
+// node, from its coinbase.
+func (x *Index) firstHeight(first *node) (int64, error) {
+	block, err := x.block(first)
+	if err != nil {
+		return 0, err
+	}
+	if len(block.Transactions) == 0 {
+		return 0, fmt.Errorf("%w: block %v has no transactions",
+			ErrUnknownHeight, first.header.BlockHash())
+	}
+	height, err := blockchain.ExtractCoinbaseHeight(btcutil.NewTx(block.Transactions[0]))
+	if err != nil {
+		return 0, fmt.Errorf("%w: block %v: %v", ErrUnknownHeight,
+			first.header.BlockHash(), err)
+	}
+	return int64(height), nil
+}
+
+// blockFiles returns the numbers of the blk*.dat files of dir in order.
+func blockFiles(dir string) ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	var files []int
+	for _, name := range names {
+		var n int
+		_, err := fmt.Sscanf(filepath.Base(name), "blk%05d.dat", &n)
+		if err == nil && filepath.Base(name) == fileName(n) {
+			files = append(files, n)
+		}
+	}
+	sort.Ints(files)
+	return files, nil
+}
+
+// fileName returns the name of block file n.
+func fileName(n int) string {
+	return fmt.Sprintf("blk%05d.dat", n)
+}
+
+// indexFile indexes the blocks of block file n in file order.
+func (x *Index) indexFile(n int) ([]*node, error) {
+	f, err := os.Open(filepath.Join(x.dir, fileName(n)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var nodes []*node
+	r := NewReader(f, x.params.Net, x.key)
+	for {
+		block, offset, err := r.Next()
+		if err == io.EOF || errors.Is(err, ErrTruncated) {
+			return nodes, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fileName(n), err)
+		}
+
+		nd := &node{loc: location{file: n, offset: offset, size: len(block)}}
+		err = nd.header.Deserialize(bytes.NewReader(block))
+		if err != nil || lightmirror.CheckProofOfWork(&nd.header, x.params.PowLimit) != nil {
+			x.skipped++
+			continue
+		}
+		hash := nd.header.BlockHash()
+		if _, ok := x.nodes[hash]; ok {
+			continue
+		}
+		x.nodes[hash] = nd
+		nodes = append(nodes, nd)
+	}
+}
+
+// chainWork sets the parent and chain work of n and of its ancestors.
+func chainWork(n *node, nodes map[chainhash.Hash]*node) {
+	var pending []*node
+	for ; n != nil && n.work == nil; n = nodes[n.header.PrevBlock] {
+		pending = append(pending, n)
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		n := pending[i]
+		n.work = blockchain.CalcWork(n.header.Bits)
+		if parent := nodes[n.header.PrevBlock]; parent != nil {
+			n.parent = parent
+			n.work.Add(n.work, parent.work)
+		}
+	}
+}
+
+// Blocks returns the number of indexed blocks, including those off the best
+// chain.
+func (x *Index) Blocks() int {
+	return len(x.nodes)
+}
+
+// Skipped returns the number of records skipped for an invalid header.
+func (x *Index) Skipped() int {
+	return x.skipped
+}
+
+// Close closes the block files.
+func (x *Index) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var firstErr error
+	for n, f := range x.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(x.files, n)
+	}
+	return firstErr
+}
+
+// BestHeight returns the height of the best chain tip.
+func (x *Index) BestHeight(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return x.base + int64(len(x.chain)) - 1, nil
+}
+
+// BlockHash returns the hash of the best chain block at height.
+func (x *Index) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i := height - x.base
+	if i < 0 || i >= int64(len(x.chain)) {
+		return nil, blocksource.ErrBlockNotFound
+	}
+	hash := x.chain[i].header.BlockHash()
+	return &hash, nil
+}
+
+// BlockHeader returns the header of the block with the given hash, which may
+// be off the best chain.
+func (x *Index) BlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	n, ok := x.nodes[*hash]
+	if !ok {
+		return nil, blocksource.ErrBlockNotFound
+	}
+	header := n.header
+	return &header, nil
+}
+
+// Mirror reads the block with the given hash and builds its mirror.
+func (x *Index) Mirror(ctx context.Context, hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	n, ok := x.nodes[*hash]
+	if !ok {
+		return nil, blocksource.ErrBlockNotFound
+	}
+	block, err := x.block(n)
+	if err != nil {
+		return nil, err
+	}
+	return blocksource.MirrorFromBlock(block)
+}
+
+// block reads the block of n from its file.
+func (x *Index) block(n *node) (*wire.MsgBlock, error) {
+	f, err := x.file(n.loc.file)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n.loc.size)
+	if _, err := f.ReadAt(b, n.loc.offset); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName(n.loc.file), err)
+	}
+	xorAt(b, x.key, n.loc.offset)
+
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("%s: block at offset %d: %w",
+			fileName(n.loc.file), n.loc.offset, err)
+	}
+	if block.BlockHash() != n.header.BlockHash() {
+		return nil, fmt.Errorf("%s: block at offset %d changed",
+			fileName(n.loc.file), n.loc.offset)
+	}
+	return &block, nil
+}
+
+// file returns block file n, opening it on first use.
+func (x *Index) file(n int) (*os.File, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if f, ok := x.files[n]; ok {
+		return f, nil
+	}
+	f, err := os.Open(filepath.Join(x.dir, fileName(n)))
+	if err != nil {
+		return nil, err
+	}
+	x.files[n] = f
+	return f, nil
+}
+
+// Entry is a best chain block read from the block files, with its power
+// params.
+type Entry struct {
+	Height int64
+	Mirror *lightmirror.BtcLightMirrorV2
+
+	// Marker is the power marker selected under the policy of the walk,
+	// nil when the block does not delegate.  PowerErr is set instead when
+	// the policy rejects the markers of the coinbase.
+	Marker   *lightmirror.PowerMarker
+	PowerErr error
+}
+
+// Walk calls fn with the best chain blocks from height from to height to
+// included, in chain order, decoding their power params under policy.  It
+// stops at the first error returned by fn.
+func (x *Index) Walk(ctx context.Context, from, to int64, policy lightmirror.PowerPolicy, fn func(*Entry) error) error {
+	if from < x.base {
+		from = x.base
+	}
+	for height := from; height <= to && height-x.base < int64(len(x.chain)); height++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		block, err := x.block(x.chain[height-x.base])
+		if err != nil {
+			return err
+		}
+		light, err := blocksource.MirrorFromBlock(block)
+		if err != nil {
+			return err
+		}
+
+		e := &Entry{Height: height, Mirror: light}
+		e.Marker, e.PowerErr = lightmirror.ValidatePowerMarkers(&light.CoinBaseTx, policy)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
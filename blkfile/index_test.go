@@ -0,0 +1,197 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blkfile
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/chaingen"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// testBlocks is a regtest chain of 6 blocks with a stale branch of two
+// blocks forking at height 1.  Block 3 delegates its power.
+type testBlocks struct {
+	chain     *chaingen.Chain
+	main      []*wire.MsgBlock
+	stale     []*wire.MsgBlock
+	candidate common.Address
+	reward    common.Address
+}
+
+func newTestBlocks(t *testing.T) *testBlocks {
+	t.Helper()
+	c := chaingen.New(testParams)
+	b := &testBlocks{
+		chain:     c,
+		main:      []*wire.MsgBlock{c.Block(0)},
+		candidate: common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		reward:    common.HexToAddress("0x1111111111111111111111111111111111111111"),
+	}
+	for height := int64(1); height <= 5; height++ {
+		tmpl := &chaingen.Template{}
+		if height == 3 {
+			tmpl.Markers = [][]byte{chaingen.CoreMarker(b.candidate, b.reward)}
+		}
+		b.main = append(b.main, c.Mine(tmpl))
+	}
+	b.stale = []*wire.MsgBlock{b.mineOn(t, b.main[1], "stale")}
+	b.stale = append(b.stale, b.mineOn(t, b.stale[0], "stale"))
+	return b
+}
+
+// mineOn mines a block on parent, outside the best chain unless the branch
+// grows longer than it.
+func (b *testBlocks) mineOn(t *testing.T, parent *wire.MsgBlock, tag string) *wire.MsgBlock {
+	t.Helper()
+	block, err := b.chain.MineOn(parent.BlockHash(), &chaingen.Template{Tag: []byte(tag)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// write writes the blocks to dir across two files, out of chain order.
+func (b *testBlocks) write(t *testing.T, dir string, key []byte) {
+	writeBlkFile(t, dir, 0, blkFile(t, key, 0,
+		b.main[0], b.main[1], b.stale[0], b.main[3], b.main[2]))
+	writeBlkFile(t, dir, 1, blkFile(t, key, 1000,
+		b.stale[1], b.main[5], b.main[4]))
+}
+
+func TestIndex(t *testing.T) {
+	blocks := newTestBlocks(t)
+	ctx := context.Background()
+
+	plain := t.TempDir()
+	blocks.write(t, plain, nil)
+	obfuscated := t.TempDir()
+	key := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x23, 0x45, 0x67}
+	blocks.write(t, obfuscated, key)
+	os.WriteFile(filepath.Join(obfuscated, "xor.dat"), key, 0644)
+
+	for _, dir := range []string{plain, obfuscated} {
+		index, err := OpenIndex(dir, testParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+
+		if index.Blocks() != 8 || index.Skipped() != 0 {
+			t.Errorf("%d blocks indexed, %d skipped", index.Blocks(), index.Skipped())
+		}
+		best, err := index.BestHeight(ctx)
+		if err != nil || best != 5 {
+			t.Fatalf("BestHeight: got %d, %v, want 5", best, err)
+		}
+		for height, block := range blocks.main {
+			hash, err := index.BlockHash(ctx, int64(height))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *hash != block.BlockHash() {
+				t.Errorf("height %d: got %v, want %v", height, hash, block.BlockHash())
+			}
+		}
+		if _, err := index.BlockHash(ctx, 6); !errors.Is(err, blocksource.ErrBlockNotFound) {
+			t.Errorf("BlockHash above tip: got %v, want %v", err, blocksource.ErrBlockNotFound)
+		}
+
+		// Stale blocks are indexed but off the best chain.
+		stale := blocks.stale[1].BlockHash()
+		if header, err := index.BlockHeader(ctx, &stale); err != nil || *header != blocks.stale[1].Header {
+			t.Errorf("BlockHeader of stale block: %v", err)
+		}
+		light, err := index.Mirror(ctx, &stale)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := light.CheckMerkle(); err != nil {
+			t.Error(err)
+		}
+
+		var heights []int64
+		err = index.Walk(ctx, 1, 10, lightmirror.PowerPolicyStrict, func(e *Entry) error {
+			heights = append(heights, e.Height)
+			if e.Mirror.BtcHeader != blocks.main[e.Height].Header {
+				t.Errorf("Walk: block %v at height %d", e.Mirror.BtcHeader.BlockHash(), e.Height)
+			}
+			if err := e.Mirror.CheckProofOfWork(testParams.PowLimit); err != nil {
+				t.Error(err)
+			}
+			switch {
+			case e.PowerErr != nil:
+				t.Errorf("height %d: %v", e.Height, e.PowerErr)
+			case e.Height == 3 && (e.Marker == nil || e.Marker.Candidate != blocks.candidate ||
+				e.Marker.Reward != blocks.reward):
+				t.Errorf("height 3: marker %+v", e.Marker)
+			case e.Height != 3 && e.Marker != nil:
+				t.Errorf("height %d: unexpected marker %+v", e.Height, e.Marker)
+			}
+			return nil
+		})
+		if err != nil || len(heights) != 5 {
+			t.Errorf("Walk: heights %v, %v", heights, err)
+		}
+
+		stop := errors.New("stop")
+		err = index.Walk(ctx, 0, 5, lightmirror.PowerPolicyFirst, func(e *Entry) error {
+			return stop
+		})
+		if err != stop {
+			t.Errorf("Walk: got %v, want %v", err, stop)
+		}
+	}
+}
+
+func TestIndexPruned(t *testing.T) {
+	blocks := newTestBlocks(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A pruned node keeps the most recent files only.  A record with a bad
+	// proof of work is skipped and a truncated one ends the file.
+	invalid := blocks.mineOn(t, blocks.main[2], "invalid")
+	for lightmirror.CheckProofOfWork(&invalid.Header, testParams.PowLimit) == nil {
+		invalid.Header.Nonce++
+	}
+	file := blkFile(t, nil, 0, blocks.main[3], invalid, blocks.main[4], blocks.main[5])
+	writeBlkFile(t, dir, 7, file[:len(file)-10])
+
+	index, err := OpenIndex(dir, testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	if index.Blocks() != 2 || index.Skipped() != 1 {
+		t.Errorf("%d blocks indexed, %d skipped", index.Blocks(), index.Skipped())
+	}
+	if best, _ := index.BestHeight(ctx); best != 4 {
+		t.Errorf("BestHeight: got %d, want 4", best)
+	}
+	if hash, err := index.BlockHash(ctx, 3); err != nil || *hash != blocks.main[3].BlockHash() {
+		t.Errorf("BlockHash(3): got %v, %v", hash, err)
+	}
+	if _, err := index.BlockHash(ctx, 2); !errors.Is(err, blocksource.ErrBlockNotFound) {
+		t.Errorf("pruned block: got %v, want %v", err, blocksource.ErrBlockNotFound)
+	}
+	unknown := chainhash.Hash{1}
+	if _, err := index.Mirror(ctx, &unknown); !errors.Is(err, blocksource.ErrBlockNotFound) {
+		t.Errorf("unknown block: got %v, want %v", err, blocksource.ErrBlockNotFound)
+	}
+
+	if _, err := OpenIndex(t.TempDir(), testParams); !errors.Is(err, ErrNoBlocks) {
+		t.Errorf("empty directory: got %v, want %v", err, ErrNoBlocks)
+	}
+}
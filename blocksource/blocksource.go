@@ -0,0 +1,55 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package blocksource defines how the rest of powermirror reads the Bitcoin
+// chain.  A BlockSource answers the handful of questions needed to follow the
+// best chain and to produce a BtcLightMirrorV2 for any block on it; concrete
+// backends (bitcoind/btcd RPC, in-memory fixtures, ...) live alongside it.
+package blocksource
+
+import (
+	"context"
+	"errors"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// ErrBlockNotFound is returned by a BlockSource when the requested block hash
+// or height is unknown to the backend.
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockSource is a read-only view of a Bitcoin best chain.
+//
+// Implementations must be safe for concurrent use.
+type BlockSource interface {
+	// BestHeight returns the height of the current best chain tip.
+	BestHeight(ctx context.Context) (int64, error)
+
+	// BlockHash returns the hash of the best chain block at height.
+	BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error)
+
+	// BlockHeader returns the header of the block with the given hash.
+	BlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error)
+
+	// Mirror returns a BtcLightMirrorV2 proving the coinbase transaction of
+	// the block with the given hash.
+	Mirror(ctx context.Context, hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error)
+}
+
+// MirrorFromBlock builds the BtcLightMirrorV2 of a full block.
+func MirrorFromBlock(block *wire.MsgBlock) (*lightmirror.BtcLightMirrorV2, error) {
+	if len(block.Transactions) == 0 {
+		return nil, errors.New("block has no transactions")
+	}
+
+	transactions := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		transactions[i] = tx.TxHash()
+	}
+
+	return lightmirror.CreateBtcLightMirrorV2(&block.Header,
+		block.Transactions[0], transactions), nil
+}
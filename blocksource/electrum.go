@@ -0,0 +1,528 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blocksource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// electrumProtocolVersion is the Electrum protocol version negotiated with
+// server.version.  1.4 introduced blockchain.block.header without checkpoint
+// and blockchain.transaction.id_from_pos.
+const electrumProtocolVersion = "1.4"
+
+// maxElectrumResponse bounds the size of a single response line.  The largest
+// response used is a raw coinbase transaction, itself bounded by the block
+// size.
+const maxElectrumResponse = 2 * wire.MaxBlockPayload
+
+// maxElectrumHeights bounds the number of block hashes whose height an
+// ElectrumSource remembers.  It is well above the window of recent blocks a
+// relayer looks up again while following the tip and handling reorgs.
+const maxElectrumHeights = 1 << 14
+
+var (
+	// ErrElectrumClosed is returned by calls made after Close.
+	ErrElectrumClosed = errors.New("electrum source closed")
+
+	// ErrElectrumResponse is returned when the server answers with a
+	// malformed or inconsistent result.
+	ErrElectrumResponse = errors.New("invalid electrum response")
+)
+
+// ElectrumError is an error returned by the Electrum server for a request.
+type ElectrumError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface.
+func (e *ElectrumError) Error() string {
+	return fmt.Sprintf("electrum error %d: %s", e.Code, e.Message)
+}
+
+// ElectrumConfig describes how to reach an Electrum server.
+type ElectrumConfig struct {
+	// Addr is the host:port of the server.
+	Addr string
+
+	// TLS, when not nil, is used to connect over TLS.  Servers usually
+	// listen for TLS on port 50002 and for plain TCP on 50001.
+	TLS *tls.Config
+
+	// DialTimeout bounds connecting and the version handshake.  Zero
+	// means 30 seconds.
+	DialTimeout time.Duration
+
+	// ClientName is sent to the server with server.version.
+	ClientName string
+}
+
+// ElectrumSource is a BlockSource backed by an Electrum server such as
+// ElectrumX, Fulcrum or electrs.  Mirrors are built without downloading full
+// blocks: blockchain.transaction.id_from_pos returns the coinbase txid with
+// its merkle branch and blockchain.transaction.get the coinbase itself.
+//
+// Electrum indexes headers by height only, so BlockHeader and Mirror know the
+// blocks whose hash was returned by BlockHash.  Blocks reorganized out of the
+// best chain are reported as not found, as are blocks forgotten once more
+// than maxElectrumHeights heights are known, farthest from the last height
+// requested first.
+//
+// The connection is dialed lazily and redialed after a failure.
+type ElectrumSource struct {
+	cfg ElectrumConfig
+
+	mu      sync.Mutex
+	conn    *electrumConn
+	closed  bool
+	heights map[chainhash.Hash]int64
+	hashes  map[int64]chainhash.Hash
+}
+
+// NewElectrumSource returns a source for the server described by cfg.  No
+// connection is made until the first call.
+func NewElectrumSource(cfg *ElectrumConfig) *ElectrumSource {
+	s := &ElectrumSource{
+		cfg:     *cfg,
+		heights: make(map[chainhash.Hash]int64),
+		hashes:  make(map[int64]chainhash.Hash),
+	}
+	if s.cfg.DialTimeout == 0 {
+		s.cfg.DialTimeout = 30 * time.Second
+	}
+	if s.cfg.ClientName == "" {
+		s.cfg.ClientName = "powermirror"
+	}
+	return s
+}
+
+// Close closes the connection to the server.
+func (s *ElectrumSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.close(ErrElectrumClosed)
+	s.conn = nil
+	return err
+}
+
+// BestHeight returns the height of the server's best chain tip.
+func (s *ElectrumSource) BestHeight(ctx context.Context) (int64, error) {
+	var tip struct {
+		Height int64  `json:"height"`
+		Hex    string `json:"hex"`
+	}
+	err := s.call(ctx, "blockchain.headers.subscribe", nil, &tip)
+	if err != nil {
+		return 0, err
+	}
+	return tip.Height, nil
+}
+
+// BlockHash returns the hash of the best chain block at height.
+func (s *ElectrumSource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	header, err := s.header(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	hash := header.BlockHash()
+
+	s.mu.Lock()
+	s.remember(hash, height)
+	s.mu.Unlock()
+	return &hash, nil
+}
+
+// remember records that the block at height has the given hash, replacing the
+// block previously known there.  When too many heights are known, it forgets
+// the ones at least half of maxElectrumHeights away from height, which leaves
+// fewer than maxElectrumHeights.  s.mu must be held.
+func (s *ElectrumSource) remember(hash chainhash.Hash, height int64) {
+	if old, ok := s.hashes[height]; ok && old != hash {
+		delete(s.heights, old)
+	}
+	s.hashes[height] = hash
+	s.heights[hash] = height
+	if len(s.hashes) <= maxElectrumHeights {
+		return
+	}
+	for h, old := range s.hashes {
+		if h <= height-maxElectrumHeights/2 || h >= height+maxElectrumHeights/2 {
+			delete(s.hashes, h)
+			delete(s.heights, old)
+		}
+	}
+}
+
+// forget drops the block with the given hash at height.
+func (s *ElectrumSource) forget(hash chainhash.Hash, height int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hashes[height] == hash {
+		delete(s.hashes, height)
+	}
+	delete(s.heights, hash)
+}
+
+// BlockHeader returns the header of the block with the given hash.
+func (s *ElectrumSource) BlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	_, header, err := s.lookup(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// Mirror builds the mirror of the block with the given hash from its coinbase
+// and the merkle branch served by the server.
+func (s *ElectrumSource) Mirror(ctx context.Context, hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	height, header, err := s.lookup(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var pos struct {
+		TxHash string   `json:"tx_hash"`
+		Merkle []string `json:"merkle"`
+	}
+	err = s.call(ctx, "blockchain.transaction.id_from_pos",
+		[]interface{}{height, 0, true}, &pos)
+	if err != nil {
+		return nil, err
+	}
+	txid, err := chainhash.NewHashFromStr(pos.TxHash)
+	if err != nil {
+		return nil, fmt.Errorf("%w: coinbase txid: %v", ErrElectrumResponse, err)
+	}
+	// Electrum serves hashes in display order, as NewHashFromStr expects.
+	branch := make([]chainhash.Hash, len(pos.Merkle))
+	for i, node := range pos.Merkle {
+		h, err := chainhash.NewHashFromStr(node)
+		if err != nil {
+			return nil, fmt.Errorf("%w: merkle node %d: %v",
+				ErrElectrumResponse, i, err)
+		}
+		branch[i] = *h
+	}
+
+	var raw string
+	err = s.call(ctx, "blockchain.transaction.get",
+		[]interface{}{pos.TxHash, false}, &raw)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: coinbase: %v", ErrElectrumResponse, err)
+	}
+	var coinbase wire.MsgTx
+	if err := coinbase.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("%w: coinbase: %v", ErrElectrumResponse, err)
+	}
+	if coinbase.TxHash() != *txid {
+		return nil, fmt.Errorf("%w: transaction %v served for %v",
+			ErrElectrumResponse, coinbase.TxHash(), txid)
+	}
+
+	light := &lightmirror.BtcLightMirrorV2{
+		BtcHeader:   *header,
+		CoinBaseTx:  coinbase,
+		MerkleNodes: branch,
+	}
+	if err := light.CheckMerkle(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrElectrumResponse, err)
+	}
+	return light, nil
+}
+
+// lookup returns the height and header of the best chain block with the given
+// hash.
+func (s *ElectrumSource) lookup(ctx context.Context, hash *chainhash.Hash) (int64, *wire.BlockHeader, error) {
+	s.mu.Lock()
+	height, ok := s.heights[*hash]
+	s.mu.Unlock()
+	if !ok {
+		return 0, nil, ErrBlockNotFound
+	}
+
+	header, err := s.header(ctx, height)
+	if errors.Is(err, ErrBlockNotFound) || err == nil && header.BlockHash() != *hash {
+		// The block was reorganized out of the best chain.
+		s.forget(*hash, height)
+		return 0, nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return height, header, nil
+}
+
+// header fetches the best chain header at height.
+func (s *ElectrumSource) header(ctx context.Context, height int64) (*wire.BlockHeader, error) {
+	if height < 0 {
+		return nil, ErrBlockNotFound
+	}
+
+	var raw string
+	err := s.call(ctx, "blockchain.block.header", []interface{}{height}, &raw)
+	var rpcErr *ElectrumError
+	if errors.As(err, &rpcErr) {
+		// Servers do not agree on an error code for heights above the
+		// tip, so ask for the tip before reporting the block as not
+		// found.  Other failures, such as a busy server, are passed
+		// through.
+		best, bestErr := s.BestHeight(ctx)
+		if bestErr == nil && height > best {
+			return nil, fmt.Errorf("%w: height %d above tip %d: %v",
+				ErrBlockNotFound, height, best, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := hex.DecodeString(raw)
+	if err != nil || len(b) != wire.MaxBlockHeaderPayload {
+		return nil, fmt.Errorf("%w: header at height %d", ErrElectrumResponse, height)
+	}
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("%w: header at height %d: %v",
+			ErrElectrumResponse, height, err)
+	}
+	return &header, nil
+}
+
+// call sends a request and decodes its result into result.
+func (s *ElectrumSource) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	raw, err := conn.call(ctx, method, params)
+	if err != nil {
+		var rpcErr *ElectrumError
+		if !errors.As(err, &rpcErr) && ctx.Err() == nil {
+			s.drop(conn, err)
+		}
+		return err
+	}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrElectrumResponse, method, err)
+	}
+	return nil
+}
+
+// connect returns the current connection, dialing one if needed.
+func (s *ElectrumSource) connect(ctx context.Context) (*electrumConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrElectrumClosed
+	}
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.DialTimeout)
+	defer cancel()
+
+	var (
+		nc  net.Conn
+		err error
+	)
+	if s.cfg.TLS != nil {
+		d := &tls.Dialer{Config: s.cfg.TLS}
+		nc, err = d.DialContext(ctx, "tcp", s.cfg.Addr)
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp", s.cfg.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := newElectrumConn(nc)
+	_, err = conn.call(ctx, "server.version",
+		[]interface{}{s.cfg.ClientName, electrumProtocolVersion})
+	if err != nil {
+		conn.close(err)
+		return nil, fmt.Errorf("electrum handshake: %w", err)
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// drop discards conn after a transport failure so the next call redials.
+func (s *ElectrumSource) drop(conn *electrumConn, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == conn {
+		s.conn = nil
+	}
+	conn.close(err)
+}
+
+// electrumResponse is a response or notification read from the server.
+type electrumResponse struct {
+	ID     *uint64         `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *ElectrumError  `json:"error"`
+}
+
+// electrumConn multiplexes newline delimited JSON-RPC requests over a single
+// connection.
+type electrumConn struct {
+	nc net.Conn
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *electrumResponse
+	err     error
+	done    chan struct{}
+}
+
+func newElectrumConn(nc net.Conn) *electrumConn {
+	c := &electrumConn{
+		nc:      nc,
+		pending: make(map[uint64]chan *electrumResponse),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// call sends a request and waits for its result.
+func (c *electrumConn) call(ctx context.Context, method string, params []interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	ch := make(chan *electrumResponse, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	req, err := json.Marshal(struct {
+		JSONRPC string        `json:"jsonrpc"`
+		ID      uint64        `json:"id"`
+		Method  string        `json:"method"`
+		Params  []interface{} `json:"params"`
+	}{"2.0", id, method, params})
+	if err != nil {
+		return nil, err
+	}
+	req = append(req, '\n')
+
+	c.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	c.nc.SetWriteDeadline(deadline)
+	_, err = c.nc.Write(req)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return nil, fmt.Errorf("%s: %w", method, resp.Error)
+		}
+		return resp.Result, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLoop dispatches responses to their callers until the connection fails.
+// Notifications, such as new tips after blockchain.headers.subscribe, are
+// ignored.
+func (c *electrumConn) readLoop() {
+	scanner := bufio.NewScanner(c.nc)
+	scanner.Buffer(make([]byte, 0, 4096), maxElectrumResponse)
+	for scanner.Scan() {
+		var resp electrumResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			c.close(fmt.Errorf("%w: %v", ErrElectrumResponse, err))
+			return
+		}
+		if resp.ID == nil {
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[*resp.ID]
+		c.mu.Unlock()
+		if ok {
+			// Drop duplicate responses rather than block.
+			select {
+			case ch <- &resp:
+			default:
+			}
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("electrum connection closed by server")
+	}
+	c.close(err)
+}
+
+// close fails every pending and future call with err.
+func (c *electrumConn) close(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil
+	}
+	c.err = err
+	close(c.done)
+	return c.nc.Close()
+}
@@ -0,0 +1,451 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blocksource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// fakeElectrum is an Electrum server serving the blocks of a chain.
+type fakeElectrum struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu      sync.Mutex
+	chain   []*wire.MsgBlock
+	conns   []net.Conn
+	corrupt bool
+	busy    bool
+}
+
+func newFakeElectrum(t *testing.T, config *tls.Config, chain ...*wire.MsgBlock) *fakeElectrum {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	s := &fakeElectrum{t: t, listener: listener, chain: chain}
+	go s.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		s.disconnect()
+	})
+	return s
+}
+
+func (s *fakeElectrum) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeElectrum) setChain(chain ...*wire.MsgBlock) {
+	s.mu.Lock()
+	s.chain = chain
+	s.mu.Unlock()
+}
+
+// disconnect closes every client connection.
+func (s *fakeElectrum) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeElectrum) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeElectrum) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	send := func(v interface{}) {
+		b, _ := json.Marshal(v)
+		writeMu.Lock()
+		conn.Write(append(b, '\n'))
+		writeMu.Unlock()
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req struct {
+			ID     uint64            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			s.t.Errorf("fake electrum: %v", err)
+			return
+		}
+		// Answer concurrently so responses may arrive out of order.
+		go func() {
+			result, rpcErr := s.dispatch(req.Method, req.Params)
+			resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+			if rpcErr != nil {
+				resp["error"] = rpcErr
+			} else {
+				resp["result"] = result
+			}
+			if req.Method == "blockchain.headers.subscribe" {
+				send(map[string]interface{}{"jsonrpc": "2.0",
+					"method": req.Method, "params": []interface{}{result}})
+			}
+			send(resp)
+		}()
+	}
+}
+
+func (s *fakeElectrum) dispatch(method string, params []json.RawMessage) (interface{}, *ElectrumError) {
+	s.mu.Lock()
+	chain := s.chain
+	corrupt := s.corrupt
+	busy := s.busy
+	s.mu.Unlock()
+
+	height := func() (*wire.MsgBlock, *ElectrumError) {
+		var h int
+		if len(params) == 0 || json.Unmarshal(params[0], &h) != nil {
+			return nil, &ElectrumError{Code: 1, Message: "invalid height"}
+		}
+		if h < 0 || h >= len(chain) {
+			return nil, &ElectrumError{Code: 1, Message: "height out of range"}
+		}
+		return chain[h], nil
+	}
+	headerHex := func(block *wire.MsgBlock) string {
+		var buf bytes.Buffer
+		block.Header.Serialize(&buf)
+		return hex.EncodeToString(buf.Bytes())
+	}
+
+	switch method {
+	case "server.version":
+		return []string{"FakeElectrum 1.0", electrumProtocolVersion}, nil
+
+	case "blockchain.headers.subscribe":
+		tip := chain[len(chain)-1]
+		return map[string]interface{}{"height": len(chain) - 1, "hex": headerHex(tip)}, nil
+
+	case "blockchain.block.header":
+		if busy {
+			return nil, &ElectrumError{Code: -102, Message: "server busy"}
+		}
+		block, rpcErr := height()
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		return headerHex(block), nil
+
+	case "blockchain.transaction.id_from_pos":
+		block, rpcErr := height()
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		mirror, err := MirrorFromBlock(block)
+		if err != nil {
+			return nil, &ElectrumError{Code: 2, Message: err.Error()}
+		}
+		merkle := make([]string, len(mirror.MerkleNodes))
+		for i := range mirror.MerkleNodes {
+			merkle[i] = mirror.MerkleNodes[i].String()
+		}
+		if corrupt && len(merkle) > 0 {
+			merkle[0] = chainhash.Hash{1}.String()
+		}
+		return map[string]interface{}{
+			"tx_hash": block.Transactions[0].TxHash().String(),
+			"merkle":  merkle,
+		}, nil
+
+	case "blockchain.transaction.get":
+		var txid string
+		if len(params) == 0 || json.Unmarshal(params[0], &txid) != nil {
+			return nil, &ElectrumError{Code: 1, Message: "invalid txid"}
+		}
+		for _, block := range chain {
+			for _, tx := range block.Transactions {
+				if tx.TxHash().String() == txid {
+					var buf bytes.Buffer
+					tx.Serialize(&buf)
+					return hex.EncodeToString(buf.Bytes()), nil
+				}
+			}
+		}
+		return nil, &ElectrumError{Code: 2, Message: "no such transaction"}
+	}
+	return nil, &ElectrumError{Code: -32601, Message: "unknown method " + method}
+}
+
+// testChain returns a chain of n blocks with varying transaction counts.
+// Unlike testBlock, the blocks have timestamps that survive serialization.
+func testChain(n int, tag byte) []*wire.MsgBlock {
+	var chain []*wire.MsgBlock
+	prev := chainhash.Hash{}
+	for i := 0; i < n; i++ {
+		block := testBlock(prev, 1+i*3, tag)
+		block.Header.Timestamp = time.Unix(1600000000+int64(i)*600, 0)
+		chain = append(chain, block)
+		prev = block.BlockHash()
+	}
+	return chain
+}
+
+func testElectrumSource(t *testing.T, source *ElectrumSource, chain []*wire.MsgBlock) {
+	t.Helper()
+	ctx := context.Background()
+
+	best, err := source.BestHeight(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best != int64(len(chain)-1) {
+		t.Fatalf("BestHeight: got %d, want %d", best, len(chain)-1)
+	}
+
+	var wg sync.WaitGroup
+	for height, block := range chain {
+		wg.Add(1)
+		go func(height int64, block *wire.MsgBlock) {
+			defer wg.Done()
+
+			hash, err := source.BlockHash(ctx, height)
+			if err != nil {
+				t.Errorf("BlockHash(%d): %v", height, err)
+				return
+			}
+			if *hash != block.BlockHash() {
+				t.Errorf("BlockHash(%d): got %v, want %v", height, hash, block.BlockHash())
+			}
+			header, err := source.BlockHeader(ctx, hash)
+			if err != nil || *header != block.Header {
+				t.Errorf("BlockHeader(%d): %v", height, err)
+			}
+
+			mirror, err := source.Mirror(ctx, hash)
+			if err != nil {
+				t.Errorf("Mirror(%d): %v", height, err)
+				return
+			}
+			want, _ := MirrorFromBlock(block)
+			if !reflect.DeepEqual(mirror, want) {
+				t.Errorf("Mirror(%d): got %v, want %v", height, mirror, want)
+			}
+		}(int64(height), block)
+	}
+	wg.Wait()
+}
+
+func TestElectrumSource(t *testing.T) {
+	ctx := context.Background()
+	chain := testChain(8, 0)
+	server := newFakeElectrum(t, nil, chain...)
+	source := NewElectrumSource(&ElectrumConfig{Addr: server.addr()})
+	defer source.Close()
+
+	testElectrumSource(t, source, chain)
+
+	if _, err := source.BlockHash(ctx, int64(len(chain))); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("BlockHash above tip: got %v, want %v", err, ErrBlockNotFound)
+	}
+	unknown := chainhash.Hash{0xff}
+	if _, err := source.Mirror(ctx, &unknown); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("Mirror of unknown block: got %v, want %v", err, ErrBlockNotFound)
+	}
+
+	// Blocks reorganized out of the best chain are no longer found.
+	stale := chain[5].BlockHash()
+	fork := append([]*wire.MsgBlock(nil), chain[:5]...)
+	fork = append(fork, testBlock(chain[4].BlockHash(), 2, 1))
+	server.setChain(fork...)
+	if _, err := source.BlockHeader(ctx, &stale); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("BlockHeader of stale block: got %v, want %v", err, ErrBlockNotFound)
+	}
+	if _, err := source.Mirror(ctx, &stale); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("Mirror of stale block: got %v, want %v", err, ErrBlockNotFound)
+	}
+
+	// A merkle branch not leading to the header is rejected.
+	hash, err := source.BlockHash(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	server.corrupt = true
+	server.mu.Unlock()
+	if _, err := source.Mirror(ctx, hash); !errors.Is(err, ErrElectrumResponse) {
+		t.Errorf("corrupt merkle branch: got %v, want %v", err, ErrElectrumResponse)
+	}
+	server.mu.Lock()
+	server.corrupt = false
+	server.busy = true
+	server.mu.Unlock()
+
+	// Server errors for heights below the tip are passed through, and the
+	// block stays known.
+	_, err = source.BlockHash(ctx, 2)
+	var rpcErr *ElectrumError
+	if errors.Is(err, ErrBlockNotFound) || !errors.As(err, &rpcErr) {
+		t.Errorf("BlockHash on a busy server: %v", err)
+	}
+	if _, err := source.Mirror(ctx, hash); err == nil || errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("Mirror on a busy server: %v", err)
+	}
+	server.mu.Lock()
+	server.busy = false
+	server.mu.Unlock()
+	if _, err := source.Mirror(ctx, hash); err != nil {
+		t.Errorf("Mirror once the server recovered: %v", err)
+	}
+
+	// The source redials after losing its connection.
+	server.disconnect()
+	if _, err := source.Mirror(ctx, hash); err != nil {
+		t.Logf("call on the lost connection: %v", err)
+	}
+	if _, err := source.Mirror(ctx, hash); err != nil {
+		t.Errorf("after reconnecting: %v", err)
+	}
+
+	source.Close()
+	if _, err := source.BestHeight(ctx); !errors.Is(err, ErrElectrumClosed) {
+		t.Errorf("after Close: got %v, want %v", err, ErrElectrumClosed)
+	}
+}
+
+// TestElectrumHeights checks that the known heights are bounded and follow
+// the best chain.
+func TestElectrumHeights(t *testing.T) {
+	source := NewElectrumSource(&ElectrumConfig{})
+	for height := int64(0); height < 3*maxElectrumHeights; height++ {
+		source.remember(chainhash.Hash{byte(height), byte(height >> 8), byte(height >> 16)}, height)
+		if len(source.hashes) > maxElectrumHeights || len(source.heights) != len(source.hashes) {
+			t.Fatalf("height %d: %d hashes, %d heights", height,
+				len(source.hashes), len(source.heights))
+		}
+	}
+	last := int64(3*maxElectrumHeights - 1)
+	if _, ok := source.hashes[last]; !ok {
+		t.Errorf("last height %d forgotten", last)
+	}
+	if _, ok := source.hashes[0]; ok {
+		t.Errorf("first height kept")
+	}
+
+	// A new block at a known height replaces the old one.
+	old := source.hashes[last]
+	source.remember(chainhash.Hash{0xff}, last)
+	if _, ok := source.heights[old]; ok || source.heights[chainhash.Hash{0xff}] != last {
+		t.Errorf("block at height %d not replaced", last)
+	}
+}
+
+func TestElectrumSourceTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	chain := testChain(4, 0)
+	server := newFakeElectrum(t, &tls.Config{Certificates: []tls.Certificate{cert}}, chain...)
+
+	source := NewElectrumSource(&ElectrumConfig{
+		Addr: server.addr(),
+		TLS:  &tls.Config{RootCAs: pool, ServerName: "localhost"},
+	})
+	defer source.Close()
+	testElectrumSource(t, source, chain)
+
+	untrusted := NewElectrumSource(&ElectrumConfig{
+		Addr:        server.addr(),
+		TLS:         &tls.Config{ServerName: "localhost"},
+		DialTimeout: 5 * time.Second,
+	})
+	defer untrusted.Close()
+	if _, err := untrusted.BestHeight(context.Background()); err == nil {
+		t.Errorf("untrusted certificate accepted")
+	}
+}
+
+func TestElectrumContext(t *testing.T) {
+	// A server that never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			bufio.NewReader(conn).ReadString(0)
+		}
+	}()
+
+	source := NewElectrumSource(&ElectrumConfig{Addr: listener.Addr().String()})
+	defer source.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := source.BestHeight(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// testCertificate returns a self-signed certificate for localhost and a pool
+// trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blocksource
+
+import (
+	"context"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// MemorySource is a BlockSource over blocks held in memory.  The best chain
+// starts at height 0 and can be extended or reorganized at will, which makes
+// it convenient for tests and offline tooling.  Blocks that are reorganized
+// out of the best chain stay retrievable by hash.
+type MemorySource struct {
+	mu     sync.RWMutex
+	chain  []*wire.MsgBlock
+	blocks map[chainhash.Hash]*wire.MsgBlock
+}
+
+// NewMemorySource returns a MemorySource whose best chain is blocks.
+func NewMemorySource(blocks ...*wire.MsgBlock) *MemorySource {
+	s := &MemorySource{blocks: make(map[chainhash.Hash]*wire.MsgBlock)}
+	s.Extend(blocks...)
+	return s
+}
+
+// Extend appends blocks to the tip of the best chain.
+func (s *MemorySource) Extend(blocks ...*wire.MsgBlock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, block := range blocks {
+		s.chain = append(s.chain, block)
+		s.blocks[block.BlockHash()] = block
+	}
+}
+
+// Reorg disconnects every best chain block above forkHeight and then connects
+// blocks in their place.
+func (s *MemorySource) Reorg(forkHeight int64, blocks ...*wire.MsgBlock) {
+	s.mu.Lock()
+	if forkHeight+1 < int64(len(s.chain)) {
+		s.chain = s.chain[:forkHeight+1]
+	}
+	s.mu.Unlock()
+
+	s.Extend(blocks...)
+}
+
+// BestHeight returns the height of the best chain tip, or -1 when the chain
+// is empty.
+func (s *MemorySource) BestHeight(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.chain)) - 1, nil
+}
+
+// BlockHash returns the hash of the best chain block at height.
+func (s *MemorySource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if height < 0 || height >= int64(len(s.chain)) {
+		return nil, ErrBlockNotFound
+	}
+	hash := s.chain[height].BlockHash()
+	return &hash, nil
+}
+
+// BlockHeader returns the header of the block with the given hash.
+func (s *MemorySource) BlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	block, err := s.block(hash)
+	if err != nil {
+		return nil, err
+	}
+	header := block.Header
+	return &header, nil
+}
+
+// Mirror builds the mirror of the block with the given hash.
+func (s *MemorySource) Mirror(ctx context.Context, hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	block, err := s.block(hash)
+	if err != nil {
+		return nil, err
+	}
+	return MirrorFromBlock(block)
+}
+
+func (s *MemorySource) block(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	block, ok := s.blocks[*hash]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return block, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blocksource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// testBlock returns an unmined block with txCount transactions on top of prev.
+func testBlock(prev chainhash.Hash, txCount int, tag byte) *wire.MsgBlock {
+	block := wire.NewMsgBlock(&wire.BlockHeader{Version: 1, PrevBlock: prev})
+	hashes := make([]chainhash.Hash, 0, txCount)
+	for i := 0; i < txCount; i++ {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			SignatureScript:  []byte{0x01, byte(i), tag},
+		})
+		tx.AddTxOut(wire.NewTxOut(int64(i), []byte{0x51}))
+		block.AddTransaction(tx)
+		hashes = append(hashes, tx.TxHash())
+	}
+	merkles := lightmirror.BuildMerkleTreeStore(&hashes[0], hashes[1:])
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	return block
+}
+
+func TestMirrorFromBlock(t *testing.T) {
+	for _, txCount := range []int{1, 2, 3, 7, 64, 100} {
+		block := testBlock(chainhash.Hash{}, txCount, 0)
+		mirror, err := MirrorFromBlock(block)
+		if err != nil {
+			t.Fatalf("MirrorFromBlock(%d txs): %v", txCount, err)
+		}
+		if err := mirror.CheckMerkle(); err != nil {
+			t.Errorf("MirrorFromBlock(%d txs): %v", txCount, err)
+		}
+	}
+
+	if _, err := MirrorFromBlock(wire.NewMsgBlock(&wire.BlockHeader{})); err == nil {
+		t.Errorf("MirrorFromBlock: expected error for empty block")
+	}
+}
+
+func TestMemorySource(t *testing.T) {
+	ctx := context.Background()
+	genesis := testBlock(chainhash.Hash{}, 1, 0)
+	a := testBlock(genesis.BlockHash(), 2, 0)
+	b := testBlock(genesis.BlockHash(), 3, 1)
+	source := NewMemorySource(genesis, a)
+
+	if best, _ := source.BestHeight(ctx); best != 1 {
+		t.Fatalf("BestHeight: got %d, want 1", best)
+	}
+
+	source.Reorg(0, b)
+	hash, err := source.BlockHash(ctx, 1)
+	if err != nil {
+		t.Fatalf("BlockHash: %v", err)
+	}
+	if *hash != b.BlockHash() {
+		t.Fatalf("BlockHash: got %v, want %v", hash, b.BlockHash())
+	}
+
+	// The stale block is still served by hash.
+	staleHash := a.BlockHash()
+	if _, err := source.Mirror(ctx, &staleHash); err != nil {
+		t.Fatalf("Mirror(stale): %v", err)
+	}
+
+	if _, err := source.BlockHash(ctx, 2); err != ErrBlockNotFound {
+		t.Fatalf("BlockHash(2): got %v, want %v", err, ErrBlockNotFound)
+	}
+	if _, err := source.BlockHeader(ctx, &chainhash.Hash{1}); err != ErrBlockNotFound {
+		t.Fatalf("BlockHeader(unknown): got %v, want %v", err, ErrBlockNotFound)
+	}
+}
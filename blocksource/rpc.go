@@ -0,0 +1,102 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blocksource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// RPCSource is a BlockSource backed by the JSON-RPC interface of bitcoind or
+// btcd.  Mirrors are built from full blocks fetched with getblock.
+type RPCSource struct {
+	client *rpcclient.Client
+}
+
+// NewRPCSource connects to the node described by cfg in HTTP POST mode.
+func NewRPCSource(cfg *rpcclient.ConnConfig) (*RPCSource, error) {
+	connCfg := *cfg
+	connCfg.HTTPPostMode = true
+
+	client, err := rpcclient.New(&connCfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &RPCSource{client: client}, nil
+}
+
+// Close shuts down the underlying RPC client.
+func (s *RPCSource) Close() {
+	s.client.Shutdown()
+}
+
+// BestHeight returns the height of the node's best chain tip.
+func (s *RPCSource) BestHeight(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.client.GetBlockCount()
+}
+
+// BlockHash returns the hash of the best chain block at height.
+func (s *RPCSource) BlockHash(ctx context.Context, height int64) (*chainhash.Hash, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hash, err := s.client.GetBlockHash(height)
+	if err != nil {
+		// bitcoind reports heights above the tip as invalid
+		// parameters, btcd as out of range.
+		return nil, notFound(err, btcjson.ErrRPCInvalidParameter,
+			btcjson.ErrRPCOutOfRange)
+	}
+	return hash, nil
+}
+
+// BlockHeader returns the header of the block with the given hash.
+func (s *RPCSource) BlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	header, err := s.client.GetBlockHeader(hash)
+	if err != nil {
+		return nil, notFound(err, btcjson.ErrRPCBlockNotFound)
+	}
+	return header, nil
+}
+
+// Mirror fetches the full block with the given hash and builds its mirror.
+func (s *RPCSource) Mirror(ctx context.Context, hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	block, err := s.client.GetBlock(hash)
+	if err != nil {
+		return nil, notFound(err, btcjson.ErrRPCBlockNotFound)
+	}
+	return MirrorFromBlock(block)
+}
+
+// notFound wraps err in ErrBlockNotFound when it is a node error with one of
+// codes, and returns it unchanged otherwise.
+func notFound(err error, codes ...btcjson.RPCErrorCode) error {
+	var rpcErr *btcjson.RPCError
+	if !errors.As(err, &rpcErr) {
+		return err
+	}
+	for _, code := range codes {
+		if rpcErr.Code == code {
+			return fmt.Errorf("%w: %v", ErrBlockNotFound, rpcErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blocksource
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// fakeNode answers the JSON-RPC calls of RPCSource for a chain of blocks the
+// way bitcoind does, failing with warmup when warmup is set.
+type fakeNode struct {
+	*MemorySource
+	warmup bool
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, rpcErr := n.call(req.Method, req.Params)
+	json.NewEncoder(w).Encode(struct {
+		ID     json.RawMessage   `json:"id"`
+		Result interface{}       `json:"result"`
+		Error  *btcjson.RPCError `json:"error"`
+	}{req.ID, result, rpcErr})
+}
+
+func (n *fakeNode) call(method string, params []json.RawMessage) (interface{}, *btcjson.RPCError) {
+	ctx := context.Background()
+	if n.warmup {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInWarmup, "Loading block index...")
+	}
+	notFound := btcjson.NewRPCError(btcjson.ErrRPCBlockNotFound, "Block not found")
+
+	switch method {
+	case "getnetworkinfo":
+		return map[string]interface{}{"subversion": "/Satoshi:25.0.0/"}, nil
+
+	case "getblockcount":
+		best, _ := n.BestHeight(ctx)
+		return best, nil
+
+	case "getblockhash":
+		var height int64
+		json.Unmarshal(params[0], &height)
+		hash, err := n.BlockHash(ctx, height)
+		if err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Block height out of range")
+		}
+		return hash.String(), nil
+
+	case "getblockheader", "getblock":
+		var s string
+		json.Unmarshal(params[0], &s)
+		hash, err := chainhash.NewHashFromStr(s)
+		if err != nil {
+			return nil, notFound
+		}
+		block, err := n.block(hash)
+		if err != nil {
+			return nil, notFound
+		}
+		var buf bytes.Buffer
+		if method == "getblock" {
+			block.Serialize(&buf)
+		} else {
+			block.Header.Serialize(&buf)
+		}
+		return hex.EncodeToString(buf.Bytes()), nil
+	}
+	return nil, btcjson.ErrRPCMethodNotFound
+}
+
+func TestRPCSource(t *testing.T) {
+	ctx := context.Background()
+	genesis := testBlock(chainhash.Hash{}, 1, 0)
+	tip := testBlock(genesis.BlockHash(), 3, 1)
+	node := &fakeNode{MemorySource: NewMemorySource(genesis, tip)}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	s, err := NewRPCSource(&rpcclient.ConnConfig{
+		Host:       strings.TrimPrefix(server.URL, "http://"),
+		User:       "u",
+		Pass:       "p",
+		DisableTLS: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if best, err := s.BestHeight(ctx); err != nil || best != 1 {
+		t.Fatalf("BestHeight: %d, %v", best, err)
+	}
+	hash, err := s.BlockHash(ctx, 1)
+	if err != nil || *hash != tip.BlockHash() {
+		t.Fatalf("BlockHash(1): %v, %v", hash, err)
+	}
+	if header, err := s.BlockHeader(ctx, hash); err != nil || header.BlockHash() != *hash {
+		t.Errorf("BlockHeader: %v, %v", header, err)
+	}
+	if mirror, err := s.Mirror(ctx, hash); err != nil || mirror.BtcHeader.BlockHash() != *hash {
+		t.Errorf("Mirror: %v, %v", mirror, err)
+	}
+
+	// Unknown heights and blocks are reported as ErrBlockNotFound.
+	if _, err := s.BlockHash(ctx, 2); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("BlockHash above the tip: got %v, want %v", err, ErrBlockNotFound)
+	}
+	unknown := chainhash.Hash{1}
+	if _, err := s.BlockHeader(ctx, &unknown); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("BlockHeader of an unknown block: got %v, want %v", err, ErrBlockNotFound)
+	}
+	if _, err := s.Mirror(ctx, &unknown); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("Mirror of an unknown block: got %v, want %v", err, ErrBlockNotFound)
+	}
+
+	// Other node errors are passed through.
+	node.warmup = true
+	_, err = s.BlockHash(ctx, 0)
+	var rpcErr *btcjson.RPCError
+	if errors.Is(err, ErrBlockNotFound) || !errors.As(err, &rpcErr) || rpcErr.Code != btcjson.ErrRPCInWarmup {
+		t.Errorf("BlockHash during warmup: %v", err)
+	}
+	if _, err := s.Mirror(ctx, hash); err == nil || errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("Mirror during warmup: %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package chaingen mines real Bitcoin blocks in process for tests.  A Chain
+// starts at the genesis block of a regtest-like network, whose proof of work
+// limit lets every block be mined in a few hashes, and grows one block at a
+// time from a Template choosing the coinbase payout, CORE markers, extra
+// outputs and transactions.  Blocks may be mined on any known block: a branch
+// overtaking the best chain reorganizes it, as a node would.
+//
+// The best chain is mirrored into a blocksource.MemorySource, so relayers,
+// indexes and exporters can be tested end to end against it.
+package chaingen
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+var (
+	// ErrUnknownBlock is returned when mining on top of a block the chain
+	// does not know.
+	ErrUnknownBlock = errors.New("unknown block")
+
+	// ErrUnknownHeight is returned when forking from a height above the
+	// best chain tip.
+	ErrUnknownHeight = errors.New("height above the best chain tip")
+)
+
+// BlockInterval is the time between a block and its parent when the template
+// does not set a timestamp.
+const BlockInterval = 10 * time.Minute
+
+// Template describes a block to mine.  The zero value mines a block whose
+// coinbase pays the subsidy to an OP_TRUE output.
+type Template struct {
+	// Payout is the script of the first coinbase output, which receives
+	// the block subsidy.  OP_TRUE is used when nil.
+	Payout []byte
+
+	// Markers are scripts, typically built with CoreMarker, added as
+	// zero-value coinbase outputs after the payout.
+	Markers [][]byte
+
+	// Outputs are added to the coinbase after the markers.  When the
+	// template holds witness transactions the witness commitment follows
+	// them.
+	Outputs []*wire.TxOut
+
+	// Transactions are included after the coinbase, in order.  The chain
+	// does not check that they spend existing outputs.
+	Transactions []*wire.MsgTx
+
+	// Tag is appended to the BIP34 height in the coinbase script, making
+	// otherwise identical coinbases of competing branches differ.
+	Tag []byte
+
+	// Timestamp is the block time, BlockInterval after the parent when
+	// zero.
+	Timestamp time.Time
+}
+
+// node is a block known to the chain.
+type node struct {
+	block  *wire.MsgBlock
+	height int64
+	parent *node
+}
+
+// Chain is a tree of mined blocks and its best chain.  The best chain is the
+// longest branch, the first mined one among branches of equal length: every
+// block has the same difficulty.
+//
+// A Chain is not safe for concurrent use, its Source is.
+type Chain struct {
+	params *chaincfg.Params
+	nodes  map[chainhash.Hash]*node
+	best   []*node
+	source *blocksource.MemorySource
+}
+
+// New returns a chain holding the genesis block of params, or of
+// chaincfg.RegressionNetParams when params is nil.  Blocks are mined at the
+// proof of work limit of params, which must be a regtest-like one.
+func New(params *chaincfg.Params) *Chain {
+	if params == nil {
+		params = &chaincfg.RegressionNetParams
+	}
+	genesis := &node{block: params.GenesisBlock}
+	return &Chain{
+		params: params,
+		nodes:  map[chainhash.Hash]*node{*params.GenesisHash: genesis},
+		best:   []*node{genesis},
+		source: blocksource.NewMemorySource(params.GenesisBlock),
+	}
+}
+
+// Params returns the network parameters of the chain.
+func (c *Chain) Params() *chaincfg.Params {
+	return c.params
+}
+
+// Source returns a BlockSource following the best chain.
+func (c *Chain) Source() *blocksource.MemorySource {
+	return c.source
+}
+
+// Height returns the height of the best chain tip.
+func (c *Chain) Height() int64 {
+	return int64(len(c.best)) - 1
+}
+
+// Tip returns the best chain tip.
+func (c *Chain) Tip() *wire.MsgBlock {
+	return c.best[len(c.best)-1].block
+}
+
+// Block returns the best chain block at height, or nil.
+func (c *Chain) Block(height int64) *wire.MsgBlock {
+	if height < 0 || height >= int64(len(c.best)) {
+		return nil
+	}
+	return c.best[height].block
+}
+
+// Lookup returns the block with the given hash, on the best chain or not, and
+// its height.
+func (c *Chain) Lookup(hash chainhash.Hash) (*wire.MsgBlock, int64, bool) {
+	n, ok := c.nodes[hash]
+	if !ok {
+		return nil, 0, false
+	}
+	return n.block, n.height, true
+}
+
+// Headers returns the headers of the best chain blocks with heights in
+// [from, to].
+func (c *Chain) Headers(from, to int64) []wire.BlockHeader {
+	var headers []wire.BlockHeader
+	for height := from; height <= to; height++ {
+		if block := c.Block(height); block != nil {
+			headers = append(headers, block.Header)
+		}
+	}
+	return headers
+}
+
+// Mirror returns the mirror of the best chain block at height.
+func (c *Chain) Mirror(height int64) (*lightmirror.BtcLightMirrorV2, error) {
+	block := c.Block(height)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownHeight, height)
+	}
+	return blocksource.MirrorFromBlock(block)
+}
+
+// Mine mines a block from tmpl, nil for the zero Template, on the best chain
+// tip.  It panics when tmpl cannot be mined, which only happens for a Tag
+// longer than a script push allows.
+func (c *Chain) Mine(tmpl *Template) *wire.MsgBlock {
+	block, err := c.MineOn(c.Tip().BlockHash(), tmpl)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// MineN mines n blocks from tmpl on the best chain tip.
+func (c *Chain) MineN(n int, tmpl *Template) []*wire.MsgBlock {
+	blocks := make([]*wire.MsgBlock, n)
+	for i := range blocks {
+		blocks[i] = c.Mine(tmpl)
+	}
+	return blocks
+}
+
+// Fork mines n blocks from tmpl on the best chain block at height.  The
+// branch becomes the best chain when it is longer than the blocks it
+// competes with.  A non-empty tmpl.Tag keeps the branch from repeating the
+// coinbases it replaces.
+func (c *Chain) Fork(height int64, n int, tmpl *Template) ([]*wire.MsgBlock, error) {
+	parent := c.Block(height)
+	if parent == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownHeight, height)
+	}
+	blocks := make([]*wire.MsgBlock, n)
+	prev := parent.BlockHash()
+	for i := range blocks {
+		block, err := c.MineOn(prev, tmpl)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = block
+		prev = block.BlockHash()
+	}
+	return blocks, nil
+}
+
+// MineOn mines a block from tmpl on the block with hash parent, updating the
+// best chain when the new block extends it or makes another branch the
+// longest.
+func (c *Chain) MineOn(parent chainhash.Hash, tmpl *Template) (*wire.MsgBlock, error) {
+	p, ok := c.nodes[parent]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownBlock, parent)
+	}
+	if tmpl == nil {
+		tmpl = &Template{}
+	}
+
+	height := p.height + 1
+	block, err := c.newBlock(p.block, height, tmpl)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{block: block, height: height, parent: p}
+	c.nodes[block.BlockHash()] = n
+
+	if height > c.Height() {
+		c.connect(n)
+	}
+	return block, nil
+}
+
+// connect makes n the best chain tip.
+func (c *Chain) connect(n *node) {
+	var branch []*node
+	fork := n
+	for fork.height >= int64(len(c.best)) || c.best[fork.height] != fork {
+		branch = append(branch, fork)
+		fork = fork.parent
+	}
+
+	c.best = c.best[:fork.height+1]
+	blocks := make([]*wire.MsgBlock, len(branch))
+	for i := range branch {
+		next := branch[len(branch)-1-i]
+		c.best = append(c.best, next)
+		blocks[i] = next.block
+	}
+	c.source.Reorg(fork.height, blocks...)
+}
+
+// newBlock mines the block of tmpl at height on top of parent.
+func (c *Chain) newBlock(parent *wire.MsgBlock, height int64, tmpl *Template) (*wire.MsgBlock, error) {
+	coinbase, err := c.coinbase(height, tmpl)
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]*btcutil.Tx, 0, 1+len(tmpl.Transactions))
+	txs = append(txs, btcutil.NewTx(coinbase))
+	witness := false
+	for _, tx := range tmpl.Transactions {
+		txs = append(txs, btcutil.NewTx(tx))
+		witness = witness || tx.HasWitness()
+	}
+	if witness {
+		addWitnessCommitment(coinbase, txs)
+	}
+
+	timestamp := tmpl.Timestamp
+	if timestamp.IsZero() {
+		timestamp = parent.Header.Timestamp.Add(BlockInterval)
+	}
+	merkles := blockchain.BuildMerkleTreeStore(txs, false)
+	block := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:    4,
+		PrevBlock:  parent.BlockHash(),
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  timestamp,
+		Bits:       c.params.PowLimitBits,
+	})
+	for _, tx := range txs {
+		block.AddTransaction(tx.MsgTx())
+	}
+
+	for lightmirror.CheckProofOfWork(&block.Header, c.params.PowLimit) != nil {
+		block.Header.Nonce++
+	}
+	return block, nil
+}
+
+// coinbase returns the coinbase of tmpl at height.
+func (c *Chain) coinbase(height int64, tmpl *Template) (*wire.MsgTx, error) {
+	sigScript, err := txscript.NewScriptBuilder().AddInt64(height).
+		AddData(tmpl.Tag).Script()
+	if err != nil {
+		return nil, err
+	}
+	payout := tmpl.Payout
+	if payout == nil {
+		payout = []byte{txscript.OP_TRUE}
+	}
+
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  sigScript,
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	tx.AddTxOut(wire.NewTxOut(blockchain.CalcBlockSubsidy(int32(height), c.params), payout))
+	for _, marker := range tmpl.Markers {
+		tx.AddTxOut(wire.NewTxOut(0, marker))
+	}
+	for _, out := range tmpl.Outputs {
+		tx.AddTxOut(wire.NewTxOut(out.Value, out.PkScript))
+	}
+	return tx, nil
+}
+
+// addWitnessCommitment commits the coinbase of txs to their witness data as
+// BIP141 requires, with an all-zero witness nonce.
+func addWitnessCommitment(coinbase *wire.MsgTx, txs []*btcutil.Tx) {
+	var nonce [blockchain.CoinbaseWitnessDataLen]byte
+	coinbase.TxIn[0].Witness = wire.TxWitness{nonce[:]}
+
+	merkles := blockchain.BuildMerkleTreeStore(txs, true)
+	root := merkles[len(merkles)-1]
+	commitment := chainhash.DoubleHashB(append(root[:], nonce[:]...))
+	script := append(append([]byte{}, blockchain.WitnessMagicBytes...), commitment...)
+	coinbase.AddTxOut(wire.NewTxOut(0, script))
+
+	// The coinbase changed after being wrapped.
+	txs[0] = btcutil.NewTx(coinbase)
+}
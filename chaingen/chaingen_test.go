@@ -0,0 +1,202 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package chaingen
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// checkBlock checks block with the context-free rules of a node.
+func checkBlock(t *testing.T, c *Chain, block *wire.MsgBlock, height int64) {
+	t.Helper()
+	b := btcutil.NewBlock(block)
+	if err := blockchain.CheckBlockSanity(b, c.Params().PowLimit, blockchain.NewMedianTime()); err != nil {
+		t.Errorf("block %d: %v", height, err)
+	}
+	if err := blockchain.ValidateWitnessCommitment(b); err != nil {
+		t.Errorf("block %d: %v", height, err)
+	}
+	got, err := blockchain.ExtractCoinbaseHeight(b.Transactions()[0])
+	if err != nil || int64(got) != height {
+		t.Errorf("block %d: coinbase height %d, %v", height, got, err)
+	}
+}
+
+// checkSource checks that the source of c follows its best chain.
+func checkSource(t *testing.T, c *Chain) {
+	t.Helper()
+	ctx := context.Background()
+	best, err := c.Source().BestHeight(ctx)
+	if err != nil || best != c.Height() {
+		t.Fatalf("source at height %d, chain at %d (%v)", best, c.Height(), err)
+	}
+	for height := int64(0); height <= best; height++ {
+		hash, err := c.Source().BlockHash(ctx, height)
+		if err != nil || *hash != c.Block(height).BlockHash() {
+			t.Errorf("source block %d: %v, %v", height, hash, err)
+		}
+	}
+}
+
+func TestMine(t *testing.T) {
+	c := New(nil)
+	if c.Height() != 0 || c.Tip().BlockHash() != *c.Params().GenesisHash {
+		t.Fatalf("new chain at height %d", c.Height())
+	}
+
+	candidate := common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	payout := P2PKH(common.HexToAddress("0x1111111111111111111111111111111111111111"))
+	plain := c.Mine(nil)
+	spend := Spend(CoinbaseOutPoint(plain, 0), wire.NewTxOut(1000, []byte{0x51}))
+	delegated := c.Mine(&Template{
+		Payout:       payout,
+		Markers:      [][]byte{CoreMarker(candidate, candidate)},
+		Outputs:      []*wire.TxOut{wire.NewTxOut(7, []byte{0x52})},
+		Transactions: []*wire.MsgTx{spend, Spend(wire.OutPoint{Index: 3}, wire.NewTxOut(1, []byte{0x51}))},
+		Tag:          []byte("tag"),
+	})
+	c.MineN(3, nil)
+	timestamp := c.Tip().Header.Timestamp.Add(time.Hour)
+	c.Mine(&Template{Timestamp: timestamp})
+
+	if c.Height() != 6 {
+		t.Fatalf("height %d, want 6", c.Height())
+	}
+	for height := int64(1); height <= c.Height(); height++ {
+		block := c.Block(height)
+		checkBlock(t, c, block, height)
+		if block.Header.PrevBlock != c.Block(height-1).BlockHash() {
+			t.Errorf("block %d does not extend block %d", height, height-1)
+		}
+	}
+	checkSource(t, c)
+
+	coinbase := delegated.Transactions[0]
+	if len(delegated.Transactions) != 3 || delegated.Transactions[1] != spend ||
+		len(coinbase.TxOut) != 3 || coinbase.TxOut[2].Value != 7 ||
+		coinbase.TxOut[0].Value != blockchain.CalcBlockSubsidy(2, c.Params()) {
+		t.Errorf("block 2 does not follow its template: %v", delegated)
+	}
+	if got := c.Tip().Header.Timestamp; !got.Equal(timestamp) {
+		t.Errorf("tip timestamp %v, want %v", got, timestamp)
+	}
+	if got := c.Headers(2, 4); len(got) != 3 || got[0] != delegated.Header {
+		t.Errorf("Headers(2, 4): %v", got)
+	}
+
+	mirror, err := c.Mirror(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := mirror.Verify(&lightmirror.VerifyOptions{PowLimit: c.Params().PowLimit})
+	if !report.Valid || report.Candidate == nil || *report.Candidate != candidate ||
+		report.PayoutType != lightmirror.PUBKEYHASH {
+		t.Errorf("mirror of block 2: %+v", report)
+	}
+}
+
+func TestWitness(t *testing.T) {
+	c := New(nil)
+	base := c.Mine(nil)
+	tx := Spend(CoinbaseOutPoint(base, 0), wire.NewTxOut(1, P2WPKH(common.Address{1})))
+	tx.TxIn[0].Witness = wire.TxWitness{{0x01, 0x02}, {0x03}}
+	block := c.Mine(&Template{Transactions: []*wire.MsgTx{tx}})
+
+	checkBlock(t, c, block, 2)
+	coinbase := block.Transactions[0]
+	if !coinbase.HasWitness() || len(coinbase.TxOut) != 2 {
+		t.Errorf("coinbase without witness commitment: %v", coinbase)
+	}
+
+	// Mirrors commit to the coinbase without its witness.
+	mirror, err := c.Mirror(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.CheckMerkle(); err != nil {
+		t.Errorf("mirror of a witness block: %v", err)
+	}
+}
+
+func TestReorg(t *testing.T) {
+	c := New(nil)
+	main := c.MineN(5, nil)
+
+	// A branch as long as the best chain does not replace it.
+	side, err := c.Fork(2, 3, &Template{Tag: []byte("side")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Tip() != main[4] {
+		t.Fatalf("tie replaced the best chain")
+	}
+	checkSource(t, c)
+	if block, height, ok := c.Lookup(side[2].BlockHash()); !ok || block != side[2] || height != 5 {
+		t.Errorf("side tip: %v, %d, %v", block, height, ok)
+	}
+
+	// One more block makes it the best chain.
+	next, err := c.MineOn(side[2].BlockHash(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Height() != 6 || c.Tip() != next || c.Block(3) != side[0] || c.Block(2) != main[1] {
+		t.Fatalf("branch did not become the best chain")
+	}
+	for height := int64(3); height <= 6; height++ {
+		checkBlock(t, c, c.Block(height), height)
+	}
+	checkSource(t, c)
+
+	// Stale blocks stay retrievable.
+	hash := main[4].BlockHash()
+	if _, err := c.Source().Mirror(context.Background(), &hash); err != nil {
+		t.Errorf("stale block: %v", err)
+	}
+	if block, height, ok := c.Lookup(hash); !ok || block != main[4] || height != 5 {
+		t.Errorf("stale block: %v, %d, %v", block, height, ok)
+	}
+
+	// Extending the old branch past the new one switches back.
+	prev := hash
+	for i := 0; i < 2; i++ {
+		block, err := c.MineOn(prev, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev = block.BlockHash()
+	}
+	if c.Height() != 7 || c.Block(5) != main[4] || c.Tip().BlockHash() != prev {
+		t.Errorf("old branch did not come back: tip %v", c.Tip().BlockHash())
+	}
+	checkSource(t, c)
+}
+
+func TestErrors(t *testing.T) {
+	c := New(nil)
+	c.MineN(2, nil)
+	if _, err := c.MineOn(chainhash.Hash{1}, nil); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("mining on an unknown block: %v", err)
+	}
+	if _, err := c.Fork(3, 1, nil); !errors.Is(err, ErrUnknownHeight) {
+		t.Errorf("forking above the tip: %v", err)
+	}
+	if _, err := c.Mirror(-1); !errors.Is(err, ErrUnknownHeight) {
+		t.Errorf("mirror below genesis: %v", err)
+	}
+	if _, err := c.MineOn(c.Tip().BlockHash(), &Template{Tag: make([]byte, 1000)}); err == nil {
+		t.Errorf("oversized tag accepted")
+	}
+}
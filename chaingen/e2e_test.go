@@ -0,0 +1,216 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package chaingen
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/coredao-org/btcpowermirror/chainproof"
+	"github.com/coredao-org/btcpowermirror/delegation"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/coredao-org/btcpowermirror/sqlindex"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	candidateA = common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	candidateB = common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	rewardX    = common.HexToAddress("0x1111111111111111111111111111111111111111")
+)
+
+// delegatingChain mines n blocks, the ones at even heights delegating to
+// candidate.
+func delegatingChain(c *Chain, n int, candidate common.Address) {
+	for i := 0; i < n; i++ {
+		tmpl := &Template{Payout: P2WPKH(rewardX)}
+		if (c.Height()+1)%2 == 0 {
+			tmpl.Markers = [][]byte{CoreMarker(candidate, rewardX)}
+		}
+		c.Mine(tmpl)
+	}
+}
+
+func candidateHeights(t *testing.T, ix *sqlindex.Index, candidate common.Address) []int64 {
+	t.Helper()
+	blocks, err := ix.CandidateBlocks(context.Background(), candidate, 0, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heights := []int64{}
+	for _, b := range blocks {
+		heights = append(heights, b.Height)
+	}
+	return heights
+}
+
+func recordHeights(records []delegation.Record) []int64 {
+	heights := []int64{}
+	for _, rec := range records {
+		heights = append(heights, rec.Height)
+	}
+	return heights
+}
+
+// TestRelayEndToEnd relays a mined chain into the delegation indexes and
+// checks that they follow a reorganization.
+func TestRelayEndToEnd(t *testing.T) {
+	ctx := context.Background()
+	c := New(nil)
+	delegatingChain(c, 8, candidateA)
+
+	sqlIndex, err := sqlindex.Open(ctx, ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlIndex.Close()
+	memIndex := delegation.NewIndex(nil)
+
+	var relayers []*relayer.Relayer
+	for _, submitter := range []relayer.Submitter{sqlIndex, memIndex} {
+		r, err := relayer.New(relayer.Config{
+			Source:        c.Source(),
+			Submitter:     submitter,
+			StartHeight:   1,
+			Confirmations: 1,
+			PowLimit:      c.Params().PowLimit,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		relayers = append(relayers, r)
+	}
+	step := func() {
+		t.Helper()
+		for _, r := range relayers {
+			if err := r.Step(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	step()
+	want := []int64{2, 4, 6, 8}
+	if got := candidateHeights(t, sqlIndex, candidateA); !reflect.DeepEqual(got, want) {
+		t.Errorf("sqlindex: candidate A blocks %v, want %v", got, want)
+	}
+	if got := recordHeights(memIndex.CandidateBlocks(candidateA, 0, 1000)); !reflect.DeepEqual(got, want) {
+		t.Errorf("delegation index: candidate A blocks %v, want %v", got, want)
+	}
+
+	// A longer branch from height 4 delegates to candidate B instead.
+	fork := c.Block(4).BlockHash()
+	for i := 0; i < 6; i++ {
+		tmpl := &Template{Tag: []byte("fork"), Markers: [][]byte{CoreMarker(candidateB, rewardX)}}
+		block, err := c.MineOn(fork, tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fork = block.BlockHash()
+	}
+	if c.Height() != 10 {
+		t.Fatalf("fork did not become the best chain, height %d", c.Height())
+	}
+
+	step()
+	want = []int64{2, 4}
+	if got := candidateHeights(t, sqlIndex, candidateA); !reflect.DeepEqual(got, want) {
+		t.Errorf("sqlindex after reorg: candidate A blocks %v, want %v", got, want)
+	}
+	if got := recordHeights(memIndex.CandidateBlocks(candidateA, 0, 1000)); !reflect.DeepEqual(got, want) {
+		t.Errorf("delegation index after reorg: candidate A blocks %v, want %v", got, want)
+	}
+	want = []int64{5, 6, 7, 8, 9, 10}
+	if got := candidateHeights(t, sqlIndex, candidateB); !reflect.DeepEqual(got, want) {
+		t.Errorf("sqlindex after reorg: candidate B blocks %v, want %v", got, want)
+	}
+	if tip, err := sqlIndex.Tip(ctx); err != nil || tip != 10 {
+		t.Errorf("sqlindex tip %d, %v", tip, err)
+	}
+	b, err := sqlIndex.Lookup(ctx, c.Block(10).BlockHash())
+	if err != nil || b.PayoutType != lightmirror.NOT_SUPPORT {
+		t.Errorf("tip of the fork: %+v, %v", b, err)
+	}
+}
+
+// TestChainBatchEndToEnd proves the delegated blocks of a mined chain with a
+// ChainBatch.
+func TestChainBatchEndToEnd(t *testing.T) {
+	c := New(nil)
+	delegatingChain(c, 12, candidateA)
+
+	var mirrors []*lightmirror.BtcLightMirrorV2
+	work := new(big.Int)
+	for height := int64(1); height <= c.Height(); height++ {
+		mirror, err := c.Mirror(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirrors = append(mirrors, mirror)
+		work.Add(work, blockchain.CalcWork(mirror.BtcHeader.Bits))
+	}
+	batch, err := lightmirror.NewChainBatch(mirrors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := batch.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded lightmirror.ChainBatch
+	if err := decoded.Deserialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := c.Block(0).BlockHash()
+	res, err := decoded.Verify(&genesis, &lightmirror.VerifyOptions{PowLimit: c.Params().PowLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Tip != c.Tip().BlockHash() || res.Work.Cmp(work) != 0 || len(res.Proofs) != 6 {
+		t.Errorf("tip %v, work %v, %d proofs", res.Tip, res.Work, len(res.Proofs))
+	}
+	for i, proof := range res.Proofs {
+		if !proof.Delegated() || proof.Candidate != candidateA || proof.Hash != c.Block(int64(2*i+2)).BlockHash() {
+			t.Errorf("proof %d: %+v", i, proof)
+		}
+	}
+
+	// The mainnet proof of work limit rejects regtest blocks.
+	if _, err := decoded.Verify(&genesis, nil); err == nil {
+		t.Errorf("regtest batch verified under the mainnet limit")
+	}
+}
+
+// TestChainProofEndToEnd proves that a mined block sits under the work of the
+// chain built on it.
+func TestChainProofEndToEnd(t *testing.T) {
+	c := New(nil)
+	c.MineN(200, nil)
+
+	checkpoint := c.Block(0).BlockHash()
+	chain, err := chainproof.NewChain(checkpoint, c.Headers(1, c.Height()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := chain.Prove(149, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := proof.Verify(checkpoint, &chainproof.VerifyOptions{PowLimit: c.Params().PowLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Target != c.Block(150).BlockHash() || res.Tip != c.Tip().BlockHash() ||
+		res.Work.Cmp(chain.Work()) != 0 {
+		t.Errorf("result %+v", res)
+	}
+}
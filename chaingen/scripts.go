@@ -0,0 +1,71 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package chaingen
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// P2PKH returns the pay-to-pubkey-hash script of the 20 byte hash addr, which
+// GetCoinbaseAddress reports as a PUBKEYHASH payout to addr.
+func P2PKH(addr common.Address) []byte {
+	script := []byte{txscript.OP_DUP, txscript.OP_HASH160, txscript.OP_DATA_20}
+	script = append(script, addr[:]...)
+	return append(script, txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG)
+}
+
+// P2WPKH returns the pay-to-witness-pubkey-hash script of the 20 byte hash
+// addr, which GetCoinbaseAddress reports as a WITNESS_V0_KEYHASH payout to
+// addr.
+func P2WPKH(addr common.Address) []byte {
+	return append([]byte{txscript.OP_0, txscript.OP_DATA_20}, addr[:]...)
+}
+
+// CoreMarker returns the OP_RETURN script delegating the hash power of a block
+// to candidate, with its rewards paid to reward.
+func CoreMarker(candidate, reward common.Address) []byte {
+	return coreMarker(candidate[:], reward[:])
+}
+
+// CoreMarkerWithHash returns the delegation script of CoreMarker carrying the
+// optional Core block hash.  The longer payload is pushed with OP_PUSHDATA1,
+// which PowerPolicyStrict requires but ParsePowerParams does not read.
+func CoreMarkerWithHash(candidate, reward common.Address, coreBlock common.Hash) []byte {
+	return coreMarker(candidate[:], reward[:], coreBlock[:])
+}
+
+// coreMarker returns a version 1 CORE marker holding the concatenation of
+// fields.
+func coreMarker(fields ...[]byte) []byte {
+	payload := []byte{'C', 'O', 'R', 'E', 0x01}
+	for _, field := range fields {
+		payload = append(payload, field...)
+	}
+	script, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_RETURN).AddData(payload).Script()
+	if err != nil {
+		panic(err)
+	}
+	return script
+}
+
+// Spend returns a version 2 transaction spending prev to outputs.  Set the
+// witness of its input to make it a witness transaction.
+func Spend(prev wire.OutPoint, outputs ...*wire.TxOut) *wire.MsgTx {
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&prev, nil, nil))
+	for _, out := range outputs {
+		tx.AddTxOut(out)
+	}
+	return tx
+}
+
+// CoinbaseOutPoint returns the outpoint of output index of the coinbase of
+// block.
+func CoinbaseOutPoint(block *wire.MsgBlock, index uint32) wire.OutPoint {
+	return wire.OutPoint{Hash: block.Transactions[0].TxHash(), Index: index}
+}
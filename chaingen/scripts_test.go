@@ -0,0 +1,70 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package chaingen
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPayoutScripts(t *testing.T) {
+	addr := common.HexToAddress("0x0123456789abcdef0123456789abcdef01234567")
+	tests := []struct {
+		script []byte
+		class  txscript.ScriptClass
+		typ    int
+	}{
+		{P2PKH(addr), txscript.PubKeyHashTy, lightmirror.PUBKEYHASH},
+		{P2WPKH(addr), txscript.WitnessV0PubKeyHashTy, lightmirror.WITNESS_V0_KEYHASH},
+	}
+	for _, test := range tests {
+		if class := txscript.GetScriptClass(test.script); class != test.class {
+			t.Errorf("%x: class %v, want %v", test.script, class, test.class)
+		}
+
+		c := New(nil)
+		c.Mine(&Template{Payout: test.script})
+		mirror, err := c.Mirror(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, typ := mirror.GetCoinbaseAddress(); got != addr || typ != test.typ {
+			t.Errorf("%x: payout %v of type %d, want %v of type %d", test.script,
+				got, typ, addr, test.typ)
+		}
+	}
+}
+
+func TestCoreMarker(t *testing.T) {
+	candidate := common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	reward := common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	coreBlock := common.HexToHash("0x77")
+
+	tests := []struct {
+		script       []byte
+		hasBlockHash bool
+	}{
+		{CoreMarker(candidate, reward), false},
+		{CoreMarkerWithHash(candidate, reward, coreBlock), true},
+	}
+	for _, test := range tests {
+		coinbase := wire.NewMsgTx(1)
+		coinbase.AddTxOut(wire.NewTxOut(1, []byte{txscript.OP_TRUE}))
+		coinbase.AddTxOut(wire.NewTxOut(0, test.script))
+
+		m, err := lightmirror.ValidatePowerMarkers(coinbase, lightmirror.PowerPolicyStrict)
+		if err != nil || m == nil {
+			t.Fatalf("%x: %v, %v", test.script, m, err)
+		}
+		if m.Candidate != candidate || m.Reward != reward || m.HasBlockHash != test.hasBlockHash ||
+			(test.hasBlockHash && m.BlockHash != coreBlock) {
+			t.Errorf("%x: marker %+v", test.script, m)
+		}
+	}
+}
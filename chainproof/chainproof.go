@@ -0,0 +1,492 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package chainproof builds and verifies succinct proofs of chainwork in the
+// style of FlyClient.  Instead of relaying every header since a checkpoint,
+// a prover commits to the range with a merkle tree whose leaves bind each
+// block hash to the cumulative work up to that block.  The verifier derives
+// random work offsets from the commitment, Fiat-Shamir style, and the proof
+// opens the headers covering those offsets together with their parents.
+//
+// Every opened header must satisfy its proof of work, extend its parent and
+// add exactly the work of its difficulty to the cumulative work.  A prover who
+// did not do a fraction f of the claimed work is caught unless all samples
+// miss it, which happens with probability (1-f)^m for m samples.  Bitcoin
+// headers do not commit to the tree, so unlike FlyClient the commitment is
+// built by the prover and difficulty adjustments are not validated; the
+// sampling bounds the unproven work rather than proving a particular chain.
+//
+// Since the prover builds the commitment, it can also grind it: rebuild the
+// tree, for instance by reordering the forged part of the chain, until the
+// samples miss the work it lacks.  Each attempt costs a tree rather than
+// proof of work, so a prover trying 2^k commitments passes with probability
+// about 2^k * (1-f)^m.  The seed cannot be taken from the headers alone,
+// such as the tip, since the prover would then pick the cumulative works of
+// the leaves after seeing the samples.  Verify therefore requires enough
+// samples that a prover building up to 2^GrindBits commitments passes with
+// probability at most 2^-SecurityBits while lacking more than MaxForged of
+// the work above the target.  Proofs with fewer samples are rejected, and
+// bounds no proof can meet are rejected as well.
+//
+// A proof is anchored on a target block, such as a mirrored block.  It opens
+// the target and the tip and samples the work from the target to the tip,
+// which Verify reports as the work the target sits under.
+package chainproof
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"sort"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+const (
+	// DefaultSamples is the number of sampled headers of a proof when
+	// none is given.  It is the number Verify requires under the default
+	// bound.
+	DefaultSamples = 299
+
+	// DefaultMaxForged, DefaultGrindBits and DefaultSecurityBits are the
+	// default bound of Verify: a prover lacking a fifth of the work above
+	// the target passes with probability at most 2^-32 after building
+	// 2^64 commitments.
+	DefaultMaxForged    = 0.2
+	DefaultGrindBits    = 64
+	DefaultSecurityBits = 32
+
+	// MaxSamples bounds the samples of a decoded proof.
+	MaxSamples = 1000
+
+	// MaxHeaders is the largest number of headers a proof can cover.
+	MaxHeaders = 1 << 24
+
+	// workSize is the size of an encoded cumulative work.
+	workSize = 32
+)
+
+var (
+	// ErrEmptyChain is returned when proving over no headers.
+	ErrEmptyChain = errors.New("no headers")
+
+	// ErrBadTarget is returned when the target block is out of range.
+	ErrBadTarget = errors.New("target block out of range")
+
+	// ErrTooFewSamples is returned when a proof samples fewer headers than
+	// required.
+	ErrTooFewSamples = errors.New("too few samples")
+
+	// ErrBadBound is returned when the bound of VerifyOptions is invalid
+	// or needs more than MaxSamples samples.
+	ErrBadBound = errors.New("invalid forged work bound")
+
+	// ErrBadSample is returned when an opened header does not match the
+	// commitment, the sampled work or its parent.
+	ErrBadSample = errors.New("invalid sample")
+)
+
+// Chain is the commitment to a range of consecutive headers.
+type Chain struct {
+	checkpoint chainhash.Hash
+	headers    []wire.BlockHeader
+	hashes     []chainhash.Hash
+	work       []*big.Int
+
+	// tree holds the levels of the merkle tree, from the leaves up to
+	// the root, so that openings do not rebuild it.
+	tree [][]chainhash.Hash
+	root chainhash.Hash
+}
+
+// NewChain commits to headers, the first of which extends checkpoint.  It
+// checks that the headers are chained but not their proof of work, which is
+// up to the verifier.
+func NewChain(checkpoint chainhash.Hash, headers []wire.BlockHeader) (*Chain, error) {
+	if len(headers) == 0 {
+		return nil, ErrEmptyChain
+	}
+	if len(headers) > MaxHeaders {
+		return nil, fmt.Errorf("%d headers, max %d", len(headers), MaxHeaders)
+	}
+
+	c := &Chain{
+		checkpoint: checkpoint,
+		headers:    headers,
+		hashes:     make([]chainhash.Hash, len(headers)),
+		work:       make([]*big.Int, len(headers)),
+	}
+	leaves := make([]chainhash.Hash, len(headers))
+	prev, work := checkpoint, new(big.Int)
+	for i := range headers {
+		if headers[i].PrevBlock != prev {
+			return nil, fmt.Errorf("%w: block %d does not extend %v",
+				lightmirror.ErrChainBroken, i, prev)
+		}
+		c.hashes[i] = headers[i].BlockHash()
+		work = new(big.Int).Add(work, blockchain.CalcWork(headers[i].Bits))
+		c.work[i] = work
+		leaves[i] = leafHash(&c.hashes[i], work)
+		prev = c.hashes[i]
+	}
+	c.tree = merkleTree(leaves)
+	c.root = c.tree[len(c.tree)-1][0]
+	return c, nil
+}
+
+// merkleTree returns the levels of the merkle tree of leaves, the leaves
+// first and the root last.  Like Bitcoin, a level of odd length hashes its
+// last node with itself.
+func merkleTree(leaves []chainhash.Hash) [][]chainhash.Hash {
+	tree := [][]chainhash.Hash{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([]chainhash.Hash, (len(level)+1)/2)
+		for i := range next {
+			left, right := &level[2*i], &level[2*i]
+			if 2*i+1 < len(level) {
+				right = &level[2*i+1]
+			}
+			next[i] = *blockchain.HashMerkleBranches(left, right)
+		}
+		tree = append(tree, next)
+		level = next
+	}
+	return tree
+}
+
+// branch returns the merkle branch of the leaf at index i.
+func (c *Chain) branch(i int) []chainhash.Hash {
+	branch := make([]chainhash.Hash, 0, len(c.tree)-1)
+	for _, level := range c.tree[:len(c.tree)-1] {
+		sibling := i ^ 1
+		if sibling >= len(level) {
+			sibling = i
+		}
+		branch = append(branch, level[sibling])
+		i >>= 1
+	}
+	return branch
+}
+
+// Root returns the merkle root of the commitment.
+func (c *Chain) Root() chainhash.Hash {
+	return c.root
+}
+
+// Work returns the cumulative work of the headers.
+func (c *Chain) Work() *big.Int {
+	return new(big.Int).Set(c.work[len(c.work)-1])
+}
+
+// Prove returns a proof with the given number of samples that the header at
+// index target sits under the work of the chain.  DefaultSamples are taken
+// when samples is zero; VerifyOptions.RequiredSamples gives the number a
+// verifier with another bound requires.
+func (c *Chain) Prove(target, samples int) (*Proof, error) {
+	if target < 0 || target >= len(c.headers) {
+		return nil, fmt.Errorf("%w: %d of %d headers", ErrBadTarget, target,
+			len(c.headers))
+	}
+	if samples <= 0 {
+		samples = DefaultSamples
+	}
+	if samples > MaxSamples {
+		return nil, fmt.Errorf("%d samples, max %d", samples, MaxSamples)
+	}
+
+	p := &Proof{
+		Checkpoint: c.checkpoint,
+		Length:     uint32(len(c.headers)),
+		Root:       c.root,
+		Target:     c.open(target),
+		Tip:        c.open(len(c.headers) - 1),
+		Samples:    make([]Sample, samples),
+	}
+	from := c.workBefore(target)
+	tip := c.hashes[len(c.hashes)-1]
+	for j := range p.Samples {
+		w := sampleWork(&c.root, p.Length, &tip, uint32(target), uint32(j), from, c.Work())
+		i := sort.Search(len(c.work), func(i int) bool { return c.work[i].Cmp(w) > 0 })
+		p.Samples[j] = c.open(i)
+	}
+	return p, nil
+}
+
+// workBefore returns the cumulative work before the header at index i.
+func (c *Chain) workBefore(i int) *big.Int {
+	if i == 0 {
+		return new(big.Int)
+	}
+	return c.work[i-1]
+}
+
+// open returns the sample opening the header at index i and its parent.
+func (c *Chain) open(i int) Sample {
+	s := Sample{
+		Index:    uint32(i),
+		Header:   c.headers[i],
+		Work:     new(big.Int).Set(c.work[i]),
+		PrevHash: c.checkpoint,
+		PrevWork: new(big.Int),
+	}
+	s.Branch = c.branch(i)
+	if i > 0 {
+		s.PrevHash = c.hashes[i-1]
+		s.PrevWork.Set(c.work[i-1])
+		s.PrevBranch = c.branch(i - 1)
+	}
+	return s
+}
+
+// Sample opens a committed header and the leaf of its parent.
+type Sample struct {
+	// Index is the position of the header in the chain.
+	Index uint32
+
+	Header wire.BlockHeader
+
+	// Work is the cumulative work up to and including the header.
+	Work *big.Int
+
+	// PrevHash and PrevWork are the hash and cumulative work of the
+	// parent, the checkpoint and zero for the first header.
+	PrevHash chainhash.Hash
+	PrevWork *big.Int
+
+	// Branch and PrevBranch are the merkle branches of the leaves of the
+	// header and of its parent.  PrevBranch is empty for the first header.
+	Branch     []chainhash.Hash
+	PrevBranch []chainhash.Hash
+}
+
+// Proof is a succinct proof of the work above a target block.
+type Proof struct {
+	// Checkpoint is the hash of the block before the first header.
+	Checkpoint chainhash.Hash
+
+	// Length is the number of committed headers.
+	Length uint32
+
+	// Root is the merkle root of the commitment.
+	Root chainhash.Hash
+
+	// Target opens the proven block and Tip the last header.
+	Target Sample
+	Tip    Sample
+
+	// Samples open the headers covering the work offsets derived from the
+	// commitment, in order.
+	Samples []Sample
+}
+
+// VerifyOptions configures proof verification.
+type VerifyOptions struct {
+	// PowLimit is the highest allowed proof of work target.  The main
+	// network limit is used when nil.
+	PowLimit *big.Int
+
+	// MaxForged is the largest fraction of the work above the target,
+	// in (0, 1), that a prover may lack and still pass.  GrindBits is the
+	// log2 of the number of commitments a prover is assumed to build, and
+	// SecurityBits the log2 of the inverse of its chance to pass.  The
+	// defaults are used for zero values.
+	MaxForged    float64
+	GrindBits    int
+	SecurityBits int
+}
+
+// RequiredSamples returns the least number of samples meeting the bound of
+// opts, the least m with 2^GrindBits * (1-MaxForged)^m <= 2^-SecurityBits.
+func (opts *VerifyOptions) RequiredSamples() (int, error) {
+	maxForged, grind, security := DefaultMaxForged, DefaultGrindBits, DefaultSecurityBits
+	if opts != nil {
+		if opts.MaxForged != 0 {
+			maxForged = opts.MaxForged
+		}
+		if opts.GrindBits != 0 {
+			grind = opts.GrindBits
+		}
+		if opts.SecurityBits != 0 {
+			security = opts.SecurityBits
+		}
+	}
+	if !(maxForged > 0 && maxForged < 1) || grind < 0 || security < 0 {
+		return 0, fmt.Errorf("%w: forged fraction %v, %d grinding bits, "+
+			"%d security bits", ErrBadBound, maxForged, grind, security)
+	}
+
+	m := math.Ceil(float64(grind+security) / -math.Log2(1-maxForged))
+	if m > MaxSamples {
+		return 0, fmt.Errorf("%w: needs %v samples, max %d", ErrBadBound,
+			m, MaxSamples)
+	}
+	if m < 1 {
+		m = 1
+	}
+	return int(m), nil
+}
+
+// Result is the outcome of verifying a proof.
+type Result struct {
+	// Target and Tip are the hashes of the proven block and of the last
+	// header, TargetIndex the position of the target in the chain.
+	Target      chainhash.Hash
+	TargetIndex uint32
+	Tip         chainhash.Hash
+
+	// Work is the cumulative work of the chain since the checkpoint and
+	// WorkAbove the part of it done by the target and its descendants.
+	Work      *big.Int
+	WorkAbove *big.Int
+}
+
+// Verify checks the proof against checkpoint.  It returns the work the target
+// sits under, which the caller compares with the work it requires.
+func (p *Proof) Verify(checkpoint chainhash.Hash, opts *VerifyOptions) (*Result, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	minSamples, err := opts.RequiredSamples()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Checkpoint != checkpoint {
+		return nil, fmt.Errorf("%w: proof starts at %v, not %v",
+			lightmirror.ErrChainBroken, p.Checkpoint, checkpoint)
+	}
+	if p.Length == 0 || p.Length > MaxHeaders {
+		return nil, fmt.Errorf("%w: %d headers", ErrEmptyChain, p.Length)
+	}
+	if len(p.Samples) < minSamples {
+		return nil, fmt.Errorf("%w: %d, want %d", ErrTooFewSamples,
+			len(p.Samples), minSamples)
+	}
+
+	if p.Tip.Index != p.Length-1 {
+		return nil, fmt.Errorf("%w: tip at %d of %d headers", ErrBadSample,
+			p.Tip.Index, p.Length)
+	}
+	if err := p.verifySample(&p.Tip, opts.PowLimit); err != nil {
+		return nil, fmt.Errorf("tip: %w", err)
+	}
+	if err := p.verifySample(&p.Target, opts.PowLimit); err != nil {
+		return nil, fmt.Errorf("target: %w", err)
+	}
+	if p.Tip.Work.Cmp(p.Target.PrevWork) <= 0 {
+		return nil, fmt.Errorf("%w: tip work %v not above target work %v",
+			ErrBadSample, p.Tip.Work, p.Target.PrevWork)
+	}
+
+	tip := p.Tip.Header.BlockHash()
+	for j := range p.Samples {
+		s := &p.Samples[j]
+		w := sampleWork(&p.Root, p.Length, &tip, p.Target.Index, uint32(j),
+			p.Target.PrevWork, p.Tip.Work)
+		if err := p.verifySample(s, opts.PowLimit); err != nil {
+			return nil, fmt.Errorf("sample %d: %w", j, err)
+		}
+		if s.PrevWork.Cmp(w) > 0 || s.Work.Cmp(w) <= 0 {
+			return nil, fmt.Errorf("%w: sample %d opens block %d, which does "+
+				"not cover work %v", ErrBadSample, j, s.Index, w)
+		}
+	}
+
+	return &Result{
+		Target:      p.Target.Header.BlockHash(),
+		TargetIndex: p.Target.Index,
+		Tip:         tip,
+		Work:        new(big.Int).Set(p.Tip.Work),
+		WorkAbove:   new(big.Int).Sub(p.Tip.Work, p.Target.PrevWork),
+	}, nil
+}
+
+// verifySample checks that s opens a header of the commitment which extends
+// its parent and satisfies its proof of work.
+func (p *Proof) verifySample(s *Sample, powLimit *big.Int) error {
+	if s.Index >= p.Length {
+		return fmt.Errorf("%w: block %d of %d", ErrBadSample, s.Index, p.Length)
+	}
+	if !validWork(s.Work) || !validWork(s.PrevWork) {
+		return fmt.Errorf("%w: block %d lacks a valid work", ErrBadSample, s.Index)
+	}
+
+	hash := s.Header.BlockHash()
+	if !p.committed(leafHash(&hash, s.Work), s.Index, s.Branch) {
+		return fmt.Errorf("%w: block %d %v is not committed", ErrBadSample,
+			s.Index, hash)
+	}
+	if s.Index == 0 {
+		if s.PrevHash != p.Checkpoint || s.PrevWork.Sign() != 0 || len(s.PrevBranch) != 0 {
+			return fmt.Errorf("%w: first block does not start at the "+
+				"checkpoint", ErrBadSample)
+		}
+	} else if !p.committed(leafHash(&s.PrevHash, s.PrevWork), s.Index-1, s.PrevBranch) {
+		return fmt.Errorf("%w: parent of block %d is not committed",
+			ErrBadSample, s.Index)
+	}
+	if s.Header.PrevBlock != s.PrevHash {
+		return fmt.Errorf("%w: block %d %v does not extend %v",
+			lightmirror.ErrChainBroken, s.Index, hash, s.PrevHash)
+	}
+
+	if err := lightmirror.CheckProofOfWork(&s.Header, powLimit); err != nil {
+		return fmt.Errorf("block %d: %w", s.Index, err)
+	}
+	work := new(big.Int).Sub(s.Work, s.PrevWork)
+	if work.Cmp(blockchain.CalcWork(s.Header.Bits)) != 0 {
+		return fmt.Errorf("%w: block %d claims work %v for bits %08x",
+			ErrBadSample, s.Index, work, s.Header.Bits)
+	}
+	return nil
+}
+
+// committed reports whether leaf is at index in the commitment.
+func (p *Proof) committed(leaf chainhash.Hash, index uint32, branch []chainhash.Hash) bool {
+	if len(branch) != bits.Len32(p.Length-1) {
+		return false
+	}
+	return lightmirror.MerkleBranchRoot(leaf, int(index), branch) == p.Root
+}
+
+// validWork reports whether work can be encoded in a leaf.
+func validWork(work *big.Int) bool {
+	return work != nil && work.Sign() >= 0 && work.BitLen() <= 8*workSize
+}
+
+// leafHash returns the leaf committing to a block hash and the cumulative
+// work up to that block.
+func leafHash(hash *chainhash.Hash, work *big.Int) chainhash.Hash {
+	var buf [chainhash.HashSize + workSize]byte
+	copy(buf[:], hash[:])
+	work.FillBytes(buf[chainhash.HashSize:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// sampleWork derives the work offset of sample j from the commitment.  The
+// offset is uniform in [from, to).
+func sampleWork(root *chainhash.Hash, length uint32, tip *chainhash.Hash, target, j uint32, from, to *big.Int) *big.Int {
+	var buf [2*chainhash.HashSize + 12]byte
+	copy(buf[:], root[:])
+	copy(buf[chainhash.HashSize:], tip[:])
+	binary.LittleEndian.PutUint32(buf[2*chainhash.HashSize:], length)
+	binary.LittleEndian.PutUint32(buf[2*chainhash.HashSize+4:], target)
+	binary.LittleEndian.PutUint32(buf[2*chainhash.HashSize+8:], j)
+	seed := sha256.Sum256(buf[:])
+
+	span := new(big.Int).Sub(to, from)
+	if span.Sign() <= 0 {
+		return new(big.Int).Set(from)
+	}
+	w := new(big.Int).SetBytes(seed[:])
+	w.Mod(w, span)
+	return w.Add(w, from)
+}
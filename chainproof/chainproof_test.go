@@ -0,0 +1,269 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package chainproof
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+var regtest = &VerifyOptions{PowLimit: chaincfg.RegressionNetParams.PowLimit}
+
+// appendChain extends headers, or checkpoint when empty, by n headers of the
+// given difficulty.  Headers are mined only when mine is set.
+func appendChain(headers []wire.BlockHeader, checkpoint chainhash.Hash, n int, bits uint32, mine bool) []wire.BlockHeader {
+	prev := checkpoint
+	if len(headers) > 0 {
+		prev = headers[len(headers)-1].BlockHash()
+	}
+	target := blockchain.CompactToBig(bits)
+	for i := 0; i < n; i++ {
+		header := wire.BlockHeader{
+			Version:    4,
+			PrevBlock:  prev,
+			MerkleRoot: chainhash.Hash{byte(len(headers)), byte(len(headers) >> 8)},
+			Timestamp:  time.Unix(1600000000+int64(len(headers))*600, 0),
+			Bits:       bits,
+		}
+		for mine {
+			hash := header.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			header.Nonce++
+		}
+		headers = append(headers, header)
+		prev = header.BlockHash()
+	}
+	return headers
+}
+
+func TestProof(t *testing.T) {
+	const n = 2000
+	checkpoint := chainhash.Hash{0xcc}
+	bits := chaincfg.RegressionNetParams.PowLimitBits
+	headers := appendChain(nil, checkpoint, n, bits, true)
+
+	chain, err := NewChain(checkpoint, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockWork := blockchain.CalcWork(bits)
+
+	for _, target := range []int{0, 1, 1500, n - 1} {
+		proof, err := chain.Prove(target, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := proof.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		raw := append([]byte(nil), buf.Bytes()...)
+		var decoded Proof
+		if err := decoded.Deserialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		if err := decoded.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), raw) {
+			t.Fatalf("target %d: proof does not round trip", target)
+		}
+		if target == 1500 {
+			t.Logf("proof of %d headers: %d bytes instead of %d", n, len(raw),
+				n*wire.MaxBlockHeaderPayload)
+		}
+
+		res, err := decoded.Verify(checkpoint, regtest)
+		if err != nil {
+			t.Fatalf("target %d: %v", target, err)
+		}
+		if res.Target != headers[target].BlockHash() || res.TargetIndex != uint32(target) ||
+			res.Tip != headers[n-1].BlockHash() {
+			t.Errorf("target %d: result %+v", target, res)
+		}
+		want := new(big.Int).Mul(blockWork, big.NewInt(int64(n-target)))
+		if res.WorkAbove.Cmp(want) != 0 || res.Work.Cmp(chain.Work()) != 0 {
+			t.Errorf("target %d: work above %v, want %v", target, res.WorkAbove, want)
+		}
+	}
+
+	// A single header chain has no merkle branches.
+	single, err := NewChain(checkpoint, headers[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := single.Prove(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proof.Verify(checkpoint, regtest); err != nil {
+		t.Errorf("single header: %v", err)
+	}
+
+	headers[7].PrevBlock = chainhash.Hash{}
+	if _, err := NewChain(checkpoint, headers); !errors.Is(err, lightmirror.ErrChainBroken) {
+		t.Errorf("unchained headers: got %v, want %v", err, lightmirror.ErrChainBroken)
+	}
+}
+
+func TestRequiredSamples(t *testing.T) {
+	tests := []struct {
+		opts *VerifyOptions
+		want int
+		err  error
+	}{
+		{nil, DefaultSamples, nil},
+		{&VerifyOptions{}, DefaultSamples, nil},
+		{&VerifyOptions{MaxForged: 0.5, SecurityBits: 64}, 128, nil},
+		{&VerifyOptions{MaxForged: 0.1}, 632, nil},
+		{&VerifyOptions{MaxForged: 0.05}, 0, ErrBadBound},
+		{&VerifyOptions{MaxForged: 1}, 0, ErrBadBound},
+		{&VerifyOptions{MaxForged: -0.5}, 0, ErrBadBound},
+		{&VerifyOptions{GrindBits: -1}, 0, ErrBadBound},
+	}
+	for _, test := range tests {
+		got, err := test.opts.RequiredSamples()
+		if got != test.want || !errors.Is(err, test.err) {
+			t.Errorf("%+v: got %d, %v, want %d, %v", test.opts, got, err,
+				test.want, test.err)
+		}
+	}
+}
+
+// TestChainTree checks the stored tree against the in-place merkle helpers for
+// trees of odd and even widths.
+func TestChainTree(t *testing.T) {
+	checkpoint := chainhash.Hash{0xcc}
+	headers := appendChain(nil, checkpoint, 13, chaincfg.RegressionNetParams.PowLimitBits, false)
+	for n := 1; n <= len(headers); n++ {
+		chain, err := NewChain(checkpoint, headers[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves := chain.tree[0]
+		if root := lightmirror.MerkleRootInPlace(append([]chainhash.Hash(nil), leaves...)); root != chain.Root() {
+			t.Errorf("%d leaves: root %v, want %v", n, chain.Root(), root)
+		}
+		for i := range leaves {
+			_, want := lightmirror.MerkleBranchInPlace(append([]chainhash.Hash(nil), leaves...), i, nil)
+			if got := chain.branch(i); len(got) != len(want) ||
+				lightmirror.MerkleBranchRoot(leaves[i], i, got) != chain.Root() {
+				t.Errorf("%d leaves: branch of %d %v, want %v", n, i, got, want)
+			}
+		}
+	}
+}
+
+func TestProofForged(t *testing.T) {
+	checkpoint := chainhash.Hash{0xcc}
+	regtestBits := chaincfg.RegressionNetParams.PowLimitBits
+
+	// A prover extends 100 mined regtest blocks with headers claiming far
+	// more work without mining them.
+	headers := appendChain(nil, checkpoint, 100, regtestBits, true)
+	headers = appendChain(headers, checkpoint, 900, 0x1d00ffff, false)
+	chain, err := NewChain(checkpoint, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := chain.Prove(50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proof.Verify(checkpoint, regtest); !errors.Is(err, lightmirror.ErrHighHash) {
+		t.Errorf("forged work: got %v, want %v", err, lightmirror.ErrHighHash)
+	}
+}
+
+func TestProofInvalid(t *testing.T) {
+	checkpoint := chainhash.Hash{0xcc}
+	headers := appendChain(nil, checkpoint, 300, chaincfg.RegressionNetParams.PowLimitBits, true)
+	chain, err := NewChain(checkpoint, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Prove(300, 0); !errors.Is(err, ErrBadTarget) {
+		t.Errorf("target past tip: got %v, want %v", err, ErrBadTarget)
+	}
+
+	proof, err := chain.Prove(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proof.Verify(chainhash.Hash{}, regtest); !errors.Is(err, lightmirror.ErrChainBroken) {
+		t.Errorf("wrong checkpoint: got %v, want %v", err, lightmirror.ErrChainBroken)
+	}
+	if _, err := proof.Verify(checkpoint, nil); !errors.Is(err, lightmirror.ErrTargetOutOfRange) {
+		t.Errorf("main network: got %v, want %v", err, lightmirror.ErrTargetOutOfRange)
+	}
+	strict := &VerifyOptions{PowLimit: regtest.PowLimit, MaxForged: 0.1}
+	if _, err := proof.Verify(checkpoint, strict); !errors.Is(err, ErrTooFewSamples) {
+		t.Errorf("stricter bound: got %v, want %v", err, ErrTooFewSamples)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *Proof)
+		want   error
+	}{
+		{"few samples", func(p *Proof) {
+			p.Samples = p.Samples[:DefaultSamples-1]
+		}, ErrTooFewSamples},
+		{"other sample", func(p *Proof) {
+			// Opening a valid header covering a different offset.
+			p.Samples[0], p.Samples[1] = p.Samples[1], p.Samples[0]
+		}, ErrBadSample},
+		{"sample index", func(p *Proof) {
+			p.Samples[3].Index++
+		}, ErrBadSample},
+		{"tip work", func(p *Proof) {
+			p.Tip.Work.Add(p.Tip.Work, big.NewInt(1))
+		}, ErrBadSample},
+		{"tip index", func(p *Proof) {
+			p.Tip = p.Target
+		}, ErrBadSample},
+		{"parent", func(p *Proof) {
+			p.Target.Header.PrevBlock = chainhash.Hash{1}
+		}, ErrBadSample},
+		{"length", func(p *Proof) {
+			p.Length++
+		}, ErrBadSample},
+	}
+	for _, test := range tests {
+		proof, err := chain.Prove(10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.modify(proof)
+		if _, err := proof.Verify(checkpoint, regtest); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := proof.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	for _, n := range []int{0, 40, 200, len(raw) - 1} {
+		err := new(Proof).Deserialize(bytes.NewReader(raw[:n]))
+		if !errors.Is(err, lightmirror.ErrMalformedMirror) {
+			t.Errorf("cut at %d: got %v, want %v", n, err, lightmirror.ErrMalformedMirror)
+		}
+	}
+}
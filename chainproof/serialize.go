@@ -0,0 +1,245 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package chainproof
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// maxBranch is the longest merkle branch of a commitment to MaxHeaders.
+const maxBranch = 24
+
+// Deserialize decodes a proof from r into the receiver.
+func (p *Proof) Deserialize(r io.Reader) error {
+	const typ = "Proof"
+
+	_, err := io.ReadFull(r, p.Checkpoint[:])
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "checkpoint", Err: err}
+	}
+
+	var buf [4]byte
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "length", Err: err}
+	}
+	p.Length = binary.LittleEndian.Uint32(buf[:])
+
+	_, err = io.ReadFull(r, p.Root[:])
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "root", Err: err}
+	}
+
+	err = p.Target.deserialize(r)
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "target", Err: err}
+	}
+
+	err = p.Tip.deserialize(r)
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "tip", Err: err}
+	}
+
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "sample count", Err: err}
+	}
+	if count > MaxSamples {
+		return &lightmirror.DecodeError{Type: typ, Field: "sample count",
+			Err: fmt.Errorf("%d samples, max %d", count, MaxSamples)}
+	}
+
+	p.Samples = make([]Sample, count)
+	for i := range p.Samples {
+		err := p.Samples[i].deserialize(r)
+		if err != nil {
+			return &lightmirror.DecodeError{Type: typ,
+				Field: fmt.Sprintf("sample %d", i), Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Serialize encodes the proof to w.
+func (p *Proof) Serialize(w io.Writer) error {
+	_, err := w.Write(p.Checkpoint[:])
+	if err != nil {
+		return err
+	}
+
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], p.Length)
+	_, err = w.Write(buf[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(p.Root[:])
+	if err != nil {
+		return err
+	}
+
+	err = p.Target.serialize(w)
+	if err != nil {
+		return err
+	}
+
+	err = p.Tip.serialize(w)
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarInt(w, 0, uint64(len(p.Samples)))
+	if err != nil {
+		return err
+	}
+
+	for i := range p.Samples {
+		err := p.Samples[i].serialize(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Sample) deserialize(r io.Reader) error {
+	index, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if index >= MaxHeaders {
+		return fmt.Errorf("block %d, max %d", index, MaxHeaders-1)
+	}
+	s.Index = uint32(index)
+
+	err = s.Header.Deserialize(r)
+	if err != nil {
+		return err
+	}
+
+	s.Work, err = readWork(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(r, s.PrevHash[:])
+	if err != nil {
+		return err
+	}
+
+	s.PrevWork, err = readWork(r)
+	if err != nil {
+		return err
+	}
+
+	s.Branch, err = readBranch(r)
+	if err != nil {
+		return err
+	}
+
+	s.PrevBranch, err = readBranch(r)
+	return err
+}
+
+func (s *Sample) serialize(w io.Writer) error {
+	err := wire.WriteVarInt(w, 0, uint64(s.Index))
+	if err != nil {
+		return err
+	}
+
+	err = s.Header.Serialize(w)
+	if err != nil {
+		return err
+	}
+
+	err = writeWork(w, s.Work)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(s.PrevHash[:])
+	if err != nil {
+		return err
+	}
+
+	err = writeWork(w, s.PrevWork)
+	if err != nil {
+		return err
+	}
+
+	err = writeBranch(w, s.Branch)
+	if err != nil {
+		return err
+	}
+
+	return writeBranch(w, s.PrevBranch)
+}
+
+func readWork(r io.Reader) (*big.Int, error) {
+	var buf [workSize]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf[:]), nil
+}
+
+func writeWork(w io.Writer, work *big.Int) error {
+	if !validWork(work) {
+		return fmt.Errorf("work %v does not fit %d bytes", work, workSize)
+	}
+	var buf [workSize]byte
+	work.FillBytes(buf[:])
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readBranch(r io.Reader) ([]chainhash.Hash, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxBranch {
+		return nil, fmt.Errorf("%w [count %d, max %d]",
+			lightmirror.ErrTooManyMerkleNodes, count, maxBranch)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	branch := make([]chainhash.Hash, count)
+	for i := range branch {
+		_, err := io.ReadFull(r, branch[i][:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return branch, nil
+}
+
+func writeBranch(w io.Writer, branch []chainhash.Hash) error {
+	err := wire.WriteVarInt(w, 0, uint64(len(branch)))
+	if err != nil {
+		return err
+	}
+
+	for _, node := range branch {
+		_, err := w.Write(node[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Command powermirror-backfill exports the CORE-delegated blocks of a height
+// range as JSON lines or CSV.  Blocks are read from a bitcoind or btcd node,
+// from an Electrum server with -electrum, or from the block files of a Bitcoin
+// Core data directory with -blocksdir.  With -checkpoint an interrupted
+// export resumes where it stopped.
+//
+// Usage:
+//
+//	powermirror-backfill -rpcconnect 127.0.0.1:8332 -rpcuser u -rpcpass p \
+//		-from 780000 -to 790000 -format csv -out delegations.csv \
+//		-checkpoint delegations.checkpoint
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/coredao-org/btcpowermirror/backfill"
+	"github.com/coredao-org/btcpowermirror/blkfile"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+func main() {
+	var (
+		rpcConnect     = flag.String("rpcconnect", "127.0.0.1:8332", "Bitcoin node RPC host:port")
+		rpcUser        = flag.String("rpcuser", "", "Bitcoin node RPC user")
+		rpcPass        = flag.String("rpcpass", "", "Bitcoin node RPC password")
+		rpcCookie      = flag.String("rpccookie", "", "Bitcoin node RPC cookie file, used instead of user/password")
+		rpcTLS         = flag.Bool("rpctls", false, "connect to the Bitcoin node over TLS")
+		electrum       = flag.String("electrum", "", "Electrum server host:port, used instead of the Bitcoin node")
+		electrumTLS    = flag.Bool("electrumtls", false, "connect to the Electrum server over TLS")
+		blocksDir      = flag.String("blocksdir", "", "Bitcoin Core blocks directory, read instead of the Bitcoin node")
+		network        = flag.String("net", "mainnet", "Bitcoin network: mainnet, testnet3, signet or regtest")
+		from           = flag.Int64("from", 0, "first height to export")
+		to             = flag.Int64("to", -1, "last height to export, -1 for the last block with -confirmations")
+		confirmations  = flag.Int64("confirmations", 6, "confirmations required when -to is -1")
+		workers        = flag.Int("workers", backfill.DefaultWorkers, "blocks fetched concurrently")
+		format         = flag.String("format", "jsonl", "output format: jsonl or csv")
+		outPath        = flag.String("out", "-", "output file, - for stdout")
+		checkpointPath = flag.String("checkpoint", "", "checkpoint file making the export resumable; needs -out")
+		all            = flag.Bool("all", false, "export every block, not only delegated ones")
+		strict         = flag.Bool("strict", false, "reject coinbases with several or malformed delegation markers")
+	)
+	flag.Parse()
+
+	params, err := netParams(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outFormat, err := backfill.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *checkpointPath != "" && *outPath == "-" {
+		log.Fatal("-checkpoint needs -out")
+	}
+
+	var source blocksource.BlockSource
+	switch {
+	case *blocksDir != "":
+		start := time.Now()
+		index, err := blkfile.OpenIndex(*blocksDir, params)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer index.Close()
+		log.Printf("indexed %d blocks in %v, %d skipped", index.Blocks(),
+			time.Since(start).Round(time.Second), index.Skipped())
+		source = index
+
+	case *electrum != "":
+		cfg := &blocksource.ElectrumConfig{Addr: *electrum}
+		if *electrumTLS {
+			cfg.TLS = &tls.Config{}
+		}
+		s := blocksource.NewElectrumSource(cfg)
+		defer s.Close()
+		source = s
+
+	default:
+		s, err := blocksource.NewRPCSource(&rpcclient.ConnConfig{
+			Host:       *rpcConnect,
+			User:       *rpcUser,
+			Pass:       *rpcPass,
+			CookiePath: *rpcCookie,
+			DisableTLS: !*rpcTLS,
+		})
+		if err != nil {
+			log.Fatalf("connect to bitcoin node: %v", err)
+		}
+		defer s.Close()
+		source = s
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *to < 0 {
+		best, err := source.BestHeight(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*to = best - *confirmations + 1
+	}
+
+	cfg := backfill.Config{
+		Source:  source,
+		From:    *from,
+		To:      *to,
+		Workers: *workers,
+		All:     *all,
+		Format:  outFormat,
+		Logf:    log.Printf,
+	}
+	if *strict {
+		cfg.Policy = lightmirror.PowerPolicyStrict
+	}
+	if *checkpointPath != "" {
+		cfg.Checkpoint = backfill.NewCheckpointFile(*checkpointPath)
+	}
+	e, err := backfill.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "-" {
+		cp := e.Checkpoint()
+		f, err := backfill.OpenOutput(*outPath, &cp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	start := time.Now()
+	log.Printf("exporting heights %d to %d", e.Checkpoint().Next, *to)
+	if err := e.Run(ctx, out); err != nil {
+		log.Fatal(err)
+	}
+	cp := e.Checkpoint()
+	log.Printf("exported %d rows up to height %d in %v", cp.Rows, cp.Next-1,
+		time.Since(start).Round(time.Second))
+}
+
+func netParams(name string) (*chaincfg.Params, error) {
+	switch name {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Command powermirror-relayer follows a bitcoind or btcd node and relays a
+// BtcLightMirrorV2 of every confirmed block.  Mirrors are written as JSON lines
+// unless -corerpc is given, in which case they are stored in the Core BTC
+// light client contract with transactions signed by -corekey or
+// -corekeystore, or -index is given, in which case they are stored in the
+// SQLite delegation index served by powermirrord -db.  Feeding both the Core
+// chain and an index takes two relayers with their own -state files.
+//
+// Usage:
+//
+//	powermirror-relayer -rpcconnect 127.0.0.1:8332 -rpcuser u -rpcpass p \
+//		-state relayer.json -start 780000
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/coresubmit"
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/coredao-org/btcpowermirror/sqlindex"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+func main() {
+	var (
+		rpcConnect    = flag.String("rpcconnect", "127.0.0.1:8332", "Bitcoin node RPC host:port")
+		rpcUser       = flag.String("rpcuser", "", "Bitcoin node RPC user")
+		rpcPass       = flag.String("rpcpass", "", "Bitcoin node RPC password")
+		rpcCookie     = flag.String("rpccookie", "", "Bitcoin node RPC cookie file, used instead of user/password")
+		rpcTLS        = flag.Bool("rpctls", false, "connect to the Bitcoin node over TLS")
+		network       = flag.String("net", "mainnet", "Bitcoin network: mainnet, testnet3, signet or regtest")
+		statePath     = flag.String("state", "relayer.json", "file that stores relay progress")
+		startHeight   = flag.Int64("start", 0, "first height to relay when no progress is stored")
+		confirmations = flag.Int64("confirmations", relayer.DefaultConfirmations, "confirmations required before relaying a block")
+		pollInterval  = flag.Duration("poll", relayer.DefaultPollInterval, "interval between polls of the Bitcoin node")
+		keepWitness   = flag.Bool("keepwitness", false, "keep the coinbase witness in relayed mirrors")
+		outPath       = flag.String("out", "-", "file receiving relayed mirrors as JSON lines, - for stdout")
+		indexPath     = flag.String("index", "", "SQLite delegation index receiving relayed mirrors instead of -out")
+		coreRPC       = flag.String("corerpc", "", "Core chain RPC endpoint; mirrors are submitted on chain when set")
+		coreChainID   = flag.Int64("corechainid", 1116, "Core chain id")
+		coreKey       = flag.String("corekey", "", "file holding the hex private key that signs Core transactions")
+		coreKeystore  = flag.String("corekeystore", "", "encrypted keystore file that signs Core transactions")
+		corePassword  = flag.String("corepassword", "", "file holding the keystore passphrase")
+		coreMaxPrice  = flag.Int64("coremaxgasprice", 0, "maximum gas price in wei, 0 for no limit")
+	)
+	flag.Parse()
+
+	params, err := netParams(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	source, err := blocksource.NewRPCSource(&rpcclient.ConnConfig{
+		Host:       *rpcConnect,
+		User:       *rpcUser,
+		Pass:       *rpcPass,
+		CookiePath: *rpcCookie,
+		DisableTLS: !*rpcTLS,
+	})
+	if err != nil {
+		log.Fatalf("connect to bitcoin node: %v", err)
+	}
+	defer source.Close()
+
+	if *coreRPC != "" && *indexPath != "" {
+		log.Fatal("-corerpc and -index are mutually exclusive")
+	}
+
+	var submitter relayer.Submitter
+	switch {
+	case *coreRPC != "":
+		client, err := ethclient.Dial(*coreRPC)
+		if err != nil {
+			log.Fatalf("connect to core chain: %v", err)
+		}
+		defer client.Close()
+
+		auth, err := coreAuth(*coreKey, *coreKeystore, *corePassword, big.NewInt(*coreChainID))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cfg := coresubmit.Config{
+			Backend:    client,
+			Auth:       auth,
+			SkipSynced: true,
+		}
+		if *coreMaxPrice > 0 {
+			cfg.MaxGasPrice = big.NewInt(*coreMaxPrice)
+		}
+		submitter, err = coresubmit.New(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("submitting mirrors to %v as %v", coresubmit.LightClientAddress, auth.From)
+
+	case *indexPath != "":
+		index, err := sqlindex.Open(context.Background(), *indexPath, nil)
+		if err != nil {
+			log.Fatalf("open index: %v", err)
+		}
+		defer index.Close()
+		submitter = index
+		log.Printf("indexing mirrors in %v", *indexPath)
+
+	default:
+		var out io.Writer = os.Stdout
+		if *outPath != "-" {
+			f, err := os.OpenFile(*outPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			out = f
+		}
+		submitter = relayer.NewWriterSubmitter(out)
+	}
+
+	r, err := relayer.New(relayer.Config{
+		Source:        source,
+		Submitter:     submitter,
+		Store:         relayer.NewFileStore(*statePath),
+		StartHeight:   *startHeight,
+		Confirmations: *confirmations,
+		PollInterval:  *pollInterval,
+		PowLimit:      params.PowLimit,
+		KeepWitness:   *keepWitness,
+		Logf:          log.Printf,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start := time.Now()
+	if err := r.Run(ctx); err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+	log.Printf("relayer stopped after %v", time.Since(start).Round(time.Second))
+}
+
+func coreAuth(keyPath, keystorePath, passwordPath string, chainID *big.Int) (*bind.TransactOpts, error) {
+	switch {
+	case keyPath != "" && keystorePath != "":
+		return nil, errors.New("-corekey and -corekeystore are mutually exclusive")
+
+	case keyPath != "":
+		key, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		return coresubmit.NewKeyedAuth(string(key), chainID)
+
+	case keystorePath != "":
+		var passphrase string
+		if passwordPath != "" {
+			var err error
+			passphrase, err = coresubmit.ReadPassphrase(passwordPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return coresubmit.NewKeystoreAuth(keystorePath, passphrase, chainID)
+	}
+	return nil, errors.New("-corerpc needs -corekey or -corekeystore")
+}
+
+func netParams(name string) (*chaincfg.Params, error) {
+	switch name {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Command powermirrord serves mirror verification and delegation queries over
+// HTTP, see package httpapi for the endpoints.  Block and candidate queries
+// are answered from the SQLite index given with -db, which powermirror-relayer
+// -index keeps up to date; with -rpcconnect, blocks missing from the index are
+// read from a bitcoind or btcd node.
+//
+// Usage:
+//
+//	powermirrord -listen 127.0.0.1:8080 -db delegations.db \
+//		-rpcconnect 127.0.0.1:8332 -rpcuser u -rpcpass p
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/httpapi"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/sqlindex"
+)
+
+func main() {
+	var (
+		listen      = flag.String("listen", "127.0.0.1:8080", "HTTP listen address")
+		dbPath      = flag.String("db", "", "SQLite delegation index")
+		rpcConnect  = flag.String("rpcconnect", "", "Bitcoin node RPC host:port, to build mirrors of blocks missing from -db")
+		rpcUser     = flag.String("rpcuser", "", "Bitcoin node RPC user")
+		rpcPass     = flag.String("rpcpass", "", "Bitcoin node RPC password")
+		rpcCookie   = flag.String("rpccookie", "", "Bitcoin node RPC cookie file, used instead of user/password")
+		rpcTLS      = flag.Bool("rpctls", false, "connect to the Bitcoin node over TLS")
+		network     = flag.String("net", "mainnet", "Bitcoin network: mainnet, testnet3, signet or regtest")
+		strict      = flag.Bool("strict", false, "reject coinbases with several or malformed delegation markers")
+		maxBodySize = flag.Int64("maxbody", httpapi.DefaultMaxBodySize, "largest request body accepted, in bytes")
+		maxBlocks   = flag.Int("maxblocks", httpapi.DefaultMaxBlocks, "largest number of blocks returned by a candidate query")
+		grace       = flag.Duration("shutdowntimeout", 10*time.Second, "time given to requests in flight on shutdown")
+	)
+	flag.Parse()
+
+	params, err := netParams(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg := httpapi.Config{
+		Verify:      &lightmirror.VerifyOptions{PowLimit: params.PowLimit},
+		MaxBodySize: *maxBodySize,
+		MaxBlocks:   *maxBlocks,
+		Logf:        log.Printf,
+	}
+	if *strict {
+		cfg.Verify.PowerPolicy = lightmirror.PowerPolicyStrict
+	}
+	if *dbPath != "" {
+		index, err := sqlindex.Open(ctx, *dbPath, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer index.Close()
+		cfg.Index = index
+	}
+	if *rpcConnect != "" {
+		s, err := blocksource.NewRPCSource(&rpcclient.ConnConfig{
+			Host:       *rpcConnect,
+			User:       *rpcUser,
+			Pass:       *rpcPass,
+			CookiePath: *rpcCookie,
+			DisableTLS: !*rpcTLS,
+		})
+		if err != nil {
+			log.Fatalf("connect to bitcoin node: %v", err)
+		}
+		defer s.Close()
+		cfg.Source = s
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:           httpapi.New(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Printf("listening on %v", l.Addr())
+	if err := httpapi.Serve(ctx, srv, l, *grace); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("shut down")
+}
+
+func netParams(name string) (*chaincfg.Params, error) {
+	switch name {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
@@ -0,0 +1,347 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package coresubmit implements a relayer.Submitter that stores mirrors in
+// the BTC light client system contract of the Core chain.  Every submission
+// becomes a signed storeBlockHeader transaction; the submitter tracks the
+// account nonce itself, estimates gas and waits for the receipt before
+// reporting success.
+package coresubmit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// LightClientAddress is the address of the BTC light client system contract
+// on the Core chain.
+var LightClientAddress = common.HexToAddress("0x0000000000000000000000000000000000001003")
+
+// lightClientABI is the subset of the BTC light client interface used by the
+// submitter.
+const lightClientABI = `[
+	{"type":"function","name":"storeBlockHeader","stateMutability":"nonpayable",
+	 "inputs":[{"name":"blockBytes","type":"bytes"}],"outputs":[]},
+	{"type":"function","name":"isHeaderSynced","stateMutability":"view",
+	 "inputs":[{"name":"btcHash","type":"bytes32"}],"outputs":[{"name":"","type":"bool"}]}
+]`
+
+const (
+	// DefaultGasMultiplier scales the estimated gas limit when
+	// Config.GasMultiplier is zero.
+	DefaultGasMultiplier = 1.2
+
+	// DefaultReceiptTimeout bounds the wait for a receipt when
+	// Config.ReceiptTimeout is zero.
+	DefaultReceiptTimeout = 2 * time.Minute
+
+	// DefaultPollInterval is the receipt polling interval when
+	// Config.PollInterval is zero.
+	DefaultPollInterval = 3 * time.Second
+)
+
+// ErrTxFailed is returned when a submission was mined but reverted.
+var ErrTxFailed = errors.New("storeBlockHeader transaction reverted")
+
+// Backend is the part of a Core chain client used by the submitter.  Both
+// ethclient.Client and the go-ethereum simulated backend satisfy it.
+type Backend interface {
+	bind.ContractCaller
+	bind.ContractTransactor
+	bind.DeployBackend
+}
+
+// Config configures a Submitter.
+type Config struct {
+	// Backend is the Core chain client.
+	Backend Backend
+
+	// Auth signs transactions; see NewKeyedAuth and NewKeystoreAuth.  Its
+	// GasLimit and GasPrice fields, when set, override the values the
+	// submitter would otherwise choose.  Its Nonce, when set, is the nonce
+	// of the first transaction; later ones count up from it until a send
+	// fails, after which the pending nonce is fetched again.
+	Auth *bind.TransactOpts
+
+	// Contract is the light client address, LightClientAddress when zero.
+	Contract common.Address
+
+	// GasMultiplier scales the estimated gas limit to leave headroom.
+	GasMultiplier float64
+
+	// MaxGasPrice caps the suggested gas price when non-nil.
+	MaxGasPrice *big.Int
+
+	// SkipSynced asks the contract whether a block is already stored and
+	// skips the transaction if so.  This keeps resubmissions after a
+	// relayer restart from reverting.
+	SkipSynced bool
+
+	// ReceiptTimeout bounds the wait for a transaction receipt.
+	ReceiptTimeout time.Duration
+
+	// PollInterval is the delay between receipt polls.
+	PollInterval time.Duration
+}
+
+// Submitter relays mirrors to the Core chain.
+type Submitter struct {
+	cfg Config
+	abi abi.ABI
+
+	mu    sync.Mutex
+	nonce *uint64
+}
+
+var _ relayer.Submitter = (*Submitter)(nil)
+
+// New returns a Submitter for cfg.
+func New(cfg Config) (*Submitter, error) {
+	if cfg.Backend == nil {
+		return nil, errors.New("coresubmit: no backend")
+	}
+	if cfg.Auth == nil || cfg.Auth.Signer == nil {
+		return nil, errors.New("coresubmit: no transaction signer")
+	}
+	if cfg.Contract == (common.Address{}) {
+		cfg.Contract = LightClientAddress
+	}
+	if cfg.GasMultiplier <= 0 {
+		cfg.GasMultiplier = DefaultGasMultiplier
+	}
+	if cfg.ReceiptTimeout <= 0 {
+		cfg.ReceiptTimeout = DefaultReceiptTimeout
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+
+	parsed, err := abi.JSON(strings.NewReader(lightClientABI))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Submitter{cfg: cfg, abi: parsed}
+	if cfg.Auth.Nonce != nil {
+		nonce := cfg.Auth.Nonce.Uint64()
+		s.nonce = &nonce
+	}
+	return s, nil
+}
+
+// NewKeyedAuth returns transaction options signing with the hex encoded
+// private key for the chain with the given id.
+func NewKeyedAuth(hexKey string, chainID *big.Int) (*bind.TransactOpts, error) {
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(hexKey), "0x"))
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewKeyedTransactorWithChainID(key, chainID)
+}
+
+// NewKeystoreAuth returns transaction options signing with the key in the
+// encrypted keystore file at path for the chain with the given id.
+func NewKeystoreAuth(path, passphrase string, chainID *big.Int) (*bind.TransactOpts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return bind.NewTransactorWithChainID(f, passphrase, chainID)
+}
+
+// ReadPassphrase reads a passphrase file, dropping the trailing newline.
+func ReadPassphrase(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Submit sends sub.Raw to storeBlockHeader and waits until the transaction is
+// mined.  It implements relayer.Submitter.
+func (s *Submitter) Submit(ctx context.Context, sub *relayer.Submission) error {
+	if s.cfg.SkipSynced {
+		synced, err := s.IsSynced(ctx, sub.Block.Hash)
+		if err != nil {
+			return err
+		}
+		if synced {
+			return nil
+		}
+	}
+
+	tx, err := s.Send(ctx, sub.Raw)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.WaitMined(ctx, tx)
+	return err
+}
+
+// IsSynced reports whether the light client already stores the block with
+// the given hash.  Hash is in the internal byte order of chainhash.Hash.
+func (s *Submitter) IsSynced(ctx context.Context, hash [32]byte) (bool, error) {
+	input, err := s.abi.Pack("isHeaderSynced", hash)
+	if err != nil {
+		return false, err
+	}
+
+	output, err := s.cfg.Backend.CallContract(ctx, ethereum.CallMsg{
+		From: s.cfg.Auth.From,
+		To:   &s.cfg.Contract,
+		Data: input,
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+
+	results, err := s.abi.Unpack("isHeaderSynced", output)
+	if err != nil {
+		return false, err
+	}
+	synced, ok := results[0].(bool)
+	if !ok {
+		return false, fmt.Errorf("isHeaderSynced returned %T", results[0])
+	}
+	return synced, nil
+}
+
+// Send signs and broadcasts a storeBlockHeader transaction carrying the
+// serialized mirror.  It does not wait for the transaction to be mined.
+func (s *Submitter) Send(ctx context.Context, mirror []byte) (*types.Transaction, error) {
+	input, err := s.abi.Pack("storeBlockHeader", mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	gasPrice, err := s.gasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gasLimit, err := s.gasLimit(ctx, input, gasPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nonce, err := s.nextNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := types.NewTx(&types.LegacyTx{
+		Nonce:    nonce,
+		GasPrice: gasPrice,
+		Gas:      gasLimit,
+		To:       &s.cfg.Contract,
+		Data:     input,
+	})
+	signed, err := s.cfg.Auth.Signer(s.cfg.Auth.From, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.cfg.Backend.SendTransaction(ctx, signed); err != nil {
+		// The node may have seen transactions we do not know
+		// about; refetch the nonce next time.
+		s.nonce = nil
+		return nil, err
+	}
+
+	nonce++
+	s.nonce = &nonce
+	return signed, nil
+}
+
+// WaitMined polls for the receipt of tx until it is mined, the receipt
+// timeout expires or ctx is cancelled.  A reverted transaction yields
+// ErrTxFailed together with its receipt.
+func (s *Submitter) WaitMined(ctx context.Context, tx *types.Transaction) (*types.Receipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ReceiptTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		receipt, err := s.cfg.Backend.TransactionReceipt(ctx, tx.Hash())
+		if err == nil && receipt != nil {
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				return receipt, fmt.Errorf("%w: tx %v", ErrTxFailed, tx.Hash())
+			}
+			return receipt, nil
+		}
+		if err != nil && !errors.Is(err, ethereum.NotFound) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for tx %v: %w", tx.Hash(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// nextNonce returns the nonce of the next transaction.  It must be called
+// with s.mu held.
+func (s *Submitter) nextNonce(ctx context.Context) (uint64, error) {
+	if s.nonce != nil {
+		return *s.nonce, nil
+	}
+	return s.cfg.Backend.PendingNonceAt(ctx, s.cfg.Auth.From)
+}
+
+func (s *Submitter) gasPrice(ctx context.Context) (*big.Int, error) {
+	if s.cfg.Auth.GasPrice != nil {
+		return s.cfg.Auth.GasPrice, nil
+	}
+
+	price, err := s.cfg.Backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.MaxGasPrice != nil && price.Cmp(s.cfg.MaxGasPrice) > 0 {
+		price = new(big.Int).Set(s.cfg.MaxGasPrice)
+	}
+	return price, nil
+}
+
+func (s *Submitter) gasLimit(ctx context.Context, input []byte, gasPrice *big.Int) (uint64, error) {
+	if s.cfg.Auth.GasLimit != 0 {
+		return s.cfg.Auth.GasLimit, nil
+	}
+
+	gas, err := s.cfg.Backend.EstimateGas(ctx, ethereum.CallMsg{
+		From:     s.cfg.Auth.From,
+		To:       &s.cfg.Contract,
+		GasPrice: gasPrice,
+		Data:     input,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("estimate gas: %w", err)
+	}
+	return uint64(float64(gas) * s.cfg.GasMultiplier), nil
+}
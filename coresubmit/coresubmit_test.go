@@ -0,0 +1,191 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package coresubmit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	// returnFalseCode answers every call with 32 zero bytes, which reads as
+	// isHeaderSynced() == false and lets storeBlockHeader succeed.
+	returnFalseCode = []byte{0x60, 0x20, 0x60, 0x00, 0xf3}
+
+	// returnTrueCode answers every call with the word 1.
+	returnTrueCode = []byte{0x60, 0x01, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3}
+
+	// revertCode reverts every call.
+	revertCode = []byte{0x60, 0x00, 0x60, 0x00, 0xfd}
+)
+
+// newTestSubmitter deploys code at LightClientAddress on a simulated backend
+// that mines a block every few milliseconds.
+func newTestSubmitter(t *testing.T, code []byte, skipSynced bool) (*Submitter, *backends.SimulatedBackend) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := backends.NewSimulatedBackend(core.GenesisAlloc{
+		auth.From:          {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+		LightClientAddress: {Balance: new(big.Int), Code: code},
+	}, 10000000)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				backend.Commit()
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+		backend.Close()
+	})
+
+	s, err := New(Config{
+		Backend:      backend,
+		Auth:         auth,
+		SkipSynced:   skipSynced,
+		PollInterval: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, backend
+}
+
+func testSubmission(i byte) *relayer.Submission {
+	return &relayer.Submission{
+		Block: relayer.BlockID{Height: int64(i), Hash: chainhash.Hash{i}},
+		Raw:   bytes.Repeat([]byte{i}, 200),
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	s, backend := newTestSubmitter(t, returnFalseCode, true)
+	ctx := context.Background()
+
+	for i := byte(1); i <= 3; i++ {
+		sub := testSubmission(i)
+		tx, err := s.Send(ctx, sub.Raw)
+		if err != nil {
+			t.Fatalf("Send #%d: %v", i, err)
+		}
+		if tx.Nonce() != uint64(i-1) {
+			t.Errorf("Send #%d: nonce %d, want %d", i, tx.Nonce(), i-1)
+		}
+		if _, err := s.WaitMined(ctx, tx); err != nil {
+			t.Fatalf("WaitMined #%d: %v", i, err)
+		}
+
+		mined, _, err := backend.TransactionByHash(ctx, tx.Hash())
+		if err != nil {
+			t.Fatalf("TransactionByHash #%d: %v", i, err)
+		}
+		args, err := s.abi.Methods["storeBlockHeader"].Inputs.Unpack(mined.Data()[4:])
+		if err != nil {
+			t.Fatalf("Unpack #%d: %v", i, err)
+		}
+		if !bytes.Equal(args[0].([]byte), sub.Raw) {
+			t.Errorf("tx #%d carries %x, want %x", i, args[0], sub.Raw)
+		}
+	}
+
+	if err := s.Submit(ctx, testSubmission(4)); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	nonce, err := backend.NonceAt(ctx, s.cfg.Auth.From, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 4 {
+		t.Fatalf("account nonce %d, want 4", nonce)
+	}
+}
+
+// TestSubmitAuthNonce checks that a nonce set in Auth only starts the
+// sequence of nonces.
+func TestSubmitAuthNonce(t *testing.T) {
+	s, backend := newTestSubmitter(t, returnFalseCode, false)
+	ctx := context.Background()
+
+	auth := *s.cfg.Auth
+	auth.Nonce = big.NewInt(0)
+	s, err := New(Config{Backend: backend, Auth: &auth, PollInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(1); i <= 3; i++ {
+		tx, err := s.Send(ctx, testSubmission(i).Raw)
+		if err != nil {
+			t.Fatalf("Send #%d: %v", i, err)
+		}
+		if tx.Nonce() != uint64(i-1) {
+			t.Errorf("Send #%d: nonce %d, want %d", i, tx.Nonce(), i-1)
+		}
+		if _, err := s.WaitMined(ctx, tx); err != nil {
+			t.Fatalf("WaitMined #%d: %v", i, err)
+		}
+	}
+}
+
+func TestSubmitSkipsSynced(t *testing.T) {
+	s, backend := newTestSubmitter(t, returnTrueCode, true)
+	ctx := context.Background()
+
+	if err := s.Submit(ctx, testSubmission(1)); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	nonce, err := backend.PendingNonceAt(ctx, s.cfg.Auth.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce != 0 {
+		t.Fatalf("synced block was submitted (nonce %d)", nonce)
+	}
+}
+
+func TestSubmitRevert(t *testing.T) {
+	s, _ := newTestSubmitter(t, revertCode, false)
+	ctx := context.Background()
+
+	if err := s.Submit(ctx, testSubmission(1)); err == nil {
+		t.Fatalf("Submit: expected error from reverting contract")
+	}
+
+	// A forced gas limit skips estimation, so the revert is only seen in
+	// the receipt.
+	s.cfg.Auth.GasLimit = 100000
+	err := s.Submit(ctx, testSubmission(2))
+	if !errors.Is(err, ErrTxFailed) {
+		t.Fatalf("Submit: got %v, want %v", err, ErrTxFailed)
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package delegation indexes the hash power that Bitcoin miners delegate to
+// Core candidates.  It consumes verified BtcLightMirrorV2 in height order,
+// keys every delegated block on the result of ParsePowerParams and keeps
+// per-round block counts by candidate and by reward address.  Blocks above a
+// fork point can be rolled back when the Bitcoin chain reorganizes.
+package delegation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrHeightTaken is returned when adding a block at a height that holds
+// another block.  The index must be rolled back first.
+var ErrHeightTaken = errors.New("height holds another block")
+
+// secondsPerDay is the length of the default round.
+const secondsPerDay = 24 * 60 * 60
+
+// RoundFunc assigns a Bitcoin block to a Core round.
+type RoundFunc func(header *wire.BlockHeader) uint64
+
+// UTCDayRound is the default RoundFunc: the number of whole UTC days between
+// the Unix epoch and the block timestamp.
+func UTCDayRound(header *wire.BlockHeader) uint64 {
+	return uint64(header.Timestamp.Unix()) / secondsPerDay
+}
+
+// Record is a delegated block.
+type Record struct {
+	Height    int64
+	Hash      chainhash.Hash
+	ID        lightmirror.MirrorID
+	Round     uint64
+	Candidate common.Address
+	Reward    common.Address
+
+	// PowerBlockHash is the optional Core block hash carried by the
+	// delegation marker.
+	PowerBlockHash common.Hash
+}
+
+// RoundStats holds the delegation counts of a single round.
+type RoundStats struct {
+	Round uint64
+
+	// Blocks is the number of delegated blocks in the round.
+	Blocks int
+
+	ByCandidate map[common.Address]int
+	ByReward    map[common.Address]int
+}
+
+func newRoundStats(round uint64) *RoundStats {
+	return &RoundStats{
+		Round:       round,
+		ByCandidate: make(map[common.Address]int),
+		ByReward:    make(map[common.Address]int),
+	}
+}
+
+func (s *RoundStats) add(rec *Record, delta int) {
+	s.Blocks += delta
+	s.ByCandidate[rec.Candidate] += delta
+	if s.ByCandidate[rec.Candidate] == 0 {
+		delete(s.ByCandidate, rec.Candidate)
+	}
+	s.ByReward[rec.Reward] += delta
+	if s.ByReward[rec.Reward] == 0 {
+		delete(s.ByReward, rec.Reward)
+	}
+}
+
+func (s *RoundStats) copy() *RoundStats {
+	c := newRoundStats(s.Round)
+	c.Blocks = s.Blocks
+	for addr, n := range s.ByCandidate {
+		c.ByCandidate[addr] = n
+	}
+	for addr, n := range s.ByReward {
+		c.ByReward[addr] = n
+	}
+	return c
+}
+
+// Ranked is an address together with the number of blocks attributed to it.
+type Ranked struct {
+	Address common.Address
+	Blocks  int
+}
+
+// Index is an in-memory delegation index.  It is safe for concurrent use.
+type Index struct {
+	mu      sync.RWMutex
+	roundOf RoundFunc
+
+	// tip is the height of the last ingested block, delegated or not.
+	// hashes holds the hash of every ingested block from height first to
+	// tip, zero for the heights that were skipped.
+	tip    int64
+	first  int64
+	hashes []chainhash.Hash
+
+	// records holds the delegated blocks in ascending height order;
+	// byCandidate and byReward hold positions into it.
+	records     []Record
+	byID        map[lightmirror.MirrorID]int
+	byCandidate map[common.Address][]int
+	byReward    map[common.Address][]int
+	rounds      map[uint64]*RoundStats
+}
+
+// NewIndex returns an empty index assigning blocks to rounds with roundOf, or
+// with UTCDayRound when roundOf is nil.
+func NewIndex(roundOf RoundFunc) *Index {
+	if roundOf == nil {
+		roundOf = UTCDayRound
+	}
+	return &Index{
+		roundOf:     roundOf,
+		tip:         -1,
+		byID:        make(map[lightmirror.MirrorID]int),
+		byCandidate: make(map[common.Address][]int),
+		byReward:    make(map[common.Address][]int),
+		rounds:      make(map[uint64]*RoundStats),
+	}
+}
+
+// Tip returns the height of the last ingested block, or -1.
+func (ix *Index) Tip() int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return ix.tip
+}
+
+// Add ingests the verified mirror of the block at height.  Heights must be
+// strictly increasing, except that adding a block again at the height it was
+// ingested at is a no-op, delegated or not.  Adding another block at a height
+// up to the tip fails with ErrHeightTaken.  It returns the record of the
+// block, or nil when the coinbase carries no delegation marker.
+func (ix *Index) Add(height int64, mirror *lightmirror.BtcLightMirrorV2) (*Record, error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	hash := mirror.BtcHeader.BlockHash()
+	if height <= ix.tip {
+		if height < ix.first || ix.hashes[height-ix.first] != hash {
+			return nil, fmt.Errorf("%w: block %v at height %d, tip %d",
+				ErrHeightTaken, hash, height, ix.tip)
+		}
+		pos := sort.Search(len(ix.records), func(i int) bool {
+			return ix.records[i].Height >= height
+		})
+		if pos == len(ix.records) || ix.records[pos].Height != height {
+			return nil, nil
+		}
+		rec := ix.records[pos]
+		return &rec, nil
+	}
+	if len(ix.hashes) == 0 {
+		ix.first = height
+	}
+	for h := ix.first + int64(len(ix.hashes)); h < height; h++ {
+		ix.hashes = append(ix.hashes, chainhash.Hash{})
+	}
+	ix.hashes = append(ix.hashes, hash)
+	ix.tip = height
+
+	candidate, reward, powerBlockHash := mirror.ParsePowerParams()
+	if candidate == (common.Address{}) {
+		return nil, nil
+	}
+
+	rec := Record{
+		Height:         height,
+		Hash:           hash,
+		ID:             mirror.MirrorID(),
+		Round:          ix.roundOf(&mirror.BtcHeader),
+		Candidate:      candidate,
+		Reward:         reward,
+		PowerBlockHash: powerBlockHash,
+	}
+
+	pos := len(ix.records)
+	ix.records = append(ix.records, rec)
+	ix.byID[rec.ID] = pos
+	ix.byCandidate[candidate] = append(ix.byCandidate[candidate], pos)
+	ix.byReward[reward] = append(ix.byReward[reward], pos)
+
+	stats, ok := ix.rounds[rec.Round]
+	if !ok {
+		stats = newRoundStats(rec.Round)
+		ix.rounds[rec.Round] = stats
+	}
+	stats.add(&rec, 1)
+
+	return &rec, nil
+}
+
+// Rollback removes every block above height, typically the fork point of a
+// Bitcoin reorganization.
+func (ix *Index) Rollback(height int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for len(ix.records) > 0 {
+		pos := len(ix.records) - 1
+		rec := &ix.records[pos]
+		if rec.Height <= height {
+			break
+		}
+
+		delete(ix.byID, rec.ID)
+		dropLast(ix.byCandidate, rec.Candidate)
+		dropLast(ix.byReward, rec.Reward)
+
+		stats := ix.rounds[rec.Round]
+		stats.add(rec, -1)
+		if stats.Blocks == 0 {
+			delete(ix.rounds, rec.Round)
+		}
+
+		ix.records = ix.records[:pos]
+	}
+
+	if height < ix.tip {
+		ix.tip = height
+		if keep := height - ix.first + 1; keep < 0 {
+			ix.hashes = ix.hashes[:0]
+		} else {
+			ix.hashes = ix.hashes[:keep]
+		}
+	}
+}
+
+// dropLast removes the last position listed for addr.
+func dropLast(m map[common.Address][]int, addr common.Address) {
+	positions := m[addr]
+	if len(positions) == 1 {
+		delete(m, addr)
+		return
+	}
+	m[addr] = positions[:len(positions)-1]
+}
+
+// Lookup returns the delegated block whose mirror has the given ID.
+func (ix *Index) Lookup(id lightmirror.MirrorID) (Record, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	pos, ok := ix.byID[id]
+	if !ok {
+		return Record{}, false
+	}
+	return ix.records[pos], true
+}
+
+// CandidateBlocks returns the delegated blocks of candidate with heights in
+// [from, to].
+func (ix *Index) CandidateBlocks(candidate common.Address, from, to int64) []Record {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return ix.collect(ix.byCandidate[candidate], from, to)
+}
+
+// RewardBlocks returns the delegated blocks paying reward with heights in
+// [from, to].
+func (ix *Index) RewardBlocks(reward common.Address, from, to int64) []Record {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	return ix.collect(ix.byReward[reward], from, to)
+}
+
+func (ix *Index) collect(positions []int, from, to int64) []Record {
+	start := sort.Search(len(positions), func(i int) bool {
+		return ix.records[positions[i]].Height >= from
+	})
+
+	var out []Record
+	for _, pos := range positions[start:] {
+		if ix.records[pos].Height > to {
+			break
+		}
+		out = append(out, ix.records[pos])
+	}
+	return out
+}
+
+// Round returns a copy of the counts of round, or nil if no delegated block
+// was assigned to it.
+func (ix *Index) Round(round uint64) *RoundStats {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	stats, ok := ix.rounds[round]
+	if !ok {
+		return nil
+	}
+	return stats.copy()
+}
+
+// Rounds returns the rounds that hold delegated blocks in ascending order.
+func (ix *Index) Rounds() []uint64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	rounds := make([]uint64, 0, len(ix.rounds))
+	for round := range ix.rounds {
+		rounds = append(rounds, round)
+	}
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i] < rounds[j] })
+	return rounds
+}
+
+// TopCandidates returns up to n candidates with the most delegated blocks
+// with heights in [from, to].  A non-positive n returns all of them.
+func (ix *Index) TopCandidates(from, to int64, n int) []Ranked {
+	return ix.top(from, to, n, func(rec *Record) common.Address { return rec.Candidate })
+}
+
+// TopDelegators returns up to n reward addresses, i.e. delegating miners,
+// with the most delegated blocks with heights in [from, to].  A non-positive
+// n returns all of them.
+func (ix *Index) TopDelegators(from, to int64, n int) []Ranked {
+	return ix.top(from, to, n, func(rec *Record) common.Address { return rec.Reward })
+}
+
+func (ix *Index) top(from, to int64, n int, key func(*Record) common.Address) []Ranked {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	start := sort.Search(len(ix.records), func(i int) bool {
+		return ix.records[i].Height >= from
+	})
+
+	counts := make(map[common.Address]int)
+	for i := start; i < len(ix.records) && ix.records[i].Height <= to; i++ {
+		counts[key(&ix.records[i])]++
+	}
+
+	ranked := make([]Ranked, 0, len(counts))
+	for addr, blocks := range counts {
+		ranked = append(ranked, Ranked{Address: addr, Blocks: blocks})
+	}
+	sortRanked(ranked)
+
+	if n > 0 && len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// sortRanked orders by descending block count, breaking ties by address so
+// the result is deterministic.
+func sortRanked(ranked []Ranked) {
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Blocks != ranked[j].Blocks {
+			return ranked[i].Blocks > ranked[j].Blocks
+		}
+		return bytes.Compare(ranked[i].Address[:], ranked[j].Address[:]) < 0
+	})
+}
+
+// Submit ingests a relayed mirror, which lets an Index be used directly as
+// a relayer.Submitter.  Blocks the relayer submits again are ignored.
+func (ix *Index) Submit(ctx context.Context, sub *relayer.Submission) error {
+	_, err := ix.Add(sub.Block.Height, sub.Mirror)
+	return err
+}
+
+// Reorg rolls the index back to the fork point.  It implements
+// relayer.ReorgHandler.
+func (ix *Index) Reorg(ctx context.Context, fork relayer.BlockID) error {
+	ix.Rollback(fork.Height)
+	return nil
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package delegation
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	candidateA = common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	candidateB = common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	rewardX    = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	rewardY    = common.HexToAddress("0x2222222222222222222222222222222222222222")
+)
+
+// testMirror returns a mirror whose coinbase delegates to candidate, or
+// carries no marker when candidate is the zero address.
+func testMirror(timestamp int64, candidate, reward common.Address) *lightmirror.BtcLightMirrorV2 {
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{0x01, byte(timestamp)},
+	})
+	coinbase.AddTxOut(wire.NewTxOut(50e8, []byte{txscript.OP_TRUE}))
+	if candidate != (common.Address{}) {
+		script := []byte{txscript.OP_RETURN, 45, 'C', 'O', 'R', 'E', 0x01}
+		script = append(script, candidate[:]...)
+		script = append(script, reward[:]...)
+		coinbase.AddTxOut(wire.NewTxOut(0, script))
+	}
+
+	return &lightmirror.BtcLightMirrorV2{
+		BtcHeader: wire.BlockHeader{
+			Version:    4,
+			MerkleRoot: coinbase.TxHash(),
+			Timestamp:  time.Unix(timestamp, 0),
+		},
+		CoinBaseTx: *coinbase,
+	}
+}
+
+func TestIndex(t *testing.T) {
+	const day = secondsPerDay
+	ix := NewIndex(nil)
+
+	blocks := []struct {
+		candidate, reward common.Address
+		timestamp         int64
+	}{
+		{candidateA, rewardX, 10*day + 100},
+		{candidateB, rewardX, 10*day + 200},
+		{common.Address{}, common.Address{}, 10*day + 300},
+		{candidateA, rewardY, 11*day + 100},
+		{candidateA, rewardX, 11*day + 200},
+	}
+	for height, b := range blocks {
+		rec, err := ix.Add(int64(height), testMirror(b.timestamp, b.candidate, b.reward))
+		if err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+		if (rec != nil) != (b.candidate != common.Address{}) {
+			t.Fatalf("Add(%d): record %v", height, rec)
+		}
+	}
+
+	delegated := testMirror(blocks[3].timestamp, blocks[3].candidate, blocks[3].reward)
+	if rec, ok := ix.Lookup(delegated.MirrorID()); !ok || rec.Height != 3 {
+		t.Fatalf("Lookup: got %+v, %v", rec, ok)
+	}
+	undelegated := testMirror(blocks[2].timestamp, blocks[2].candidate, blocks[2].reward)
+	if _, ok := ix.Lookup(undelegated.MirrorID()); ok {
+		t.Fatalf("Lookup: found undelegated block")
+	}
+
+	if _, err := ix.Add(2, testMirror(0, candidateA, rewardX)); !errors.Is(err, ErrHeightTaken) {
+		t.Fatalf("Add below the tip: got %v, want %v", err, ErrHeightTaken)
+	}
+
+	// Adding a block again at its height is a no-op, delegated or not.
+	if rec, err := ix.Add(3, delegated); err != nil || rec == nil || rec.Height != 3 {
+		t.Fatalf("Add of an indexed block: %+v, %v", rec, err)
+	}
+	if rec, err := ix.Add(2, undelegated); err != nil || rec != nil {
+		t.Fatalf("Add of an undelegated block below the tip: %+v, %v", rec, err)
+	}
+	tip := testMirror(blocks[4].timestamp, blocks[4].candidate, blocks[4].reward)
+	if _, err := ix.Add(3, tip); !errors.Is(err, ErrHeightTaken) {
+		t.Fatalf("Add of an indexed block at another height: got %v, want %v", err, ErrHeightTaken)
+	}
+	if rec, err := ix.Add(4, tip); err != nil || rec == nil || rec.Height != 4 {
+		t.Fatalf("Add of the tip: %+v, %v", rec, err)
+	}
+
+	recs := ix.CandidateBlocks(candidateA, 1, 4)
+	if len(recs) != 2 || recs[0].Height != 3 || recs[1].Height != 4 {
+		t.Fatalf("CandidateBlocks(A, 1, 4): %+v", recs)
+	}
+	if recs := ix.RewardBlocks(rewardX, 0, 10); len(recs) != 3 {
+		t.Fatalf("RewardBlocks(X): got %d blocks, want 3", len(recs))
+	}
+
+	if got := ix.Rounds(); !reflect.DeepEqual(got, []uint64{10, 11}) {
+		t.Fatalf("Rounds: got %v", got)
+	}
+	want := &RoundStats{
+		Round:       10,
+		Blocks:      2,
+		ByCandidate: map[common.Address]int{candidateA: 1, candidateB: 1},
+		ByReward:    map[common.Address]int{rewardX: 2},
+	}
+	if got := ix.Round(10); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Round(10): got %+v, want %+v", got, want)
+	}
+
+	wantTop := []Ranked{{candidateA, 3}, {candidateB, 1}}
+	if got := ix.TopCandidates(0, 10, 0); !reflect.DeepEqual(got, wantTop) {
+		t.Fatalf("TopCandidates: got %v, want %v", got, wantTop)
+	}
+	wantTop = []Ranked{{rewardX, 3}}
+	if got := ix.TopDelegators(0, 10, 1); !reflect.DeepEqual(got, wantTop) {
+		t.Fatalf("TopDelegators: got %v, want %v", got, wantTop)
+	}
+}
+
+func TestIndexRollback(t *testing.T) {
+	const day = secondsPerDay
+	ix := NewIndex(nil)
+	for height := int64(0); height < 6; height++ {
+		candidate := candidateA
+		if height >= 3 {
+			candidate = candidateB
+		}
+		if _, err := ix.Add(height, testMirror(height*day/2, candidate, rewardX)); err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+
+	sub := &relayer.Submission{Block: relayer.BlockID{Height: 2}}
+	if err := ix.Reorg(context.Background(), sub.Block); err != nil {
+		t.Fatalf("Reorg: %v", err)
+	}
+
+	if _, ok := ix.Lookup(testMirror(4*day/2, candidateB, rewardX).MirrorID()); ok {
+		t.Fatalf("Lookup: found rolled back block")
+	}
+	if ix.Tip() != 2 {
+		t.Fatalf("Tip: got %d, want 2", ix.Tip())
+	}
+	if recs := ix.CandidateBlocks(candidateB, 0, 10); len(recs) != 0 {
+		t.Fatalf("rolled back blocks still indexed: %+v", recs)
+	}
+	if got := ix.Rounds(); !reflect.DeepEqual(got, []uint64{0, 1}) {
+		t.Fatalf("Rounds: got %v", got)
+	}
+	if got := ix.TopCandidates(0, 10, 0); !reflect.DeepEqual(got, []Ranked{{candidateA, 3}}) {
+		t.Fatalf("TopCandidates: got %v", got)
+	}
+
+	sub = &relayer.Submission{
+		Block:  relayer.BlockID{Height: 3},
+		Mirror: testMirror(3*day/2, candidateB, rewardY),
+	}
+	if err := ix.Submit(context.Background(), sub); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if got := ix.Round(1); got.ByReward[rewardY] != 1 || got.Blocks != 2 {
+		t.Fatalf("Round(1) after resubmit: %+v", got)
+	}
+}
+
+func TestSubmitAgain(t *testing.T) {
+	ctx := context.Background()
+	ix := NewIndex(nil)
+	delegated := testMirror(100, candidateA, rewardX)
+	undelegated := testMirror(200, common.Address{}, common.Address{})
+	subs := []*relayer.Submission{
+		{Block: relayer.BlockID{Height: 1}, Mirror: delegated},
+		{Block: relayer.BlockID{Height: 2}, Mirror: undelegated},
+	}
+
+	// A relayer resubmits blocks when saving its progress failed.
+	for i := 0; i < 2; i++ {
+		for _, sub := range subs {
+			if err := ix.Submit(ctx, sub); err != nil {
+				t.Fatalf("Submit(%d), pass %d: %v", sub.Block.Height, i, err)
+			}
+		}
+	}
+	if recs := ix.CandidateBlocks(candidateA, 0, 10); len(recs) != 1 || ix.Tip() != 2 {
+		t.Fatalf("after resubmission: %+v, tip %d", recs, ix.Tip())
+	}
+	if got := ix.Round(0); got == nil || got.Blocks != 1 {
+		t.Fatalf("Round(0) after resubmission: %+v", got)
+	}
+
+	// After a rollback only the delegated block is known.
+	ix.Rollback(1)
+	if err := ix.Submit(ctx, subs[0]); err != nil {
+		t.Fatalf("Submit after rollback: %v", err)
+	}
+	if err := ix.Submit(ctx, subs[1]); err != nil {
+		t.Fatalf("Submit after rollback: %v", err)
+	}
+	if err := ix.Submit(ctx, subs[1]); err != nil {
+		t.Fatalf("Submit after rollback: %v", err)
+	}
+
+	// Undelegated blocks below the tip are known as well.
+	next := &relayer.Submission{Block: relayer.BlockID{Height: 3}, Mirror: testMirror(300, candidateB, rewardX)}
+	if err := ix.Submit(ctx, next); err != nil {
+		t.Fatalf("Submit(3): %v", err)
+	}
+	if err := ix.Submit(ctx, subs[1]); err != nil {
+		t.Fatalf("Submit of an undelegated block below the tip: %v", err)
+	}
+
+	// A rollback below every block starts the index over.
+	ix.Rollback(-1)
+	if err := ix.Submit(ctx, subs[1]); err != nil || ix.Tip() != 2 {
+		t.Fatalf("Submit after rolling back everything: %v, tip %d", err, ix.Tip())
+	}
+	if err := ix.Submit(ctx, subs[0]); !errors.Is(err, ErrHeightTaken) {
+		t.Fatalf("Submit below the first block: got %v, want %v", err, ErrHeightTaken)
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package httpapi serves mirror verification and delegation queries over
+// HTTP with JSON responses, for services that cannot link the Go packages.
+//
+// The endpoints are:
+//
+//	POST /verify                              raw BtcLightMirrorV2, returns its lightmirror.Report
+//	POST /build                               raw block, returns its mirror
+//	GET  /blocks/{hash}/mirror                mirror of an indexed or known block
+//	GET  /candidates/{addr}/blocks?from=&to=&limit=
+//	                                          delegated blocks of a candidate, a page at a time
+//
+// Request bodies are binary, or hex with a text/plain content type.  Errors
+// are returned as {"error": "..."} with a matching status code.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/sqlindex"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// DefaultMaxBodySize is the largest request body accepted by default:
+	// a block of the maximum size, hex encoded.
+	DefaultMaxBodySize = 2*wire.MaxBlockPayload + 2
+
+	// DefaultMaxBlocks is the largest number of blocks returned by one
+	// candidate query by default.
+	DefaultMaxBlocks = 1000
+)
+
+// Config configures a Server.  Every field is optional.
+type Config struct {
+	// Index answers the block and candidate queries.  The candidate
+	// endpoint is unavailable without it.
+	Index *sqlindex.Index
+
+	// Source builds the mirrors of blocks missing from Index.
+	Source blocksource.BlockSource
+
+	// Verify is used by /verify.  Main network proof of work limits and
+	// PowerPolicyFirst are used when nil.
+	Verify *lightmirror.VerifyOptions
+
+	// Decode bounds the mirrors accepted by /verify.
+	// lightmirror.DefaultDecodeOptions is used when nil.
+	Decode *lightmirror.DecodeOptions
+
+	// MaxBodySize is the largest request body accepted, in bytes.
+	// DefaultMaxBodySize is used when zero.
+	MaxBodySize int64
+
+	// MaxBlocks is the largest number of blocks returned by one candidate
+	// query, whatever limit it asks for.  DefaultMaxBlocks is used when
+	// zero.
+	MaxBlocks int
+
+	// Logf, when set, receives internal errors.
+	Logf func(format string, args ...interface{})
+}
+
+// Server is the http.Handler of the API.
+type Server struct {
+	cfg Config
+	mux *http.ServeMux
+}
+
+// New creates a Server.
+func New(cfg Config) *Server {
+	if cfg.Verify == nil {
+		cfg.Verify = &lightmirror.VerifyOptions{}
+	}
+	if cfg.Decode == nil {
+		cfg.Decode = lightmirror.DefaultDecodeOptions()
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = DefaultMaxBodySize
+	}
+	if cfg.MaxBlocks <= 0 {
+		cfg.MaxBlocks = DefaultMaxBlocks
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = func(string, ...interface{}) {}
+	}
+
+	s := &Server{cfg: cfg, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/verify", s.post(s.verify))
+	s.mux.HandleFunc("/build", s.post(s.build))
+	s.mux.HandleFunc("/blocks/", s.get(s.blockMirror))
+	s.mux.HandleFunc("/candidates/", s.get(s.candidateBlocks))
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// httpError is an error with the status code it is reported with.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// handler handles a request and returns the value to encode as the JSON
+// response.
+type handler func(r *http.Request) (interface{}, error)
+
+func (s *Server) post(h handler) http.HandlerFunc {
+	return s.method(http.MethodPost, h)
+}
+
+func (s *Server) get(h handler) http.HandlerFunc {
+	return s.method(http.MethodGet, h)
+}
+
+// method serves h for requests using method.
+func (s *Server) method(method string, h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			s.reply(w, r, nil, errorf(http.StatusMethodNotAllowed,
+				"method %s not allowed", r.Method))
+			return
+		}
+		v, err := h(r)
+		s.reply(w, r, v, err)
+	}
+}
+
+// reply writes v, or err, as the JSON response.
+func (s *Server) reply(w http.ResponseWriter, r *http.Request, v interface{}, err error) {
+	status := http.StatusOK
+	if err != nil {
+		var he *httpError
+		if !errors.As(err, &he) {
+			s.cfg.Logf("%s %s: %v", r.Method, r.URL.Path, err)
+			he = &httpError{status: http.StatusInternalServerError, msg: "internal error"}
+		}
+		status = he.status
+		v = struct {
+			Error string `json:"error"`
+		}{he.msg}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.cfg.Logf("%s %s: write response: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// readBody reads the request body, decoding it from hex when its content type
+// is text/plain.
+func (s *Server) readBody(r *http.Request) ([]byte, error) {
+	if r.ContentLength > s.cfg.MaxBodySize {
+		return nil, errorf(http.StatusRequestEntityTooLarge,
+			"request body larger than %d bytes", s.cfg.MaxBodySize)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.cfg.MaxBodySize+1))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "read request body: %v", err)
+	}
+	if int64(len(body)) > s.cfg.MaxBodySize {
+		return nil, errorf(http.StatusRequestEntityTooLarge,
+			"request body larger than %d bytes", s.cfg.MaxBodySize)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/plain" {
+		return body, nil
+	}
+	raw, err := hex.DecodeString(string(bytes.TrimSpace(body)))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "decode hex body: %v", err)
+	}
+	return raw, nil
+}
+
+// verify handles POST /verify.
+func (s *Server) verify(r *http.Request) (interface{}, error) {
+	body, err := s.readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	var mirror lightmirror.BtcLightMirrorV2
+	if err := mirror.DeserializeWithOptions(body, s.cfg.Decode); err != nil {
+		return nil, errorf(http.StatusBadRequest, "decode mirror: %v", err)
+	}
+	return mirror.Verify(s.cfg.Verify), nil
+}
+
+// Mirror is the response of /build and /blocks/{hash}/mirror.
+type Mirror struct {
+	BlockHash string               `json:"block_hash"`
+	ID        lightmirror.MirrorID `json:"mirror_id"`
+
+	// Height is set when the block is indexed.
+	Height *int64 `json:"height,omitempty"`
+
+	// Mirror is the serialized BtcLightMirrorV2, hex encoded.
+	Mirror string `json:"mirror"`
+}
+
+func newMirror(mirror *lightmirror.BtcLightMirrorV2) (*Mirror, error) {
+	var raw bytes.Buffer
+	if err := mirror.Serialize(&raw); err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		BlockHash: mirror.BtcHeader.BlockHash().String(),
+		ID:        mirror.MirrorID(),
+		Mirror:    hex.EncodeToString(raw.Bytes()),
+	}, nil
+}
+
+// build handles POST /build.
+func (s *Server) build(r *http.Request) (interface{}, error) {
+	body, err := s.readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	var block wire.MsgBlock
+	reader := bytes.NewReader(body)
+	if err := block.Deserialize(reader); err != nil {
+		return nil, errorf(http.StatusBadRequest, "decode block: %v", err)
+	}
+	if reader.Len() != 0 {
+		return nil, errorf(http.StatusBadRequest, "%d bytes after the block", reader.Len())
+	}
+	mirror, err := blocksource.MirrorFromBlock(&block)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "build mirror: %v", err)
+	}
+	return newMirror(mirror)
+}
+
+// pathArg returns the argument of paths of the form prefix{arg}/suffix.
+func pathArg(r *http.Request, prefix, suffix string) (string, error) {
+	arg := strings.TrimPrefix(r.URL.Path, prefix)
+	arg = strings.TrimSuffix(arg, "/"+suffix)
+	if arg == "" || strings.Contains(arg, "/") || !strings.HasSuffix(r.URL.Path, "/"+suffix) {
+		return "", errorf(http.StatusNotFound, "no such endpoint %s", r.URL.Path)
+	}
+	return arg, nil
+}
+
+// blockMirror handles GET /blocks/{hash}/mirror.
+func (s *Server) blockMirror(r *http.Request) (interface{}, error) {
+	arg, err := pathArg(r, "/blocks/", "mirror")
+	if err != nil {
+		return nil, err
+	}
+	hash, err := chainhash.NewHashFromStr(arg)
+	if err != nil || len(arg) != 2*chainhash.HashSize {
+		return nil, errorf(http.StatusBadRequest, "invalid block hash %q", arg)
+	}
+
+	ctx := r.Context()
+	if s.cfg.Index != nil {
+		mirror, err := s.cfg.Index.Mirror(ctx, *hash)
+		if err == nil {
+			b, err := s.cfg.Index.Lookup(ctx, *hash)
+			if err != nil {
+				return nil, err
+			}
+			m, err := newMirror(mirror)
+			if err != nil {
+				return nil, err
+			}
+			m.Height = &b.Height
+			return m, nil
+		}
+		if !errors.Is(err, sqlindex.ErrUnknownBlock) {
+			return nil, err
+		}
+	}
+	if s.cfg.Source != nil {
+		mirror, err := s.cfg.Source.Mirror(ctx, hash)
+		if err == nil {
+			return newMirror(mirror)
+		}
+		if !errors.Is(err, blocksource.ErrBlockNotFound) {
+			return nil, err
+		}
+	}
+	return nil, errorf(http.StatusNotFound, "block %v not found", hash)
+}
+
+// Block is a delegated block in the response of /candidates/{addr}/blocks.
+type Block struct {
+	Height         int64                `json:"height"`
+	Hash           string               `json:"hash"`
+	ID             lightmirror.MirrorID `json:"mirror_id"`
+	Timestamp      time.Time            `json:"timestamp"`
+	Round          uint64               `json:"round"`
+	PayoutAddress  *common.Address      `json:"payout_address,omitempty"`
+	PayoutType     int                  `json:"payout_type"`
+	Candidate      common.Address       `json:"candidate"`
+	Reward         common.Address       `json:"reward"`
+	PowerBlockHash *common.Hash         `json:"power_block_hash,omitempty"`
+}
+
+// CandidateBlocks is the response of /candidates/{addr}/blocks.
+type CandidateBlocks struct {
+	Blocks []Block `json:"blocks"`
+
+	// Next is the from height of the next page, set when the limit cut
+	// the blocks short.
+	Next *int64 `json:"next,omitempty"`
+}
+
+func newBlock(b *sqlindex.Block) Block {
+	block := Block{
+		Height:     b.Height,
+		Hash:       b.Hash.String(),
+		ID:         b.ID,
+		Timestamp:  b.Timestamp.UTC(),
+		Round:      b.Round,
+		PayoutType: b.PayoutType,
+		Candidate:  b.Candidate,
+		Reward:     b.Reward,
+	}
+	if b.PayoutType != lightmirror.NOT_SUPPORT {
+		block.PayoutAddress = &b.PayoutAddress
+	}
+	if b.PowerBlockHash != (common.Hash{}) {
+		block.PowerBlockHash = &b.PowerBlockHash
+	}
+	return block
+}
+
+// heightParam returns the height query parameter name, or def when absent.
+func heightParam(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	height, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || height < 0 {
+		return 0, errorf(http.StatusBadRequest, "invalid %s height %q", name, v)
+	}
+	return height, nil
+}
+
+// candidateBlocks handles GET /candidates/{addr}/blocks.
+func (s *Server) candidateBlocks(r *http.Request) (interface{}, error) {
+	arg, err := pathArg(r, "/candidates/", "blocks")
+	if err != nil {
+		return nil, err
+	}
+	if !common.IsHexAddress(arg) {
+		return nil, errorf(http.StatusBadRequest, "invalid candidate address %q", arg)
+	}
+	from, err := heightParam(r, "from", 0)
+	if err != nil {
+		return nil, err
+	}
+	to, err := heightParam(r, "to", math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	limit := s.cfg.MaxBlocks
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, errorf(http.StatusBadRequest, "invalid limit %q", v)
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	if s.cfg.Index == nil {
+		return nil, errorf(http.StatusNotImplemented, "no delegation index")
+	}
+
+	// One more block than returned tells whether there is a next page.
+	indexed, err := s.cfg.Index.CandidateBlocks(r.Context(), common.HexToAddress(arg),
+		from, to, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	resp := &CandidateBlocks{Blocks: make([]Block, 0, len(indexed))}
+	if len(indexed) > limit {
+		next := indexed[limit].Height
+		resp.Next = &next
+		indexed = indexed[:limit]
+	}
+	for i := range indexed {
+		resp.Blocks = append(resp.Blocks, newBlock(&indexed[i]))
+	}
+	return resp, nil
+}
+
+// Serve serves srv on l until ctx is done, then shuts it down gracefully:
+// the listener is closed and requests in flight are given grace to finish.
+func Serve(ctx context.Context, srv *http.Server, l net.Listener, grace time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return err
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/chaingen"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/sqlindex"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	candidate = common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	reward    = common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	payout    = common.HexToAddress("0x3333333333333333333333333333333333333333")
+)
+
+type testServer struct {
+	*httptest.Server
+	t     *testing.T
+	chain []*wire.MsgBlock
+}
+
+// newTestServer serves a chain of 6 blocks above the genesis block, the
+// first 4 of which are indexed.  Blocks at even heights delegate to
+// candidate.
+func newTestServer(t *testing.T, cfg Config) *testServer {
+	ctx := context.Background()
+	c := chaingen.New(nil)
+	chain := []*wire.MsgBlock{c.Block(0)}
+	for height := 1; height <= 6; height++ {
+		tmpl := &chaingen.Template{Payout: chaingen.P2WPKH(payout)}
+		if height%2 == 0 {
+			tmpl.Markers = [][]byte{chaingen.CoreMarker(candidate, reward)}
+		}
+		chain = append(chain, c.Mine(tmpl))
+	}
+
+	index, err := sqlindex.Open(ctx, ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+	for height := int64(1); height <= 4; height++ {
+		mirror, err := c.Mirror(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := index.Add(ctx, height, mirror); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.Index = index
+	cfg.Source = c.Source()
+	cfg.Verify = &lightmirror.VerifyOptions{PowLimit: c.Params().PowLimit}
+	cfg.Logf = t.Logf
+	s := httptest.NewServer(New(cfg))
+	t.Cleanup(s.Close)
+	return &testServer{Server: s, t: t, chain: chain}
+}
+
+// do sends a request and decodes the JSON response into v, returning the
+// status code.
+func (s *testServer) do(method, path, contentType string, body []byte, v interface{}) int {
+	s.t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		s.t.Errorf("%s %s: content type %q", method, path, ct)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			s.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func serialize(t *testing.T, block *wire.MsgBlock) []byte {
+	var buf bytes.Buffer
+	if err := block.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBuildVerify(t *testing.T) {
+	s := newTestServer(t, Config{})
+	block := s.chain[6]
+
+	var built Mirror
+	if code := s.do("POST", "/build", "", serialize(t, block), &built); code != http.StatusOK {
+		t.Fatalf("/build: status %d", code)
+	}
+	want, _ := blocksource.MirrorFromBlock(block)
+	if built.BlockHash != block.BlockHash().String() || built.ID != want.MirrorID() || built.Height != nil {
+		t.Errorf("/build: %+v", built)
+	}
+	raw, err := hex.DecodeString(built.Mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report lightmirror.Report
+	if code := s.do("POST", "/verify", "", raw, &report); code != http.StatusOK {
+		t.Fatalf("/verify: status %d", code)
+	}
+	if !report.Valid || report.BlockHash != built.BlockHash || report.Candidate == nil ||
+		*report.Candidate != candidate || *report.Reward != reward {
+		t.Errorf("/verify: %+v", report)
+	}
+
+	// Hex bodies are accepted with a text/plain content type.
+	var hexBuilt Mirror
+	code := s.do("POST", "/build", "text/plain; charset=utf-8",
+		[]byte(hex.EncodeToString(serialize(t, block))+"\n"), &hexBuilt)
+	if code != http.StatusOK || hexBuilt != built {
+		t.Errorf("/build with hex body: status %d, %+v", code, hexBuilt)
+	}
+
+	// An invalid mirror, here with a tampered coinbase, gets a report of
+	// its failed checks.
+	raw[80] ^= 1
+	report = lightmirror.Report{}
+	if code := s.do("POST", "/verify", "", raw, &report); code != http.StatusOK || report.Valid {
+		t.Errorf("/verify of a corrupt mirror: status %d, %+v", code, report)
+	}
+}
+
+func TestBlockMirror(t *testing.T) {
+	s := newTestServer(t, Config{})
+
+	var m Mirror
+	hash := s.chain[2].BlockHash()
+	if code := s.do("GET", "/blocks/"+hash.String()+"/mirror", "", nil, &m); code != http.StatusOK {
+		t.Fatalf("indexed block: status %d", code)
+	}
+	if m.BlockHash != hash.String() || m.Height == nil || *m.Height != 2 {
+		t.Errorf("indexed block: %+v", m)
+	}
+
+	// Blocks missing from the index come from the source.
+	m = Mirror{}
+	hash = s.chain[5].BlockHash()
+	if code := s.do("GET", "/blocks/"+hash.String()+"/mirror", "", nil, &m); code != http.StatusOK {
+		t.Fatalf("source block: status %d", code)
+	}
+	want, _ := blocksource.MirrorFromBlock(s.chain[5])
+	if m.BlockHash != hash.String() || m.ID != want.MirrorID() || m.Height != nil {
+		t.Errorf("source block: %+v", m)
+	}
+
+	var e struct{ Error string }
+	unknown := chainhash.Hash{1}
+	if code := s.do("GET", "/blocks/"+unknown.String()+"/mirror", "", nil, &e); code != http.StatusNotFound || e.Error == "" {
+		t.Errorf("unknown block: status %d, %+v", code, e)
+	}
+}
+
+func TestCandidateBlocks(t *testing.T) {
+	s := newTestServer(t, Config{})
+	capped := newTestServer(t, Config{MaxBlocks: 1})
+
+	tests := []struct {
+		server  *testServer
+		query   string
+		heights []int64
+		next    int64
+	}{
+		{s, "", []int64{2, 4}, 0},
+		{s, "?from=3", []int64{4}, 0},
+		{s, "?from=0&to=3", []int64{2}, 0},
+		{s, "?from=5&to=9", []int64{}, 0},
+		{s, "?limit=1", []int64{2}, 4},
+		{s, "?from=4&limit=1", []int64{4}, 0},
+		{s, "?to=3&limit=1", []int64{2}, 0},
+		{capped, "?limit=5", []int64{2}, 4},
+	}
+	for _, test := range tests {
+		var resp CandidateBlocks
+		path := "/candidates/" + candidate.Hex() + "/blocks" + test.query
+		if code := test.server.do("GET", path, "", nil, &resp); code != http.StatusOK {
+			t.Errorf("%s: status %d", path, code)
+			continue
+		}
+		if next := resp.Next; (next == nil) != (test.next == 0) || (next != nil && *next != test.next) {
+			t.Errorf("%s: next %v, want %d", path, next, test.next)
+		}
+		if len(resp.Blocks) != len(test.heights) {
+			t.Errorf("%s: %d blocks, want %d", path, len(resp.Blocks), len(test.heights))
+			continue
+		}
+		for i, b := range resp.Blocks {
+			height := test.heights[i]
+			if b.Height != height || b.Hash != s.chain[height].BlockHash().String() ||
+				b.Candidate != candidate || b.Reward != reward ||
+				b.PayoutType != lightmirror.WITNESS_V0_KEYHASH || b.PayoutAddress == nil ||
+				!b.Timestamp.Equal(s.chain[height].Header.Timestamp) {
+				t.Errorf("%s: block %d: %+v", path, i, b)
+			}
+		}
+	}
+
+	var resp CandidateBlocks
+	lower := "/candidates/" + strings.ToLower(reward.Hex()) + "/blocks"
+	if code := s.do("GET", lower, "", nil, &resp); code != http.StatusOK || resp.Blocks == nil || len(resp.Blocks) != 0 {
+		t.Errorf("%s: status %d, %+v", lower, code, resp)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := newTestServer(t, Config{MaxBodySize: 1000})
+	noIndex := httptest.NewServer(New(Config{}))
+	defer noIndex.Close()
+
+	big := serialize(t, s.chain[1])
+	big = append(big, make([]byte, 1000)...)
+	hash := s.chain[1].BlockHash().String()
+	tests := []struct {
+		method, path, contentType string
+		body                      []byte
+		status                    int
+	}{
+		{"GET", "/verify", "", nil, http.StatusMethodNotAllowed},
+		{"POST", "/blocks/" + hash + "/mirror", "", nil, http.StatusMethodNotAllowed},
+		{"POST", "/verify", "", []byte{1, 2, 3}, http.StatusBadRequest},
+		{"POST", "/verify", "text/plain", []byte("zz"), http.StatusBadRequest},
+		{"POST", "/build", "", big, http.StatusRequestEntityTooLarge},
+		{"POST", "/build", "", append(serialize(t, s.chain[1]), 0), http.StatusBadRequest},
+		{"GET", "/blocks/" + hash, "", nil, http.StatusNotFound},
+		{"GET", "/blocks/" + hash + "/header", "", nil, http.StatusNotFound},
+		{"GET", "/blocks/00/mirror", "", nil, http.StatusBadRequest},
+		{"GET", "/candidates/0x12/blocks", "", nil, http.StatusBadRequest},
+		{"GET", "/candidates/" + candidate.Hex() + "/blocks?from=x", "", nil, http.StatusBadRequest},
+		{"GET", "/candidates/" + candidate.Hex() + "/blocks?to=-1", "", nil, http.StatusBadRequest},
+		{"GET", "/candidates/" + candidate.Hex() + "/blocks?limit=0", "", nil, http.StatusBadRequest},
+		{"GET", "/unknown", "", nil, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, s.URL+test.path, bytes.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		resp, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: status %d, want %d: %s", test.method, test.path,
+				resp.StatusCode, test.status, body)
+		}
+		if test.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") == "" {
+			t.Errorf("%s %s: no Allow header", test.method, test.path)
+		}
+	}
+
+	resp, err := http.Get(noIndex.URL + "/candidates/" + candidate.Hex() + "/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("candidate query without index: status %d", resp.StatusCode)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, srv, l, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+
+	// The request in flight completes after shutdown started.
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned with a request in flight: %v", err)
+	default:
+	}
+	close(release)
+
+	if res := <-results; res.err != nil || res.body != "done" {
+		t.Errorf("request in flight: %q, %v", res.body, res.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Errorf("server still accepts requests after shutdown")
+	}
+}
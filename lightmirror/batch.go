@@ -0,0 +1,118 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"math/big"
+	"runtime"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// VerifyOptions configures mirror verification.  The zero value verifies
+// main network mirrors under PowerPolicyFirst.
+type VerifyOptions struct {
+	// PowLimit is the highest allowed proof of work target.  The main
+	// network limit is used when nil.
+	PowLimit *big.Int
+
+	// PowerPolicy decides the delegation of each block.
+	PowerPolicy PowerPolicy
+
+	// Workers bounds the number of mirrors VerifyBatch checks
+	// concurrently.  GOMAXPROCS is used when zero.
+	Workers int
+}
+
+// VerifyResult is the outcome of verifying one mirror.
+type VerifyResult struct {
+	// Hash is the hash of the mirrored block.
+	Hash chainhash.Hash
+
+	// Candidate, Reward and PowerBlockHash are the delegation parameters
+	// of a verified, delegated block and zero otherwise.
+	Candidate      common.Address
+	Reward         common.Address
+	PowerBlockHash common.Hash
+
+	// Err is the first failed check, or nil when the mirror is valid.
+	Err error
+}
+
+// Delegated reports whether the block was verified to delegate its hash power.
+func (res *VerifyResult) Delegated() bool {
+	return res.Err == nil && res.Candidate != (common.Address{})
+}
+
+// VerifyBatch verifies mirrors concurrently on a pool of at most opts.Workers
+// goroutines.  Each mirror goes through the required checks of Verify: its
+// structure, the coinbase rules, the merkle branch, the proof of work and the
+// power params.  Results are in the order of mirrors.
+//
+// Verification stops when ctx is done: the mirrors not verified by then get
+// the context error as result, which VerifyBatch also returns.
+func VerifyBatch(ctx context.Context, mirrors []*BtcLightMirrorV2, opts *VerifyOptions) ([]VerifyResult, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(mirrors) {
+		workers = len(mirrors)
+	}
+
+	results := make([]VerifyResult, len(mirrors))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = verifyMirror(mirrors[i], opts)
+			}
+		}()
+	}
+
+	var err error
+	next := 0
+feed:
+	for ; next < len(mirrors); next++ {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		select {
+		case jobs <- next:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := next; i < len(mirrors); i++ {
+		results[i] = VerifyResult{Hash: mirrors[i].BtcHeader.BlockHash(), Err: err}
+	}
+	return results, err
+}
+
+// verifyMirror runs the required checks of Verify on light.
+func verifyMirror(light *BtcLightMirrorV2, opts *VerifyOptions) VerifyResult {
+	report := light.Verify(opts)
+	res := VerifyResult{Hash: light.BtcHeader.BlockHash(), Err: report.Err()}
+	if res.Err == nil && report.Candidate != nil {
+		res.Candidate, res.Reward = *report.Candidate, *report.Reward
+		if report.PowerBlockHash != nil {
+			res.PowerBlockHash = *report.PowerBlockHash
+		}
+	}
+	return res
+}
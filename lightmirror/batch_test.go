@@ -0,0 +1,126 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// batchMirrors returns regtest mirrors followed by the error VerifyBatch
+// should report for each of them.
+func batchMirrors() ([]*BtcLightMirrorV2, []error) {
+	marker := mustDecodeHex("6a2d434f524501" +
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+		"1111111111111111111111111111111111111111")
+
+	var mirrors []*BtcLightMirrorV2
+	var errs []error
+	for i := 0; i < 40; i++ {
+		coinbase := validCoinbase()
+		coinbase.TxIn[0].SignatureScript = []byte{0x02, byte(i), byte(i >> 8)}
+		coinbase.AddTxOut(wire.NewTxOut(0, marker))
+
+		var err error
+		switch i % 5 {
+		case 1:
+			coinbase.TxOut = coinbase.TxOut[:1]
+		case 2:
+			coinbase.AddTxOut(wire.NewTxOut(0, marker))
+			err = ErrAmbiguousDelegation
+		case 3:
+			coinbase.TxIn[0].PreviousOutPoint.Index = 0
+			err = ErrCoinbaseNullPrevOut
+		}
+
+		light := testMirrorV2(coinbase, 1+i%7)
+		mineHeader(&light.BtcHeader)
+		if i%5 == 4 {
+			// 0x20800000 has the sign bit of the compact target set.
+			light.BtcHeader.Bits = chaincfg.RegressionNetParams.PowLimitBits + 1
+			err = ErrTargetOutOfRange
+		}
+		mirrors = append(mirrors, light)
+		errs = append(errs, err)
+	}
+	return mirrors, errs
+}
+
+func TestVerifyBatch(t *testing.T) {
+	mirrors, errs := batchMirrors()
+	opts := &VerifyOptions{
+		PowLimit:    chaincfg.RegressionNetParams.PowLimit,
+		PowerPolicy: PowerPolicyStrict,
+	}
+
+	var first []VerifyResult
+	for _, workers := range []int{1, 3, 0} {
+		opts.Workers = workers
+		results, err := VerifyBatch(context.Background(), mirrors, opts)
+		if err != nil {
+			t.Fatalf("VerifyBatch: %v", err)
+		}
+		if len(results) != len(mirrors) {
+			t.Fatalf("%d results for %d mirrors", len(results), len(mirrors))
+		}
+
+		for i, res := range results {
+			if res.Hash != mirrors[i].BtcHeader.BlockHash() {
+				t.Fatalf("result #%d is for block %v", i, res.Hash)
+			}
+			if !errors.Is(res.Err, errs[i]) || (res.Err == nil) != (errs[i] == nil) {
+				t.Errorf("result #%d: got %v, want %v", i, res.Err, errs[i])
+			}
+			delegated := i%5 == 0
+			if res.Delegated() != delegated {
+				t.Errorf("result #%d: delegated %v, want %v", i, res.Delegated(), delegated)
+			}
+			if delegated && res.Candidate != common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa") {
+				t.Errorf("result #%d: candidate %v", i, res.Candidate)
+			}
+		}
+
+		if first == nil {
+			first = results
+		} else if !reflect.DeepEqual(results, first) {
+			t.Errorf("%d workers changed the results", workers)
+		}
+	}
+
+	// A mirror with an invalid merkle branch fails as well.
+	bad := *mirrors[5]
+	bad.MerkleNodes = append(bad.MerkleNodes[:0:0], bad.MerkleNodes...)
+	bad.MerkleNodes[0][0] ^= 1
+	results, err := VerifyBatch(context.Background(), []*BtcLightMirrorV2{&bad}, opts)
+	if err != nil || results[0].Err == nil || results[0].Delegated() {
+		t.Errorf("invalid merkle branch: %+v, %v", results[0], err)
+	}
+}
+
+func TestVerifyBatchCancel(t *testing.T) {
+	mirrors, _ := batchMirrors()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := VerifyBatch(ctx, mirrors, &VerifyOptions{Workers: 2})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("VerifyBatch: got %v, want %v", err, context.Canceled)
+	}
+	for i, res := range results {
+		if !errors.Is(res.Err, context.Canceled) || res.Hash != mirrors[i].BtcHeader.BlockHash() {
+			t.Fatalf("result #%d after cancel: %+v", i, res)
+		}
+	}
+
+	if results, err := VerifyBatch(context.Background(), nil, nil); err != nil || len(results) != 0 {
+		t.Fatalf("empty batch: %v, %v", results, err)
+	}
+}
@@ -5,7 +5,6 @@
 package lightmirror
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -67,27 +66,34 @@ type BtcLightMirror struct {
 
 // Deserialize decodes a block header from r into the receiver using a format.
 func (light *BtcLightMirror) Deserialize(r io.Reader) error {
+	return light.deserialize(r, nil)
+}
+
+// deserialize decodes a mirror from r within the limits of opts.
+func (light *BtcLightMirror) deserialize(r io.Reader, opts *DecodeOptions) error {
+	const typ = "BtcLightMirror"
+
 	err := light.BtcHeader.Deserialize(r)
 	if err != nil {
-		return err
+		return &DecodeError{typ, "header", err}
 	}
 
-	err = light.CoinBaseTx.Deserialize(r)
+	err = opts.readCoinbase(typ, r, &light.CoinBaseTx)
 	if err != nil {
 		return err
 	}
 
 	txCount, err := wire.ReadVarInt(r, 0)
 	if err != nil {
-		return err
+		return &DecodeError{typ, "transaction count", err}
 	}
 
 	// Prevent more transactions than could possibly fit into a block.
 	// It would be possible to cause memory exhaustion and panics without
 	// a sane upper bound on this count.
-	if txCount > maxTxPerBlock {
-		return fmt.Errorf("BtcBlock.BtcDecode too many transactions to fit "+
-			"into a block [count %d, max %d]", txCount, maxTxPerBlock)
+	if max := opts.maxTxHashes(); txCount > max {
+		return &DecodeError{typ, "transaction count", fmt.Errorf("%w "+
+			"[count %d, max %d]", ErrTooManyTxHashes, txCount, max)}
 	}
 
 	light.TxHashes = make([]chainhash.Hash, txCount, txCount)
@@ -95,7 +101,7 @@ func (light *BtcLightMirror) Deserialize(r io.Reader) error {
 	for i := uint64(0); i < txCount; i++ {
 		_, err := io.ReadFull(r, light.TxHashes[i][:])
 		if err != nil {
-			return err
+			return &DecodeError{typ, fmt.Sprintf("transaction hash %d", i), err}
 		}
 	}
 
@@ -129,7 +135,18 @@ func (light *BtcLightMirror) Serialize(w io.Writer) error {
 	return nil
 }
 
+// CheckMerkle checks that CoinBaseTx is structurally a coinbase and that it
+// and TxHashes hash to the merkle root of BtcHeader.
 func (light *BtcLightMirror) CheckMerkle() error {
+	if err := light.CheckCoinbase(); err != nil {
+		return err
+	}
+	return light.checkMerkleRoot()
+}
+
+// checkMerkleRoot checks that CoinBaseTx and TxHashes hash to the merkle root
+// of BtcHeader.
+func (light *BtcLightMirror) checkMerkleRoot() error {
 	coinbaseHash := light.CoinBaseTx.TxHash()
 	h := light.BtcHeader.BlockHash()
 	ph := light.BtcHeader.PrevBlock
@@ -144,13 +161,14 @@ func (light *BtcLightMirror) CheckMerkle() error {
 		ph[31-i] = t
 	}
 
-	merkles := BuildMerkleTreeStore(&coinbaseHash, light.TxHashes)
-	calculatedMerkleRoot := merkles[len(merkles)-1]
-	if !light.BtcHeader.MerkleRoot.IsEqual(calculatedMerkleRoot) {
-		str := fmt.Sprintf("block merkle root is invalid - block "+
-			"header indicates %v, but calculated value is %v",
-			light.BtcHeader.MerkleRoot, calculatedMerkleRoot)
-		return errors.New(str)
+	hashes := make([]chainhash.Hash, 0, len(light.TxHashes)+1)
+	hashes = append(append(hashes, coinbaseHash), light.TxHashes...)
+	calculatedMerkleRoot := MerkleRootInPlace(hashes)
+	if !light.BtcHeader.MerkleRoot.IsEqual(&calculatedMerkleRoot) {
+		return &MerkleMismatchError{
+			Want: light.BtcHeader.MerkleRoot,
+			Got:  calculatedMerkleRoot,
+		}
 	}
 	return nil
 }
@@ -159,8 +177,12 @@ func (light *BtcLightMirror) CheckMerkle() error {
 // PubKeyHashTy: OP_DUP OP_HASH160 OP_DATA_20 <hash> OP_EQUALVERIFY OP_CHECKSIG
 // WitnessV0PubKeyHashTy: OP_0 OP_DATA_20 <hash>
 func (light *BtcLightMirror) GetCoinbaseAddress() (addr common.Address, addrType int) {
-	// parse pkScript
-	pkScript := light.CoinBaseTx.TxOut[0].PkScript
+	return coinbaseAddress(light.CoinBaseTx.TxOut[0].PkScript)
+}
+
+// coinbaseAddress extracts the address paid by pkScript as described for
+// GetCoinbaseAddress.
+func coinbaseAddress(pkScript []byte) (addr common.Address, addrType int) {
 	pkLength := len(pkScript)
 	addrType = NOT_SUPPORT
 	if pkLength == pubKeyHashTxPkScriptLength && pkScript[0] == OP_DUP && pkScript[1] == OP_HASH160 && pkScript[2] == OP_DATA_20 && pkScript[23] == OP_EQUALVERIFY && pkScript[24] == OP_CHECKSIG {
@@ -5,11 +5,9 @@
 package lightmirror
 
 import (
-	"errors"
 	"fmt"
 	"io"
 
-	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
@@ -31,20 +29,24 @@ type BtcLightMirrorV2 struct {
 	MerkleNodes []chainhash.Hash
 }
 
-func CreateBtcLightMirrorV2(btcHeader *wire.BlockHeader, coinBaseTx *wire.MsgTx, transactions []chainhash.Hash) *BtcLightMirrorV2 {
-
-	merkles := BuildMerkleTreeStore(&transactions[0], transactions[1:])
-
-	exponent := getExponent(len(transactions))
-	merkleNodes := make([]chainhash.Hash, 0, exponent)
-	offset := 1 << exponent
-	lastIndex := 1
-	for i := 0; i < exponent; i++ {
-		merkleNodes = append(merkleNodes, *merkles[lastIndex])
-		lastIndex += offset
-		offset >>= 1
+// CreateBtcLightMirrorV2 builds the mirror of the block with header btcHeader
+// whose transactions have the txids transactions, the first one being
+// coinBaseTx.
+func CreateBtcLightMirrorV2(btcHeader *wire.BlockHeader, coinBaseTx *wire.MsgTx, transactions []chainhash.Hash, opts ...MirrorOption) *BtcLightMirrorV2 {
+	var options mirrorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.stripWitness {
+		coinBaseTx = stripWitness(coinBaseTx)
 	}
 
+	// The calculation runs in place, so it must not touch transactions.
+	scratch := make([]chainhash.Hash, len(transactions))
+	copy(scratch, transactions)
+	merkleNodes := make([]chainhash.Hash, 0, getExponent(len(transactions)))
+	_, merkleNodes = MerkleBranchInPlace(scratch, 0, merkleNodes)
+
 	return &BtcLightMirrorV2{
 		*btcHeader,
 		*coinBaseTx,
@@ -54,31 +56,38 @@ func CreateBtcLightMirrorV2(btcHeader *wire.BlockHeader, coinBaseTx *wire.MsgTx,
 
 // Deserialize decodes a block header from r into the receiver using a format.
 func (light *BtcLightMirrorV2) Deserialize(r io.Reader) error {
+	return light.deserialize(r, nil)
+}
+
+// deserialize decodes a mirror from r within the limits of opts.
+func (light *BtcLightMirrorV2) deserialize(r io.Reader, opts *DecodeOptions) error {
+	const typ = "BtcLightMirrorV2"
+
 	err := light.BtcHeader.Deserialize(r)
 	if err != nil {
-		return err
+		return &DecodeError{typ, "header", err}
 	}
 
-	err = light.CoinBaseTx.Deserialize(r)
+	err = opts.readCoinbase(typ, r, &light.CoinBaseTx)
 	if err != nil {
 		return err
 	}
 
 	merkleNodeSize, err := wire.ReadVarInt(r, 0)
 	if err != nil {
-		return err
+		return &DecodeError{typ, "merkle node count", err}
 	}
 
-	if merkleNodeSize > maxMerkleNode {
-		return fmt.Errorf("BtcLightMirrorV2.Deserialize too many merkle node to fit "+
-			"into a block [count %d, max %d]", merkleNodeSize, maxMerkleNode)
+	if max := opts.maxMerkleNodes(); merkleNodeSize > max {
+		return &DecodeError{typ, "merkle node count", fmt.Errorf("%w "+
+			"[count %d, max %d]", ErrTooManyMerkleNodes, merkleNodeSize, max)}
 	}
 
 	light.MerkleNodes = make([]chainhash.Hash, merkleNodeSize, merkleNodeSize)
 	for i := uint64(0); i < merkleNodeSize; i++ {
 		_, err := io.ReadFull(r, light.MerkleNodes[i][:])
 		if err != nil {
-			return err
+			return &DecodeError{typ, fmt.Sprintf("merkle node %d", i), err}
 		}
 	}
 
@@ -113,6 +122,9 @@ func (light *BtcLightMirrorV2) Serialize(w io.Writer) error {
 }
 
 func (light *BtcLightMirrorV2) ParsePowerParams() (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash) {
+	if len(light.CoinBaseTx.TxOut) == 0 {
+		return
+	}
 	for _, txout := range light.CoinBaseTx.TxOut[1:] {
 		pkScript := txout.PkScript
 		if len(pkScript) >= 1+1+4+1+20+20 && pkScript[0] == txscript.OP_RETURN && string(pkScript[2:6]) == powerMagicString && pkScript[6] == txscript.OP_DATA_1 {
@@ -127,24 +139,34 @@ func (light *BtcLightMirrorV2) ParsePowerParams() (candidateAddr common.Address,
 	return
 }
 
+// CheckMerkle checks that CoinBaseTx is structurally a coinbase and that its
+// merkle branch MerkleNodes leads to the merkle root of BtcHeader.
 func (light *BtcLightMirrorV2) CheckMerkle() error {
+	if err := light.CheckCoinbase(); err != nil {
+		return err
+	}
+	return light.checkMerkleRoot()
+}
+
+// checkMerkleRoot checks that the merkle branch MerkleNodes leads from
+// CoinBaseTx to the merkle root of BtcHeader.
+func (light *BtcLightMirrorV2) checkMerkleRoot() error {
 	coinbaseHash := light.CoinBaseTx.TxHash()
 	root := calculateMerkleRoot(&coinbaseHash, light.MerkleNodes)
 	if !light.BtcHeader.MerkleRoot.IsEqual(&root) {
-		str := fmt.Sprintf("block merkle root is invalid - block "+
-			"header indicates %v, but calculated value is %v",
-			light.BtcHeader.MerkleRoot, root)
-		return errors.New(str)
+		return &MerkleMismatchError{Want: light.BtcHeader.MerkleRoot, Got: root}
 	}
 	return nil
 }
 
+// GetCoinbaseAddress returns the address paid by the first coinbase output
+// like BtcLightMirror.GetCoinbaseAddress.
+func (light *BtcLightMirrorV2) GetCoinbaseAddress() (addr common.Address, addrType int) {
+	return coinbaseAddress(light.CoinBaseTx.TxOut[0].PkScript)
+}
+
 func calculateMerkleRoot(coinbaseHash *chainhash.Hash, merkleNodes []chainhash.Hash) chainhash.Hash {
-	res := coinbaseHash
-	for _, node := range merkleNodes {
-		res = blockchain.HashMerkleBranches(res, &node)
-	}
-	return *res
+	return MerkleBranchRoot(*coinbaseHash, 0, merkleNodes)
 }
 
 func getExponent(v int) int {
@@ -0,0 +1,554 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// sha256BlockSize is the SHA-256 block size.  A midstate only covers
+	// whole blocks.
+	sha256BlockSize = 64
+
+	// minOutputsOffset is the smallest offset in a coinbase serialization
+	// at which its output count can start: version, input count, null
+	// outpoint, a two byte signature script and sequence.
+	minOutputsOffset = 4 + 1 + 36 + 1 + 2 + 4
+
+	// minTxOutSize is the size of an output with an empty script.
+	minTxOutSize = 8 + 1
+
+	// lockTimeSize is the size of the lock time ending a transaction.
+	lockTimeSize = 4
+)
+
+var (
+	// ErrNoPowerMarker is returned when building a BtcLightMirrorV3 of a
+	// coinbase without CORE-tagged output beyond the first, and when
+	// checking one whose tail does not start with such an output.
+	ErrNoPowerMarker = errors.New("coinbase carries no delegation marker")
+
+	// ErrMidstateAlignment is returned when the coinbase prefix of a
+	// BtcLightMirrorV3 is not a whole number of SHA-256 blocks.
+	ErrMidstateAlignment = errors.New("coinbase prefix is not a whole number of SHA-256 blocks")
+
+	// ErrOutputBoundary is returned when the coinbase tail of a
+	// BtcLightMirrorV3 does not parse as the outputs its output count and
+	// tail output index call for, followed by the lock time.
+	ErrOutputBoundary = errors.New("coinbase tail does not start at an output boundary")
+
+	// ErrHiddenOutputs is returned under PowerPolicyStrict when outputs
+	// other than the first are compressed into the coinbase prefix of a
+	// BtcLightMirrorV3, where a second delegation marker could hide.
+	ErrHiddenOutputs = errors.New("coinbase outputs hidden in the compressed prefix")
+)
+
+// BtcLightMirrorV3 is a BtcLightMirrorV2 whose coinbase transaction is
+// compressed to the SHA-256 midstate of its leading bytes and the tail
+// holding the delegation output.  Pools paying hundreds of outputs produce
+// coinbases of many kilobytes of which only the tail matters to Core.
+//
+// The verifier finishes the double SHA-256 of the coinbase from the midstate
+// and the tail to recover its txid, and parses the tail from TailOutputOffset
+// as exactly OutputCount-TailOutputIndex outputs that end at the lock time,
+// the first of which has to be a delegation marker.  That proves the outputs
+// it finds are real as long as no output script of the coinbase embeds data
+// chosen by someone other than the miner: such data could be crafted to parse
+// as outputs of its own.  Outputs in the compressed prefix are not visible,
+// so under PowerPolicyFirst the verifier trusts that none of them is an
+// earlier marker, and PowerPolicyStrict rejects mirrors hiding any output
+// but the first with ErrHiddenOutputs.
+type BtcLightMirrorV3 struct {
+	BtcHeader wire.BlockHeader
+
+	// CoinbaseMidstate is the SHA-256 state, as eight big-endian words,
+	// after hashing the first CoinbasePrefixLen bytes of the coinbase
+	// serialized without witness.  CoinbasePrefixLen is a multiple of 64.
+	CoinbaseMidstate  [chainhash.HashSize]byte
+	CoinbasePrefixLen uint64
+
+	// CoinbaseTail holds the remaining bytes of the coinbase.  Whole
+	// outputs start TailOutputOffset bytes into it and run up to the
+	// lock time ending it.  The first of them is output TailOutputIndex
+	// of the OutputCount outputs of the coinbase.
+	CoinbaseTail     []byte
+	TailOutputOffset uint64
+	OutputCount      uint64
+	TailOutputIndex  uint64
+
+	MerkleNodes []chainhash.Hash
+}
+
+// CreateBtcLightMirrorV3 builds the BtcLightMirrorV3 of a block the same way
+// CreateBtcLightMirrorV2 builds its BtcLightMirrorV2.
+func CreateBtcLightMirrorV3(btcHeader *wire.BlockHeader, coinBaseTx *wire.MsgTx, transactions []chainhash.Hash) (*BtcLightMirrorV3, error) {
+	return NewBtcLightMirrorV3(CreateBtcLightMirrorV2(btcHeader, coinBaseTx, transactions))
+}
+
+// NewBtcLightMirrorV3 compresses light.  The tail starts at the SHA-256 block
+// holding the first CORE-tagged output beyond the first output, so every
+// marker up to the first one is kept.
+func NewBtcLightMirrorV3(light *BtcLightMirrorV2) (*BtcLightMirrorV3, error) {
+	coinbase := &light.CoinBaseTx
+
+	markerIndex := -1
+	for _, m := range ScanPowerMarkers(coinbase) {
+		if m.OutputIndex > 0 {
+			markerIndex = m.OutputIndex
+			break
+		}
+	}
+	if markerIndex < 0 {
+		return nil, ErrNoPowerMarker
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(coinbase.SerializeSizeStripped())
+	if err := coinbase.SerializeNoWitness(&buf); err != nil {
+		return nil, err
+	}
+	raw := buf.Bytes()
+
+	offset := outputOffset(coinbase, markerIndex)
+	prefixLen := offset - offset%sha256BlockSize
+	midstate, err := sha256Midstate(raw[:prefixLen])
+	if err != nil {
+		return nil, err
+	}
+
+	return &BtcLightMirrorV3{
+		BtcHeader:         light.BtcHeader,
+		CoinbaseMidstate:  midstate,
+		CoinbasePrefixLen: uint64(prefixLen),
+		CoinbaseTail:      append([]byte(nil), raw[prefixLen:]...),
+		TailOutputOffset:  uint64(offset - prefixLen),
+		OutputCount:       uint64(len(coinbase.TxOut)),
+		TailOutputIndex:   uint64(markerIndex),
+		MerkleNodes:       append([]chainhash.Hash(nil), light.MerkleNodes...),
+	}, nil
+}
+
+// outputOffset returns the offset of output index in the serialization of tx
+// without witness.
+func outputOffset(tx *wire.MsgTx, index int) int {
+	offset := 4 + wire.VarIntSerializeSize(uint64(len(tx.TxIn)))
+	for _, txIn := range tx.TxIn {
+		offset += 36 + wire.VarIntSerializeSize(uint64(len(txIn.SignatureScript))) +
+			len(txIn.SignatureScript) + 4
+	}
+	offset += wire.VarIntSerializeSize(uint64(len(tx.TxOut)))
+	for _, txOut := range tx.TxOut[:index] {
+		offset += txOut.SerializeSize()
+	}
+	return offset
+}
+
+// Deserialize decodes a mirror from r into the receiver.
+func (light *BtcLightMirrorV3) Deserialize(r io.Reader) error {
+	return light.deserialize(r, nil)
+}
+
+// deserialize decodes a mirror from r within the limits of opts.
+func (light *BtcLightMirrorV3) deserialize(r io.Reader, opts *DecodeOptions) error {
+	const typ = "BtcLightMirrorV3"
+
+	err := light.BtcHeader.Deserialize(r)
+	if err != nil {
+		return &DecodeError{typ, "header", err}
+	}
+
+	_, err = io.ReadFull(r, light.CoinbaseMidstate[:])
+	if err != nil {
+		return &DecodeError{typ, "coinbase midstate", err}
+	}
+
+	light.CoinbasePrefixLen, err = wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "coinbase prefix length", err}
+	}
+	maxCoinbase := opts.maxCoinbaseSize()
+	if light.CoinbasePrefixLen > maxCoinbase {
+		return &DecodeError{typ, "coinbase prefix length", fmt.Errorf("%w "+
+			"[len %d, max %d]", ErrCoinbasePrefixTooLong, light.CoinbasePrefixLen,
+			maxCoinbase)}
+	}
+
+	tailLen, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "coinbase tail", err}
+	}
+	if tailLen > maxCoinbase-light.CoinbasePrefixLen {
+		return &DecodeError{typ, "coinbase tail", fmt.Errorf("%w: tail of %d "+
+			"bytes after a prefix of %d, max %d", ErrCoinbaseTooLarge, tailLen,
+			light.CoinbasePrefixLen, maxCoinbase)}
+	}
+	light.CoinbaseTail = make([]byte, tailLen)
+	_, err = io.ReadFull(r, light.CoinbaseTail)
+	if err != nil {
+		return &DecodeError{typ, "coinbase tail", err}
+	}
+
+	light.TailOutputOffset, err = wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "tail output offset", err}
+	}
+
+	light.OutputCount, err = wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "output count", err}
+	}
+
+	light.TailOutputIndex, err = wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "tail output index", err}
+	}
+
+	merkleNodeSize, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "merkle node count", err}
+	}
+	if max := opts.maxMerkleNodes(); merkleNodeSize > max {
+		return &DecodeError{typ, "merkle node count", fmt.Errorf("%w "+
+			"[count %d, max %d]", ErrTooManyMerkleNodes, merkleNodeSize, max)}
+	}
+
+	light.MerkleNodes = make([]chainhash.Hash, merkleNodeSize)
+	for i := range light.MerkleNodes {
+		_, err := io.ReadFull(r, light.MerkleNodes[i][:])
+		if err != nil {
+			return &DecodeError{typ, fmt.Sprintf("merkle node %d", i), err}
+		}
+	}
+
+	return nil
+}
+
+// Serialize encodes the mirror to w.
+func (light *BtcLightMirrorV3) Serialize(w io.Writer) error {
+	err := light.BtcHeader.Serialize(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(light.CoinbaseMidstate[:])
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarInt(w, 0, light.CoinbasePrefixLen)
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarBytes(w, 0, light.CoinbaseTail)
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarInt(w, 0, light.TailOutputOffset)
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarInt(w, 0, light.OutputCount)
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarInt(w, 0, light.TailOutputIndex)
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarInt(w, 0, uint64(len(light.MerkleNodes)))
+	if err != nil {
+		return err
+	}
+
+	for _, node := range light.MerkleNodes {
+		_, err := w.Write(node[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SerializeSize returns the number of bytes Serialize writes.
+func (light *BtcLightMirrorV3) SerializeSize() int {
+	return wire.MaxBlockHeaderPayload + chainhash.HashSize +
+		wire.VarIntSerializeSize(light.CoinbasePrefixLen) +
+		wire.VarIntSerializeSize(uint64(len(light.CoinbaseTail))) +
+		len(light.CoinbaseTail) +
+		wire.VarIntSerializeSize(light.TailOutputOffset) +
+		wire.VarIntSerializeSize(light.OutputCount) +
+		wire.VarIntSerializeSize(light.TailOutputIndex) +
+		serializeHashesSize(len(light.MerkleNodes))
+}
+
+// TailOutputs parses the outputs of the coinbase tail.  It fails with
+// ErrOutputBoundary unless there are as many as OutputCount and
+// TailOutputIndex call for and they run exactly up to the lock time.
+func (light *BtcLightMirrorV3) TailOutputs() ([]*wire.TxOut, error) {
+	tail := light.CoinbaseTail
+	if light.TailOutputOffset > uint64(len(tail)) {
+		return nil, fmt.Errorf("%w: offset %d beyond the %d byte tail",
+			ErrOutputBoundary, light.TailOutputOffset, len(tail))
+	}
+	if light.TailOutputIndex == 0 || light.TailOutputIndex >= light.OutputCount {
+		return nil, fmt.Errorf("%w: tail starts at output %d of %d",
+			ErrOutputBoundary, light.TailOutputIndex, light.OutputCount)
+	}
+	// The outputs before the tail take at least minTxOutSize bytes each,
+	// which also bounds TailOutputIndex.
+	start := light.CoinbasePrefixLen + light.TailOutputOffset
+	if start < minOutputsOffset ||
+		(start-minOutputsOffset)/minTxOutSize < light.TailOutputIndex {
+		return nil, fmt.Errorf("%w: offset %d cannot follow %d outputs",
+			ErrOutputBoundary, start, light.TailOutputIndex)
+	}
+	want := light.OutputCount - light.TailOutputIndex
+
+	var txOuts []*wire.TxOut
+	r := bytes.NewReader(tail[light.TailOutputOffset:])
+	for r.Len() > lockTimeSize && uint64(len(txOuts)) < want {
+		var value [8]byte
+		if _, err := io.ReadFull(r, value[:]); err != nil {
+			return nil, fmt.Errorf("%w: output %d: %v", ErrOutputBoundary, len(txOuts), err)
+		}
+		amount := int64(binary.LittleEndian.Uint64(value[:]))
+		if amount < 0 || amount > btcutil.MaxSatoshi {
+			return nil, fmt.Errorf("%w: output %d value %d out of range",
+				ErrOutputBoundary, len(txOuts), amount)
+		}
+
+		// Anything but a whole script before the lock time breaks the
+		// framing, so the size limit is whatever is left.
+		max := uint32(r.Len())
+		pkScript, err := wire.ReadVarBytes(r, 0, max, "PkScript")
+		if err != nil {
+			return nil, fmt.Errorf("%w: output %d: %v", ErrOutputBoundary, len(txOuts), err)
+		}
+		txOuts = append(txOuts, wire.NewTxOut(amount, pkScript))
+	}
+	if uint64(len(txOuts)) != want {
+		return nil, fmt.Errorf("%w: %d outputs in the tail, want %d",
+			ErrOutputBoundary, len(txOuts), want)
+	}
+	if r.Len() != lockTimeSize {
+		return nil, fmt.Errorf("%w: %d bytes left for the lock time",
+			ErrOutputBoundary, r.Len())
+	}
+	return txOuts, nil
+}
+
+// CoinbaseTxID finishes the double SHA-256 of the coinbase and returns its
+// txid.
+func (light *BtcLightMirrorV3) CoinbaseTxID() (chainhash.Hash, error) {
+	h, err := resumeSHA256(light.CoinbaseMidstate, light.CoinbasePrefixLen)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	h.Write(light.CoinbaseTail)
+	return chainhash.Hash(sha256.Sum256(h.Sum(nil))), nil
+}
+
+// CheckMerkle checks that the coinbase tail is made of whole outputs starting
+// with a delegation marker and that the recovered coinbase txid and
+// MerkleNodes lead to the merkle root of BtcHeader.  The coinbase structure
+// rules of CheckCoinbase and the output count and tail output index can only
+// be checked against the coinbase when nothing was compressed.
+func (light *BtcLightMirrorV3) CheckMerkle() error {
+	txOuts, err := light.TailOutputs()
+	if err != nil {
+		return err
+	}
+
+	if light.CoinbasePrefixLen == 0 {
+		coinbase, err := light.coinbase()
+		if err != nil {
+			return err
+		}
+		if err := light.checkCoinbase(coinbase); err != nil {
+			return err
+		}
+	}
+
+	if err := light.checkTail(txOuts); err != nil {
+		return err
+	}
+
+	coinbaseHash, err := light.CoinbaseTxID()
+	if err != nil {
+		return err
+	}
+	return light.checkMerkleRoot(&coinbaseHash)
+}
+
+// checkCoinbase checks coinbase, the whole coinbase of a mirror with nothing
+// compressed, and that the tail fields describe it.
+func (light *BtcLightMirrorV3) checkCoinbase(coinbase *wire.MsgTx) error {
+	if err := CheckCoinbase(coinbase); err != nil {
+		return err
+	}
+	if light.OutputCount != uint64(len(coinbase.TxOut)) ||
+		light.TailOutputOffset != uint64(outputOffset(coinbase, int(light.TailOutputIndex))) {
+		return fmt.Errorf("%w: tail output %d of %d does not match the "+
+			"coinbase", ErrOutputBoundary, light.TailOutputIndex, light.OutputCount)
+	}
+	return nil
+}
+
+// checkTail checks that txOuts, the outputs of the tail, start with a valid
+// delegation marker.
+func (light *BtcLightMirrorV3) checkTail(txOuts []*wire.TxOut) error {
+	// The tail starts at the first CORE-tagged output and holds the
+	// marker ParsePowerParams takes, so neither can be hashed into the
+	// prefix.
+	markers := scanPowerOutputs(txOuts, int(light.TailOutputIndex))
+	if len(markers) == 0 || markers[0].OutputIndex != int(light.TailOutputIndex) {
+		return fmt.Errorf("%w: tail does not start with a CORE-tagged output",
+			ErrNoPowerMarker)
+	}
+	if m, _ := decidePowerMarkers(markers, PowerPolicyFirst); m == nil {
+		return fmt.Errorf("%w: no valid marker in the tail", ErrNoPowerMarker)
+	}
+	return nil
+}
+
+// checkMerkleRoot checks that the coinbase txid and MerkleNodes lead to the
+// merkle root of BtcHeader.
+func (light *BtcLightMirrorV3) checkMerkleRoot(coinbaseHash *chainhash.Hash) error {
+	root := calculateMerkleRoot(coinbaseHash, light.MerkleNodes)
+	if !light.BtcHeader.MerkleRoot.IsEqual(&root) {
+		return &MerkleMismatchError{Want: light.BtcHeader.MerkleRoot, Got: root}
+	}
+	return nil
+}
+
+// coinbase decodes the coinbase of a mirror with nothing compressed.
+func (light *BtcLightMirrorV3) coinbase() (*wire.MsgTx, error) {
+	var coinbase wire.MsgTx
+	err := coinbase.DeserializeNoWitness(bytes.NewReader(light.CoinbaseTail))
+	if err != nil {
+		return nil, fmt.Errorf("%w: coinbase tail: %v", ErrMalformedMirror, err)
+	}
+	return &coinbase, nil
+}
+
+// PowerMarkers lists every CORE-tagged output of the coinbase tail, or of the
+// whole coinbase when nothing was compressed.
+func (light *BtcLightMirrorV3) PowerMarkers() ([]PowerMarker, error) {
+	txOuts, err := light.TailOutputs()
+	if err != nil {
+		return nil, err
+	}
+	if light.CoinbasePrefixLen == 0 {
+		coinbase, err := light.coinbase()
+		if err != nil {
+			return nil, err
+		}
+		return ScanPowerMarkers(coinbase), nil
+	}
+	return scanPowerOutputs(txOuts, int(light.TailOutputIndex)), nil
+}
+
+// HidesOutputs reports whether outputs other than the first are compressed
+// into the coinbase prefix, where a marker could hide from the verifier.
+func (light *BtcLightMirrorV3) HidesOutputs() bool {
+	return light.CoinbasePrefixLen > 0 && light.TailOutputIndex > 1
+}
+
+// ValidatePowerParams decides the delegation of the block under policy from
+// the coinbase tail and returns its parameters.  All values are zero when
+// the block is not delegated.  PowerPolicyStrict fails with ErrHiddenOutputs
+// when outputs other than the first are compressed.
+func (light *BtcLightMirrorV3) ValidatePowerParams(policy PowerPolicy) (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash, err error) {
+	m, err := light.decidePowerParams(policy)
+	if err != nil || m == nil {
+		return
+	}
+	return m.Candidate, m.Reward, m.BlockHash, nil
+}
+
+// decidePowerParams returns the marker deciding the delegation of the block
+// under policy, or nil when it is not delegated.
+func (light *BtcLightMirrorV3) decidePowerParams(policy PowerPolicy) (*PowerMarker, error) {
+	markers, err := light.PowerMarkers()
+	if err != nil {
+		return nil, err
+	}
+	if policy == PowerPolicyStrict && light.HidesOutputs() {
+		return nil, fmt.Errorf("%w: outputs 1 to %d", ErrHiddenOutputs, light.TailOutputIndex-1)
+	}
+	return decidePowerMarkers(markers, policy)
+}
+
+// ParsePowerParams returns the delegation parameters of the first marker in
+// the coinbase tail.  All values are zero when the tail is malformed or when
+// the mirror hides outputs, since an earlier marker in the prefix would
+// decide the delegation of the block instead.  Callers trusting the relayer
+// not to hide markers use ValidatePowerParams with PowerPolicyFirst.
+func (light *BtcLightMirrorV3) ParsePowerParams() (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash) {
+	if light.HidesOutputs() {
+		return
+	}
+	candidateAddr, rewardAddr, blockHash, _ = light.ValidatePowerParams(PowerPolicyFirst)
+	return
+}
+
+// sha256Midstate returns the SHA-256 state after hashing prefix, which has to
+// be a whole number of blocks.
+func sha256Midstate(prefix []byte) (midstate [chainhash.HashSize]byte, err error) {
+	if len(prefix)%sha256BlockSize != 0 {
+		return midstate, ErrMidstateAlignment
+	}
+
+	h := sha256.New()
+	h.Write(prefix)
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return midstate, err
+	}
+
+	// The marshaled state is a four byte magic followed by the state
+	// words in big-endian order.
+	copy(midstate[:], state[4:])
+	return midstate, nil
+}
+
+// resumeSHA256 returns a SHA-256 hash continuing from midstate after n bytes.
+func resumeSHA256(midstate [chainhash.HashSize]byte, n uint64) (hash.Hash, error) {
+	if n%sha256BlockSize != 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMidstateAlignment, n)
+	}
+
+	// Magic, state words, the empty pending block and the byte count.
+	state := make([]byte, 0, 4+chainhash.HashSize+sha256BlockSize+8)
+	state = append(state, "sha\x03"...)
+	state = append(state, midstate[:]...)
+	state = append(state, make([]byte, sha256BlockSize+8)...)
+	binary.BigEndian.PutUint64(state[len(state)-8:], n)
+
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestMidstate(t *testing.T) {
+	data := bytes.Repeat([]byte("midstate"), 40)
+	for _, prefixLen := range []int{0, 64, 256} {
+		midstate, err := sha256Midstate(data[:prefixLen])
+		if err != nil {
+			t.Fatalf("sha256Midstate(%d): %v", prefixLen, err)
+		}
+		h, err := resumeSHA256(midstate, uint64(prefixLen))
+		if err != nil {
+			t.Fatalf("resumeSHA256(%d): %v", prefixLen, err)
+		}
+		h.Write(data[prefixLen:])
+		if want := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), want[:]) {
+			t.Errorf("resumed hash after %d bytes differs", prefixLen)
+		}
+	}
+
+	if _, err := sha256Midstate(data[:65]); !errors.Is(err, ErrMidstateAlignment) {
+		t.Errorf("unaligned prefix: got %v, want %v", err, ErrMidstateAlignment)
+	}
+}
+
+// largeCoinbaseMirror returns the v2 mirror of a block whose coinbase pays
+// payouts P2WPKH outputs before the CORE marker.
+func largeCoinbaseMirror(payouts int) *BtcLightMirrorV2 {
+	coreMarker := mustDecodeHex("6a2d434f524501" +
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+		"1111111111111111111111111111111111111111")
+	var scripts [][]byte
+	for i := 0; i < payouts; i++ {
+		scripts = append(scripts, append([]byte{0x00, 0x14}, bytes.Repeat([]byte{byte(i + 1)}, 20)...))
+	}
+	scripts = append(scripts, coreMarker)
+
+	block := segwitBlock(800000, "/pool/", scripts, 1500)
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	return CreateBtcLightMirrorV2(&block.Header, block.Transactions[0], txids, WithoutWitness())
+}
+
+func TestBtcLightMirrorV3(t *testing.T) {
+	for _, payouts := range []int{1, 3, 300} {
+		v2 := largeCoinbaseMirror(payouts)
+		v3, err := NewBtcLightMirrorV3(v2)
+		if err != nil {
+			t.Fatalf("%d payouts: NewBtcLightMirrorV3: %v", payouts, err)
+		}
+		if err := v3.CheckMerkle(); err != nil {
+			t.Fatalf("%d payouts: CheckMerkle: %v", payouts, err)
+		}
+		if txid, err := v3.CoinbaseTxID(); err != nil || txid != v2.CoinBaseTx.TxHash() {
+			t.Fatalf("%d payouts: CoinbaseTxID: got %v, %v", payouts, txid, err)
+		}
+
+		cand, reward, blockHash := v2.ParsePowerParams()
+		gotCand, gotReward, gotHash, err := v3.ValidatePowerParams(PowerPolicyFirst)
+		if err != nil || gotCand != cand || gotReward != reward || gotHash != blockHash {
+			t.Errorf("%d payouts: first ValidatePowerParams: got %v %v, %v, want %v %v",
+				payouts, gotCand, gotReward, err, cand, reward)
+		}
+
+		// Only the marker right after the payout leaves no output for a
+		// second marker to hide in.
+		hides := payouts > 1
+		if v3.HidesOutputs() != hides {
+			t.Errorf("%d payouts: HidesOutputs %v, want %v", payouts, !hides, hides)
+		}
+		if hides {
+			cand, reward, blockHash = common.Address{}, common.Address{}, common.Hash{}
+		}
+		gotCand, gotReward, gotHash = v3.ParsePowerParams()
+		if gotCand != cand || gotReward != reward || gotHash != blockHash {
+			t.Errorf("%d payouts: ParsePowerParams: got %v %v, want %v %v",
+				payouts, gotCand, gotReward, cand, reward)
+		}
+		if v3.OutputCount != uint64(len(v2.CoinBaseTx.TxOut)) || v3.TailOutputIndex != uint64(payouts) {
+			t.Errorf("%d payouts: tail starts at output %d of %d", payouts,
+				v3.TailOutputIndex, v3.OutputCount)
+		}
+
+		var want error
+		if hides {
+			want = ErrHiddenOutputs
+		}
+		if _, _, _, err := v3.ValidatePowerParams(PowerPolicyStrict); !errors.Is(err, want) {
+			t.Errorf("%d payouts: strict ValidatePowerParams: got %v, want %v", payouts, err, want)
+		}
+
+		var buf bytes.Buffer
+		if err := v3.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != v3.SerializeSize() {
+			t.Errorf("%d payouts: SerializeSize %d, wrote %d", payouts, v3.SerializeSize(), buf.Len())
+		}
+		var decoded BtcLightMirrorV3
+		if err := decoded.Deserialize(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("%d payouts: Deserialize: %v", payouts, err)
+		}
+		if !reflect.DeepEqual(&decoded, v3) {
+			t.Errorf("%d payouts: round trip: got %+v, want %+v", payouts, &decoded, v3)
+		}
+
+		// Tail plus midstate are bounded by a few SHA-256 blocks
+		// whatever the number of payouts.
+		t.Logf("%d payouts: v2 %d bytes, v3 %d bytes", payouts,
+			v2.SerializeSize(), v3.SerializeSize())
+		if payouts == 300 && v3.SerializeSize()*10 > v2.SerializeSize() {
+			t.Errorf("v3 mirror of %d bytes is not much smaller than %d",
+				v3.SerializeSize(), v2.SerializeSize())
+		}
+	}
+
+	if _, err := NewBtcLightMirrorV3(testMirrorV2(validCoinbase(), 3)); !errors.Is(err, ErrNoPowerMarker) {
+		t.Errorf("undelegated coinbase: got %v, want %v", err, ErrNoPowerMarker)
+	}
+}
+
+func TestBtcLightMirrorV3Uncompressed(t *testing.T) {
+	// The marker of a small coinbase falls in the first SHA-256 block, so
+	// nothing is compressed and the coinbase rules are checked.
+	coinbase := validCoinbase()
+	coinbase.AddTxOut(wire.NewTxOut(0, mustDecodeHex("6a2d434f524501"+
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"+
+		"1111111111111111111111111111111111111111")))
+	v3, err := NewBtcLightMirrorV3(testMirrorV2(coinbase, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3.CoinbasePrefixLen != 0 {
+		t.Fatalf("prefix of %d bytes compressed", v3.CoinbasePrefixLen)
+	}
+	if err := v3.CheckMerkle(); err != nil {
+		t.Fatalf("CheckMerkle: %v", err)
+	}
+	if _, _, _, err := v3.ValidatePowerParams(PowerPolicyStrict); err != nil {
+		t.Errorf("strict ValidatePowerParams: %v", err)
+	}
+
+	coinbase.TxIn[0].SignatureScript = []byte{0x00}
+	v3, err = NewBtcLightMirrorV3(testMirrorV2(coinbase, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v3.CheckMerkle(); !errors.Is(err, ErrCoinbaseScriptLength) {
+		t.Errorf("short coinbase script: got %v, want %v", err, ErrCoinbaseScriptLength)
+	}
+}
+
+func TestBtcLightMirrorV3Tampering(t *testing.T) {
+	v2 := largeCoinbaseMirror(100)
+	v3, err := NewBtcLightMirrorV3(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(light *BtcLightMirrorV3)
+		err    error
+	}{
+		{"offset inside output", func(light *BtcLightMirrorV3) {
+			light.TailOutputOffset++
+		}, ErrOutputBoundary},
+		{"more outputs", func(light *BtcLightMirrorV3) {
+			light.OutputCount++
+		}, ErrOutputBoundary},
+		{"fewer outputs", func(light *BtcLightMirrorV3) {
+			light.OutputCount--
+		}, ErrOutputBoundary},
+		{"later tail output index", func(light *BtcLightMirrorV3) {
+			light.TailOutputIndex++
+		}, ErrOutputBoundary},
+		{"tail output index beyond prefix", func(light *BtcLightMirrorV3) {
+			light.OutputCount += 1000
+			light.TailOutputIndex += 1000
+		}, ErrOutputBoundary},
+		{"tail output index zero", func(light *BtcLightMirrorV3) {
+			light.OutputCount -= light.TailOutputIndex
+			light.TailOutputIndex = 0
+		}, ErrOutputBoundary},
+		{"marker in prefix", func(light *BtcLightMirrorV3) {
+			// Skip the marker as if it had been hashed into
+			// the prefix.
+			light.TailOutputOffset += uint64(v2.CoinBaseTx.TxOut[light.TailOutputIndex].SerializeSize())
+			light.TailOutputIndex++
+		}, ErrNoPowerMarker},
+		{"offset before output", func(light *BtcLightMirrorV3) {
+			light.TailOutputOffset--
+		}, ErrOutputBoundary},
+		{"offset beyond tail", func(light *BtcLightMirrorV3) {
+			light.TailOutputOffset = uint64(len(light.CoinbaseTail) + 1)
+		}, ErrOutputBoundary},
+		{"missing lock time", func(light *BtcLightMirrorV3) {
+			light.CoinbaseTail = light.CoinbaseTail[:len(light.CoinbaseTail)-1]
+		}, ErrOutputBoundary},
+		{"offset in first output", func(light *BtcLightMirrorV3) {
+			light.CoinbaseTail = append(light.CoinbaseTail[:0:0], light.CoinbaseTail[light.TailOutputOffset:]...)
+			light.TailOutputOffset = 0
+			light.CoinbasePrefixLen = 0
+		}, ErrOutputBoundary},
+		{"unaligned prefix", func(light *BtcLightMirrorV3) {
+			light.CoinbasePrefixLen++
+		}, ErrMidstateAlignment},
+		{"forged marker", func(light *BtcLightMirrorV3) {
+			tail := append([]byte{}, light.CoinbaseTail...)
+			tail[len(tail)-lockTimeSize-60] ^= 0xff
+			light.CoinbaseTail = tail
+		}, nil},
+		{"midstate", func(light *BtcLightMirrorV3) {
+			light.CoinbaseMidstate[0] ^= 1
+		}, nil},
+	}
+
+	for _, test := range tests {
+		light := *v3
+		light.CoinbaseTail = append([]byte{}, v3.CoinbaseTail...)
+		test.mutate(&light)
+
+		err := light.CheckMerkle()
+		if err == nil {
+			t.Errorf("%s: CheckMerkle accepted tampered mirror", test.name)
+			continue
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestBtcLightMirrorV3HiddenMarker(t *testing.T) {
+	marker := func(candidate byte) []byte {
+		script := mustDecodeHex("6a2d434f524501")
+		script = append(script, bytes.Repeat([]byte{candidate}, 20)...)
+		return append(script, bytes.Repeat([]byte{0x11}, 20)...)
+	}
+	var scripts [][]byte
+	for i := 0; i < 10; i++ {
+		scripts = append(scripts, append([]byte{0x00, 0x14}, bytes.Repeat([]byte{byte(i + 1)}, 20)...))
+	}
+	scripts = append(scripts, marker(0xaa))
+	for i := 0; i < 10; i++ {
+		scripts = append(scripts, append([]byte{0x00, 0x14}, bytes.Repeat([]byte{byte(i + 1)}, 20)...))
+	}
+	scripts = append(scripts, marker(0xbb))
+
+	block := segwitBlock(800000, "/pool/", scripts, 10)
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	v2 := CreateBtcLightMirrorV2(&block.Header, block.Transactions[0], txids, WithoutWitness())
+	if _, _, _, err := v2.ValidatePowerParams(PowerPolicyStrict); !errors.Is(err, ErrAmbiguousDelegation) {
+		t.Fatalf("v2 strict: got %v, want %v", err, ErrAmbiguousDelegation)
+	}
+
+	// A relayer starting the tail at the second marker hides the first
+	// one in the prefix.
+	raw := bytes.NewBuffer(nil)
+	if err := v2.CoinBaseTx.SerializeNoWitness(raw); err != nil {
+		t.Fatal(err)
+	}
+	const second = 21
+	offset := outputOffset(&v2.CoinBaseTx, second)
+	prefixLen := offset - offset%sha256BlockSize
+	midstate, err := sha256Midstate(raw.Bytes()[:prefixLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3 := &BtcLightMirrorV3{
+		BtcHeader:         v2.BtcHeader,
+		CoinbaseMidstate:  midstate,
+		CoinbasePrefixLen: uint64(prefixLen),
+		CoinbaseTail:      raw.Bytes()[prefixLen:],
+		TailOutputOffset:  uint64(offset - prefixLen),
+		OutputCount:       uint64(len(v2.CoinBaseTx.TxOut)),
+		TailOutputIndex:   second,
+		MerkleNodes:       v2.MerkleNodes,
+	}
+	if err := v3.CheckMerkle(); err != nil {
+		t.Fatalf("CheckMerkle: %v", err)
+	}
+	if _, _, _, err := v3.ValidatePowerParams(PowerPolicyStrict); !errors.Is(err, ErrHiddenOutputs) {
+		t.Errorf("strict: got %v, want %v", err, ErrHiddenOutputs)
+	}
+	markers, err := v3.PowerMarkers()
+	if err != nil || len(markers) != 1 || markers[0].OutputIndex != second {
+		t.Errorf("PowerMarkers: %+v, %v", markers, err)
+	}
+
+	// The visible marker is not the one deciding the delegation.
+	if !v3.HidesOutputs() {
+		t.Errorf("HidesOutputs: got false")
+	}
+	if cand, reward, _ := v3.ParsePowerParams(); cand != (common.Address{}) || reward != (common.Address{}) {
+		t.Errorf("ParsePowerParams: got %v %v, want nothing", cand, reward)
+	}
+}
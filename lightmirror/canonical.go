@@ -0,0 +1,99 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// MaxStrictCoinbaseSize is the largest coinbase transaction, in stripped
+// bytes, accepted by the strict decoders.  It equals the standard transaction
+// weight limit of Bitcoin Core expressed in non-witness bytes.
+const MaxStrictCoinbaseSize = 100000
+
+var (
+	// ErrTrailingData is returned by the strict decoders when bytes are
+	// left after the mirror.
+	ErrTrailingData = errors.New("trailing data after mirror")
+
+	// ErrNonCanonical is returned by the strict decoders when the input is
+	// a valid but not the canonical encoding of the mirror, for instance
+	// because the coinbase carries witness data.
+	ErrNonCanonical = errors.New("mirror is not canonically encoded")
+
+	// ErrCoinbaseTooLarge is returned by the strict decoders when the
+	// coinbase exceeds MaxStrictCoinbaseSize.
+	ErrCoinbaseTooLarge = errors.New("coinbase transaction too large")
+)
+
+// The canonical encoding of a mirror is its regular encoding with the
+// coinbase transaction serialized without witness data.  Witness data does
+// not contribute to the txid, so it is irrelevant to the merkle proof, and
+// dropping it leaves exactly one encoding per logical mirror: wire.ReadVarInt
+// already rejects non-minimal varints.
+
+// SerializeCanonical encodes the mirror to w in canonical form.
+func (light *BtcLightMirror) SerializeCanonical(w io.Writer) error {
+	stripped := *light
+	stripped.CoinBaseTx = *stripWitness(&light.CoinBaseTx)
+	return stripped.Serialize(w)
+}
+
+// CanonicalBytes returns the canonical encoding of the mirror.
+func (light *BtcLightMirror) CanonicalBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := light.SerializeCanonical(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeserializeStrict decodes b into the receiver, accepting only the canonical
+// encoding of a mirror with nothing after it and a coinbase of at most
+// MaxStrictCoinbaseSize bytes.
+func (light *BtcLightMirror) DeserializeStrict(b []byte) error {
+	return light.DeserializeWithOptions(b, StrictDecodeOptions())
+}
+
+// SerializeCanonical encodes the mirror to w in canonical form.
+func (light *BtcLightMirrorV2) SerializeCanonical(w io.Writer) error {
+	stripped := *light
+	stripped.CoinBaseTx = *stripWitness(&light.CoinBaseTx)
+	return stripped.Serialize(w)
+}
+
+// CanonicalBytes returns the canonical encoding of the mirror.
+func (light *BtcLightMirrorV2) CanonicalBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := light.SerializeCanonical(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeserializeStrict decodes b into the receiver, accepting only the canonical
+// encoding of a mirror with nothing after it and a coinbase of at most
+// MaxStrictCoinbaseSize bytes.
+func (light *BtcLightMirrorV2) DeserializeStrict(b []byte) error {
+	return light.DeserializeWithOptions(b, StrictDecodeOptions())
+}
+
+// stripWitness returns tx without witness data.  Tx itself is returned when
+// it carries none.
+func stripWitness(tx *wire.MsgTx) *wire.MsgTx {
+	if !tx.HasWitness() {
+		return tx
+	}
+
+	stripped := tx.Copy()
+	for _, txIn := range stripped.TxIn {
+		txIn.Witness = nil
+	}
+	return stripped
+}
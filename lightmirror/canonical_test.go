@@ -0,0 +1,137 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testMirrorV2 returns a mirror over a block of txCount transactions whose
+// coinbase is coinbase.
+func testMirrorV2(coinbase *wire.MsgTx, txCount int) *BtcLightMirrorV2 {
+	transactions := []chainhash.Hash{coinbase.TxHash()}
+	for i := 1; i < txCount; i++ {
+		transactions = append(transactions, chainhash.Hash{byte(i)})
+	}
+	merkles := BuildMerkleTreeStore(&transactions[0], transactions[1:])
+	header := wire.BlockHeader{
+		Version:    1,
+		MerkleRoot: *merkles[len(merkles)-1],
+		Timestamp:  time.Unix(1600000000, 0),
+	}
+	return CreateBtcLightMirrorV2(&header, coinbase, transactions)
+}
+
+func witnessCoinbase() *wire.MsgTx {
+	tx := validCoinbase()
+	tx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	return tx
+}
+
+func TestDeserializeStrictV2(t *testing.T) {
+	plain := testMirrorV2(validCoinbase(), 5)
+	var buf bytes.Buffer
+	if err := plain.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := append([]byte{}, buf.Bytes()...)
+
+	var got BtcLightMirrorV2
+	if err := got.DeserializeStrict(raw); err != nil {
+		t.Fatalf("DeserializeStrict: %v", err)
+	}
+	if !reflect.DeepEqual(&got, plain) {
+		t.Fatalf("DeserializeStrict decoded %v, want %v", &got, plain)
+	}
+
+	if err := got.DeserializeStrict(append(raw[:len(raw):len(raw)], 0)); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("trailing byte: got %v, want %v", err, ErrTrailingData)
+	}
+
+	// The merkle node count is the byte right after the coinbase.  A
+	// three byte encoding of the same count is rejected.
+	pos := len(raw) - len(plain.MerkleNodes)*chainhash.HashSize - 1
+	padded := append(append(append([]byte{}, raw[:pos]...), 0xfd, raw[pos], 0x00), raw[pos+1:]...)
+	if err := got.DeserializeStrict(padded); err == nil {
+		t.Errorf("non-minimal varint accepted")
+	}
+
+	// A witness coinbase decodes leniently but is not canonical.
+	witness := testMirrorV2(witnessCoinbase(), 5)
+	buf.Reset()
+	if err := witness.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(BtcLightMirrorV2).Deserialize(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Deserialize(witness): %v", err)
+	}
+	if err := got.DeserializeStrict(buf.Bytes()); !errors.Is(err, ErrNonCanonical) {
+		t.Errorf("witness coinbase: got %v, want %v", err, ErrNonCanonical)
+	}
+
+	canonical, err := witness.CanonicalBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(canonical, raw) {
+		t.Errorf("canonical encoding of witness mirror differs from plain mirror")
+	}
+	if err := got.DeserializeStrict(canonical); err != nil {
+		t.Errorf("DeserializeStrict(canonical): %v", err)
+	}
+	if err := got.CheckMerkle(); err != nil {
+		t.Errorf("CheckMerkle(canonical): %v", err)
+	}
+	if !witness.CoinBaseTx.HasWitness() {
+		t.Errorf("CanonicalBytes modified the receiver")
+	}
+
+	big := validCoinbase()
+	big.TxOut[0].PkScript = make([]byte, MaxStrictCoinbaseSize)
+	buf.Reset()
+	if err := testMirrorV2(big, 2).Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.DeserializeStrict(buf.Bytes()); !errors.Is(err, ErrCoinbaseTooLarge) {
+		t.Errorf("oversize coinbase: got %v, want %v", err, ErrCoinbaseTooLarge)
+	}
+}
+
+func TestDeserializeStrictV1(t *testing.T) {
+	light := &BtcLightMirror{
+		CoinBaseTx: *witnessCoinbase(),
+		TxHashes:   []chainhash.Hash{{1}, {2}},
+	}
+
+	var buf bytes.Buffer
+	if err := light.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got BtcLightMirror
+	if err := got.DeserializeStrict(buf.Bytes()); !errors.Is(err, ErrNonCanonical) {
+		t.Errorf("witness coinbase: got %v, want %v", err, ErrNonCanonical)
+	}
+
+	canonical, err := light.CanonicalBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.DeserializeStrict(canonical); err != nil {
+		t.Fatalf("DeserializeStrict(canonical): %v", err)
+	}
+	if got.CoinBaseTx.TxHash() != light.CoinBaseTx.TxHash() {
+		t.Errorf("canonical coinbase has a different txid")
+	}
+	if err := got.DeserializeStrict(append(canonical, 1, 2)); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("trailing bytes: got %v, want %v", err, ErrTrailingData)
+	}
+}
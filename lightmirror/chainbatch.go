@@ -0,0 +1,395 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// MaxChainBatchHeaders is the largest number of headers in a
+	// ChainBatch, one difficulty adjustment period.
+	MaxChainBatchHeaders = 2016
+
+	// chainedHeaderSize is the size of a header without its PrevBlock.
+	chainedHeaderSize = wire.MaxBlockHeaderPayload - chainhash.HashSize
+)
+
+var (
+	// ErrChainBroken is returned when blocks do not extend each other or
+	// the expected parent.
+	ErrChainBroken = errors.New("blocks are not chained")
+
+	// ErrTooManyHeaders is returned when a ChainBatch holds more than
+	// MaxChainBatchHeaders headers.
+	ErrTooManyHeaders = errors.New("too many headers")
+
+	// ErrProofIndex is returned when the coinbase proofs of a ChainBatch
+	// are not in strictly increasing header order.
+	ErrProofIndex = errors.New("coinbase proof index out of order")
+)
+
+// ChainProof is the coinbase proof of one block of a ChainBatch.
+type ChainProof struct {
+	// Index is the position of the block in ChainBatch.Headers.
+	Index uint32
+
+	CoinBaseTx wire.MsgTx
+
+	MerkleNodes []chainhash.Hash
+}
+
+// ChainBatch carries consecutive blocks in one payload.  The PrevBlock of each
+// header is implied by the header before it, so only the parent of the first
+// block is encoded, and coinbase proofs are carried only for the blocks that
+// need them.  Catching up on N blocks with k proofs costs 32 + 48N bytes plus
+// the proofs, instead of N full BtcLightMirrorV2.
+type ChainBatch struct {
+	// PrevBlock is the hash of the block before the first header.
+	PrevBlock chainhash.Hash
+
+	// Headers are the consecutive headers.  Their PrevBlock fields are
+	// set from the chain when decoding and ignored when encoding.
+	Headers []wire.BlockHeader
+
+	// Proofs are the coinbase proofs, in increasing Index order.
+	Proofs []ChainProof
+}
+
+// NeedsPowerProof reports whether the coinbase of light carries a power
+// marker.  It is the default selection of NewChainBatch.
+func NeedsPowerProof(light *BtcLightMirrorV2) bool {
+	return len(ScanPowerMarkers(&light.CoinBaseTx)) != 0
+}
+
+// NewChainBatch returns the batch of mirrors, which must be consecutive
+// blocks.  Only the mirrors for which needsProof returns true keep their
+// coinbase proof; NeedsPowerProof is used when it is nil.
+func NewChainBatch(mirrors []*BtcLightMirrorV2, needsProof func(*BtcLightMirrorV2) bool) (*ChainBatch, error) {
+	if len(mirrors) == 0 {
+		return &ChainBatch{}, nil
+	}
+	if len(mirrors) > MaxChainBatchHeaders {
+		return nil, fmt.Errorf("%w [count %d, max %d]", ErrTooManyHeaders,
+			len(mirrors), MaxChainBatchHeaders)
+	}
+	if needsProof == nil {
+		needsProof = NeedsPowerProof
+	}
+
+	batch := &ChainBatch{
+		PrevBlock: mirrors[0].BtcHeader.PrevBlock,
+		Headers:   make([]wire.BlockHeader, len(mirrors)),
+	}
+	for i, light := range mirrors {
+		if i > 0 {
+			if prev := batch.Headers[i-1].BlockHash(); light.BtcHeader.PrevBlock != prev {
+				return nil, fmt.Errorf("%w: block %d %v does not extend %v",
+					ErrChainBroken, i, light.BtcHeader.BlockHash(), prev)
+			}
+		}
+		batch.Headers[i] = light.BtcHeader
+		if needsProof(light) {
+			batch.Proofs = append(batch.Proofs, ChainProof{
+				Index:       uint32(i),
+				CoinBaseTx:  *stripWitness(&light.CoinBaseTx),
+				MerkleNodes: light.MerkleNodes,
+			})
+		}
+	}
+	return batch, nil
+}
+
+// Tip returns the hash of the last block, or PrevBlock for an empty batch.
+func (batch *ChainBatch) Tip() chainhash.Hash {
+	if len(batch.Headers) == 0 {
+		return batch.PrevBlock
+	}
+	return batch.Headers[len(batch.Headers)-1].BlockHash()
+}
+
+// Mirror returns the mirror of the block proven by proof.
+func (batch *ChainBatch) Mirror(proof *ChainProof) *BtcLightMirrorV2 {
+	return &BtcLightMirrorV2{
+		BtcHeader:   batch.Headers[proof.Index],
+		CoinBaseTx:  proof.CoinBaseTx,
+		MerkleNodes: proof.MerkleNodes,
+	}
+}
+
+// Mirrors returns the mirrors of the proven blocks, in chain order.
+func (batch *ChainBatch) Mirrors() []*BtcLightMirrorV2 {
+	mirrors := make([]*BtcLightMirrorV2, len(batch.Proofs))
+	for i := range batch.Proofs {
+		mirrors[i] = batch.Mirror(&batch.Proofs[i])
+	}
+	return mirrors
+}
+
+// link sets the PrevBlock of every header from the one before it.
+func (batch *ChainBatch) link() {
+	prev := batch.PrevBlock
+	for i := range batch.Headers {
+		batch.Headers[i].PrevBlock = prev
+		prev = batch.Headers[i].BlockHash()
+	}
+}
+
+// ChainBatchResult is the outcome of verifying a ChainBatch.
+type ChainBatchResult struct {
+	// Tip is the hash of the last block.
+	Tip chainhash.Hash
+
+	// Work is the work proven by all headers together.
+	Work *big.Int
+
+	// Proofs holds the result of every coinbase proof, in batch order.
+	Proofs []VerifyResult
+}
+
+// Verify checks that the headers extend parent, unless parent is nil, and
+// each other, that each of them satisfies its proof of work and that every
+// coinbase proof passes the required checks of BtcLightMirrorV2.Verify.  It
+// returns the cumulative work of the batch, which the caller compares with
+// the work of competing chains.  Unlike VerifyBatch it stops at the first
+// failure: a batch is accepted or rejected as a whole.
+func (batch *ChainBatch) Verify(parent *chainhash.Hash, opts *VerifyOptions) (*ChainBatchResult, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	if parent != nil && *parent != batch.PrevBlock {
+		return nil, fmt.Errorf("%w: batch extends %v, not %v", ErrChainBroken,
+			batch.PrevBlock, *parent)
+	}
+	if len(batch.Headers) > MaxChainBatchHeaders {
+		return nil, fmt.Errorf("%w [count %d, max %d]", ErrTooManyHeaders,
+			len(batch.Headers), MaxChainBatchHeaders)
+	}
+
+	res := &ChainBatchResult{Tip: batch.PrevBlock, Work: new(big.Int)}
+	for i := range batch.Headers {
+		header := &batch.Headers[i]
+		if header.PrevBlock != res.Tip {
+			return nil, fmt.Errorf("%w: block %d %v does not extend %v",
+				ErrChainBroken, i, header.BlockHash(), res.Tip)
+		}
+		if err := CheckProofOfWork(header, opts.PowLimit); err != nil {
+			return nil, fmt.Errorf("block %d: %w", i, err)
+		}
+		res.Work.Add(res.Work, blockchain.CalcWork(header.Bits))
+		res.Tip = header.BlockHash()
+	}
+
+	next := 0
+	for i := range batch.Proofs {
+		proof := &batch.Proofs[i]
+		if int(proof.Index) < next || int(proof.Index) >= len(batch.Headers) {
+			return nil, fmt.Errorf("%w: proof %d for block %d", ErrProofIndex,
+				i, proof.Index)
+		}
+		next = int(proof.Index) + 1
+
+		result := verifyMirror(batch.Mirror(proof), opts)
+		if result.Err != nil {
+			return nil, fmt.Errorf("block %d: %w", proof.Index, result.Err)
+		}
+		res.Proofs = append(res.Proofs, result)
+	}
+	return res, nil
+}
+
+// Deserialize decodes a batch from r into the receiver.
+func (batch *ChainBatch) Deserialize(r io.Reader) error {
+	return batch.deserialize(r, nil)
+}
+
+// DeserializeWithOptions decodes b into the receiver, applying the limits of
+// opts to the coinbase proof of every block.  A nil opts decodes like
+// Deserialize, except for the trailing data that Deserialize leaves unread.
+func (batch *ChainBatch) DeserializeWithOptions(b []byte, opts *DecodeOptions) error {
+	r := bytes.NewReader(b)
+	if err := batch.deserialize(r, opts); err != nil {
+		return err
+	}
+	if !opts.strict() {
+		return nil
+	}
+	if err := checkTrailing(r); err != nil {
+		return err
+	}
+	for i := range batch.Proofs {
+		if batch.Proofs[i].CoinBaseTx.HasWitness() {
+			return fmt.Errorf("%w: proof %d", ErrNonCanonical, i)
+		}
+	}
+	return nil
+}
+
+// deserialize decodes a batch from r within the limits of opts.
+func (batch *ChainBatch) deserialize(r io.Reader, opts *DecodeOptions) error {
+	const typ = "ChainBatch"
+
+	_, err := io.ReadFull(r, batch.PrevBlock[:])
+	if err != nil {
+		return &DecodeError{typ, "previous block", err}
+	}
+
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "header count", err}
+	}
+	if count > MaxChainBatchHeaders {
+		return &DecodeError{typ, "header count", fmt.Errorf("%w [count %d, "+
+			"max %d]", ErrTooManyHeaders, count, MaxChainBatchHeaders)}
+	}
+
+	batch.Headers = make([]wire.BlockHeader, count)
+	var buf [chainedHeaderSize]byte
+	for i := range batch.Headers {
+		_, err := io.ReadFull(r, buf[:])
+		if err != nil {
+			return &DecodeError{typ, fmt.Sprintf("header %d", i), err}
+		}
+		header := &batch.Headers[i]
+		header.Version = int32(binary.LittleEndian.Uint32(buf[0:4]))
+		copy(header.MerkleRoot[:], buf[4:36])
+		header.Timestamp = time.Unix(int64(binary.LittleEndian.Uint32(buf[36:40])), 0)
+		header.Bits = binary.LittleEndian.Uint32(buf[40:44])
+		header.Nonce = binary.LittleEndian.Uint32(buf[44:48])
+	}
+	batch.link()
+
+	proofCount, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return &DecodeError{typ, "proof count", err}
+	}
+	if proofCount > count {
+		return &DecodeError{typ, "proof count", fmt.Errorf("%w: %d proofs "+
+			"for %d headers", ErrProofIndex, proofCount, count)}
+	}
+
+	batch.Proofs = make([]ChainProof, proofCount)
+	next := uint64(0)
+	for i := range batch.Proofs {
+		proof := &batch.Proofs[i]
+		field := fmt.Sprintf("proof %d", i)
+
+		index, err := wire.ReadVarInt(r, 0)
+		if err != nil {
+			return &DecodeError{typ, field, err}
+		}
+		if index < next || index >= count {
+			return &DecodeError{typ, field, fmt.Errorf("%w: block %d",
+				ErrProofIndex, index)}
+		}
+		proof.Index, next = uint32(index), index+1
+
+		err = opts.readCoinbase(typ, r, &proof.CoinBaseTx)
+		if err != nil {
+			err.(*DecodeError).Field = field + " coinbase"
+			return err
+		}
+
+		nodes, err := wire.ReadVarInt(r, 0)
+		if err != nil {
+			return &DecodeError{typ, field + " merkle node count", err}
+		}
+		if max := opts.maxMerkleNodes(); nodes > max {
+			return &DecodeError{typ, field + " merkle node count", fmt.Errorf(
+				"%w [count %d, max %d]", ErrTooManyMerkleNodes, nodes, max)}
+		}
+		proof.MerkleNodes = make([]chainhash.Hash, nodes)
+		for j := range proof.MerkleNodes {
+			_, err := io.ReadFull(r, proof.MerkleNodes[j][:])
+			if err != nil {
+				return &DecodeError{typ, fmt.Sprintf("%s merkle node %d", field, j), err}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Serialize encodes the batch to w.
+func (batch *ChainBatch) Serialize(w io.Writer) error {
+	_, err := w.Write(batch.PrevBlock[:])
+	if err != nil {
+		return err
+	}
+
+	err = wire.WriteVarInt(w, 0, uint64(len(batch.Headers)))
+	if err != nil {
+		return err
+	}
+
+	var buf [chainedHeaderSize]byte
+	for i := range batch.Headers {
+		header := &batch.Headers[i]
+		binary.LittleEndian.PutUint32(buf[0:4], uint32(header.Version))
+		copy(buf[4:36], header.MerkleRoot[:])
+		binary.LittleEndian.PutUint32(buf[36:40], uint32(header.Timestamp.Unix()))
+		binary.LittleEndian.PutUint32(buf[40:44], header.Bits)
+		binary.LittleEndian.PutUint32(buf[44:48], header.Nonce)
+		_, err := w.Write(buf[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = wire.WriteVarInt(w, 0, uint64(len(batch.Proofs)))
+	if err != nil {
+		return err
+	}
+
+	for i := range batch.Proofs {
+		proof := &batch.Proofs[i]
+		err := wire.WriteVarInt(w, 0, uint64(proof.Index))
+		if err != nil {
+			return err
+		}
+
+		err = proof.CoinBaseTx.Serialize(w)
+		if err != nil {
+			return err
+		}
+
+		err = wire.WriteVarInt(w, 0, uint64(len(proof.MerkleNodes)))
+		if err != nil {
+			return err
+		}
+
+		for _, node := range proof.MerkleNodes {
+			_, err := w.Write(node[:])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SerializeSize returns the number of bytes Serialize writes.
+func (batch *ChainBatch) SerializeSize() int {
+	n := chainhash.HashSize + wire.VarIntSerializeSize(uint64(len(batch.Headers))) +
+		len(batch.Headers)*chainedHeaderSize +
+		wire.VarIntSerializeSize(uint64(len(batch.Proofs)))
+	for i := range batch.Proofs {
+		proof := &batch.Proofs[i]
+		n += wire.VarIntSerializeSize(uint64(proof.Index)) +
+			proof.CoinBaseTx.SerializeSize() + serializeHashesSize(len(proof.MerkleNodes))
+	}
+	return n
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// chainMirrors returns mirrors of n consecutive regtest blocks.  Every tenth
+// block delegates its hash power.
+func chainMirrors(n int) []*BtcLightMirrorV2 {
+	marker := mustDecodeHex("6a2d434f524501" +
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+		"1111111111111111111111111111111111111111")
+
+	prev := chainhash.Hash{0xee}
+	mirrors := make([]*BtcLightMirrorV2, n)
+	for i := range mirrors {
+		coinbase := validCoinbase()
+		coinbase.TxIn[0].SignatureScript = []byte{0x02, byte(i), byte(i >> 8)}
+		if i%10 == 0 {
+			coinbase.AddTxOut(wire.NewTxOut(0, marker))
+		}
+
+		light := testMirrorV2(coinbase, 1+i%7)
+		light.BtcHeader.PrevBlock = prev
+		mineHeader(&light.BtcHeader)
+		prev = light.BtcHeader.BlockHash()
+		mirrors[i] = light
+	}
+	return mirrors
+}
+
+func TestChainBatch(t *testing.T) {
+	const n = 50
+	mirrors := chainMirrors(n)
+	opts := &VerifyOptions{PowLimit: chaincfg.RegressionNetParams.PowLimit}
+
+	batch, err := NewChainBatch(mirrors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Proofs) != n/10 {
+		t.Fatalf("%d proofs, want %d", len(batch.Proofs), n/10)
+	}
+
+	var buf bytes.Buffer
+	if err := batch.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != batch.SerializeSize() {
+		t.Errorf("SerializeSize %d, wrote %d bytes", batch.SerializeSize(), buf.Len())
+	}
+	raw := buf.Bytes()
+
+	var decoded ChainBatch
+	if err := decoded.Deserialize(bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, batch) {
+		t.Fatalf("decoded %v, want %v", &decoded, batch)
+	}
+
+	parent := mirrors[0].BtcHeader.PrevBlock
+	res, err := decoded.Verify(&parent, opts)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if want := mirrors[n-1].BtcHeader.BlockHash(); res.Tip != want || decoded.Tip() != want {
+		t.Errorf("tip %v, want %v", res.Tip, want)
+	}
+	work := new(big.Int).Mul(blockchain.CalcWork(mirrors[0].BtcHeader.Bits), big.NewInt(n))
+	if res.Work.Cmp(work) != 0 {
+		t.Errorf("work %v, want %v", res.Work, work)
+	}
+	for i, proof := range res.Proofs {
+		if proof.Hash != mirrors[i*10].BtcHeader.BlockHash() || !proof.Delegated() {
+			t.Errorf("proof %d: %+v", i, proof)
+		}
+	}
+	if !reflect.DeepEqual(decoded.Mirrors()[1], mirrors[10]) {
+		t.Errorf("Mirrors()[1] = %v, want %v", decoded.Mirrors()[1], mirrors[10])
+	}
+
+	// The batch replaces n mirrors.
+	var separate []byte
+	for _, light := range mirrors {
+		separate = append(separate, serializeMirrorV2(t, light)...)
+	}
+	t.Logf("%d blocks: %d bytes, %d gas as mirrors, %d bytes, %d gas batched",
+		n, len(separate), calldataGas(separate), len(raw), calldataGas(raw))
+	if calldataGas(raw)*2 > calldataGas(separate) {
+		t.Errorf("batch costs %d gas, mirrors %d", calldataGas(raw), calldataGas(separate))
+	}
+
+	// needsProof selects the proven blocks.
+	all, err := NewChainBatch(mirrors, func(*BtcLightMirrorV2) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = all.Verify(nil, opts)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(res.Proofs) != n {
+		t.Errorf("%d proofs, want %d", len(res.Proofs), n)
+	}
+}
+
+func TestChainBatchInvalid(t *testing.T) {
+	mirrors := chainMirrors(12)
+	opts := &VerifyOptions{PowLimit: chaincfg.RegressionNetParams.PowLimit}
+
+	gap := append(append([]*BtcLightMirrorV2{}, mirrors[:3]...), mirrors[4:]...)
+	if _, err := NewChainBatch(gap, nil); !errors.Is(err, ErrChainBroken) {
+		t.Errorf("gap: got %v, want %v", err, ErrChainBroken)
+	}
+
+	batch, err := NewChainBatch(mirrors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := chainhash.Hash{1}
+	if _, err := batch.Verify(&other, opts); !errors.Is(err, ErrChainBroken) {
+		t.Errorf("wrong parent: got %v, want %v", err, ErrChainBroken)
+	}
+	if _, err := batch.Verify(nil, nil); !errors.Is(err, ErrTargetOutOfRange) {
+		t.Errorf("main network: got %v, want %v", err, ErrTargetOutOfRange)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(batch *ChainBatch)
+		want   error
+	}{
+		{"unlinked", func(batch *ChainBatch) {
+			batch.Headers[5].PrevBlock = chainhash.Hash{}
+		}, ErrChainBroken},
+		{"unmined", func(batch *ChainBatch) {
+			// Replacing the last header keeps the chain linked.
+			batch.Headers[11].Bits = 0x1d00ffff
+		}, ErrHighHash},
+		{"proof index", func(batch *ChainBatch) {
+			batch.Proofs[1].Index = 0
+		}, ErrProofIndex},
+		{"merkle", func(batch *ChainBatch) {
+			batch.Proofs[1].MerkleNodes[0][0] ^= 1
+		}, ErrMerkleMismatch},
+	}
+	for _, test := range tests {
+		batch, err := NewChainBatch(chainMirrors(12), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.modify(batch)
+		if _, err := batch.Verify(nil, opts); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// Proofs out of order do not decode.
+	batch.Proofs[0], batch.Proofs[1] = batch.Proofs[1], batch.Proofs[0]
+	var buf bytes.Buffer
+	if err := batch.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	err = new(ChainBatch).Deserialize(&buf)
+	if !errors.Is(err, ErrProofIndex) || !errors.Is(err, ErrMalformedMirror) {
+		t.Errorf("unordered proofs: got %v, want %v", err, ErrProofIndex)
+	}
+}
+
+func TestChainBatchDecodeOptions(t *testing.T) {
+	batch, err := NewChainBatch(chainMirrors(30), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := batch.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := append([]byte(nil), buf.Bytes()...)
+
+	var decoded ChainBatch
+	if err := decoded.DeserializeWithOptions(raw, StrictDecodeOptions()); err != nil {
+		t.Fatalf("strict: %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, batch) {
+		t.Fatalf("decoded %v, want %v", &decoded, batch)
+	}
+
+	// A witness makes the coinbase of the second proof non-canonical.
+	witness := *batch
+	witness.Proofs = append([]ChainProof(nil), batch.Proofs...)
+	witness.Proofs[1].CoinBaseTx = *batch.Proofs[1].CoinBaseTx.Copy()
+	witness.Proofs[1].CoinBaseTx.TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	buf.Reset()
+	if err := witness.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	withWitness := buf.Bytes()
+
+	tests := []struct {
+		name string
+		raw  []byte
+		opts *DecodeOptions
+		want error
+	}{
+		{"coinbase size", raw, &DecodeOptions{MaxCoinbaseSize: 20}, ErrCoinbaseTooLarge},
+		{"merkle depth", raw, &DecodeOptions{MaxMerkleDepth: 1}, ErrTooManyMerkleNodes},
+		{"reject witness", withWitness, &DecodeOptions{RejectWitness: true}, ErrUnexpectedWitness},
+		{"strict witness", withWitness, StrictDecodeOptions(), ErrNonCanonical},
+		{"trailing", append(raw[:len(raw):len(raw)], 0), StrictDecodeOptions(), ErrTrailingData},
+	}
+	for _, test := range tests {
+		err := new(ChainBatch).DeserializeWithOptions(test.raw, test.opts)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+		if err := new(ChainBatch).DeserializeWithOptions(test.raw, nil); err != nil {
+			t.Errorf("%s: default options: %v", test.name, err)
+		}
+	}
+}
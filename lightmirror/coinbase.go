@@ -0,0 +1,120 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// CoinbaseRule identifies one of the structural rules a coinbase transaction
+// has to satisfy.
+type CoinbaseRule int
+
+const (
+	// CoinbaseInputCount requires exactly one input.
+	CoinbaseInputCount CoinbaseRule = iota
+
+	// CoinbaseNullPrevOut requires the input to spend the null outpoint:
+	// a zero hash and index 0xffffffff.
+	CoinbaseNullPrevOut
+
+	// CoinbaseScriptLength requires a signature script of between 2 and
+	// 100 bytes.
+	CoinbaseScriptLength
+
+	// CoinbaseNoOutputs requires at least one output.
+	CoinbaseNoOutputs
+)
+
+// String returns a short name for the rule.
+func (r CoinbaseRule) String() string {
+	switch r {
+	case CoinbaseInputCount:
+		return "input count"
+	case CoinbaseNullPrevOut:
+		return "null previous outpoint"
+	case CoinbaseScriptLength:
+		return "signature script length"
+	case CoinbaseNoOutputs:
+		return "no outputs"
+	}
+	return fmt.Sprintf("CoinbaseRule(%d)", int(r))
+}
+
+// CoinbaseError describes a violated coinbase rule.  The exported
+// ErrCoinbase* values carry no description and match any CoinbaseError of
+// the same rule with errors.Is.
+type CoinbaseError struct {
+	Rule        CoinbaseRule
+	Description string
+}
+
+// Error satisfies the error interface.
+func (e CoinbaseError) Error() string {
+	if e.Description == "" {
+		return "invalid coinbase: " + e.Rule.String()
+	}
+	return "invalid coinbase: " + e.Description
+}
+
+// Is reports whether target is a CoinbaseError for the same rule.
+func (e CoinbaseError) Is(target error) bool {
+	t, ok := target.(CoinbaseError)
+	return ok && t.Rule == e.Rule
+}
+
+// zeroHash is the hash of the null outpoint spent by a coinbase.
+var zeroHash chainhash.Hash
+
+// Sentinel errors for use with errors.Is, one per coinbase rule.
+var (
+	ErrCoinbaseInputCount   = CoinbaseError{Rule: CoinbaseInputCount}
+	ErrCoinbaseNullPrevOut  = CoinbaseError{Rule: CoinbaseNullPrevOut}
+	ErrCoinbaseScriptLength = CoinbaseError{Rule: CoinbaseScriptLength}
+	ErrCoinbaseNoOutputs    = CoinbaseError{Rule: CoinbaseNoOutputs}
+)
+
+// CheckCoinbase checks that tx is structurally a coinbase transaction: it has
+// a single input spending the null outpoint, a signature script of
+// blockchain.MinCoinbaseScriptLen to blockchain.MaxCoinbaseScriptLen bytes
+// and at least one output.
+func CheckCoinbase(tx *wire.MsgTx) error {
+	if len(tx.TxIn) != 1 {
+		return CoinbaseError{CoinbaseInputCount, fmt.Sprintf(
+			"coinbase has %d inputs, want 1", len(tx.TxIn))}
+	}
+
+	prevOut := &tx.TxIn[0].PreviousOutPoint
+	if prevOut.Index != wire.MaxPrevOutIndex || prevOut.Hash != zeroHash {
+		return CoinbaseError{CoinbaseNullPrevOut, fmt.Sprintf(
+			"coinbase input spends %v instead of the null outpoint", prevOut)}
+	}
+
+	slen := len(tx.TxIn[0].SignatureScript)
+	if slen < blockchain.MinCoinbaseScriptLen || slen > blockchain.MaxCoinbaseScriptLen {
+		return CoinbaseError{CoinbaseScriptLength, fmt.Sprintf(
+			"coinbase signature script is %d bytes, want %d to %d", slen,
+			blockchain.MinCoinbaseScriptLen, blockchain.MaxCoinbaseScriptLen)}
+	}
+
+	if len(tx.TxOut) == 0 {
+		return CoinbaseError{CoinbaseNoOutputs, "coinbase has no outputs"}
+	}
+	return nil
+}
+
+// CheckCoinbase checks that CoinBaseTx is structurally a coinbase.
+func (light *BtcLightMirror) CheckCoinbase() error {
+	return CheckCoinbase(&light.CoinBaseTx)
+}
+
+// CheckCoinbase checks that CoinBaseTx is structurally a coinbase.
+func (light *BtcLightMirrorV2) CheckCoinbase() error {
+	return CheckCoinbase(&light.CoinBaseTx)
+}
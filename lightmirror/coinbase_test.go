@@ -0,0 +1,82 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func validCoinbase() *wire.MsgTx {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{0x03, 0x01, 0x02, 0x03},
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	tx.AddTxOut(wire.NewTxOut(50e8, []byte{0x51}))
+	return tx
+}
+
+func TestCheckCoinbase(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(tx *wire.MsgTx)
+		err    error
+	}{
+		{"valid", func(tx *wire.MsgTx) {}, nil},
+		{"no inputs", func(tx *wire.MsgTx) { tx.TxIn = nil }, ErrCoinbaseInputCount},
+		{"two inputs", func(tx *wire.MsgTx) { tx.AddTxIn(tx.TxIn[0]) }, ErrCoinbaseInputCount},
+		{"prevout hash", func(tx *wire.MsgTx) {
+			tx.TxIn[0].PreviousOutPoint.Hash = chainhash.Hash{1}
+		}, ErrCoinbaseNullPrevOut},
+		{"prevout index", func(tx *wire.MsgTx) {
+			tx.TxIn[0].PreviousOutPoint.Index = 0
+		}, ErrCoinbaseNullPrevOut},
+		{"script too short", func(tx *wire.MsgTx) {
+			tx.TxIn[0].SignatureScript = []byte{0x00}
+		}, ErrCoinbaseScriptLength},
+		{"script minimum", func(tx *wire.MsgTx) {
+			tx.TxIn[0].SignatureScript = []byte{0x01, 0x00}
+		}, nil},
+		{"script maximum", func(tx *wire.MsgTx) {
+			tx.TxIn[0].SignatureScript = bytes.Repeat([]byte{0x00}, 100)
+		}, nil},
+		{"script too long", func(tx *wire.MsgTx) {
+			tx.TxIn[0].SignatureScript = bytes.Repeat([]byte{0x00}, 101)
+		}, ErrCoinbaseScriptLength},
+		{"no outputs", func(tx *wire.MsgTx) { tx.TxOut = nil }, ErrCoinbaseNoOutputs},
+	}
+
+	for _, test := range tests {
+		tx := validCoinbase()
+		test.mutate(tx)
+
+		err := CheckCoinbase(tx)
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+
+		var cbErr CoinbaseError
+		if !errors.As(err, &cbErr) || cbErr.Description == "" {
+			t.Errorf("%s: %v is not a described CoinbaseError", test.name, err)
+		}
+
+		// The rule is enforced on the merkle verification path.
+		light := &BtcLightMirrorV2{CoinBaseTx: *tx}
+		light.BtcHeader.MerkleRoot = tx.TxHash()
+		if err := light.CheckMerkle(); !errors.Is(err, test.err) {
+			t.Errorf("%s: CheckMerkle got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ErrUnexpectedWitness is returned when a coinbase carries witness data and
+// DecodeOptions.RejectWitness is set.
+var ErrUnexpectedWitness = errors.New("coinbase carries witness data")
+
+// DecodeOptions bounds what the DeserializeWithOptions decoders accept.  Nodes
+// and relayers use them to reject oversized inputs before allocating for them.
+// The limits can only tighten the hard limits enforced by Deserialize: zero or
+// a larger value leaves the hard limit in place, so the zero value decodes
+// like Deserialize.
+type DecodeOptions struct {
+	// MaxCoinbaseSize is the largest coinbase accepted, in bytes as they
+	// are encoded in the mirror.  For BtcLightMirrorV3 it bounds the
+	// compressed prefix plus the tail.
+	MaxCoinbaseSize int
+
+	// MaxMerkleDepth is the longest merkle branch accepted by
+	// BtcLightMirrorV2, BtcLightMirrorV3 and the proofs of a ChainBatch.
+	MaxMerkleDepth int
+
+	// MaxTxHashes is the largest number of transaction hashes accepted by
+	// BtcLightMirror.
+	MaxTxHashes int
+
+	// RejectWitness rejects coinbase transactions carrying witness data.
+	RejectWitness bool
+
+	// Strict additionally rejects data after the mirror and encodings
+	// other than the canonical one, as DeserializeStrict does.  Witness
+	// data is never canonical: it fails with ErrUnexpectedWitness when
+	// rejected and with ErrNonCanonical otherwise.
+	Strict bool
+}
+
+// DefaultDecodeOptions returns the options Deserialize decodes with.
+func DefaultDecodeOptions() *DecodeOptions {
+	return &DecodeOptions{}
+}
+
+// StrictDecodeOptions returns the options DeserializeStrict decodes with.
+// Witness data is not rejected, only to report it as ErrNonCanonical.
+func StrictDecodeOptions() *DecodeOptions {
+	return &DecodeOptions{
+		MaxCoinbaseSize: MaxStrictCoinbaseSize,
+		Strict:          true,
+	}
+}
+
+// DeserializeWithOptions decodes b into the receiver within the limits of
+// opts.  A nil opts decodes like Deserialize, except for the trailing data
+// that Deserialize leaves unread.
+func (light *BtcLightMirror) DeserializeWithOptions(b []byte, opts *DecodeOptions) error {
+	r := bytes.NewReader(b)
+	if err := light.deserialize(r, opts); err != nil {
+		return err
+	}
+	if !opts.strict() {
+		return nil
+	}
+	if err := checkTrailing(r); err != nil {
+		return err
+	}
+
+	canonical, err := light.CanonicalBytes()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(canonical, b) {
+		return ErrNonCanonical
+	}
+	return nil
+}
+
+// DeserializeWithOptions decodes b into the receiver within the limits of
+// opts.  A nil opts decodes like Deserialize, except for the trailing data
+// that Deserialize leaves unread.
+func (light *BtcLightMirrorV2) DeserializeWithOptions(b []byte, opts *DecodeOptions) error {
+	r := bytes.NewReader(b)
+	if err := light.deserialize(r, opts); err != nil {
+		return err
+	}
+	if !opts.strict() {
+		return nil
+	}
+	if err := checkTrailing(r); err != nil {
+		return err
+	}
+
+	canonical, err := light.CanonicalBytes()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(canonical, b) {
+		return ErrNonCanonical
+	}
+	return nil
+}
+
+// DeserializeWithOptions decodes b into the receiver within the limits of
+// opts.  A nil opts decodes like Deserialize, except for the trailing data
+// that Deserialize leaves unread.  BtcLightMirrorV3 never carries witness
+// data, and its encoding is canonical as long as its varints are minimal,
+// which wire.ReadVarInt enforces.
+func (light *BtcLightMirrorV3) DeserializeWithOptions(b []byte, opts *DecodeOptions) error {
+	r := bytes.NewReader(b)
+	if err := light.deserialize(r, opts); err != nil {
+		return err
+	}
+	if !opts.strict() {
+		return nil
+	}
+	return checkTrailing(r)
+}
+
+// checkTrailing rejects bytes left in r after a mirror.
+func checkTrailing(r *bytes.Reader) error {
+	if r.Len() != 0 {
+		return fmt.Errorf("%w: %d bytes", ErrTrailingData, r.Len())
+	}
+	return nil
+}
+
+func (opts *DecodeOptions) strict() bool {
+	return opts != nil && opts.Strict
+}
+
+// limit returns the tighter of the hard limit and the option value.
+func limit(hard uint64, option int) uint64 {
+	if option > 0 && uint64(option) < hard {
+		return uint64(option)
+	}
+	return hard
+}
+
+// maxTxHashes returns the transaction hash limit of opts.
+func (opts *DecodeOptions) maxTxHashes() uint64 {
+	if opts == nil {
+		return maxTxPerBlock
+	}
+	return limit(maxTxPerBlock, opts.MaxTxHashes)
+}
+
+// maxMerkleNodes returns the merkle branch length limit of opts.
+func (opts *DecodeOptions) maxMerkleNodes() uint64 {
+	if opts == nil {
+		return maxMerkleNode
+	}
+	return limit(maxMerkleNode, opts.MaxMerkleDepth)
+}
+
+// maxCoinbaseSize returns the coinbase size limit of opts.
+func (opts *DecodeOptions) maxCoinbaseSize() uint64 {
+	if opts == nil {
+		return wire.MaxBlockPayload
+	}
+	return limit(wire.MaxBlockPayload, opts.MaxCoinbaseSize)
+}
+
+// readCoinbase decodes the coinbase of a mirror of type typ from r into tx.
+// It stops reading once the coinbase exceeds the size limit of opts, so an
+// oversized coinbase is never buffered in full.
+func (opts *DecodeOptions) readCoinbase(typ string, r io.Reader, tx *wire.MsgTx) error {
+	max := opts.maxCoinbaseSize()
+	limited := &io.LimitedReader{R: r, N: int64(max)}
+	err := tx.Deserialize(limited)
+	if err != nil {
+		if limited.N == 0 {
+			err = fmt.Errorf("%w: more than %d bytes", ErrCoinbaseTooLarge, max)
+		}
+		return &DecodeError{typ, "coinbase", err}
+	}
+	if opts != nil && opts.RejectWitness && tx.HasWitness() {
+		return &DecodeError{typ, "coinbase", ErrUnexpectedWitness}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestDeserializeWithOptions(t *testing.T) {
+	plain := testMirrorV2(validCoinbase(), 40)
+	witness := testMirrorV2(witnessCoinbase(), 40)
+	v3, err := NewBtcLightMirrorV3(largeCoinbaseMirror(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := &BtcLightMirror{BtcHeader: plain.BtcHeader, CoinBaseTx: plain.CoinBaseTx,
+		TxHashes: make([]chainhash.Hash, 40)}
+
+	serialize := func(light mirror) []byte {
+		var buf bytes.Buffer
+		if err := light.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	plainRaw, witnessRaw := serialize(plain), serialize(witness)
+	v1Raw, v3Raw := serialize(v1), serialize(v3)
+	coinbaseSize := plain.CoinBaseTx.SerializeSize()
+	v3CoinbaseSize := int(v3.CoinbasePrefixLen) + len(v3.CoinbaseTail)
+
+	tests := []struct {
+		name string
+		raw  []byte
+		into func(b []byte, opts *DecodeOptions) error
+		opts *DecodeOptions
+		want error
+	}{
+		{"v2 nil", plainRaw, new(BtcLightMirrorV2).DeserializeWithOptions, nil, nil},
+		{"v2 trailing", append(plainRaw[:len(plainRaw):len(plainRaw)], 0),
+			new(BtcLightMirrorV2).DeserializeWithOptions, DefaultDecodeOptions(), nil},
+		{"v2 strict trailing", append(plainRaw[:len(plainRaw):len(plainRaw)], 0),
+			new(BtcLightMirrorV2).DeserializeWithOptions, StrictDecodeOptions(), ErrTrailingData},
+		{"v2 depth", plainRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			&DecodeOptions{MaxMerkleDepth: len(plain.MerkleNodes)}, nil},
+		{"v2 shallow", plainRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			&DecodeOptions{MaxMerkleDepth: len(plain.MerkleNodes) - 1}, ErrTooManyMerkleNodes},
+		{"v2 depth above hard limit", plainRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			&DecodeOptions{MaxMerkleDepth: 1 << 30}, nil},
+		{"v2 coinbase", plainRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			&DecodeOptions{MaxCoinbaseSize: coinbaseSize}, nil},
+		{"v2 coinbase too large", plainRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			&DecodeOptions{MaxCoinbaseSize: coinbaseSize - 1}, ErrCoinbaseTooLarge},
+		{"v2 witness", witnessRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			&DecodeOptions{}, nil},
+		{"v2 no witness", witnessRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			&DecodeOptions{RejectWitness: true}, ErrUnexpectedWitness},
+		{"v2 strict witness", witnessRaw, new(BtcLightMirrorV2).DeserializeWithOptions,
+			StrictDecodeOptions(), ErrNonCanonical},
+		{"v1 hashes", v1Raw, new(BtcLightMirror).DeserializeWithOptions,
+			&DecodeOptions{MaxTxHashes: 40}, nil},
+		{"v1 too many hashes", v1Raw, new(BtcLightMirror).DeserializeWithOptions,
+			&DecodeOptions{MaxTxHashes: 39}, ErrTooManyTxHashes},
+		{"v1 coinbase too large", v1Raw, new(BtcLightMirror).DeserializeWithOptions,
+			&DecodeOptions{MaxCoinbaseSize: 10}, ErrCoinbaseTooLarge},
+		{"v3 coinbase", v3Raw, new(BtcLightMirrorV3).DeserializeWithOptions,
+			&DecodeOptions{MaxCoinbaseSize: v3CoinbaseSize, Strict: true}, nil},
+		{"v3 tail too large", v3Raw, new(BtcLightMirrorV3).DeserializeWithOptions,
+			&DecodeOptions{MaxCoinbaseSize: v3CoinbaseSize - 1}, ErrCoinbaseTooLarge},
+		{"v3 prefix too long", v3Raw, new(BtcLightMirrorV3).DeserializeWithOptions,
+			&DecodeOptions{MaxCoinbaseSize: 64}, ErrCoinbasePrefixTooLong},
+		{"v3 shallow", v3Raw, new(BtcLightMirrorV3).DeserializeWithOptions,
+			&DecodeOptions{MaxMerkleDepth: len(v3.MerkleNodes) - 1}, ErrTooManyMerkleNodes},
+		{"v3 strict trailing", append(v3Raw[:len(v3Raw):len(v3Raw)], 0),
+			new(BtcLightMirrorV3).DeserializeWithOptions, StrictDecodeOptions(), ErrTrailingData},
+	}
+	for _, test := range tests {
+		err := test.into(test.raw, test.opts)
+		switch {
+		case test.want == nil && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != nil && !errors.Is(err, test.want):
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	var got BtcLightMirrorV2
+	if err := got.DeserializeWithOptions(plainRaw, StrictDecodeOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, plain) {
+		t.Errorf("decoded %v, want %v", &got, plain)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Errors returned by this package can be told apart with errors.Is and
+// errors.As:
+//
+//   - every Deserialize failure is a *DecodeError, which matches
+//     ErrMalformedMirror and wraps the underlying cause, such as io.EOF,
+//     io.ErrUnexpectedEOF, ErrTooManyMerkleNodes, ErrTooManyTxHashes or,
+//     under DecodeOptions, ErrCoinbaseTooLarge and ErrUnexpectedWitness;
+//   - the strict decoders add ErrTrailingData and ErrNonCanonical;
+//   - coinbase rule violations are CoinbaseError values matching the
+//     ErrCoinbase* sentinels;
+//   - a wrong merkle proof is a *MerkleMismatchError matching
+//     ErrMerkleMismatch;
+//   - proof of work failures match ErrTargetOutOfRange or ErrHighHash;
+//   - delegation failures match ErrAmbiguousDelegation,
+//     ErrInvalidPowerMarker or ErrUnknownPowerPolicy;
+//   - BtcLightMirrorV3 adds ErrNoPowerMarker, ErrMidstateAlignment,
+//     ErrOutputBoundary and ErrHiddenOutputs.
+
+var (
+	// ErrMalformedMirror matches every *DecodeError.
+	ErrMalformedMirror = errors.New("malformed mirror encoding")
+
+	// ErrTooManyMerkleNodes is returned when a merkle branch is longer
+	// than any block could need.
+	ErrTooManyMerkleNodes = errors.New("too many merkle nodes")
+
+	// ErrTooManyTxHashes is returned when a BtcLightMirror lists more
+	// transactions than could fit into a block.
+	ErrTooManyTxHashes = errors.New("too many transaction hashes")
+
+	// ErrCoinbasePrefixTooLong is returned when the compressed coinbase
+	// prefix of a BtcLightMirrorV3 is longer than a block.
+	ErrCoinbasePrefixTooLong = errors.New("coinbase prefix too long")
+
+	// ErrMerkleMismatch matches every *MerkleMismatchError.
+	ErrMerkleMismatch = errors.New("block merkle root is invalid")
+
+	// ErrUnknownPowerPolicy is returned for an undefined PowerPolicy.
+	ErrUnknownPowerPolicy = errors.New("unknown power policy")
+
+	// ErrUnsupportedPayout is reported by Verify when the first coinbase
+	// output pays to neither a P2PKH nor a P2WPKH script.
+	ErrUnsupportedPayout = errors.New("unsupported payout script")
+)
+
+// DecodeError describes why a mirror could not be decoded.
+type DecodeError struct {
+	// Type is the mirror type and Field the part of the encoding that
+	// could not be read.
+	Type  string
+	Field string
+
+	// Err is the cause.
+	Err error
+}
+
+// Error satisfies the error interface.
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s.Deserialize %s: %v", e.Type, e.Field, e.Err)
+}
+
+// Unwrap returns the cause.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrMalformedMirror.
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrMalformedMirror
+}
+
+// MerkleMismatchError is returned when a merkle proof does not lead to the
+// merkle root of the mirrored header.
+type MerkleMismatchError struct {
+	// Want is the merkle root of the header, Got the calculated one.
+	Want chainhash.Hash
+	Got  chainhash.Hash
+}
+
+// Error satisfies the error interface.
+func (e *MerkleMismatchError) Error() string {
+	return fmt.Sprintf("block merkle root is invalid - block header "+
+		"indicates %v, but calculated value is %v", e.Want, e.Got)
+}
+
+// Is matches ErrMerkleMismatch.
+func (e *MerkleMismatchError) Is(target error) bool {
+	return target == ErrMerkleMismatch
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+type mirror interface {
+	Serialize(w io.Writer) error
+	Deserialize(r io.Reader) error
+	CheckMerkle() error
+}
+
+func TestDecodeErrors(t *testing.T) {
+	v2 := largeCoinbaseMirror(3)
+	v3, err := NewBtcLightMirrorV3(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := &BtcLightMirror{BtcHeader: v2.BtcHeader, CoinBaseTx: v2.CoinBaseTx,
+		TxHashes: []chainhash.Hash{{1}, {2}}}
+
+	tests := []struct {
+		name  string
+		in    mirror
+		empty func() mirror
+	}{
+		{"v1", v1, func() mirror { return new(BtcLightMirror) }},
+		{"v2", v2, func() mirror { return new(BtcLightMirrorV2) }},
+		{"v3", v3, func() mirror { return new(BtcLightMirrorV3) }},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := test.in.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		raw := buf.Bytes()
+
+		for _, n := range []int{0, 40, 80, 100, 140, len(raw) - 33, len(raw) - 1} {
+			err := test.empty().Deserialize(bytes.NewReader(raw[:n]))
+			var decodeErr *DecodeError
+			if !errors.Is(err, ErrMalformedMirror) || !errors.As(err, &decodeErr) {
+				t.Errorf("%s cut at %d: got %v, want a DecodeError", test.name, n, err)
+				continue
+			}
+			if decodeErr.Field == "" ||
+				!(errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+				t.Errorf("%s cut at %d: %v does not name the field and cause", test.name, n, err)
+			}
+		}
+
+		// The node or transaction count is the byte right before the
+		// trailing hashes.  A count above any block is rejected.
+		count := len(raw) - 32*2 - 1
+		if test.name == "v2" || test.name == "v3" {
+			count = len(raw) - 32*len(v2.MerkleNodes) - 1
+		}
+		huge := append(append(append([]byte{}, raw[:count]...), 0xfe, 0xff, 0xff, 0xff, 0x7f), raw[count+1:]...)
+		want := ErrTooManyMerkleNodes
+		if test.name == "v1" {
+			want = ErrTooManyTxHashes
+		}
+		err := test.empty().Deserialize(bytes.NewReader(huge))
+		if !errors.Is(err, want) || !errors.Is(err, ErrMalformedMirror) {
+			t.Errorf("%s huge count: got %v, want %v", test.name, err, want)
+		}
+	}
+
+	prefix := *v3
+	prefix.CoinbasePrefixLen = wire.MaxBlockPayload + sha256BlockSize
+	var buf bytes.Buffer
+	if err := prefix.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(BtcLightMirrorV3).Deserialize(&buf); !errors.Is(err, ErrCoinbasePrefixTooLong) {
+		t.Errorf("long prefix: got %v, want %v", err, ErrCoinbasePrefixTooLong)
+	}
+}
+
+func TestMerkleMismatchError(t *testing.T) {
+	v2 := largeCoinbaseMirror(3)
+	v3, err := NewBtcLightMirrorV3(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := &BtcLightMirror{BtcHeader: v2.BtcHeader, CoinBaseTx: v2.CoinBaseTx}
+
+	for _, light := range []mirror{v1, v2, v3} {
+		err := light.CheckMerkle()
+		if light == mirror(v1) {
+			// The v1 mirror lacks the other transactions.
+			var mismatch *MerkleMismatchError
+			if !errors.As(err, &mismatch) || mismatch.Want != v2.BtcHeader.MerkleRoot ||
+				mismatch.Got != v2.CoinBaseTx.TxHash() {
+				t.Errorf("v1: got %v, want a merkle mismatch", err)
+			}
+			if !errors.Is(err, ErrMerkleMismatch) {
+				t.Errorf("v1: %v does not match %v", err, ErrMerkleMismatch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("CheckMerkle: %v", err)
+		}
+	}
+
+	root := v2.BtcHeader.MerkleRoot
+	v2.BtcHeader.MerkleRoot = chainhash.Hash{1}
+	v3.BtcHeader.MerkleRoot = chainhash.Hash{1}
+	for _, light := range []mirror{v2, v3} {
+		var mismatch *MerkleMismatchError
+		err := light.CheckMerkle()
+		if !errors.As(err, &mismatch) || mismatch.Want != (chainhash.Hash{1}) ||
+			mismatch.Got != root {
+			t.Errorf("got %v, want a merkle mismatch", err)
+		}
+	}
+
+	if _, err := ValidatePowerMarkers(validCoinbase(), PowerPolicy(7)); !errors.Is(err, ErrUnknownPowerPolicy) {
+		t.Errorf("unknown policy: got %v, want %v", err, ErrUnknownPowerPolicy)
+	}
+}
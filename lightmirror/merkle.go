@@ -0,0 +1,151 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// parallelMerkleThreshold is the number of leaves from which the in-place
+// merkle calculations split the tree across goroutines.  Below it, hashing is
+// cheaper than handing work to other goroutines.
+const parallelMerkleThreshold = 1 << 12
+
+// MerkleRootInPlace returns the merkle root of the tree whose leaves are
+// hashes.  Unlike BuildMerkleTreeStore it computes the tree in place, using
+// hashes as scratch space, so their content is lost.  Trees below a few
+// thousand leaves are computed without allocating, larger ones are split
+// across GOMAXPROCS goroutines.  The root of an empty tree is the zero hash.
+func MerkleRootInPlace(hashes []chainhash.Hash) chainhash.Hash {
+	root, _ := merkleInPlace(hashes, -1, nil, runtime.GOMAXPROCS(0))
+	return root
+}
+
+// MerkleBranchInPlace is like MerkleRootInPlace and also appends the merkle
+// branch of the leaf at index to branch.  The branch lists the sibling of the
+// leaf and of each of its ancestors below the root, as MerkleNodes does for
+// the coinbase.  Nothing is appended when index is out of range.
+func MerkleBranchInPlace(hashes []chainhash.Hash, index int, branch []chainhash.Hash) (chainhash.Hash, []chainhash.Hash) {
+	if index < 0 || index >= len(hashes) {
+		index = -1
+	}
+	return merkleInPlace(hashes, index, branch, runtime.GOMAXPROCS(0))
+}
+
+// MerkleBranchRoot returns the merkle root committed to by the leaf at index
+// with the merkle branch branch.
+func MerkleBranchRoot(leaf chainhash.Hash, index int, branch []chainhash.Hash) chainhash.Hash {
+	for i := range branch {
+		if index&1 == 0 {
+			leaf = hashMerkleBranches(&leaf, &branch[i])
+		} else {
+			leaf = hashMerkleBranches(&branch[i], &leaf)
+		}
+		index >>= 1
+	}
+	return leaf
+}
+
+// merkleInPlace computes the root of hashes and appends the branch of index
+// to branch unless index is negative.  Large trees are cut into subtrees of
+// equal, power of two size, one per worker, which are hashed concurrently
+// before hashing the top of the tree.
+func merkleInPlace(hashes []chainhash.Hash, index int, branch []chainhash.Hash, workers int) (chainhash.Hash, []chainhash.Hash) {
+	n := len(hashes)
+	if n == 0 {
+		return chainhash.Hash{}, branch
+	}
+	depth := bits.Len(uint(n - 1))
+
+	if workers > 1 && n >= parallelMerkleThreshold {
+		levels := bits.Len(uint((n - 1) / workers))
+		branch = reduceSubtrees(hashes, levels, index, branch)
+		hashes = hashes[:(n+(1<<levels)-1)>>levels]
+		depth -= levels
+		if index >= 0 {
+			index >>= levels
+		}
+	}
+
+	branch = reduceMerkle(hashes, depth, index, branch)
+	return hashes[0], branch
+}
+
+// reduceSubtrees cuts hashes into subtrees of the given number of levels and
+// reduces them concurrently, moving their roots to the start of hashes.  Every
+// subtree but the last is full.  The last one keeps duplicating its last node
+// up to the height of the others, exactly as it happens in the whole tree.
+func reduceSubtrees(hashes []chainhash.Hash, levels, index int, branch []chainhash.Hash) []chainhash.Hash {
+	n := len(hashes)
+	size := 1 << levels
+	subtrees := (n + size - 1) / size
+
+	var wg sync.WaitGroup
+	wg.Add(subtrees)
+	for i := 0; i < subtrees; i++ {
+		lo, hi := i*size, (i+1)*size
+		if hi > n {
+			hi = n
+		}
+		if index >= lo && index < hi {
+			go func() {
+				defer wg.Done()
+				branch = reduceMerkle(hashes[lo:hi], levels, index-lo, branch)
+			}()
+			continue
+		}
+		go func() {
+			defer wg.Done()
+			reduceMerkle(hashes[lo:hi], levels, -1, nil)
+		}()
+	}
+	wg.Wait()
+
+	for i := 1; i < subtrees; i++ {
+		hashes[i] = hashes[i*size]
+	}
+	return branch
+}
+
+// reduceMerkle hashes the tree levels above the nodes in level the given
+// number of times, leaving the result at the start of level.  An odd last
+// node is paired with itself.  When index is not negative, the sibling of
+// the node at index and of its ancestors are appended to branch.
+func reduceMerkle(level []chainhash.Hash, levels, index int, branch []chainhash.Hash) []chainhash.Hash {
+	n := len(level)
+	for ; levels > 0; levels-- {
+		if index >= 0 {
+			sibling := index ^ 1
+			if sibling >= n {
+				sibling = index
+			}
+			branch = append(branch, level[sibling])
+			index >>= 1
+		}
+
+		for i := 0; i < n; i += 2 {
+			right := i + 1
+			if right == n {
+				right = i
+			}
+			level[i/2] = hashMerkleBranches(&level[i], &level[right])
+		}
+		n = (n + 1) / 2
+	}
+	return branch
+}
+
+// hashMerkleBranches is blockchain.HashMerkleBranches without allocating the
+// result.
+func hashMerkleBranches(left, right *chainhash.Hash) chainhash.Hash {
+	var hash [chainhash.HashSize * 2]byte
+	copy(hash[:chainhash.HashSize], left[:])
+	copy(hash[chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(hash[:])
+}
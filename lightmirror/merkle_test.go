@@ -0,0 +1,115 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func testLeaves(n int) []chainhash.Hash {
+	leaves := make([]chainhash.Hash, n)
+	for i := range leaves {
+		leaves[i] = chainhash.DoubleHashH([]byte(fmt.Sprint(i)))
+	}
+	return leaves
+}
+
+func TestMerkleInPlace(t *testing.T) {
+	sizes := []int{1, 2, 3, 4, 5, 7, 8, 9, 31, 33, 100, 255, 257,
+		parallelMerkleThreshold - 1, parallelMerkleThreshold,
+		parallelMerkleThreshold + 1, 3*parallelMerkleThreshold + 5}
+
+	for _, n := range sizes {
+		leaves := testLeaves(n)
+		merkles := BuildMerkleTreeStore(&leaves[0], leaves[1:])
+		want := *merkles[len(merkles)-1]
+
+		for _, workers := range []int{1, 3, 4, 16} {
+			for _, index := range []int{0, 1, n / 2, n - 1} {
+				if index >= n {
+					continue
+				}
+				scratch := append([]chainhash.Hash(nil), leaves...)
+				root, branch := merkleInPlace(scratch, index, nil, workers)
+				if root != want {
+					t.Fatalf("%d leaves, %d workers: root %v, want %v", n, workers, root, want)
+				}
+				if len(branch) != getExponent(n) {
+					t.Fatalf("%d leaves, %d workers: branch of %d nodes, want %d",
+						n, workers, len(branch), getExponent(n))
+				}
+				if got := MerkleBranchRoot(leaves[index], index, branch); got != want {
+					t.Fatalf("%d leaves, %d workers: branch of leaf %d leads to %v, want %v",
+						n, workers, index, got, want)
+				}
+			}
+		}
+
+		scratch := append([]chainhash.Hash(nil), leaves...)
+		if root := MerkleRootInPlace(scratch); root != want {
+			t.Fatalf("%d leaves: MerkleRootInPlace %v, want %v", n, root, want)
+		}
+		scratch = append(scratch[:0], leaves...)
+		if _, branch := MerkleBranchInPlace(scratch, n, nil); branch != nil {
+			t.Fatalf("%d leaves: branch for index out of range", n)
+		}
+	}
+
+	if root := MerkleRootInPlace(nil); root != (chainhash.Hash{}) {
+		t.Fatalf("root of empty tree: %v", root)
+	}
+}
+
+func TestMerkleInPlaceAllocs(t *testing.T) {
+	leaves := testLeaves(parallelMerkleThreshold - 1)
+	scratch := make([]chainhash.Hash, len(leaves))
+	branch := make([]chainhash.Hash, 0, getExponent(len(leaves)))
+
+	allocs := testing.AllocsPerRun(10, func() {
+		copy(scratch, leaves)
+		MerkleBranchInPlace(scratch, len(leaves)/3, branch[:0])
+	})
+	if allocs != 0 {
+		t.Fatalf("MerkleBranchInPlace allocated %v times", allocs)
+	}
+}
+
+var benchmarkMerkleSizes = []int{500, 3000, 20000}
+
+func BenchmarkBuildMerkleTreeStore(b *testing.B) {
+	for _, n := range benchmarkMerkleSizes {
+		leaves := testLeaves(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				BuildMerkleTreeStore(&leaves[0], leaves[1:])
+			}
+		})
+	}
+}
+
+func BenchmarkMerkleInPlace(b *testing.B) {
+	for _, n := range benchmarkMerkleSizes {
+		leaves := testLeaves(n)
+		scratch := make([]chainhash.Hash, n)
+		b.Run(fmt.Sprintf("sequential/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				copy(scratch, leaves)
+				merkleInPlace(scratch, -1, nil, 1)
+			}
+		})
+		b.Run(fmt.Sprintf("parallel/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				copy(scratch, leaves)
+				MerkleRootInPlace(scratch)
+			}
+		})
+	}
+}
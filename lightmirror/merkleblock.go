@@ -0,0 +1,249 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrInvalidPartialTree is returned when the partial merkle tree of a
+	// merkle block is malformed or does not lead to the merkle root of its
+	// header.
+	ErrInvalidPartialTree = errors.New("invalid partial merkle tree")
+
+	// ErrCoinbaseNotMatched is returned when building a mirror from a
+	// merkle block which does not match the coinbase.
+	ErrCoinbaseNotMatched = errors.New("merkle block does not match the coinbase")
+)
+
+// TxInclusionProof proves that a transaction is part of a block.
+type TxInclusionProof struct {
+	Header wire.BlockHeader
+
+	TxID chainhash.Hash
+
+	// Index is the position of the transaction in the block and TxCount
+	// the number of transactions of the block.
+	Index   uint32
+	TxCount uint32
+
+	// Branch is the merkle branch of the transaction, as MerkleNodes is
+	// for the coinbase.
+	Branch []chainhash.Hash
+}
+
+// Verify checks that the branch leads from the transaction to the merkle root
+// of the header.
+func (p *TxInclusionProof) Verify() error {
+	if p.TxCount == 0 || p.Index >= p.TxCount {
+		return fmt.Errorf("%w: transaction %d of %d", ErrInvalidPartialTree,
+			p.Index, p.TxCount)
+	}
+	if depth := bits.Len32(p.TxCount - 1); len(p.Branch) != depth {
+		return fmt.Errorf("%w: branch of %d nodes for %d transactions",
+			ErrInvalidPartialTree, len(p.Branch), p.TxCount)
+	}
+
+	root := MerkleBranchRoot(p.TxID, int(p.Index), p.Branch)
+	if root != p.Header.MerkleRoot {
+		return &MerkleMismatchError{Want: p.Header.MerkleRoot, Got: root}
+	}
+	return nil
+}
+
+// ParseTxOutProof decodes the proof returned by the gettxoutproof RPC, the
+// serialization of a merkle block, and validates its partial merkle tree.
+func ParseTxOutProof(proof []byte) (*wire.MsgMerkleBlock, error) {
+	r := bytes.NewReader(proof)
+	var msg wire.MsgMerkleBlock
+	err := msg.BtcDecode(r, wire.ProtocolVersion, wire.BaseEncoding)
+	if err != nil {
+		return nil, &DecodeError{"MsgMerkleBlock", "merkle block", err}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTrailingData, r.Len())
+	}
+	if _, err := ExtractInclusionProofs(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ExtractInclusionProofs validates the partial merkle tree of msg like
+// Bitcoin Core does and returns the inclusion proofs of the matched
+// transactions, in block order.  The tree must use every hash and flag bit,
+// must not pair a node with an identical sibling (CVE-2012-2459) and must
+// lead to the merkle root of the header.
+func ExtractInclusionProofs(msg *wire.MsgMerkleBlock) ([]TxInclusionProof, error) {
+	n := msg.Transactions
+	switch {
+	case n == 0:
+		return nil, fmt.Errorf("%w: no transactions", ErrInvalidPartialTree)
+	case n > maxTxPerBlock:
+		return nil, fmt.Errorf("%w: %d transactions, max %d",
+			ErrInvalidPartialTree, n, maxTxPerBlock)
+	case uint32(len(msg.Hashes)) > n:
+		return nil, fmt.Errorf("%w: %d hashes for %d transactions",
+			ErrInvalidPartialTree, len(msg.Hashes), n)
+	case len(msg.Flags)*8 < len(msg.Hashes):
+		return nil, fmt.Errorf("%w: %d flag bits for %d hashes",
+			ErrInvalidPartialTree, len(msg.Flags)*8, len(msg.Hashes))
+	}
+
+	t := &partialTree{
+		msg:    msg,
+		height: bits.Len32(n - 1),
+		nodes:  make(map[uint64]chainhash.Hash),
+	}
+
+	root, err := t.traverse(t.height, 0)
+	if err != nil {
+		return nil, err
+	}
+	if (t.bitsUsed+7)/8 != len(msg.Flags) {
+		return nil, fmt.Errorf("%w: %d of %d flag bytes used",
+			ErrInvalidPartialTree, (t.bitsUsed+7)/8, len(msg.Flags))
+	}
+	if t.hashesUsed != len(msg.Hashes) {
+		return nil, fmt.Errorf("%w: %d of %d hashes used",
+			ErrInvalidPartialTree, t.hashesUsed, len(msg.Hashes))
+	}
+	if root != msg.Header.MerkleRoot {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPartialTree,
+			&MerkleMismatchError{Want: msg.Header.MerkleRoot, Got: root})
+	}
+
+	proofs := make([]TxInclusionProof, len(t.matches))
+	for i, index := range t.matches {
+		p := &proofs[i]
+		p.Header = msg.Header
+		p.TxID = t.nodes[nodeKey(0, index)]
+		p.Index = index
+		p.TxCount = n
+		p.Branch = make([]chainhash.Hash, t.height)
+		pos := index
+		for h := 0; h < t.height; h++ {
+			sibling := pos ^ 1
+			if sibling >= t.width(h) {
+				sibling = pos
+			}
+			p.Branch[h] = t.nodes[nodeKey(h, sibling)]
+			pos >>= 1
+		}
+	}
+	return proofs, nil
+}
+
+// NewBtcLightMirrorV2FromMerkleBlock returns the mirror of the block of msg,
+// whose partial merkle tree must match coinbase.  Coinbase is the transaction
+// served with the merkle block, so relayers with SPV access only can build
+// mirrors without downloading full blocks.
+func NewBtcLightMirrorV2FromMerkleBlock(msg *wire.MsgMerkleBlock, coinbase *wire.MsgTx, opts ...MirrorOption) (*BtcLightMirrorV2, error) {
+	proofs, err := ExtractInclusionProofs(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(proofs) == 0 || proofs[0].Index != 0 {
+		return nil, ErrCoinbaseNotMatched
+	}
+	if txid := coinbase.TxHash(); txid != proofs[0].TxID {
+		return nil, fmt.Errorf("%w: transaction %v, matched %v",
+			ErrCoinbaseNotMatched, txid, proofs[0].TxID)
+	}
+
+	var options mirrorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.stripWitness {
+		coinbase = stripWitness(coinbase)
+	}
+
+	light := &BtcLightMirrorV2{
+		BtcHeader:   msg.Header,
+		CoinBaseTx:  *coinbase,
+		MerkleNodes: proofs[0].Branch,
+	}
+	if err := light.CheckMerkle(); err != nil {
+		return nil, err
+	}
+	return light, nil
+}
+
+// partialTree walks the partial merkle tree of a merkle block.  Nodes are
+// addressed by height, 0 for the transactions, and position in their level.
+type partialTree struct {
+	msg        *wire.MsgMerkleBlock
+	height     int
+	bitsUsed   int
+	hashesUsed int
+
+	// nodes holds the hash of every visited node, keyed by nodeKey.  Only
+	// visited nodes are kept, so a merkle block claiming a huge number of
+	// transactions costs no more than its flag bits.  matches lists the
+	// matched transactions.
+	nodes   map[uint64]chainhash.Hash
+	matches []uint32
+}
+
+// nodeKey returns the key of the node at height h and position pos.
+func nodeKey(h int, pos uint32) uint64 {
+	return uint64(h)<<32 | uint64(pos)
+}
+
+// width returns the number of nodes at height h.
+func (t *partialTree) width(h int) uint32 {
+	return uint32((uint64(t.msg.Transactions) + 1<<h - 1) >> h)
+}
+
+// traverse returns the hash of the node at height h and position pos,
+// consuming flag bits and hashes in depth first order.
+func (t *partialTree) traverse(h int, pos uint32) (chainhash.Hash, error) {
+	if t.bitsUsed >= len(t.msg.Flags)*8 {
+		return chainhash.Hash{}, fmt.Errorf("%w: out of flag bits",
+			ErrInvalidPartialTree)
+	}
+	parentOfMatch := t.msg.Flags[t.bitsUsed/8]>>(t.bitsUsed%8)&1 == 1
+	t.bitsUsed++
+
+	var hash chainhash.Hash
+	if h == 0 || !parentOfMatch {
+		if t.hashesUsed >= len(t.msg.Hashes) {
+			return hash, fmt.Errorf("%w: out of hashes", ErrInvalidPartialTree)
+		}
+		hash = *t.msg.Hashes[t.hashesUsed]
+		t.hashesUsed++
+		if h == 0 && parentOfMatch {
+			t.matches = append(t.matches, pos)
+		}
+	} else {
+		left, err := t.traverse(h-1, pos*2)
+		if err != nil {
+			return hash, err
+		}
+		right := left
+		if pos*2+1 < t.width(h-1) {
+			right, err = t.traverse(h-1, pos*2+1)
+			if err != nil {
+				return hash, err
+			}
+			if right == left {
+				return hash, fmt.Errorf("%w: identical siblings at height "+
+					"%d", ErrInvalidPartialTree, h-1)
+			}
+		}
+		hash = hashMerkleBranches(&left, &right)
+	}
+
+	t.nodes[nodeKey(h, pos)] = hash
+	return hash, nil
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/bloom"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testMerkleBlock returns the merkle block of block matching the transactions
+// at the given indexes, as a BIP37 peer would serve it.
+func testMerkleBlock(block *wire.MsgBlock, match ...int) *wire.MsgMerkleBlock {
+	filter := bloom.NewFilter(uint32(len(match)), 0, 0.000001, wire.BloomUpdateNone)
+	for _, i := range match {
+		txid := block.Transactions[i].TxHash()
+		filter.AddHash(&txid)
+	}
+	msg, _ := bloom.NewMerkleBlock(btcutil.NewBlock(block), filter)
+	return msg
+}
+
+func TestTxOutProofGenesis(t *testing.T) {
+	// gettxoutproof of the coinbase of the main network genesis block.
+	genesis := chaincfg.MainNetParams.GenesisBlock
+	var buf bytes.Buffer
+	if err := genesis.Header.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write([]byte{0x01, 0x00, 0x00, 0x00, 0x01})
+	buf.Write(genesis.Header.MerkleRoot[:])
+	buf.Write([]byte{0x01, 0x01})
+
+	msg, err := ParseTxOutProof(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	light, err := NewBtcLightMirrorV2FromMerkleBlock(msg, genesis.Transactions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if light.BtcHeader.BlockHash() != *chaincfg.MainNetParams.GenesisHash {
+		t.Errorf("mirror of block %v, want the genesis block", light.BtcHeader.BlockHash())
+	}
+	if err := light.CheckProofOfWork(nil); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ParseTxOutProof(append(buf.Bytes(), 0)); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("trailing byte: got %v, want %v", err, ErrTrailingData)
+	}
+	if _, err := ParseTxOutProof(buf.Bytes()[:100]); !errors.Is(err, ErrMalformedMirror) {
+		t.Errorf("truncated: got %v, want %v", err, ErrMalformedMirror)
+	}
+}
+
+func TestMerkleBlockMirror(t *testing.T) {
+	coreMarker := mustDecodeHex("6a2d434f524501" +
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+		"1111111111111111111111111111111111111111")
+	p2wpkh := mustDecodeHex("0014" + "751e76e8199196d454941c45d1b3a323f1433bd6")
+	block := segwitBlock(750000, "/pool/", [][]byte{p2wpkh, coreMarker}, 1337)
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	coinbase := block.Transactions[0]
+	want := CreateBtcLightMirrorV2(&block.Header, coinbase, txids, WithoutWitness())
+
+	msg := testMerkleBlock(block, 0, 400, 1336)
+	var buf bytes.Buffer
+	if err := msg.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("merkle block of %d transactions: %d bytes", len(txids), buf.Len())
+	msg, err := ParseTxOutProof(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proofs, err := ExtractInclusionProofs(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofs) != 3 {
+		t.Fatalf("%d proofs, want 3", len(proofs))
+	}
+	for i, index := range []uint32{0, 400, 1336} {
+		p := &proofs[i]
+		if p.Index != index || p.TxID != txids[index] || p.TxCount != uint32(len(txids)) {
+			t.Errorf("proof %d: transaction %d %v", i, p.Index, p.TxID)
+		}
+		if err := p.Verify(); err != nil {
+			t.Errorf("proof %d: %v", i, err)
+		}
+	}
+	proofs[1].Index++
+	if err := proofs[1].Verify(); !errors.Is(err, ErrMerkleMismatch) {
+		t.Errorf("wrong index: got %v, want %v", err, ErrMerkleMismatch)
+	}
+
+	light, err := NewBtcLightMirrorV2FromMerkleBlock(msg, coinbase, WithoutWitness())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(light, want) {
+		t.Errorf("mirror %v, want %v", light, want)
+	}
+	if c, _, _, err := light.ValidatePowerParams(PowerPolicyStrict); err != nil ||
+		c.Hex() != "0xaAaAaAaaAaAaAaaAaAAAAAAAAaaaAaAaAaaAaaAa" {
+		t.Errorf("power params: candidate %v, %v", c, err)
+	}
+
+	if _, err := NewBtcLightMirrorV2FromMerkleBlock(msg, block.Transactions[1]); !errors.Is(err, ErrCoinbaseNotMatched) {
+		t.Errorf("wrong coinbase: got %v, want %v", err, ErrCoinbaseNotMatched)
+	}
+	other := testMerkleBlock(block, 400)
+	if _, err := NewBtcLightMirrorV2FromMerkleBlock(other, coinbase); !errors.Is(err, ErrCoinbaseNotMatched) {
+		t.Errorf("coinbase not matched: got %v, want %v", err, ErrCoinbaseNotMatched)
+	}
+}
+
+func TestInvalidPartialTree(t *testing.T) {
+	p2wpkh := mustDecodeHex("0014" + "751e76e8199196d454941c45d1b3a323f1433bd6")
+	block := segwitBlock(750000, "/pool/", [][]byte{p2wpkh}, 21)
+
+	tests := []struct {
+		name   string
+		modify func(msg *wire.MsgMerkleBlock)
+	}{
+		{"no transactions", func(msg *wire.MsgMerkleBlock) {
+			msg.Transactions = 0
+		}},
+		{"too many transactions", func(msg *wire.MsgMerkleBlock) {
+			msg.Transactions = maxTxPerBlock + 1
+		}},
+		{"taller tree", func(msg *wire.MsgMerkleBlock) {
+			msg.Transactions = 33
+		}},
+		{"extra hash", func(msg *wire.MsgMerkleBlock) {
+			msg.Hashes = append(msg.Hashes, &chainhash.Hash{})
+		}},
+		{"missing hash", func(msg *wire.MsgMerkleBlock) {
+			msg.Hashes = msg.Hashes[:len(msg.Hashes)-1]
+		}},
+		{"extra flags", func(msg *wire.MsgMerkleBlock) {
+			msg.Flags = append(msg.Flags, 0)
+		}},
+		{"missing flags", func(msg *wire.MsgMerkleBlock) {
+			msg.Flags = msg.Flags[:1]
+		}},
+		{"flag", func(msg *wire.MsgMerkleBlock) {
+			msg.Flags[0] ^= 2
+		}},
+		{"hash", func(msg *wire.MsgMerkleBlock) {
+			msg.Hashes[1] = &chainhash.Hash{1}
+		}},
+	}
+	for _, test := range tests {
+		msg := testMerkleBlock(block, 0, 13)
+		if _, err := ExtractInclusionProofs(msg); err != nil {
+			t.Fatal(err)
+		}
+		test.modify(msg)
+		if _, err := ExtractInclusionProofs(msg); !errors.Is(err, ErrInvalidPartialTree) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrInvalidPartialTree)
+		}
+	}
+
+	// Duplicating the last transaction of a block of three keeps the merkle
+	// root (CVE-2012-2459).  A tree claiming four transactions is rejected.
+	a, b, c := chainhash.Hash{0xa}, chainhash.Hash{0xb}, chainhash.Hash{0xc}
+	root := BuildMerkleTreeStore(&a, []chainhash.Hash{b, c})
+	msg := &wire.MsgMerkleBlock{
+		Header:       wire.BlockHeader{MerkleRoot: *root[len(root)-1]},
+		Transactions: 4,
+		Hashes:       []*chainhash.Hash{&a, &b, &c, &c},
+		Flags:        []byte{0x7f},
+	}
+	if _, err := ExtractInclusionProofs(msg); !errors.Is(err, ErrInvalidPartialTree) {
+		t.Errorf("duplicated transaction: got %v, want %v", err, ErrInvalidPartialTree)
+	}
+	msg.Transactions, msg.Hashes, msg.Flags = 3, msg.Hashes[:3], []byte{0x3f}
+	if proofs, err := ExtractInclusionProofs(msg); err != nil || len(proofs) != 3 {
+		t.Errorf("three transactions: %d proofs, %v", len(proofs), err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Tags separating the MirrorID domains of the mirror versions, so that
+// mirrors of different versions can never share an identifier.
+var (
+	mirrorIDTagV1 = []byte("BtcLightMirror")
+	mirrorIDTagV2 = []byte("BtcLightMirrorV2")
+	mirrorIDTagV3 = []byte("BtcLightMirrorV3")
+)
+
+// MirrorID identifies a mirror independently of how it was encoded.  It is
+// the BIP340 tagged SHA-256 of the canonical encoding, so mirrors that differ
+// only in coinbase witness data share an ID.
+type MirrorID chainhash.Hash
+
+// String returns the ID as hex in the byte order of chainhash.Hash strings.
+func (id MirrorID) String() string {
+	return chainhash.Hash(id).String()
+}
+
+// MarshalText encodes the ID in its String form.
+func (id MirrorID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes an ID in its String form.
+func (id *MirrorID) UnmarshalText(text []byte) error {
+	return chainhash.Decode((*chainhash.Hash)(id), string(text))
+}
+
+// NewMirrorIDFromStr decodes an ID in its String form.
+func NewMirrorIDFromStr(s string) (MirrorID, error) {
+	var id MirrorID
+	err := id.UnmarshalText([]byte(s))
+	return id, err
+}
+
+// UnknownHeight is the BlockRef height of a block whose height is unknown.
+const UnknownHeight int64 = -1
+
+// BlockRef is a human-meaningful reference to a mirrored block.  It is
+// comparable and can be used as a map key.
+type BlockRef struct {
+	// Hash is the block hash.
+	Hash chainhash.Hash
+
+	// Height is the block height, or UnknownHeight.
+	Height int64
+
+	// CoinbaseTxID is the txid of the mirrored coinbase.
+	CoinbaseTxID chainhash.Hash
+}
+
+// String describes the reference.
+func (ref BlockRef) String() string {
+	if ref.Height == UnknownHeight {
+		return fmt.Sprintf("%v (coinbase %v)", ref.Hash, ref.CoinbaseTxID)
+	}
+	return fmt.Sprintf("%v@%d (coinbase %v)", ref.Hash, ref.Height, ref.CoinbaseTxID)
+}
+
+// MirrorID returns the identifier of the mirror.
+func (light *BtcLightMirror) MirrorID() MirrorID {
+	var buf bytes.Buffer
+	// Writes to a bytes.Buffer cannot fail.
+	_ = light.SerializeCanonical(&buf)
+	return MirrorID(*chainhash.TaggedHash(mirrorIDTagV1, buf.Bytes()))
+}
+
+// BlockRef returns the reference of the mirrored block.  Pass UnknownHeight
+// when the height is not known.
+func (light *BtcLightMirror) BlockRef(height int64) BlockRef {
+	return BlockRef{
+		Hash:         light.BtcHeader.BlockHash(),
+		Height:       height,
+		CoinbaseTxID: light.CoinBaseTx.TxHash(),
+	}
+}
+
+// MirrorID returns the identifier of the mirror.
+func (light *BtcLightMirrorV2) MirrorID() MirrorID {
+	var buf bytes.Buffer
+	// Writes to a bytes.Buffer cannot fail.
+	_ = light.SerializeCanonical(&buf)
+	return MirrorID(*chainhash.TaggedHash(mirrorIDTagV2, buf.Bytes()))
+}
+
+// BlockRef returns the reference of the mirrored block.  Pass UnknownHeight
+// when the height is not known.
+func (light *BtcLightMirrorV2) BlockRef(height int64) BlockRef {
+	return BlockRef{
+		Hash:         light.BtcHeader.BlockHash(),
+		Height:       height,
+		CoinbaseTxID: light.CoinBaseTx.TxHash(),
+	}
+}
+
+// MirrorID returns the identifier of the mirror.  The encoding of a
+// BtcLightMirrorV3 is canonical, so it is hashed as is.
+func (light *BtcLightMirrorV3) MirrorID() MirrorID {
+	var buf bytes.Buffer
+	// Writes to a bytes.Buffer cannot fail.
+	_ = light.Serialize(&buf)
+	return MirrorID(*chainhash.TaggedHash(mirrorIDTagV3, buf.Bytes()))
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMirrorID(t *testing.T) {
+	plain := testMirrorV2(validCoinbase(), 4)
+	witness := testMirrorV2(witnessCoinbase(), 4)
+
+	if plain.MirrorID() != witness.MirrorID() {
+		t.Fatalf("witness changed the mirror id")
+	}
+
+	other := testMirrorV2(validCoinbase(), 5)
+	if plain.MirrorID() == other.MirrorID() {
+		t.Fatalf("different mirrors share an id")
+	}
+
+	// A v1 mirror of the same content lives in another domain.
+	v1 := &BtcLightMirror{BtcHeader: plain.BtcHeader, CoinBaseTx: plain.CoinBaseTx}
+	if v1.MirrorID() == plain.MirrorID() {
+		t.Fatalf("v1 and v2 mirrors share an id")
+	}
+
+	id := plain.MirrorID()
+	data, err := json.Marshal(map[string]MirrorID{"id": id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]MirrorID
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["id"] != id {
+		t.Fatalf("JSON round trip: got %v, want %v", decoded["id"], id)
+	}
+	if parsed, err := NewMirrorIDFromStr(id.String()); err != nil || parsed != id {
+		t.Fatalf("NewMirrorIDFromStr: got %v, %v", parsed, err)
+	}
+}
+
+func TestBlockRef(t *testing.T) {
+	plain := testMirrorV2(validCoinbase(), 4)
+	witness := testMirrorV2(witnessCoinbase(), 4)
+
+	ref := plain.BlockRef(100)
+	if ref != witness.BlockRef(100) {
+		t.Fatalf("witness changed the block ref")
+	}
+	if ref.Hash != plain.BtcHeader.BlockHash() || ref.CoinbaseTxID != plain.CoinBaseTx.TxHash() {
+		t.Fatalf("BlockRef: %v", ref)
+	}
+
+	refs := map[BlockRef]bool{ref: true}
+	if refs[plain.BlockRef(UnknownHeight)] {
+		t.Fatalf("heights are part of the reference")
+	}
+	if ref.String() == plain.BlockRef(UnknownHeight).String() {
+		t.Fatalf("String ignores the height")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrTargetOutOfRange is returned when the target encoded in the
+	// header bits is not positive or above the proof of work limit.
+	ErrTargetOutOfRange = errors.New("block target difficulty is out of range")
+
+	// ErrHighHash is returned when the block hash is above its target.
+	ErrHighHash = errors.New("block hash is higher than its target")
+)
+
+// CheckProofOfWork checks that header carries a target of at most powLimit and
+// hashes below it, like blockchain.CheckProofOfWork.  The main network limit
+// is used when powLimit is nil.
+func CheckProofOfWork(header *wire.BlockHeader, powLimit *big.Int) error {
+	if powLimit == nil {
+		powLimit = chaincfg.MainNetParams.PowLimit
+	}
+
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(powLimit) > 0 {
+		return fmt.Errorf("%w: target of %064x, limit %064x",
+			ErrTargetOutOfRange, target, powLimit)
+	}
+
+	hash := header.BlockHash()
+	if hashNum := blockchain.HashToBig(&hash); hashNum.Cmp(target) > 0 {
+		return fmt.Errorf("%w: hash of %064x, target %064x",
+			ErrHighHash, hashNum, target)
+	}
+	return nil
+}
+
+// CheckProofOfWork checks the proof of work of the mirrored header.
+func (light *BtcLightMirror) CheckProofOfWork(powLimit *big.Int) error {
+	return CheckProofOfWork(&light.BtcHeader, powLimit)
+}
+
+// CheckProofOfWork checks the proof of work of the mirrored header.
+func (light *BtcLightMirrorV2) CheckProofOfWork(powLimit *big.Int) error {
+	return CheckProofOfWork(&light.BtcHeader, powLimit)
+}
+
+// CheckProofOfWork checks the proof of work of the mirrored header.
+func (light *BtcLightMirrorV3) CheckProofOfWork(powLimit *big.Int) error {
+	return CheckProofOfWork(&light.BtcHeader, powLimit)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// mineHeader sets header to the regression test difficulty and searches a
+// nonce satisfying it.
+func mineHeader(header *wire.BlockHeader) {
+	header.Bits = chaincfg.RegressionNetParams.PowLimitBits
+	target := blockchain.CompactToBig(header.Bits)
+	for {
+		hash := header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			return
+		}
+		header.Nonce++
+	}
+}
+
+func TestCheckProofOfWork(t *testing.T) {
+	regtest := chaincfg.RegressionNetParams.PowLimit
+
+	header := wire.BlockHeader{Version: 4}
+	mineHeader(&header)
+	if err := CheckProofOfWork(&header, regtest); err != nil {
+		t.Fatalf("mined header: %v", err)
+	}
+	if err := CheckProofOfWork(&header, nil); !errors.Is(err, ErrTargetOutOfRange) {
+		t.Errorf("regtest header against main network: got %v, want %v", err, ErrTargetOutOfRange)
+	}
+
+	// Find a nonce failing the target.
+	for {
+		header.Nonce++
+		hash := header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(blockchain.CompactToBig(header.Bits)) > 0 {
+			break
+		}
+	}
+	if err := CheckProofOfWork(&header, regtest); !errors.Is(err, ErrHighHash) {
+		t.Errorf("unmined header: got %v, want %v", err, ErrHighHash)
+	}
+
+	header.Bits = 0
+	if err := CheckProofOfWork(&header, regtest); !errors.Is(err, ErrTargetOutOfRange) {
+		t.Errorf("zero target: got %v, want %v", err, ErrTargetOutOfRange)
+	}
+}
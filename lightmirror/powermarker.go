@@ -0,0 +1,274 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// powerMarkerVersion is the only delegation marker version understood.
+	powerMarkerVersion = txscript.OP_DATA_1
+
+	// powerPayloadLength is the length of the data pushed by a marker
+	// without the optional Core block hash, powerPayloadHashLength with it.
+	powerPayloadLength     = 4 + 1 + 20 + 20
+	powerPayloadHashLength = powerPayloadLength + 32
+)
+
+// MarkerStatus classifies a CORE-tagged coinbase output.
+type MarkerStatus int
+
+const (
+	// MarkerValid is a well formed marker with or without block hash.
+	MarkerValid MarkerStatus = iota
+
+	// MarkerWrongVersion carries a version byte other than 0x01.
+	MarkerWrongVersion
+
+	// MarkerTruncated is too short to hold the candidate and reward
+	// addresses.
+	MarkerTruncated
+
+	// MarkerTrailingBytes holds bytes beyond the addresses that do not
+	// form exactly one 32 byte block hash.
+	MarkerTrailingBytes
+
+	// MarkerMalformedPush is a well formed marker whose push opcode does
+	// not push exactly the rest of the script with the smallest push.
+	MarkerMalformedPush
+)
+
+// String returns a short name for the status.
+func (s MarkerStatus) String() string {
+	switch s {
+	case MarkerValid:
+		return "valid"
+	case MarkerWrongVersion:
+		return "wrong version"
+	case MarkerTruncated:
+		return "truncated"
+	case MarkerTrailingBytes:
+		return "trailing bytes"
+	case MarkerMalformedPush:
+		return "malformed push"
+	}
+	return fmt.Sprintf("MarkerStatus(%d)", int(s))
+}
+
+// PowerMarker is a CORE-tagged output found in a coinbase transaction.
+type PowerMarker struct {
+	// OutputIndex is the index of the output in the coinbase.
+	OutputIndex int
+
+	Status  MarkerStatus
+	Version byte
+
+	// Candidate, Reward and BlockHash are decoded as far as the script
+	// allows.  HasBlockHash reports whether the optional Core block hash
+	// was present.
+	Candidate    common.Address
+	Reward       common.Address
+	BlockHash    common.Hash
+	HasBlockHash bool
+
+	// pushData1 is set when the payload is pushed with OP_PUSHDATA1.
+	pushData1 bool
+}
+
+// legacy reports whether ParsePowerParams would accept the marker.
+// ParsePowerParams reads the magic right after the push opcode, so it does
+// not see markers pushed with OP_PUSHDATA1.
+func (m *PowerMarker) legacy() bool {
+	return m.OutputIndex > 0 && !m.pushData1 &&
+		(m.Status == MarkerValid || m.Status == MarkerTrailingBytes ||
+			m.Status == MarkerMalformedPush)
+}
+
+// powerPayload returns the offset of the marker payload in the OP_RETURN
+// script pkScript and whether it is pushed with OP_PUSHDATA1.  The payload
+// follows the push opcode as ParsePowerParams expects, unless an
+// OP_PUSHDATA1 length byte precedes the CORE magic.  The push length is not
+// checked, see canonicalPush.
+func powerPayload(pkScript []byte) (int, bool) {
+	if len(pkScript) >= 7 && pkScript[1] == txscript.OP_PUSHDATA1 &&
+		string(pkScript[3:7]) == powerMagicString {
+		return 3, true
+	}
+	return 2, false
+}
+
+// isPowerTagged reports whether pkScript is an OP_RETURN output tagged with
+// the CORE magic.
+func isPowerTagged(pkScript []byte) bool {
+	off, _ := powerPayload(pkScript)
+	return len(pkScript) >= off+4 && pkScript[0] == txscript.OP_RETURN &&
+		string(pkScript[off:off+4]) == powerMagicString
+}
+
+// canonicalPush reports whether the push opcode of the CORE-tagged script
+// pkScript pushes exactly the rest of the script, using a direct push for
+// up to 75 bytes and OP_PUSHDATA1 above.
+func canonicalPush(pkScript []byte) bool {
+	op := pkScript[1]
+	switch {
+	case op >= txscript.OP_DATA_1 && op <= txscript.OP_DATA_75:
+		return int(op) == len(pkScript)-2
+	case op == txscript.OP_PUSHDATA1:
+		n := len(pkScript) - 3
+		return n > txscript.OP_DATA_75 && int(pkScript[2]) == n
+	}
+	return false
+}
+
+// ScanPowerMarkers lists and classifies every CORE-tagged output of tx in
+// output order.  Unlike ParsePowerParams it does not stop at the first marker
+// and also reports output 0, which ParsePowerParams never looks at.
+func ScanPowerMarkers(tx *wire.MsgTx) []PowerMarker {
+	return scanPowerOutputs(tx.TxOut, 0)
+}
+
+// scanPowerOutputs classifies the CORE-tagged outputs among txOuts, the first
+// of which has index first in its transaction.
+func scanPowerOutputs(txOuts []*wire.TxOut, first int) []PowerMarker {
+	var markers []PowerMarker
+	for i, txOut := range txOuts {
+		pkScript := txOut.PkScript
+		if !isPowerTagged(pkScript) {
+			continue
+		}
+
+		off, pushData1 := powerPayload(pkScript)
+		payload := pkScript[off:]
+		m := PowerMarker{OutputIndex: first + i, pushData1: pushData1}
+		switch {
+		case len(payload) < 5:
+			m.Status = MarkerTruncated
+			markers = append(markers, m)
+			continue
+		case payload[4] != powerMarkerVersion:
+			m.Version = payload[4]
+			m.Status = MarkerWrongVersion
+			markers = append(markers, m)
+			continue
+		}
+
+		m.Version = payload[4]
+		switch {
+		case len(payload) < powerPayloadLength:
+			m.Status = MarkerTruncated
+		case len(payload) != powerPayloadLength &&
+			len(payload) != powerPayloadHashLength:
+			m.Status = MarkerTrailingBytes
+		case !canonicalPush(pkScript):
+			m.Status = MarkerMalformedPush
+		default:
+			m.Status = MarkerValid
+		}
+
+		if len(payload) >= powerPayloadLength {
+			m.Candidate = common.BytesToAddress(payload[5:25])
+			m.Reward = common.BytesToAddress(payload[25:45])
+		}
+		if len(payload) >= powerPayloadHashLength {
+			m.BlockHash = common.BytesToHash(payload[45:powerPayloadHashLength])
+			m.HasBlockHash = true
+		}
+		markers = append(markers, m)
+	}
+	return markers
+}
+
+// PowerPolicy selects how the delegation of a coinbase is decided.
+type PowerPolicy int
+
+const (
+	// PowerPolicyFirst accepts the first marker ParsePowerParams would
+	// accept and ignores the rest.  It matches ParsePowerParams.
+	PowerPolicyFirst PowerPolicy = iota
+
+	// PowerPolicyStrict requires the coinbase to carry at most one
+	// CORE-tagged output and that output to be valid.
+	PowerPolicyStrict
+)
+
+var (
+	// ErrAmbiguousDelegation is returned under PowerPolicyStrict when a
+	// coinbase carries more than one CORE-tagged output.
+	ErrAmbiguousDelegation = errors.New("coinbase carries more than one delegation marker")
+
+	// ErrInvalidPowerMarker is returned under PowerPolicyStrict when the
+	// only CORE-tagged output of a coinbase is malformed.
+	ErrInvalidPowerMarker = errors.New("coinbase delegation marker is malformed")
+)
+
+// ValidatePowerMarkers decides the delegation of tx under policy.  It returns
+// the marker that delegates the block, or nil when the block is not
+// delegated.
+func ValidatePowerMarkers(tx *wire.MsgTx, policy PowerPolicy) (*PowerMarker, error) {
+	return decidePowerMarkers(ScanPowerMarkers(tx), policy)
+}
+
+// decidePowerMarkers applies policy to markers as returned by
+// ScanPowerMarkers.
+func decidePowerMarkers(markers []PowerMarker, policy PowerPolicy) (*PowerMarker, error) {
+	switch policy {
+	case PowerPolicyFirst:
+		for i := range markers {
+			if markers[i].legacy() {
+				return &markers[i], nil
+			}
+		}
+		return nil, nil
+
+	case PowerPolicyStrict:
+		switch {
+		case len(markers) == 0:
+			return nil, nil
+		case len(markers) > 1:
+			return nil, fmt.Errorf("%w: %d markers in outputs %s",
+				ErrAmbiguousDelegation, len(markers), markerOutputs(markers))
+		case markers[0].OutputIndex == 0:
+			return nil, fmt.Errorf("%w: marker in output 0", ErrInvalidPowerMarker)
+		case markers[0].Status != MarkerValid:
+			return nil, fmt.Errorf("%w: output %d is %v", ErrInvalidPowerMarker,
+				markers[0].OutputIndex, markers[0].Status)
+		}
+		return &markers[0], nil
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownPowerPolicy, int(policy))
+}
+
+func markerOutputs(markers []PowerMarker) string {
+	s := ""
+	for i, m := range markers {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d (%v)", m.OutputIndex, m.Status)
+	}
+	return s
+}
+
+// PowerMarkers lists every CORE-tagged output of the coinbase transaction.
+func (light *BtcLightMirrorV2) PowerMarkers() []PowerMarker {
+	return ScanPowerMarkers(&light.CoinBaseTx)
+}
+
+// ValidatePowerParams decides the delegation of the block under policy and
+// returns its parameters.  All values are zero when the block is not
+// delegated.
+func (light *BtcLightMirrorV2) ValidatePowerParams(policy PowerPolicy) (candidateAddr common.Address, rewardAddr common.Address, blockHash common.Hash, err error) {
+	m, err := ValidatePowerMarkers(&light.CoinBaseTx, policy)
+	if err != nil || m == nil {
+		return
+	}
+	return m.Candidate, m.Reward, m.BlockHash, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// powerScript builds a CORE marker script with the given version byte and
+// payload following it, pushed with the smallest push.
+func powerScript(version byte, payload []byte) []byte {
+	script := []byte{0x6a, byte(5 + len(payload))}
+	if len(payload) > 75-5 {
+		script = []byte{0x6a, 0x4c, byte(5 + len(payload))}
+	}
+	script = append(script, 'C', 'O', 'R', 'E', version)
+	return append(script, payload...)
+}
+
+// legacyPowerScript builds a CORE marker script like powerScript, but with
+// the data length in place of a push opcode.
+func legacyPowerScript(version byte, payload []byte) []byte {
+	script := []byte{0x6a, byte(5 + len(payload)), 'C', 'O', 'R', 'E', version}
+	return append(script, payload...)
+}
+
+func TestScanPowerMarkers(t *testing.T) {
+	candidate := bytes.Repeat([]byte{0xca}, 20)
+	reward := bytes.Repeat([]byte{0x5e}, 20)
+	hash := bytes.Repeat([]byte{0x77}, 32)
+	addrs := append(append([]byte{}, candidate...), reward...)
+	withHash := append(append([]byte{}, addrs...), hash...)
+
+	valid := powerScript(0x01, addrs)
+	validHash := powerScript(0x01, withHash)
+	wrongVersion := powerScript(0x02, addrs)
+	truncated := powerScript(0x01, addrs[:30])
+	trailing := powerScript(0x01, append(append([]byte{}, addrs...), 0xff))
+	trailingHash := powerScript(0x01, append(append([]byte{}, withHash...), 0xff))
+	legacyHash := legacyPowerScript(0x01, withHash)
+	shortPush := append([]byte{}, valid...)
+	shortPush[1]--
+	pushData1 := append([]byte{0x6a, 0x4c}, valid[1:]...)
+	pushData1Tag := append([]byte{0x6a, 0x4c}, valid[2:]...)
+
+	tests := []struct {
+		name     string
+		scripts  [][]byte
+		statuses []MarkerStatus
+		strict   error
+	}{
+		{"none", [][]byte{{0x51}}, nil, nil},
+		{"valid", [][]byte{{0x51}, valid}, []MarkerStatus{MarkerValid}, nil},
+		{"valid with hash", [][]byte{{0x51}, validHash}, []MarkerStatus{MarkerValid}, nil},
+		{"wrong version", [][]byte{{0x51}, wrongVersion}, []MarkerStatus{MarkerWrongVersion}, ErrInvalidPowerMarker},
+		{"truncated", [][]byte{{0x51}, truncated}, []MarkerStatus{MarkerTruncated}, ErrInvalidPowerMarker},
+		{"tag only", [][]byte{{0x51}, valid[:6]}, []MarkerStatus{MarkerTruncated}, ErrInvalidPowerMarker},
+		{"trailing", [][]byte{{0x51}, trailing}, []MarkerStatus{MarkerTrailingBytes}, ErrInvalidPowerMarker},
+		{"trailing hash", [][]byte{{0x51}, trailingHash}, []MarkerStatus{MarkerTrailingBytes}, ErrInvalidPowerMarker},
+		{"legacy hash push", [][]byte{{0x51}, legacyHash}, []MarkerStatus{MarkerMalformedPush}, ErrInvalidPowerMarker},
+		{"short push", [][]byte{{0x51}, shortPush}, []MarkerStatus{MarkerMalformedPush}, ErrInvalidPowerMarker},
+		{"long push", [][]byte{{0x51}, pushData1}, []MarkerStatus{MarkerMalformedPush}, ErrInvalidPowerMarker},
+		{"push opcode tag", [][]byte{{0x51}, pushData1Tag}, []MarkerStatus{MarkerMalformedPush}, ErrInvalidPowerMarker},
+		{"output zero", [][]byte{valid}, []MarkerStatus{MarkerValid}, ErrInvalidPowerMarker},
+		{
+			"duplicate",
+			[][]byte{{0x51}, valid, validHash},
+			[]MarkerStatus{MarkerValid, MarkerValid},
+			ErrAmbiguousDelegation,
+		},
+		{
+			"invalid then valid",
+			[][]byte{{0x51}, wrongVersion, truncated, valid},
+			[]MarkerStatus{MarkerWrongVersion, MarkerTruncated, MarkerValid},
+			ErrAmbiguousDelegation,
+		},
+	}
+
+	for _, test := range tests {
+		light := &BtcLightMirrorV2{}
+		for _, script := range test.scripts {
+			light.CoinBaseTx.AddTxOut(wire.NewTxOut(0, script))
+		}
+
+		markers := light.PowerMarkers()
+		if len(markers) != len(test.statuses) {
+			t.Errorf("%s: got %d markers, want %d", test.name, len(markers), len(test.statuses))
+			continue
+		}
+		for i, m := range markers {
+			if m.Status != test.statuses[i] {
+				t.Errorf("%s: marker %d is %v, want %v", test.name, i, m.Status, test.statuses[i])
+			}
+		}
+
+		// The first-match policy must agree with ParsePowerParams.
+		c, r, h := light.ParsePowerParams()
+		gc, gr, gh, err := light.ValidatePowerParams(PowerPolicyFirst)
+		if err != nil || c != gc || r != gr || h != gh {
+			t.Errorf("%s: first policy (%v %v %v %v), ParsePowerParams (%v %v %v)",
+				test.name, gc, gr, gh, err, c, r, h)
+		}
+
+		c, r, h, err = light.ValidatePowerParams(PowerPolicyStrict)
+		if !errors.Is(err, test.strict) {
+			t.Errorf("%s: strict policy error %v, want %v", test.name, err, test.strict)
+			continue
+		}
+		if err == nil && len(markers) == 1 {
+			if c != common.BytesToAddress(candidate) || r != common.BytesToAddress(reward) {
+				t.Errorf("%s: strict policy decoded %v %v", test.name, c, r)
+			}
+			if markers[0].HasBlockHash != (h != common.Hash{}) {
+				t.Errorf("%s: strict policy block hash %v", test.name, h)
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Names of the checks recorded in a Report, in the order they run.
+const (
+	CheckNameStructure   = "structure"
+	CheckNameCoinbase    = "coinbase"
+	CheckNameMerkle      = "merkle"
+	CheckNamePoW         = "pow"
+	CheckNamePowerParams = "power_params"
+	CheckNameAddress     = "address"
+)
+
+// Check is the outcome of one verification step.
+type Check struct {
+	Name string `json:"name"`
+
+	// Required reports whether the mirror is invalid when the check
+	// fails.  Address extraction is informational only.
+	Required bool `json:"required"`
+
+	Passed   bool          `json:"passed"`
+	Duration time.Duration `json:"duration_ns"`
+
+	// Detail describes what was checked, Error why it failed.
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	err error
+}
+
+// Err returns the error of a failed check, or nil.
+func (c *Check) Err() error {
+	return c.err
+}
+
+// Report records every check run by Verify on a mirror.  It is meant to be
+// serialized to JSON for operators.
+type Report struct {
+	// Version is the mirror version, 1 for BtcLightMirror, 2 for
+	// BtcLightMirrorV2 and 3 for BtcLightMirrorV3.
+	Version int `json:"version"`
+
+	BlockHash string `json:"block_hash"`
+
+	// Valid reports whether every required check passed.
+	Valid bool `json:"valid"`
+
+	Checks   []*Check      `json:"checks"`
+	Duration time.Duration `json:"duration_ns"`
+
+	// Candidate, Reward and PowerBlockHash are set when the power params
+	// check found a delegation.
+	Candidate      *common.Address `json:"candidate,omitempty"`
+	Reward         *common.Address `json:"reward,omitempty"`
+	PowerBlockHash *common.Hash    `json:"power_block_hash,omitempty"`
+
+	// PayoutAddress and PayoutType are set when the address check could
+	// extract the address paid by the first coinbase output.  PayoutType
+	// is PUBKEYHASH or WITNESS_V0_KEYHASH.
+	PayoutAddress *common.Address `json:"payout_address,omitempty"`
+	PayoutType    int             `json:"payout_type,omitempty"`
+}
+
+// Check returns the check called name, or nil when it was not run.
+func (r *Report) Check(name string) *Check {
+	for _, c := range r.Checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Err returns the error of the first failed required check, or nil when the
+// mirror is valid.
+func (r *Report) Err() error {
+	for _, c := range r.Checks {
+		if c.Required && !c.Passed {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// run times check and records its outcome under name.
+func (r *Report) run(name string, required bool, check func() (string, error)) {
+	start := time.Now()
+	detail, err := check()
+	c := &Check{
+		Name:     name,
+		Required: required,
+		Passed:   err == nil,
+		Duration: time.Since(start),
+		Detail:   detail,
+		err:      err,
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// Verify runs every check on the mirror and reports their outcome.  Unlike
+// CheckMerkle it does not stop at the first failure.  A nil opts verifies a
+// main network mirror under PowerPolicyFirst.
+func (light *BtcLightMirror) Verify(opts *VerifyOptions) *Report {
+	return verifyReport(1, &light.BtcHeader, &light.CoinBaseTx, func() (string, error) {
+		if len(light.TxHashes) > maxTxPerBlock {
+			return "", fmt.Errorf("%w [count %d, max %d]", ErrTooManyTxHashes,
+				len(light.TxHashes), maxTxPerBlock)
+		}
+		return fmt.Sprintf("%d transaction hashes, %s", len(light.TxHashes),
+			describeCoinbaseSize(&light.CoinBaseTx)), nil
+	}, light.checkMerkleRoot, opts)
+}
+
+// Verify runs every check on the mirror and reports their outcome.  Unlike
+// CheckMerkle it does not stop at the first failure.  A nil opts verifies a
+// main network mirror under PowerPolicyFirst.
+func (light *BtcLightMirrorV2) Verify(opts *VerifyOptions) *Report {
+	return verifyReport(2, &light.BtcHeader, &light.CoinBaseTx, func() (string, error) {
+		if len(light.MerkleNodes) > maxMerkleNode {
+			return "", fmt.Errorf("%w [count %d, max %d]", ErrTooManyMerkleNodes,
+				len(light.MerkleNodes), maxMerkleNode)
+		}
+		return fmt.Sprintf("%d merkle nodes, %s", len(light.MerkleNodes),
+			describeCoinbaseSize(&light.CoinBaseTx)), nil
+	}, light.checkMerkleRoot, opts)
+}
+
+// verifyReport runs the checks shared by all mirror versions.
+func verifyReport(version int, header *wire.BlockHeader, coinbase *wire.MsgTx,
+	checkStructure func() (string, error), checkMerkleRoot func() error,
+	opts *VerifyOptions) *Report {
+
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+
+	start := time.Now()
+	blockHash := header.BlockHash()
+	r := &Report{Version: version, BlockHash: blockHash.String()}
+
+	r.run(CheckNameStructure, true, checkStructure)
+
+	r.run(CheckNameCoinbase, true, func() (string, error) {
+		detail := fmt.Sprintf("%d inputs, %d outputs", len(coinbase.TxIn), len(coinbase.TxOut))
+		return detail, CheckCoinbase(coinbase)
+	})
+
+	r.run(CheckNameMerkle, true, func() (string, error) {
+		detail := fmt.Sprintf("coinbase %v, merkle root %v", coinbase.TxHash(), header.MerkleRoot)
+		return detail, checkMerkleRoot()
+	})
+
+	r.run(CheckNamePoW, true, func() (string, error) {
+		detail := fmt.Sprintf("hash %v, bits %08x", blockHash, header.Bits)
+		return detail, CheckProofOfWork(header, opts.PowLimit)
+	})
+
+	r.run(CheckNamePowerParams, true, func() (string, error) {
+		return r.powerParams(ValidatePowerMarkers(coinbase, opts.PowerPolicy))
+	})
+
+	r.run(CheckNameAddress, false, func() (string, error) {
+		return r.payout(coinbase)
+	})
+
+	r.Valid = r.Err() == nil
+	r.Duration = time.Since(start)
+	return r
+}
+
+// Verify runs every check on the mirror and reports their outcome.  Unlike
+// CheckMerkle it does not stop at the first failure.  A nil opts verifies a
+// main network mirror under PowerPolicyFirst, which trusts the compressed
+// prefix not to hide a marker; under PowerPolicyStrict the power params
+// check fails with ErrHiddenOutputs instead.  The coinbase rules and the
+// payout address can only be checked when nothing was compressed.
+func (light *BtcLightMirrorV3) Verify(opts *VerifyOptions) *Report {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+
+	start := time.Now()
+	blockHash := light.BtcHeader.BlockHash()
+	r := &Report{Version: 3, BlockHash: blockHash.String()}
+
+	r.run(CheckNameStructure, true, func() (string, error) {
+		if len(light.MerkleNodes) > maxMerkleNode {
+			return "", fmt.Errorf("%w [count %d, max %d]", ErrTooManyMerkleNodes,
+				len(light.MerkleNodes), maxMerkleNode)
+		}
+		if _, err := light.TailOutputs(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d merkle nodes, coinbase prefix of %d bytes and "+
+			"tail of %d bytes holding outputs %d to %d", len(light.MerkleNodes),
+			light.CoinbasePrefixLen, len(light.CoinbaseTail),
+			light.TailOutputIndex, light.OutputCount-1), nil
+	})
+
+	r.run(CheckNameCoinbase, true, func() (string, error) {
+		if light.CoinbasePrefixLen > 0 {
+			return "compressed, not checked", nil
+		}
+		coinbase, err := light.coinbase()
+		if err != nil {
+			return "", err
+		}
+		detail := fmt.Sprintf("%d inputs, %d outputs", len(coinbase.TxIn), len(coinbase.TxOut))
+		return detail, light.checkCoinbase(coinbase)
+	})
+
+	r.run(CheckNameMerkle, true, func() (string, error) {
+		txOuts, err := light.TailOutputs()
+		if err != nil {
+			return "", err
+		}
+		if err := light.checkTail(txOuts); err != nil {
+			return "", err
+		}
+		coinbaseHash, err := light.CoinbaseTxID()
+		if err != nil {
+			return "", err
+		}
+		detail := fmt.Sprintf("coinbase %v from the midstate and tail, merkle root %v",
+			coinbaseHash, light.BtcHeader.MerkleRoot)
+		return detail, light.checkMerkleRoot(&coinbaseHash)
+	})
+
+	r.run(CheckNamePoW, true, func() (string, error) {
+		detail := fmt.Sprintf("hash %v, bits %08x", blockHash, light.BtcHeader.Bits)
+		return detail, CheckProofOfWork(&light.BtcHeader, opts.PowLimit)
+	})
+
+	r.run(CheckNamePowerParams, true, func() (string, error) {
+		return r.powerParams(light.decidePowerParams(opts.PowerPolicy))
+	})
+
+	r.run(CheckNameAddress, false, func() (string, error) {
+		if light.CoinbasePrefixLen > 0 {
+			return "", fmt.Errorf("%w: payout output 0", ErrHiddenOutputs)
+		}
+		coinbase, err := light.coinbase()
+		if err != nil {
+			return "", err
+		}
+		return r.payout(coinbase)
+	})
+
+	r.Valid = r.Err() == nil
+	r.Duration = time.Since(start)
+	return r
+}
+
+// powerParams records the delegation decided by marker m.
+func (r *Report) powerParams(m *PowerMarker, err error) (string, error) {
+	switch {
+	case err != nil:
+		return "", err
+	case m == nil:
+		return "not delegated", nil
+	}
+	r.Candidate, r.Reward = &m.Candidate, &m.Reward
+	if m.HasBlockHash {
+		r.PowerBlockHash = &m.BlockHash
+	}
+	return fmt.Sprintf("output %d delegates to candidate %v with reward address %v",
+		m.OutputIndex, m.Candidate, m.Reward), nil
+}
+
+// payout records the address paid by the first output of coinbase.
+func (r *Report) payout(coinbase *wire.MsgTx) (string, error) {
+	if len(coinbase.TxOut) == 0 {
+		return "", ErrCoinbaseNoOutputs
+	}
+	addr, addrType := coinbaseAddress(coinbase.TxOut[0].PkScript)
+	switch addrType {
+	case PUBKEYHASH:
+		r.PayoutAddress, r.PayoutType = &addr, addrType
+		return "p2pkh payout", nil
+	case WITNESS_V0_KEYHASH:
+		r.PayoutAddress, r.PayoutType = &addr, addrType
+		return "p2wpkh payout", nil
+	}
+	return "", fmt.Errorf("%w %x", ErrUnsupportedPayout, coinbase.TxOut[0].PkScript)
+}
+
+func describeCoinbaseSize(coinbase *wire.MsgTx) string {
+	if coinbase.HasWitness() {
+		return fmt.Sprintf("coinbase of %d bytes, %d without witness",
+			coinbase.SerializeSize(), coinbase.SerializeSizeStripped())
+	}
+	return fmt.Sprintf("coinbase of %d bytes", coinbase.SerializeSize())
+}
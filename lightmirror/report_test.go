@@ -0,0 +1,183 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func reportMirror() *BtcLightMirrorV2 {
+	coinbase := validCoinbase()
+	coinbase.TxOut[0].PkScript = mustDecodeHex("0014" + "7cd7f1f2e0b5b1fb2b6b5e0a5cff59ab4a2e2d61")
+	coinbase.AddTxOut(wire.NewTxOut(0, mustDecodeHex("6a2d434f524501"+
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"+
+		"1111111111111111111111111111111111111111")))
+	light := testMirrorV2(coinbase, 6)
+	mineHeader(&light.BtcHeader)
+	return light
+}
+
+func checkReport(t *testing.T, r *Report, failed ...string) {
+	t.Helper()
+	names := []string{CheckNameStructure, CheckNameCoinbase, CheckNameMerkle,
+		CheckNamePoW, CheckNamePowerParams, CheckNameAddress}
+	if len(r.Checks) != len(names) {
+		t.Fatalf("report has %d checks, want %d", len(r.Checks), len(names))
+	}
+	for i, c := range r.Checks {
+		if c.Name != names[i] {
+			t.Errorf("check #%d is %q, want %q", i, c.Name, names[i])
+		}
+		wantPassed := true
+		for _, name := range failed {
+			if c.Name == name {
+				wantPassed = false
+			}
+		}
+		if c.Passed != wantPassed || (c.Err() == nil) != wantPassed || (c.Error == "") != wantPassed {
+			t.Errorf("check %s: passed %v, error %v, want passed %v", c.Name, c.Passed, c.Err(), wantPassed)
+		}
+	}
+}
+
+func TestVerifyReport(t *testing.T) {
+	opts := &VerifyOptions{PowLimit: chaincfg.RegressionNetParams.PowLimit}
+
+	light := reportMirror()
+	r := light.Verify(opts)
+	checkReport(t, r)
+	if !r.Valid || r.Err() != nil || r.Version != 2 {
+		t.Fatalf("valid mirror reported as %+v", r)
+	}
+	if r.Candidate == nil || *r.Candidate != common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa") {
+		t.Errorf("candidate %v", r.Candidate)
+	}
+	if r.PayoutAddress == nil || r.PayoutType != WITNESS_V0_KEYHASH {
+		t.Errorf("payout %v type %d", r.PayoutAddress, r.PayoutType)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BlockHash != light.BtcHeader.BlockHash().String() || !decoded.Valid ||
+		len(decoded.Checks) != len(r.Checks) || *decoded.Reward != *r.Reward {
+		t.Errorf("JSON round trip: %s", data)
+	}
+
+	// Failures do not stop the other checks.
+	bad := reportMirror()
+	bad.MerkleNodes[0][0] ^= 1
+	bad.BtcHeader.Bits = chaincfg.RegressionNetParams.PowLimitBits + 1
+	bad.CoinBaseTx.TxOut[0].PkScript = []byte{0x51}
+	r = bad.Verify(opts)
+	checkReport(t, r, CheckNameMerkle, CheckNamePoW, CheckNameAddress)
+	if r.Valid || !errors.Is(r.Err(), r.Check(CheckNameMerkle).Err()) {
+		t.Errorf("invalid mirror: valid %v, error %v", r.Valid, r.Err())
+	}
+
+	// An unsupported payout script is informational only.
+	odd := reportMirror()
+	odd.CoinBaseTx.TxOut[0].PkScript = []byte{0x51}
+	odd.BtcHeader.MerkleRoot = MerkleBranchRoot(odd.CoinBaseTx.TxHash(), 0, odd.MerkleNodes)
+	mineHeader(&odd.BtcHeader)
+	r = odd.Verify(opts)
+	checkReport(t, r, CheckNameAddress)
+	if !r.Valid || r.PayoutAddress != nil {
+		t.Errorf("unsupported payout: %+v", r)
+	}
+
+	v1 := &BtcLightMirror{BtcHeader: light.BtcHeader, CoinBaseTx: light.CoinBaseTx}
+	r = v1.Verify(opts)
+	checkReport(t, r, CheckNameMerkle)
+	if r.Version != 1 {
+		t.Errorf("v1 report version %d", r.Version)
+	}
+	if r := v1.Verify(nil); r.Check(CheckNamePoW).Passed {
+		t.Errorf("regtest proof of work accepted on the main network")
+	}
+}
+
+func TestVerifyReportV3(t *testing.T) {
+	opts := &VerifyOptions{PowLimit: chaincfg.RegressionNetParams.PowLimit}
+	strict := &VerifyOptions{PowLimit: opts.PowLimit, PowerPolicy: PowerPolicyStrict}
+
+	// Every check runs when nothing is compressed.
+	light := reportMirror()
+	var raw bytes.Buffer
+	if err := light.CoinBaseTx.SerializeNoWitness(&raw); err != nil {
+		t.Fatal(err)
+	}
+	midstate, err := sha256Midstate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := &BtcLightMirrorV3{
+		BtcHeader:        light.BtcHeader,
+		CoinbaseMidstate: midstate,
+		CoinbaseTail:     raw.Bytes(),
+		TailOutputOffset: uint64(outputOffset(&light.CoinBaseTx, 1)),
+		OutputCount:      2,
+		TailOutputIndex:  1,
+		MerkleNodes:      light.MerkleNodes,
+	}
+	r := small.Verify(strict)
+	checkReport(t, r)
+	if !r.Valid || r.Version != 3 || r.PayoutType != WITNESS_V0_KEYHASH {
+		t.Fatalf("valid mirror reported as %+v", r)
+	}
+
+	// The marker of a large coinbase follows outputs hidden in the prefix.
+	v2 := largeCoinbaseMirror(300)
+	mineHeader(&v2.BtcHeader)
+	large, err := NewBtcLightMirrorV3(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = large.Verify(opts)
+	checkReport(t, r, CheckNameAddress)
+	if !r.Valid || r.Candidate == nil || *r.Candidate != common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa") {
+		t.Errorf("first policy: %+v", r)
+	}
+	if err := r.Check(CheckNameAddress).Err(); !errors.Is(err, ErrHiddenOutputs) {
+		t.Errorf("address of a compressed payout: got %v, want %v", err, ErrHiddenOutputs)
+	}
+
+	r = large.Verify(strict)
+	checkReport(t, r, CheckNamePowerParams, CheckNameAddress)
+	if r.Valid || !errors.Is(r.Err(), ErrHiddenOutputs) || r.Candidate != nil {
+		t.Errorf("strict policy: valid %v, error %v", r.Valid, r.Err())
+	}
+
+	// The txid recovered from a wrong midstate is not in the block.
+	bad := *large
+	bad.CoinbaseMidstate[0] ^= 1
+	r = bad.Verify(opts)
+	checkReport(t, r, CheckNameMerkle, CheckNameAddress)
+	var mismatch *MerkleMismatchError
+	if !errors.As(r.Err(), &mismatch) {
+		t.Errorf("wrong midstate: got %v, want a merkle mismatch", r.Err())
+	}
+
+	// A tail offset off the output boundaries breaks the structure.
+	bad = *large
+	bad.TailOutputOffset++
+	r = bad.Verify(opts)
+	checkReport(t, r, CheckNameStructure, CheckNameMerkle, CheckNamePowerParams, CheckNameAddress)
+	if !errors.Is(r.Err(), ErrOutputBoundary) {
+		t.Errorf("shifted tail: got %v, want %v", r.Err(), ErrOutputBoundary)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Since BIP141 every coinbase of a block with witness transactions carries the
+// 32 byte witness reserved value in its input witness.  Serialize writes it
+// together with the segwit marker and flag, yet none of it contributes to the
+// txid the merkle branch commits to.  Stripping it makes the mirror smaller
+// and cheaper to submit without affecting verification.
+
+// MirrorOption configures how CreateBtcLightMirrorV2 builds a mirror.
+type MirrorOption func(*mirrorOptions)
+
+type mirrorOptions struct {
+	stripWitness bool
+}
+
+// WithoutWitness makes CreateBtcLightMirrorV2 drop the witness data of the
+// coinbase transaction, as StripWitness does.
+func WithoutWitness() MirrorOption {
+	return func(opts *mirrorOptions) {
+		opts.stripWitness = true
+	}
+}
+
+// StripWitness drops the witness data of the coinbase transaction.  The
+// transaction is replaced by a copy, so transactions shared with the caller
+// are left untouched.
+func (light *BtcLightMirror) StripWitness() {
+	light.CoinBaseTx = *stripWitness(&light.CoinBaseTx)
+}
+
+// SerializeSize returns the number of bytes Serialize writes.
+func (light *BtcLightMirror) SerializeSize() int {
+	return wire.MaxBlockHeaderPayload + light.CoinBaseTx.SerializeSize() +
+		serializeHashesSize(len(light.TxHashes))
+}
+
+// StripWitness drops the witness data of the coinbase transaction.  The
+// transaction is replaced by a copy, so transactions shared with the caller
+// are left untouched.
+func (light *BtcLightMirrorV2) StripWitness() {
+	light.CoinBaseTx = *stripWitness(&light.CoinBaseTx)
+}
+
+// SerializeSize returns the number of bytes Serialize writes.
+func (light *BtcLightMirrorV2) SerializeSize() int {
+	return wire.MaxBlockHeaderPayload + light.CoinBaseTx.SerializeSize() +
+		serializeHashesSize(len(light.MerkleNodes))
+}
+
+// serializeHashesSize returns the size of a varint prefixed list of n hashes.
+func serializeHashesSize(n int) int {
+	return wire.VarIntSerializeSize(uint64(n)) + n*chainhash.HashSize
+}
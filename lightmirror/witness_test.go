@@ -0,0 +1,339 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package lightmirror
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// segwitBlock returns a block laid out like a mainnet segwit block: a BIP34
+// coinbase paying to payouts, followed by a valid BIP141 witness commitment,
+// and txCount-1 witness spends.  The coinbase input witness holds the witness
+// reserved value.
+func segwitBlock(height int32, tag string, payouts [][]byte, txCount int) *wire.MsgBlock {
+	scriptSig, err := txscript.NewScriptBuilder().
+		AddInt64(int64(height)).
+		AddData([]byte(tag)).
+		AddData([]byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x00, 0x00, 0x2a}).
+		Script()
+	if err != nil {
+		panic(err)
+	}
+
+	coinbase := wire.NewMsgTx(2)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  scriptSig,
+		Witness:          wire.TxWitness{make([]byte, blockchain.CoinbaseWitnessDataLen)},
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	for i, pkScript := range payouts {
+		value := int64(0)
+		if i == 0 {
+			value = 625e6 + 31415926
+		}
+		coinbase.AddTxOut(wire.NewTxOut(value, pkScript))
+	}
+
+	block := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   0x20000000,
+		Timestamp: time.Unix(1650000000, 0),
+		Bits:      0x170901ba,
+	})
+	block.AddTransaction(coinbase)
+	for i := 1; i < txCount; i++ {
+		spend := wire.NewMsgTx(2)
+		spend.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Hash: chainhash.Hash{byte(i), byte(i >> 8)}},
+			Witness: wire.TxWitness{
+				bytes.Repeat([]byte{0x30}, 72),
+				bytes.Repeat([]byte{0x02}, 33),
+			},
+			Sequence: wire.MaxTxInSequenceNum - 1,
+		})
+		spend.AddTxOut(wire.NewTxOut(int64(i)*1000, payouts[0]))
+		block.AddTransaction(spend)
+	}
+
+	// The witness commitment covers the wtxids, the coinbase counting as
+	// zero, and the witness reserved value.
+	wtxids := []chainhash.Hash{{}}
+	for _, tx := range block.Transactions[1:] {
+		wtxids = append(wtxids, tx.WitnessHash())
+	}
+	merkles := BuildMerkleTreeStore(&wtxids[0], wtxids[1:])
+	var preimage [2 * chainhash.HashSize]byte
+	copy(preimage[:], merkles[len(merkles)-1][:])
+	commitment := chainhash.DoubleHashB(preimage[:])
+	pkScript := append([]byte{txscript.OP_RETURN, txscript.OP_DATA_36}, blockchain.WitnessMagicBytes[2:]...)
+	coinbase.AddTxOut(wire.NewTxOut(0, append(pkScript, commitment...)))
+
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+	}
+	merkles = BuildMerkleTreeStore(&txids[0], txids[1:])
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	return block
+}
+
+// calldataGas is the EIP-2028 gas cost of b as transaction calldata.
+func calldataGas(b []byte) int {
+	gas := 0
+	for _, c := range b {
+		if c == 0 {
+			gas += 4
+		} else {
+			gas += 16
+		}
+	}
+	return gas
+}
+
+func serializeMirrorV2(t *testing.T, light *BtcLightMirrorV2) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := light.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != light.SerializeSize() {
+		t.Fatalf("SerializeSize %d, wrote %d bytes", light.SerializeSize(), buf.Len())
+	}
+	return buf.Bytes()
+}
+
+func TestStripWitness(t *testing.T) {
+	coreMarker := mustDecodeHex("6a2d434f524501" +
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+		"1111111111111111111111111111111111111111")
+	p2wpkh := mustDecodeHex("0014" + "7cd7f1f2e0b5b1fb2b6b5e0a5cff59ab4a2e2d61")
+	p2sh := mustDecodeHex("a914" + "b4d8d1f8a1b2ec3b0f6a3c0e4b4c3f5d3e9a7a6187")
+	p2tr := mustDecodeHex("5120" + "3a8d3f1e0ad1d9f7c7b6e3e0e8b0a5b1f2c3d4e5f60718293a4b5c6d7e8f9012")
+	p2pkh := mustDecodeHex("76a914" + "c825a1ecf2a6830c4401620c3a16f1995057c2ab" + "88ac")
+
+	tests := []struct {
+		name    string
+		height  int32
+		tag     string
+		payouts [][]byte
+		txCount int
+	}{
+		{"p2wpkh payout", 730000, "/pool/", [][]byte{p2wpkh}, 2000},
+		{"p2sh payout delegating to core", 740000, "/Mined by core pool/", [][]byte{p2sh, coreMarker}, 3500},
+		{"p2tr payout with split rewards", 800000, "/OCEAN.XYZ/", [][]byte{p2tr, p2pkh, p2wpkh, coreMarker}, 4000},
+	}
+
+	for _, test := range tests {
+		block := segwitBlock(test.height, test.tag, test.payouts, test.txCount)
+		if err := blockchain.ValidateWitnessCommitment(btcutil.NewBlock(block)); err != nil {
+			t.Fatalf("%s: invalid test block: %v", test.name, err)
+		}
+		txids := make([]chainhash.Hash, len(block.Transactions))
+		for i, tx := range block.Transactions {
+			txids[i] = tx.TxHash()
+		}
+
+		full := CreateBtcLightMirrorV2(&block.Header, block.Transactions[0], txids)
+		stripped := CreateBtcLightMirrorV2(&block.Header, block.Transactions[0], txids, WithoutWitness())
+		if !full.CoinBaseTx.HasWitness() || stripped.CoinBaseTx.HasWitness() {
+			t.Fatalf("%s: WithoutWitness did not strip the witness", test.name)
+		}
+		for _, light := range []*BtcLightMirrorV2{full, stripped} {
+			if err := light.CheckMerkle(); err != nil {
+				t.Fatalf("%s: CheckMerkle: %v", test.name, err)
+			}
+		}
+		if full.MirrorID() != stripped.MirrorID() {
+			t.Errorf("%s: stripping changed the mirror id", test.name)
+		}
+		cand, reward, _ := full.ParsePowerParams()
+		strippedCand, strippedReward, _ := stripped.ParsePowerParams()
+		if cand != strippedCand || reward != strippedReward {
+			t.Errorf("%s: stripping changed the power params", test.name)
+		}
+
+		fullRaw := serializeMirrorV2(t, full)
+		strippedRaw := serializeMirrorV2(t, stripped)
+		var decoded BtcLightMirrorV2
+		if err := decoded.DeserializeStrict(strippedRaw); err != nil {
+			t.Errorf("%s: stripped mirror is not canonical: %v", test.name, err)
+		}
+
+		// Marker, flag, stack item count and length prefix of the 32
+		// byte reserved value.
+		const wantSaved = 2 + 1 + 1 + blockchain.CoinbaseWitnessDataLen
+		const wantGasSaved = 4 + 16 + 16 + 16 + 4*blockchain.CoinbaseWitnessDataLen
+		saved := len(fullRaw) - len(strippedRaw)
+		gasSaved := calldataGas(fullRaw) - calldataGas(strippedRaw)
+		if saved != wantSaved || gasSaved != wantGasSaved {
+			t.Errorf("%s: stripping saved %d bytes and %d gas, want %d and %d",
+				test.name, saved, gasSaved, wantSaved, wantGasSaved)
+		}
+		t.Logf("%s: %d -> %d bytes, %d -> %d calldata gas", test.name,
+			len(fullRaw), len(strippedRaw), calldataGas(fullRaw), calldataGas(strippedRaw))
+
+		// StripWitness on a mirror sharing the block's coinbase leaves
+		// the block alone.
+		full.StripWitness()
+		if full.CoinBaseTx.HasWitness() || !block.Transactions[0].HasWitness() {
+			t.Errorf("%s: StripWitness stripped the wrong transaction", test.name)
+		}
+		if !bytes.Equal(serializeMirrorV2(t, full), strippedRaw) {
+			t.Errorf("%s: StripWitness and WithoutWitness disagree", test.name)
+		}
+
+		v1 := &BtcLightMirror{BtcHeader: block.Header, CoinBaseTx: *block.Transactions[0], TxHashes: txids[1:]}
+		size := v1.SerializeSize()
+		v1.StripWitness()
+		if err := v1.CheckMerkle(); err != nil {
+			t.Errorf("%s: v1 CheckMerkle after StripWitness: %v", test.name, err)
+		}
+		if v1.SerializeSize() != size-wantSaved {
+			t.Errorf("%s: v1 StripWitness saved %d bytes, want %d",
+				test.name, size-v1.SerializeSize(), wantSaved)
+		}
+	}
+}
+
+// TestMainnetSegwitCoinbase strips the coinbases of mainnet segwit blocks,
+// taken from btcd's wire test data, and checks them against their merkle
+// branches.
+func TestMainnetSegwitCoinbase(t *testing.T) {
+	tests := []struct {
+		hash     string
+		header   string
+		coinbase string
+		branch   []string
+		stripped int
+		txid     string
+	}{
+		{
+			hash: "00000000000000000021868c2cefc52a480d173c849412fe81c4e5ab806f94ab",
+			header: "00000020a1d2b3b757ad55fa1c670f9f59372a2a26f1a85197711e000000000000000000" +
+				"70be58da7ef0a754ef5947910fa1bb0c19160d641cf212ae46ba53e0327233bc2367905b2dd72917" +
+				"4c3ae2db",
+			coinbase: "020000000001010000000000000000000000000000000000000000000000000000000000000000" +
+				"ffffffff4b03cb3d08042467905b642f4254432e434f4d2ffabe6d6d61ea3fdfc3d238e128fb27c9" +
+				"7f95d4bd49881fcf8784fc34ae86bcb827505eba0100000000000000300f894eba58000000000000" +
+				"ffffffff03b203c64a0000000016001497cfc76442fe717f2a3f0cc9c175f7561b66199700000000" +
+				"00000000266a24aa21a9ed7c6e421f55cf406e383b46d829600dee545f127de76bb3ec4dc8fea7ea" +
+				"96d70900000000000000002952534b424c4f434b3ae3fc068128effed4a212959a1f8fde5d7caa01" +
+				"226071d40c530b99f90e099ed501200000000000000000000000000000000000000000000000000000" +
+				"00000000000000000000",
+			branch: []string{
+				"0686f5daff3b7df5eeee91f0a7b088b791d90eedaf5fe7a86caf0efa996397e5",
+				"3c3515ba606a9a5da59bcb6d010b78ce0a1bc10f1e4b5ac4dc26311a12f94a15",
+				"2e5dc009b1dcf49f4208525395b21c91378a728410a01f436ac6ef56a38bfd6f",
+				"ab63176dc40ae8c7fabc7d96704ca86a02f38c66388c3f1980ba55a5779475e8",
+				"8f3d7a12a88982b97fe1761ed5a2bbdc734741bb7ccf324e6be4041f71d4ce87",
+				"100af102ab346cc1c19c248a5dd48c40f565d93824fac13226092130a70cecbe",
+				"3df6badf194d2b2b37379a6cc0d2dd1d549fac704c2a0445c31502da822d6722",
+				"f8d7a8087256bae032c4576046b13af00033c2f335a55619e4b4e27a17cd8472",
+			},
+			stripped: 254,
+			txid:     "5301a7831d21d8395e511ba4786ddcd71b630148bd6bb902f4b1c71b7df563ed",
+		},
+		{
+			hash: "0000000000000000001602407ac49862a7bca9d00f7f402db20b7be2f5de59d2",
+			header: "0000002075aec137238bdabdc10d6cb80178ef9f6f3e5d869a891a000000000000000000" +
+				"529e3a982a92c01aa00100bbb97e1e20670433d1297b24e0de66a8889f5843735773ca5c114e2c17" +
+				"0ef23499",
+			coinbase: "020000000001010000000000000000000000000000000000000000000000000000000000000000" +
+				"ffffffff4b03f8c208044173ca5c662f4254432e434f4d2ffabe6d6d06ec30e7f6a7105653add831" +
+				"2ff758e919cbcfdb6905af82bd7bcddafddef189080000005fb54ad0037d055d2c15000000000000" +
+				"ffffffff02a1997d4d0000000016001497cfc76442fe717f2a3f0cc9c175f7561b66199700000000" +
+				"00000000266a24aa21a9ed26402ed52f8eee7114e8f5c57c79a7862371c7f0dbfe51e7152e67d36b" +
+				"143593012000000000000000000000000000000000000000000000000000000000000000000000" +
+				"0000",
+			branch: []string{
+				"a80bb6aea647e2ba69d0c5189b0976734d3918d4e9d6e0cb5bef07549706c8d1",
+				"3aa57678534ebd969456a69d754bba823881e0d2d42655d744cb7ad03d546e00",
+				"ab252d29c759ea8e140418a33775a53cccbdd81f9f15011501a09bc9d8d3b91a",
+				"9df8c75d24ea062b63c51298c056e483956deb41baabe124eea6e3cf182a932b",
+				"ed616d0522bc55ca3932709ce65334dc16358e1e669f623d85e274f4097bac80",
+				"c1c2c995a0be8c2efbed46c11a620906504a8d3f05f6cf7d35b126532f0b81fe",
+				"9330f570a3a3c8ce83cd784bd61993b7ecf089158399bef8a33c98fb3ff500cd",
+				"72a6369b93102c46b93afb51a96ae596ae383f3825e8ac01308a38ac8547a80a",
+				"79a3360c5898e67f853574f8307e12de4ba5880f1b45432c3f5e17aa0ee7352d",
+				"4d43d26bb7fde2c991ce777c30bb9cbbed8d4be46490b6b057fce6c46c7e8e3f",
+				"662ee0c5c70b86e0e977ee5af9f666f01307cfffc21cdfe50728582fb2b9dbe1",
+				"baef5a8cd18a30c290715e95f68274aed031aed1f706e57102201aec24c58521",
+			},
+			stripped: 204,
+			txid:     "57233bf44b82ef3662479e5c80f71ba00c1ae82e8c9739213841f27a2f3d0d79",
+		},
+	}
+
+	for _, test := range tests {
+		var light BtcLightMirrorV2
+		if err := light.BtcHeader.Deserialize(bytes.NewReader(mustDecodeHex(test.header))); err != nil {
+			t.Fatal(err)
+		}
+		if got := light.BtcHeader.BlockHash().String(); got != test.hash {
+			t.Fatalf("header of block %s hashes to %s", test.hash, got)
+		}
+		if err := light.CoinBaseTx.Deserialize(bytes.NewReader(mustDecodeHex(test.coinbase))); err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range test.branch {
+			hash, err := chainhash.NewHashFromStr(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			light.MerkleNodes = append(light.MerkleNodes, *hash)
+		}
+
+		if !light.CoinBaseTx.HasWitness() {
+			t.Fatalf("%s: coinbase without witness", test.hash)
+		}
+		if err := light.CheckMerkle(); err != nil {
+			t.Errorf("%s: CheckMerkle with witness: %v", test.hash, err)
+		}
+		id := light.MirrorID()
+
+		light.StripWitness()
+		if light.CoinBaseTx.HasWitness() {
+			t.Fatalf("%s: StripWitness left the witness", test.hash)
+		}
+		var buf bytes.Buffer
+		if err := light.CoinBaseTx.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != test.stripped {
+			t.Errorf("%s: stripped coinbase of %d bytes, want %d", test.hash, buf.Len(), test.stripped)
+		}
+		if got := light.CoinBaseTx.TxHash().String(); got != test.txid {
+			t.Errorf("%s: stripped coinbase txid %s, want %s", test.hash, got, test.txid)
+		}
+		if err := light.CheckMerkle(); err != nil {
+			t.Errorf("%s: CheckMerkle without witness: %v", test.hash, err)
+		}
+		if light.MirrorID() != id {
+			t.Errorf("%s: stripping changed the mirror id", test.hash)
+		}
+
+		var decoded BtcLightMirrorV2
+		if err := decoded.DeserializeStrict(serializeMirrorV2(t, &light)); err != nil {
+			t.Errorf("%s: stripped mirror is not canonical: %v", test.hash, err)
+		}
+	}
+}
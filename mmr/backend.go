@@ -0,0 +1,308 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package mmr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ErrNotFound is returned by a Backend for positions it does not hold.
+var ErrNotFound = errors.New("node not found")
+
+// Backend stores the leaves and nodes of an accumulator.  Nodes are numbered
+// by their MMR position and only ever appended or truncated.
+type Backend interface {
+	// Leaves returns the number of stored leaves.
+	Leaves() (uint64, error)
+
+	// Leaf returns the leaf at index i.
+	Leaf(i uint64) (Leaf, error)
+
+	// Node returns the node at position pos.
+	Node(pos uint64) (chainhash.Hash, error)
+
+	// Append stores leaf together with the nodes its insertion creates:
+	// the hash of the leaf followed by the merged mountains.
+	Append(leaf Leaf, nodes []chainhash.Hash) error
+
+	// Truncate keeps the first n leaves and their nodes.
+	Truncate(n uint64) error
+}
+
+// MemoryBackend is a Backend that keeps the accumulator in memory only.
+type MemoryBackend struct {
+	mu     sync.RWMutex
+	leaves []Leaf
+	nodes  []chainhash.Hash
+}
+
+// Leaves returns the number of stored leaves.
+func (b *MemoryBackend) Leaves() (uint64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return uint64(len(b.leaves)), nil
+}
+
+// Leaf returns the leaf at index i.
+func (b *MemoryBackend) Leaf(i uint64) (Leaf, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if i >= uint64(len(b.leaves)) {
+		return Leaf{}, fmt.Errorf("%w: leaf %d", ErrNotFound, i)
+	}
+	return b.leaves[i], nil
+}
+
+// Node returns the node at position pos.
+func (b *MemoryBackend) Node(pos uint64) (chainhash.Hash, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if pos >= uint64(len(b.nodes)) {
+		return chainhash.Hash{}, fmt.Errorf("%w: position %d", ErrNotFound, pos)
+	}
+	return b.nodes[pos], nil
+}
+
+// Append stores leaf and its nodes.
+func (b *MemoryBackend) Append(leaf Leaf, nodes []chainhash.Hash) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.leaves = append(b.leaves, leaf)
+	b.nodes = append(b.nodes, nodes...)
+	return nil
+}
+
+// Truncate keeps the first n leaves and their nodes.
+func (b *MemoryBackend) Truncate(n uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n < uint64(len(b.leaves)) {
+		b.leaves = b.leaves[:n]
+		b.nodes = b.nodes[:size(n)]
+	}
+	return nil
+}
+
+// FileBackend is a Backend that keeps the accumulator in two append-only
+// files of fixed size records in a directory: the leaves and the nodes.  A
+// leaf is only written once its nodes are on stable storage, and
+// OpenFileBackend drops the trailing leaves that lack their nodes or do not
+// match them, so after a crash the accumulator holds the leaves appended
+// before it, except possibly the last ones.
+type FileBackend struct {
+	mu     sync.Mutex
+	leaves *os.File
+	nodes  *os.File
+	n      uint64
+}
+
+// OpenFileBackend opens the accumulator kept in dir, creating it if needed.
+func OpenFileBackend(dir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	leaves, err := os.OpenFile(filepath.Join(dir, "leaves"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := os.OpenFile(filepath.Join(dir, "nodes"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		leaves.Close()
+		return nil, err
+	}
+
+	b := &FileBackend{leaves: leaves, nodes: nodes}
+	if err := b.recover(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// recover truncates both files to the leaves whose nodes are complete and
+// match them.
+func (b *FileBackend) recover() error {
+	leafInfo, err := b.leaves.Stat()
+	if err != nil {
+		return err
+	}
+	nodeInfo, err := b.nodes.Stat()
+	if err != nil {
+		return err
+	}
+
+	n := uint64(leafInfo.Size()) / leafSize
+	nodes := uint64(nodeInfo.Size()) / chainhash.HashSize
+	for n > 0 && size(n) > nodes {
+		n--
+	}
+
+	// The leaves are not synced before the next one is appended, so the
+	// last records may not have reached the disk although the file grew.
+	b.n = n
+	for b.n > 0 {
+		ok, err := b.consistent(b.n - 1)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		b.n--
+	}
+	return b.truncate(b.n)
+}
+
+// consistent reports whether leaf i and the nodes its insertion created
+// match.
+func (b *FileBackend) consistent(i uint64) (bool, error) {
+	var buf [leafSize]byte
+	if _, err := b.leaves.ReadAt(buf[:], int64(i*leafSize)); err != nil {
+		return false, err
+	}
+	var leaf Leaf
+	leaf.decode(buf[:])
+
+	node := leaf.NodeHash()
+	for level := 0; ; level++ {
+		var stored chainhash.Hash
+		_, err := b.nodes.ReadAt(stored[:], int64(position(level, i>>level)*chainhash.HashSize))
+		if err != nil {
+			return false, err
+		}
+		if stored != node {
+			return false, nil
+		}
+		if (i>>level)&1 == 0 {
+			return true, nil
+		}
+		var left chainhash.Hash
+		_, err = b.nodes.ReadAt(left[:], int64(position(level, (i>>level)-1)*chainhash.HashSize))
+		if err != nil {
+			return false, err
+		}
+		node = hashNodes(&left, &node)
+	}
+}
+
+// Leaves returns the number of stored leaves.
+func (b *FileBackend) Leaves() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.n, nil
+}
+
+// Leaf returns the leaf at index i.
+func (b *FileBackend) Leaf(i uint64) (Leaf, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var leaf Leaf
+	if i >= b.n {
+		return leaf, fmt.Errorf("%w: leaf %d", ErrNotFound, i)
+	}
+	var buf [leafSize]byte
+	if _, err := b.leaves.ReadAt(buf[:], int64(i*leafSize)); err != nil {
+		return leaf, err
+	}
+	leaf.decode(buf[:])
+	return leaf, nil
+}
+
+// Node returns the node at position pos.
+func (b *FileBackend) Node(pos uint64) (chainhash.Hash, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var node chainhash.Hash
+	if pos >= size(b.n) {
+		return node, fmt.Errorf("%w: position %d", ErrNotFound, pos)
+	}
+	_, err := b.nodes.ReadAt(node[:], int64(pos*chainhash.HashSize))
+	return node, err
+}
+
+// Append writes the nodes, syncs them and then writes leaf.
+func (b *FileBackend) Append(leaf Leaf, nodes []chainhash.Hash) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buf := make([]byte, 0, len(nodes)*chainhash.HashSize)
+	for i := range nodes {
+		buf = append(buf, nodes[i][:]...)
+	}
+	if _, err := b.nodes.WriteAt(buf, int64(size(b.n)*chainhash.HashSize)); err != nil {
+		return err
+	}
+	if err := b.nodes.Sync(); err != nil {
+		return err
+	}
+
+	enc := leaf.encode()
+	if _, err := b.leaves.WriteAt(enc[:], int64(b.n*leafSize)); err != nil {
+		return err
+	}
+	b.n++
+	return nil
+}
+
+// Truncate keeps the first n leaves and their nodes.
+func (b *FileBackend) Truncate(n uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n >= b.n {
+		return nil
+	}
+	if err := b.truncate(n); err != nil {
+		return err
+	}
+	b.n = n
+	return nil
+}
+
+// truncate cuts the files to n leaves.  The leaves go first so that a crash
+// in between leaves complete leaves behind.
+func (b *FileBackend) truncate(n uint64) error {
+	if err := b.leaves.Truncate(int64(n * leafSize)); err != nil {
+		return err
+	}
+	return b.nodes.Truncate(int64(size(n) * chainhash.HashSize))
+}
+
+// Sync commits the files to stable storage.
+func (b *FileBackend) Sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.nodes.Sync(); err != nil {
+		return err
+	}
+	return b.leaves.Sync()
+}
+
+// Close syncs and closes the files.
+func (b *FileBackend) Close() error {
+	err := b.Sync()
+	if cerr := b.leaves.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := b.nodes.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
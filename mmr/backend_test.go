@@ -0,0 +1,153 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package mmr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBackend(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mmr")
+	backend, err := OpenFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := New(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory, err := New(new(MemoryBackend))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 37; i++ {
+		if _, err := acc.Add(testLeaf(i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := memory.Add(testLeaf(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := acc.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := memory.Root(); root != want {
+		t.Fatalf("file root %v, memory root %v", root, want)
+	}
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash while appending: a torn node and the nodes of a
+	// leaf that was never written.
+	nodes, err := os.OpenFile(filepath.Join(dir, "nodes"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes.Write(make([]byte, 32*3+7)); err != nil {
+		t.Fatal(err)
+	}
+	nodes.Close()
+
+	reopen := func() *Accumulator {
+		t.Helper()
+		backend, err = OpenFileBackend(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc, err := New(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acc
+	}
+	acc = reopen()
+	if acc.Leaves() != 37 {
+		t.Fatalf("%d leaves after reopening, want 37", acc.Leaves())
+	}
+	if got, _ := acc.Root(); got != root {
+		t.Fatalf("root %v after reopening, want %v", got, root)
+	}
+	proof, err := acc.Prove(testLeaf(20).Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.Verify(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := acc.Rewind(30); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Rewind(30); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 105; i++ {
+		if _, err := acc.Add(testLeaf(i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := memory.Add(testLeaf(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend.Close()
+
+	// A leaf written without its nodes is dropped as well.
+	leaves, err := os.OpenFile(filepath.Join(dir, "leaves"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaves.Write(make([]byte, leafSize)); err != nil {
+		t.Fatal(err)
+	}
+	leaves.Close()
+
+	acc = reopen()
+	if acc.Leaves() != 35 {
+		t.Fatalf("%d leaves after reopening, want 35", acc.Leaves())
+	}
+	got, err := acc.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := memory.Root(); got != want {
+		t.Errorf("root %v after rewinding, want %v", got, want)
+	}
+	backend.Close()
+
+	// The last two leaf records grew the file but never reached the disk,
+	// although their nodes did.
+	leaves, err = os.OpenFile(filepath.Join(dir, "leaves"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaves.WriteAt(make([]byte, 2*leafSize), 33*leafSize); err != nil {
+		t.Fatal(err)
+	}
+	leaves.Close()
+
+	acc = reopen()
+	defer backend.Close()
+	if acc.Leaves() != 33 {
+		t.Fatalf("%d leaves after reopening, want 33", acc.Leaves())
+	}
+	if err := memory.Rewind(33); err != nil {
+		t.Fatal(err)
+	}
+	got, err = acc.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := memory.Root(); got != want {
+		t.Errorf("root %v after dropping torn leaves, want %v", got, want)
+	}
+	if _, err := acc.Add(testLeaf(34)); err != nil {
+		t.Fatal(err)
+	}
+}
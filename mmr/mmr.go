@@ -0,0 +1,307 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package mmr implements a Merkle Mountain Range accumulator over mirrored
+// blocks.  Every verified mirror appends a leaf committing to its block hash
+// and the candidate and reward address it delegates to, zero when it does
+// not delegate.  The 32 byte root commits to every leaf so far, so Core can
+// keep it instead of old headers and settle disputes about an old block with
+// an inclusion proof.
+//
+// Leaves and the inner nodes of the mountains are kept by a Backend in the
+// usual post-order of MMR positions, which makes the storage append-only.
+// Appending a leaf costs one hash per merged mountain, proofs have one node
+// per mountain level plus the other peaks.
+package mmr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Hash prefixes separate leaves, inner nodes and the root.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+	rootPrefix = 0x02
+)
+
+var (
+	// ErrUnknownBlock is returned when proving a block that is not in the
+	// accumulator.
+	ErrUnknownBlock = errors.New("block not in accumulator")
+
+	// ErrDuplicateBlock is returned when adding a block twice.
+	ErrDuplicateBlock = errors.New("block already in accumulator")
+
+	// ErrRootMismatch is returned when a proof does not lead to the
+	// expected root.
+	ErrRootMismatch = errors.New("proof does not match root")
+)
+
+// Leaf is what the accumulator commits to for a block.
+type Leaf struct {
+	Hash      chainhash.Hash
+	Candidate common.Address
+	Reward    common.Address
+}
+
+// leafSize is the size of an encoded Leaf.
+const leafSize = chainhash.HashSize + 2*common.AddressLength
+
+// encode returns the leaf as stored and hashed.
+func (l *Leaf) encode() [leafSize]byte {
+	var buf [leafSize]byte
+	copy(buf[:], l.Hash[:])
+	copy(buf[chainhash.HashSize:], l.Candidate[:])
+	copy(buf[chainhash.HashSize+common.AddressLength:], l.Reward[:])
+	return buf
+}
+
+// decode sets the leaf from its encoding.
+func (l *Leaf) decode(buf []byte) {
+	copy(l.Hash[:], buf)
+	copy(l.Candidate[:], buf[chainhash.HashSize:])
+	copy(l.Reward[:], buf[chainhash.HashSize+common.AddressLength:])
+}
+
+// NodeHash returns the hash of the leaf in the mountains.
+func (l *Leaf) NodeHash() chainhash.Hash {
+	var buf [1 + leafSize]byte
+	buf[0] = leafPrefix
+	enc := l.encode()
+	copy(buf[1:], enc[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// hashNodes returns the parent of left and right.
+func hashNodes(left, right *chainhash.Hash) chainhash.Hash {
+	var buf [1 + 2*chainhash.HashSize]byte
+	buf[0] = nodePrefix
+	copy(buf[1:], left[:])
+	copy(buf[1+chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// bagPeaks returns the root of an accumulator of the given number of leaves
+// with the given peaks, highest mountain first.
+func bagPeaks(leaves uint64, peaks []chainhash.Hash) chainhash.Hash {
+	buf := make([]byte, 1+8, 1+8+len(peaks)*chainhash.HashSize)
+	buf[0] = rootPrefix
+	binary.LittleEndian.PutUint64(buf[1:], leaves)
+	for i := range peaks {
+		buf = append(buf, peaks[i][:]...)
+	}
+	return chainhash.DoubleHashH(buf)
+}
+
+// size returns the number of nodes of an accumulator of n leaves.
+func size(n uint64) uint64 {
+	return 2*n - uint64(bits.OnesCount64(n))
+}
+
+// position returns the position of the node at the given level whose
+// subtree starts at leaf index<<level.
+func position(level int, index uint64) uint64 {
+	end := (index + 1) << level
+	// Appending the last leaf of the subtree merges the mountains up to
+	// its number of trailing zeros; the node is the level-th merge.
+	merges := bits.TrailingZeros64(end)
+	return size(end) - 1 - uint64(merges-level)
+}
+
+// mountain returns the height and first leaf of the mountain holding leaf i
+// in an accumulator of n leaves.
+func mountain(n, i uint64) (height int, first uint64) {
+	for h := 63; h >= 0; h-- {
+		if n&(1<<h) == 0 {
+			continue
+		}
+		if i < first+1<<h {
+			return h, first
+		}
+		first += 1 << h
+	}
+	return -1, first
+}
+
+// Accumulator is a Merkle Mountain Range over mirrored blocks.  It is safe
+// for concurrent use.
+type Accumulator struct {
+	mu      sync.RWMutex
+	backend Backend
+	leaves  uint64
+	byHash  map[chainhash.Hash]uint64
+}
+
+// New returns the accumulator kept by backend.
+func New(backend Backend) (*Accumulator, error) {
+	n, err := backend.Leaves()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Accumulator{
+		backend: backend,
+		leaves:  n,
+		byHash:  make(map[chainhash.Hash]uint64, n),
+	}
+	for i := uint64(0); i < n; i++ {
+		leaf, err := backend.Leaf(i)
+		if err != nil {
+			return nil, err
+		}
+		a.byHash[leaf.Hash] = i
+	}
+	return a, nil
+}
+
+// Leaves returns the number of leaves.
+func (a *Accumulator) Leaves() uint64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.leaves
+}
+
+// AddMirror appends the leaf of a verified mirror, decoding its power params
+// under policy.  It returns the index of the leaf.
+func (a *Accumulator) AddMirror(light *lightmirror.BtcLightMirrorV2, policy lightmirror.PowerPolicy) (uint64, error) {
+	leaf := Leaf{Hash: light.BtcHeader.BlockHash()}
+	m, err := lightmirror.ValidatePowerMarkers(&light.CoinBaseTx, policy)
+	if err != nil {
+		return 0, err
+	}
+	if m != nil {
+		leaf.Candidate, leaf.Reward = m.Candidate, m.Reward
+	}
+	return a.Add(leaf)
+}
+
+// Add appends leaf and returns its index.
+func (a *Accumulator) Add(leaf Leaf) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.byHash[leaf.Hash]; ok {
+		return 0, fmt.Errorf("%w: %v", ErrDuplicateBlock, leaf.Hash)
+	}
+
+	i := a.leaves
+	nodes := []chainhash.Hash{leaf.NodeHash()}
+	for level := 0; (i>>level)&1 == 1; level++ {
+		left, err := a.backend.Node(position(level, (i>>level)-1))
+		if err != nil {
+			return 0, err
+		}
+		nodes = append(nodes, hashNodes(&left, &nodes[len(nodes)-1]))
+	}
+	if err := a.backend.Append(leaf, nodes); err != nil {
+		return 0, err
+	}
+
+	a.leaves++
+	a.byHash[leaf.Hash] = i
+	return i, nil
+}
+
+// Rewind drops every leaf from index n on, as a reorganization of the Bitcoin
+// chain requires.
+func (a *Accumulator) Rewind(n uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n >= a.leaves {
+		return nil
+	}
+
+	dropped := make([]chainhash.Hash, 0, a.leaves-n)
+	for i := n; i < a.leaves; i++ {
+		leaf, err := a.backend.Leaf(i)
+		if err != nil {
+			return err
+		}
+		dropped = append(dropped, leaf.Hash)
+	}
+	if err := a.backend.Truncate(n); err != nil {
+		return err
+	}
+
+	for _, hash := range dropped {
+		delete(a.byHash, hash)
+	}
+	a.leaves = n
+	return nil
+}
+
+// Root returns the root committing to every leaf.
+func (a *Accumulator) Root() (chainhash.Hash, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	peaks, err := a.peaks(a.leaves, -1)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	return bagPeaks(a.leaves, peaks), nil
+}
+
+// peaks returns the peaks of the first n leaves, highest first, leaving out
+// the one of height skip.
+func (a *Accumulator) peaks(n uint64, skip int) ([]chainhash.Hash, error) {
+	var peaks []chainhash.Hash
+	first := uint64(0)
+	for h := 63; h >= 0; h-- {
+		if n&(1<<h) == 0 {
+			continue
+		}
+		if h != skip {
+			peak, err := a.backend.Node(position(h, first>>h))
+			if err != nil {
+				return nil, err
+			}
+			peaks = append(peaks, peak)
+		}
+		first += 1 << h
+	}
+	return peaks, nil
+}
+
+// Prove returns the inclusion proof of the block with the given hash against
+// the current root.
+func (a *Accumulator) Prove(hash chainhash.Hash) (*Proof, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	i, ok := a.byHash[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownBlock, hash)
+	}
+	leaf, err := a.backend.Leaf(i)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proof{Leaf: leaf, Index: i, Leaves: a.leaves}
+	height, _ := mountain(a.leaves, i)
+	for level := 0; level < height; level++ {
+		sibling, err := a.backend.Node(position(level, (i>>level)^1))
+		if err != nil {
+			return nil, err
+		}
+		p.Siblings = append(p.Siblings, sibling)
+	}
+	p.Peaks, err = a.peaks(a.leaves, height)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
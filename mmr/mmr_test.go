@@ -0,0 +1,261 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package mmr
+
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testLeaf(i int) Leaf {
+	leaf := Leaf{Hash: chainhash.Hash{byte(i), byte(i >> 8), 0xbb}}
+	if i%3 == 0 {
+		leaf.Candidate = common.Address{byte(i), 0xca}
+		leaf.Reward = common.Address{byte(i), 0xee}
+	}
+	return leaf
+}
+
+// mountainRoot hashes leaves, whose number is a power of two, into a peak
+// the straightforward way.
+func mountainRoot(leaves []Leaf) chainhash.Hash {
+	if len(leaves) == 1 {
+		return leaves[0].NodeHash()
+	}
+	left := mountainRoot(leaves[:len(leaves)/2])
+	right := mountainRoot(leaves[len(leaves)/2:])
+	return hashNodes(&left, &right)
+}
+
+// referenceRoot computes the root of leaves without positions.
+func referenceRoot(leaves []Leaf) chainhash.Hash {
+	var peaks []chainhash.Hash
+	rest := leaves
+	for h := 63; h >= 0; h-- {
+		if uint64(len(leaves))&(1<<h) != 0 {
+			peaks = append(peaks, mountainRoot(rest[:1<<h]))
+			rest = rest[1<<h:]
+		}
+	}
+	return bagPeaks(uint64(len(leaves)), peaks)
+}
+
+func TestPosition(t *testing.T) {
+	// Build the post-order of positions naively: every appended leaf is
+	// followed by the nodes it completes.
+	type node struct {
+		level int
+		index uint64
+	}
+	var order []node
+	for i := uint64(0); i < 300; i++ {
+		order = append(order, node{0, i})
+		for level := 0; (i>>level)&1 == 1; level++ {
+			order = append(order, node{level + 1, i >> (level + 1)})
+		}
+		if got := size(i + 1); got != uint64(len(order)) {
+			t.Fatalf("size(%d) = %d, want %d", i+1, got, len(order))
+		}
+	}
+	for pos, n := range order {
+		if got := position(n.level, n.index); got != uint64(pos) {
+			t.Errorf("position(%d, %d) = %d, want %d", n.level, n.index, got, pos)
+		}
+	}
+}
+
+func TestAccumulator(t *testing.T) {
+	acc, err := New(new(MemoryBackend))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var leaves []Leaf
+	roots := make(map[chainhash.Hash]bool)
+	for i := 0; i < 70; i++ {
+		leaf := testLeaf(i)
+		index, err := acc.Add(leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != uint64(i) {
+			t.Fatalf("Add returned index %d, want %d", index, i)
+		}
+		leaves = append(leaves, leaf)
+
+		root, err := acc.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := referenceRoot(leaves); root != want {
+			t.Fatalf("%d leaves: root %v, want %v", i+1, root, want)
+		}
+		if roots[root] {
+			t.Fatalf("%d leaves: root repeated", i+1)
+		}
+		roots[root] = true
+
+		for _, leaf := range leaves {
+			proof, err := acc.Prove(leaf.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proof.Leaf != leaf {
+				t.Fatalf("proof of %v is for %v", leaf.Hash, proof.Leaf.Hash)
+			}
+			if err := proof.Verify(root); err != nil {
+				t.Fatalf("%d leaves: proof of leaf %d: %v", i+1, proof.Index, err)
+			}
+			if len(proof.Siblings)+len(proof.Peaks) > 2*bits.Len(uint(i+1)) {
+				t.Fatalf("%d leaves: proof of %d nodes", i+1, len(proof.Siblings)+len(proof.Peaks))
+			}
+		}
+	}
+
+	if _, err := acc.Add(testLeaf(5)); !errors.Is(err, ErrDuplicateBlock) {
+		t.Errorf("duplicate: got %v, want %v", err, ErrDuplicateBlock)
+	}
+	if _, err := acc.Prove(chainhash.Hash{1}); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("unknown: got %v, want %v", err, ErrUnknownBlock)
+	}
+
+	// A reorganization replaces the last leaves.
+	if err := acc.Rewind(50); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acc.Prove(testLeaf(60).Hash); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("rewound leaf: got %v, want %v", err, ErrUnknownBlock)
+	}
+	leaves = leaves[:50]
+	for i := 1000; i < 1010; i++ {
+		if _, err := acc.Add(testLeaf(i)); err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, testLeaf(i))
+	}
+	root, err := acc.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := referenceRoot(leaves); root != want {
+		t.Errorf("after rewind: root %v, want %v", root, want)
+	}
+}
+
+func TestProof(t *testing.T) {
+	acc, err := New(new(MemoryBackend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 45; i++ {
+		if _, err := acc.Add(testLeaf(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := acc.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := acc.Prove(testLeaf(33).Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := proof.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	raw := append([]byte(nil), buf.Bytes()...)
+	var decoded Proof
+	if err := decoded.Deserialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, proof) {
+		t.Fatalf("decoded %+v, want %+v", &decoded, proof)
+	}
+	if err := decoded.Verify(root); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("proof of leaf 33 of 45: %d bytes", len(raw))
+
+	for _, n := range []int{0, 50, 80, len(raw) - 1} {
+		err := new(Proof).Deserialize(bytes.NewReader(raw[:n]))
+		if !errors.Is(err, lightmirror.ErrMalformedMirror) {
+			t.Errorf("cut at %d: got %v, want %v", n, err, lightmirror.ErrMalformedMirror)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *Proof)
+	}{
+		{"candidate", func(p *Proof) { p.Leaf.Candidate[0] ^= 1 }},
+		{"reward", func(p *Proof) { p.Leaf.Reward[0] ^= 1 }},
+		{"index", func(p *Proof) { p.Index ^= 1 }},
+		{"leaves", func(p *Proof) { p.Leaves++ }},
+		{"sibling", func(p *Proof) { p.Siblings[0][0] ^= 1 }},
+		{"peak", func(p *Proof) { p.Peaks[0][0] ^= 1 }},
+		{"missing peak", func(p *Proof) { p.Peaks = p.Peaks[1:] }},
+		{"out of range", func(p *Proof) { p.Index = p.Leaves }},
+	}
+	for _, test := range tests {
+		var p Proof
+		if err := p.Deserialize(bytes.NewReader(raw)); err != nil {
+			t.Fatal(err)
+		}
+		test.modify(&p)
+		if err := p.Verify(root); !errors.Is(err, ErrRootMismatch) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrRootMismatch)
+		}
+	}
+}
+
+func TestAddMirror(t *testing.T) {
+	candidate := common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	reward := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	marker := append([]byte{0x6a, 0x2d, 'C', 'O', 'R', 'E', 0x01}, candidate[:]...)
+	marker = append(marker, reward[:]...)
+
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{0x01, 0x01},
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	coinbase.AddTxOut(wire.NewTxOut(625000000, append([]byte{0x76, 0xa9, 0x14}, make([]byte, 22)...)))
+	coinbase.AddTxOut(wire.NewTxOut(0, marker))
+	light := lightmirror.CreateBtcLightMirrorV2(&wire.BlockHeader{Version: 4}, coinbase,
+		[]chainhash.Hash{coinbase.TxHash()})
+
+	acc, err := New(new(MemoryBackend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acc.AddMirror(light, lightmirror.PowerPolicyFirst); err != nil {
+		t.Fatal(err)
+	}
+	proof, err := acc.Prove(light.BtcHeader.BlockHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Leaf.Candidate != candidate || proof.Leaf.Reward != reward {
+		t.Errorf("leaf %+v, want candidate %v and reward %v", proof.Leaf, candidate, reward)
+	}
+
+	coinbase.AddTxOut(wire.NewTxOut(0, marker))
+	light.CoinBaseTx = *coinbase
+	light.BtcHeader.Nonce++
+	if _, err := acc.AddMirror(light, lightmirror.PowerPolicyStrict); !errors.Is(err, lightmirror.ErrAmbiguousDelegation) {
+		t.Errorf("ambiguous: got %v, want %v", err, lightmirror.ErrAmbiguousDelegation)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package mmr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// maxProofNodes bounds the siblings and peaks of a decoded proof, one per
+// bit of the leaf count.
+const maxProofNodes = 64
+
+// Proof is the inclusion proof of a leaf in an accumulator of Leaves leaves.
+type Proof struct {
+	Leaf Leaf
+
+	// Index is the position of the leaf and Leaves the number of leaves
+	// the root commits to.
+	Index  uint64
+	Leaves uint64
+
+	// Siblings are the nodes next to the leaf and its ancestors up to the
+	// peak of its mountain.
+	Siblings []chainhash.Hash
+
+	// Peaks are the peaks of the other mountains, highest first.
+	Peaks []chainhash.Hash
+}
+
+// Root returns the root the proof leads to.
+func (p *Proof) Root() (chainhash.Hash, error) {
+	if p.Index >= p.Leaves {
+		return chainhash.Hash{}, fmt.Errorf("%w: leaf %d of %d", ErrRootMismatch,
+			p.Index, p.Leaves)
+	}
+	height, _ := mountain(p.Leaves, p.Index)
+	if len(p.Siblings) != height || len(p.Peaks) != bits.OnesCount64(p.Leaves)-1 {
+		return chainhash.Hash{}, fmt.Errorf("%w: %d siblings and %d peaks for "+
+			"leaf %d of %d", ErrRootMismatch, len(p.Siblings), len(p.Peaks),
+			p.Index, p.Leaves)
+	}
+
+	node := p.Leaf.NodeHash()
+	for level := range p.Siblings {
+		if (p.Index>>level)&1 == 0 {
+			node = hashNodes(&node, &p.Siblings[level])
+		} else {
+			node = hashNodes(&p.Siblings[level], &node)
+		}
+	}
+
+	// The mountain of the leaf is preceded by the higher ones.
+	higher := bits.OnesCount64(p.Leaves >> (height + 1))
+	peaks := make([]chainhash.Hash, 0, len(p.Peaks)+1)
+	peaks = append(peaks, p.Peaks[:higher]...)
+	peaks = append(peaks, node)
+	peaks = append(peaks, p.Peaks[higher:]...)
+	return bagPeaks(p.Leaves, peaks), nil
+}
+
+// Verify checks that the proof leads to root.
+func (p *Proof) Verify(root chainhash.Hash) error {
+	got, err := p.Root()
+	if err != nil {
+		return err
+	}
+	if got != root {
+		return fmt.Errorf("%w: proof leads to %v, not %v", ErrRootMismatch, got, root)
+	}
+	return nil
+}
+
+// Deserialize decodes a proof from r into the receiver.
+func (p *Proof) Deserialize(r io.Reader) error {
+	const typ = "Proof"
+
+	var leaf [leafSize]byte
+	_, err := io.ReadFull(r, leaf[:])
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "leaf", Err: err}
+	}
+	p.Leaf.decode(leaf[:])
+
+	var buf [16]byte
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "index", Err: err}
+	}
+	p.Index = binary.LittleEndian.Uint64(buf[:8])
+	p.Leaves = binary.LittleEndian.Uint64(buf[8:])
+
+	p.Siblings, err = readNodes(r)
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "siblings", Err: err}
+	}
+
+	p.Peaks, err = readNodes(r)
+	if err != nil {
+		return &lightmirror.DecodeError{Type: typ, Field: "peaks", Err: err}
+	}
+
+	return nil
+}
+
+// Serialize encodes the proof to w.
+func (p *Proof) Serialize(w io.Writer) error {
+	leaf := p.Leaf.encode()
+	_, err := w.Write(leaf[:])
+	if err != nil {
+		return err
+	}
+
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], p.Index)
+	binary.LittleEndian.PutUint64(buf[8:], p.Leaves)
+	_, err = w.Write(buf[:])
+	if err != nil {
+		return err
+	}
+
+	err = writeNodes(w, p.Siblings)
+	if err != nil {
+		return err
+	}
+
+	return writeNodes(w, p.Peaks)
+}
+
+func readNodes(r io.Reader) ([]chainhash.Hash, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxProofNodes {
+		return nil, fmt.Errorf("%w [count %d, max %d]",
+			lightmirror.ErrTooManyMerkleNodes, count, maxProofNodes)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	nodes := make([]chainhash.Hash, count)
+	for i := range nodes {
+		_, err := io.ReadFull(r, nodes[i][:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+func writeNodes(w io.Writer, nodes []chainhash.Hash) error {
+	err := wire.WriteVarInt(w, 0, uint64(len(nodes)))
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		_, err := w.Write(node[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
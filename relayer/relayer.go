@@ -0,0 +1,355 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package relayer follows the Bitcoin best chain through a BlockSource and
+// hands a self-verified BtcLightMirrorV2 of every sufficiently confirmed block
+// to a Submitter.  Progress is persisted through a Store so a restarted
+// relayer resumes where it stopped, and reorganizations are detected by
+// comparing the recorded chain against the source.
+package relayer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+const (
+	// DefaultConfirmations is the number of confirmations a block needs
+	// before it is relayed when Config.Confirmations is zero.
+	DefaultConfirmations = 6
+
+	// DefaultPollInterval is how often Run polls the source for a new tip
+	// when Config.PollInterval is zero.
+	DefaultPollInterval = 30 * time.Second
+
+	// DefaultReorgDepth is how many submitted blocks are remembered for
+	// locating fork points when Config.ReorgDepth is zero.
+	DefaultReorgDepth = 144
+)
+
+// Config configures a Relayer.
+type Config struct {
+	// Source is the Bitcoin chain to follow.
+	Source blocksource.BlockSource
+
+	// Submitter receives every confirmed mirror.
+	Submitter Submitter
+
+	// Store persists progress.  A MemoryStore is used when nil.
+	Store Store
+
+	// StartHeight is the first height to relay when the store is empty.
+	StartHeight int64
+
+	// Confirmations is the number of confirmations, counting the block
+	// itself, a block needs before it is relayed.
+	Confirmations int64
+
+	// PollInterval is the delay between relay rounds in Run.
+	PollInterval time.Duration
+
+	// ReorgDepth is the number of submitted blocks remembered in the store.
+	// Deeper reorganizations are followed back through the parents of the
+	// stale blocks, or relayed again from StartHeight when the source no
+	// longer knows them.
+	ReorgDepth int
+
+	// PowLimit is the highest allowed proof of work target.  The main
+	// network limit is used when nil.
+	PowLimit *big.Int
+
+	// KeepWitness keeps the coinbase witness in submitted mirrors.  It is
+	// stripped by default since it only adds to the submission cost.
+	KeepWitness bool
+
+	// Logf, when set, receives progress and error messages.
+	Logf func(format string, args ...interface{})
+}
+
+// Relayer relays confirmed mirrors from a BlockSource to a Submitter.
+type Relayer struct {
+	cfg      Config
+	progress *Progress
+}
+
+// New creates a Relayer and loads its saved progress.
+func New(cfg Config) (*Relayer, error) {
+	if cfg.Source == nil {
+		return nil, errors.New("relayer: no block source")
+	}
+	if cfg.Submitter == nil {
+		return nil, errors.New("relayer: no submitter")
+	}
+	if cfg.Store == nil {
+		cfg.Store = &MemoryStore{}
+	}
+	if cfg.Confirmations <= 0 {
+		cfg.Confirmations = DefaultConfirmations
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.ReorgDepth <= 0 {
+		cfg.ReorgDepth = DefaultReorgDepth
+	}
+	if cfg.PowLimit == nil {
+		cfg.PowLimit = chaincfg.MainNetParams.PowLimit
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = func(string, ...interface{}) {}
+	}
+
+	progress, err := cfg.Store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("relayer: load progress: %v", err)
+	}
+
+	return &Relayer{cfg: cfg, progress: progress}, nil
+}
+
+// Tip returns the last block handed to the Submitter, or nil.
+func (r *Relayer) Tip() *BlockID {
+	tip := r.progress.Tip()
+	if tip == nil {
+		return nil
+	}
+	id := *tip
+	return &id
+}
+
+// Run relays blocks until ctx is cancelled.  Errors of a single round are
+// logged and the round is retried after the poll interval.
+func (r *Relayer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Step(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			r.cfg.Logf("relay round failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Step runs a single relay round: it handles a reorganization of the
+// submitted chain if one happened and then relays every newly confirmed
+// block.
+func (r *Relayer) Step(ctx context.Context) error {
+	best, err := r.cfg.Source.BestHeight(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := r.handleReorg(ctx); err != nil {
+		return err
+	}
+
+	next := r.cfg.StartHeight
+	if tip := r.progress.Tip(); tip != nil {
+		next = tip.Height + 1
+	}
+
+	for height := next; height <= best-r.cfg.Confirmations+1; height++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relayed, err := r.relay(ctx, height)
+		if err != nil {
+			return fmt.Errorf("height %d: %v", height, err)
+		}
+		if !relayed {
+			// The chain changed under us; the next round
+			// locates the fork point.
+			return nil
+		}
+	}
+	return nil
+}
+
+// handleReorg compares the submitted chain with the source and rewinds to the
+// fork point when they diverge.
+func (r *Relayer) handleReorg(ctx context.Context) error {
+	tip := r.progress.Tip()
+	if tip == nil {
+		return nil
+	}
+
+	onChain, err := r.onBestChain(ctx, tip)
+	if err != nil || onChain {
+		return err
+	}
+
+	fork, err := r.locateFork(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.cfg.Logf("reorganization: rewinding from height %d to %d (%v)",
+		tip.Height, fork.Height, fork.Hash)
+
+	if handler, ok := r.cfg.Submitter.(ReorgHandler); ok {
+		if err := handler.Reorg(ctx, fork); err != nil {
+			return err
+		}
+	}
+
+	r.progress.rewind(fork.Height)
+	if len(r.progress.Blocks) == 0 && fork.Height >= r.cfg.StartHeight {
+		// The fork lies below the remembered blocks; it becomes the
+		// tip the next blocks are relayed on.
+		r.progress.Blocks = []BlockID{fork}
+	}
+	return r.cfg.Store.Save(r.progress)
+}
+
+// locateFork returns the last submitted block still on the best chain.  It
+// looks at the remembered blocks first and then follows the parents of the
+// oldest one, which the source may still know although it left the best
+// chain.  When it does not, every block from StartHeight is treated as stale
+// and the fork is the block below StartHeight.
+func (r *Relayer) locateFork(ctx context.Context) (BlockID, error) {
+	for i := len(r.progress.Blocks) - 2; i >= 0; i-- {
+		onChain, err := r.onBestChain(ctx, &r.progress.Blocks[i])
+		if err != nil {
+			return BlockID{}, err
+		}
+		if onChain {
+			return r.progress.Blocks[i], nil
+		}
+	}
+
+	id := r.progress.Blocks[0]
+	for id.Height > r.cfg.StartHeight {
+		header, err := r.cfg.Source.BlockHeader(ctx, &id.Hash)
+		if errors.Is(err, blocksource.ErrBlockNotFound) {
+			break
+		}
+		if err != nil {
+			return BlockID{}, err
+		}
+		id = BlockID{Height: id.Height - 1, Hash: header.PrevBlock}
+		onChain, err := r.onBestChain(ctx, &id)
+		if err != nil {
+			return BlockID{}, err
+		}
+		if onChain {
+			return id, nil
+		}
+	}
+
+	r.cfg.Logf("reorganization below the known blocks: relaying again "+
+		"from height %d", r.cfg.StartHeight)
+	fork := BlockID{Height: r.cfg.StartHeight - 1}
+	hash, err := r.cfg.Source.BlockHash(ctx, fork.Height)
+	switch {
+	case err == nil:
+		fork.Hash = *hash
+	case !errors.Is(err, blocksource.ErrBlockNotFound):
+		return BlockID{}, err
+	}
+	return fork, nil
+}
+
+func (r *Relayer) onBestChain(ctx context.Context, id *BlockID) (bool, error) {
+	hash, err := r.cfg.Source.BlockHash(ctx, id.Height)
+	if errors.Is(err, blocksource.ErrBlockNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return hash.IsEqual(&id.Hash), nil
+}
+
+// relay builds, verifies and submits the mirror of the best chain block at
+// height.  It returns false without submitting when that block does not
+// extend the submitted tip.
+func (r *Relayer) relay(ctx context.Context, height int64) (bool, error) {
+	hash, err := r.cfg.Source.BlockHash(ctx, height)
+	if err != nil {
+		return false, err
+	}
+
+	mirror, err := r.cfg.Source.Mirror(ctx, hash)
+	if err != nil {
+		return false, err
+	}
+
+	if tip := r.progress.Tip(); tip != nil && tip.Height == height-1 &&
+		!mirror.BtcHeader.PrevBlock.IsEqual(&tip.Hash) {
+		return false, nil
+	}
+
+	if err := r.verify(mirror, hash); err != nil {
+		return false, err
+	}
+
+	if !r.cfg.KeepWitness {
+		mirror.StripWitness()
+	}
+
+	var buf bytes.Buffer
+	if err := mirror.Serialize(&buf); err != nil {
+		return false, err
+	}
+
+	sub := &Submission{
+		Block:  BlockID{Height: height, Hash: *hash},
+		ID:     mirror.MirrorID(),
+		Ref:    mirror.BlockRef(height),
+		Mirror: mirror,
+		Raw:    buf.Bytes(),
+	}
+	sub.Candidate, sub.Reward, sub.PowerBlockHash = mirror.ParsePowerParams()
+
+	if err := r.cfg.Submitter.Submit(ctx, sub); err != nil {
+		return false, err
+	}
+
+	r.progress.push(sub.Block, r.cfg.ReorgDepth)
+	if err := r.cfg.Store.Save(r.progress); err != nil {
+		return false, err
+	}
+
+	r.cfg.Logf("relayed block %d (%v)", height, hash)
+	return true, nil
+}
+
+// verify checks that mirror really is the block identified by hash: the
+// header hashes to it, carries valid proof of work and commits to the coinbase
+// through the merkle branch.
+func (r *Relayer) verify(mirror *lightmirror.BtcLightMirrorV2, hash *chainhash.Hash) error {
+	blockHash := mirror.BtcHeader.BlockHash()
+	if !blockHash.IsEqual(hash) {
+		return fmt.Errorf("mirror is for block %v, want %v", blockHash, hash)
+	}
+
+	report := mirror.Verify(&lightmirror.VerifyOptions{PowLimit: r.cfg.PowLimit})
+	if err := report.Err(); err != nil {
+		if data, jsonErr := json.Marshal(report); jsonErr == nil {
+			r.cfg.Logf("verification report: %s", data)
+		}
+		return err
+	}
+	return nil
+}
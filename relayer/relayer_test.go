@@ -0,0 +1,271 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package relayer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/chaingen"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+)
+
+// mineChain mines n blocks on a new chain and returns it with the blocks.
+// The relayers of the tests start above the genesis block.
+func mineChain(n int) (*chaingen.Chain, []*wire.MsgBlock) {
+	c := chaingen.New(nil)
+	return c, c.MineN(n, nil)
+}
+
+type recordingSubmitter struct {
+	subs   []*Submission
+	forks  []BlockID
+	failAt int64
+}
+
+func (s *recordingSubmitter) Submit(ctx context.Context, sub *Submission) error {
+	if s.failAt != 0 && sub.Block.Height == s.failAt {
+		return errors.New("submit failed")
+	}
+	s.subs = append(s.subs, sub)
+	return nil
+}
+
+func (s *recordingSubmitter) Reorg(ctx context.Context, fork BlockID) error {
+	s.forks = append(s.forks, fork)
+	return nil
+}
+
+func newTestRelayer(t *testing.T, source blocksource.BlockSource, sub Submitter, store Store) *Relayer {
+	r, err := New(Config{
+		Source:        source,
+		Submitter:     sub,
+		Store:         store,
+		StartHeight:   1,
+		Confirmations: 3,
+		PowLimit:      chaincfg.RegressionNetParams.PowLimit,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return r
+}
+
+func checkSubmitted(t *testing.T, subs []*Submission, blocks []*wire.MsgBlock, first int64) {
+	t.Helper()
+	if len(subs) != len(blocks) {
+		t.Fatalf("submitted %d blocks, want %d", len(subs), len(blocks))
+	}
+	for i, sub := range subs {
+		if sub.Block.Height != first+int64(i) {
+			t.Errorf("submission #%d height %d, want %d", i, sub.Block.Height, first+int64(i))
+		}
+		if want := blocks[i].BlockHash(); sub.Block.Hash != want {
+			t.Errorf("submission #%d hash %v, want %v", i, sub.Block.Hash, want)
+		}
+		if sub.ID != sub.Mirror.MirrorID() || sub.Ref.Hash != sub.Block.Hash {
+			t.Errorf("submission #%d keyed as %v %v", i, sub.ID, sub.Ref)
+		}
+	}
+}
+
+func TestRelayerConfirmations(t *testing.T) {
+	c, blocks := mineChain(10)
+	sub := &recordingSubmitter{}
+	r := newTestRelayer(t, c.Source(), sub, nil)
+
+	if err := r.Step(context.Background()); err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	checkSubmitted(t, sub.subs, blocks[:8], 1)
+
+	c.Mine(nil)
+	if err := r.Step(context.Background()); err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	checkSubmitted(t, sub.subs, blocks[:9], 1)
+}
+
+func TestRelayerResume(t *testing.T) {
+	c, blocks := mineChain(10)
+	store := NewFileStore(filepath.Join(t.TempDir(), "progress.json"))
+
+	sub := &recordingSubmitter{failAt: 6}
+	r := newTestRelayer(t, c.Source(), sub, store)
+	if err := r.Step(context.Background()); err == nil {
+		t.Fatalf("Step: expected submit error")
+	}
+	checkSubmitted(t, sub.subs, blocks[:5], 1)
+
+	sub = &recordingSubmitter{}
+	r = newTestRelayer(t, c.Source(), sub, store)
+	if tip := r.Tip(); tip == nil || tip.Height != 5 {
+		t.Fatalf("resumed tip %v, want height 5", tip)
+	}
+	if err := r.Step(context.Background()); err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	checkSubmitted(t, sub.subs, blocks[5:8], 6)
+}
+
+func TestRelayerReorg(t *testing.T) {
+	c, blocks := mineChain(10)
+	sub := &recordingSubmitter{}
+	r := newTestRelayer(t, c.Source(), sub, nil)
+
+	if err := r.Step(context.Background()); err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+
+	// Replace everything above height 5 with a longer branch.
+	branch, err := c.Fork(5, 7, &chaingen.Template{Tag: []byte("fork")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.subs = nil
+
+	if err := r.Step(context.Background()); err != nil {
+		t.Fatalf("Step: %v", err)
+	}
+	if len(sub.forks) != 1 || sub.forks[0].Height != 5 || sub.forks[0].Hash != blocks[4].BlockHash() {
+		t.Fatalf("reorg notifications %v, want fork at height 5", sub.forks)
+	}
+	checkSubmitted(t, sub.subs, branch[:5], 6)
+}
+
+// forgetfulSource does not know the blocks of chain that left its best
+// chain, as Electrum servers do.
+type forgetfulSource struct {
+	*blocksource.MemorySource
+	chain *chaingen.Chain
+}
+
+func (s forgetfulSource) BlockHeader(ctx context.Context, hash *chainhash.Hash) (*wire.BlockHeader, error) {
+	if _, height, ok := s.chain.Lookup(*hash); !ok || s.chain.Block(height).BlockHash() != *hash {
+		return nil, blocksource.ErrBlockNotFound
+	}
+	return s.MemorySource.BlockHeader(ctx, hash)
+}
+
+// TestRelayerDeepReorg reorganizes a chain below the single block a relayer
+// remembers.
+func TestRelayerDeepReorg(t *testing.T) {
+	for _, forgetful := range []bool{false, true} {
+		c, blocks := mineChain(10)
+		var source blocksource.BlockSource = c.Source()
+		if forgetful {
+			source = forgetfulSource{c.Source(), c}
+		}
+		sub := &recordingSubmitter{}
+		r, err := New(Config{
+			Source:        source,
+			Submitter:     sub,
+			StartHeight:   1,
+			Confirmations: 1,
+			ReorgDepth:    1,
+			PowLimit:      chaincfg.RegressionNetParams.PowLimit,
+		})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if err := r.Step(context.Background()); err != nil {
+			t.Fatalf("Step: %v", err)
+		}
+
+		branch, err := c.Fork(2, 10, &chaingen.Template{Tag: []byte("fork")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub.subs = nil
+		if err := r.Step(context.Background()); err != nil {
+			t.Fatalf("forgetful %v: Step after the reorg: %v", forgetful, err)
+		}
+
+		// The fork point is found through the parents of the stale tip,
+		// or everything is relayed again when the source forgot them.
+		want := BlockID{Height: 2, Hash: blocks[1].BlockHash()}
+		relayed := branch
+		if forgetful {
+			want = BlockID{Height: 0, Hash: c.Block(0).BlockHash()}
+			relayed = append(blocks[:2:2], branch...)
+		}
+		if len(sub.forks) != 1 || sub.forks[0] != want {
+			t.Fatalf("forgetful %v: reorg notifications %v, want %v", forgetful, sub.forks, want)
+		}
+		checkSubmitted(t, sub.subs, relayed, want.Height+1)
+		if tip := r.Tip(); tip == nil || tip.Hash != c.Tip().BlockHash() {
+			t.Errorf("forgetful %v: tip %v after the reorg", forgetful, tip)
+		}
+	}
+}
+
+type corruptSource struct {
+	*blocksource.MemorySource
+}
+
+func (s corruptSource) Mirror(ctx context.Context, hash *chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	mirror, err := s.MemorySource.Mirror(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	mirror.CoinBaseTx.TxOut[0].Value++
+	return mirror, nil
+}
+
+func TestRelayerRejectsInvalidMirror(t *testing.T) {
+	c, _ := mineChain(5)
+	source := corruptSource{c.Source()}
+	sub := &recordingSubmitter{}
+	r := newTestRelayer(t, source, sub, nil)
+
+	if err := r.Step(context.Background()); err == nil {
+		t.Fatalf("Step: expected verification error")
+	}
+	if len(sub.subs) != 0 || r.Tip() != nil {
+		t.Fatalf("invalid mirror was submitted")
+	}
+}
+
+func TestRelayerStripsWitness(t *testing.T) {
+	// A witness transaction gives the coinbases a witness nonce.
+	spend := chaingen.Spend(wire.OutPoint{}, wire.NewTxOut(1, []byte{txscript.OP_TRUE}))
+	spend.TxIn[0].Witness = wire.TxWitness{{1}}
+	c := chaingen.New(nil)
+	blocks := c.MineN(4, &chaingen.Template{Transactions: []*wire.MsgTx{spend}})
+
+	for _, keep := range []bool{false, true} {
+		sub := &recordingSubmitter{}
+		r, err := New(Config{
+			Source:        c.Source(),
+			Submitter:     sub,
+			StartHeight:   1,
+			Confirmations: 1,
+			PowLimit:      chaincfg.RegressionNetParams.PowLimit,
+			KeepWitness:   keep,
+		})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if err := r.Step(context.Background()); err != nil {
+			t.Fatalf("Step: %v", err)
+		}
+		checkSubmitted(t, sub.subs, blocks, 1)
+
+		for _, s := range sub.subs {
+			var decoded lightmirror.BtcLightMirrorV2
+			err := decoded.DeserializeStrict(s.Raw)
+			if keep != (err != nil) {
+				t.Fatalf("KeepWitness %v: strict decode of submission: %v", keep, err)
+			}
+		}
+	}
+}
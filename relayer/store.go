@@ -0,0 +1,176 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package relayer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// BlockID identifies a block on the chain followed by the relayer.
+type BlockID struct {
+	Height int64
+	Hash   chainhash.Hash
+}
+
+// Progress is the persisted state of a relayer.  Blocks holds the most recently
+// submitted blocks in ascending height order; the last entry is the tip that
+// has been handed to the Submitter.  Older entries are kept so that the fork
+// point of a reorganization can be located after a restart.
+type Progress struct {
+	Blocks []BlockID
+}
+
+// Tip returns the last submitted block, or nil if nothing was submitted yet.
+func (p *Progress) Tip() *BlockID {
+	if len(p.Blocks) == 0 {
+		return nil
+	}
+	return &p.Blocks[len(p.Blocks)-1]
+}
+
+// push records id as the new tip and keeps at most depth entries.
+func (p *Progress) push(id BlockID, depth int) {
+	p.Blocks = append(p.Blocks, id)
+	if len(p.Blocks) > depth {
+		p.Blocks = append(p.Blocks[:0], p.Blocks[len(p.Blocks)-depth:]...)
+	}
+}
+
+// rewind drops every entry above height.
+func (p *Progress) rewind(height int64) {
+	for len(p.Blocks) > 0 && p.Blocks[len(p.Blocks)-1].Height > height {
+		p.Blocks = p.Blocks[:len(p.Blocks)-1]
+	}
+}
+
+type jsonBlockID struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+type jsonProgress struct {
+	Blocks []jsonBlockID `json:"blocks"`
+}
+
+// MarshalJSON encodes the progress with hashes in their usual hex form.
+func (p *Progress) MarshalJSON() ([]byte, error) {
+	out := jsonProgress{Blocks: make([]jsonBlockID, len(p.Blocks))}
+	for i, id := range p.Blocks {
+		out.Blocks[i] = jsonBlockID{Height: id.Height, Hash: id.Hash.String()}
+	}
+	return json.Marshal(&out)
+}
+
+// UnmarshalJSON decodes progress written by MarshalJSON.
+func (p *Progress) UnmarshalJSON(data []byte) error {
+	var in jsonProgress
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	p.Blocks = make([]BlockID, len(in.Blocks))
+	for i, id := range in.Blocks {
+		p.Blocks[i].Height = id.Height
+		if err := chainhash.Decode(&p.Blocks[i].Hash, id.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store persists relayer progress between runs.
+type Store interface {
+	// Load returns the saved progress, or an empty Progress if nothing has
+	// been saved yet.
+	Load() (*Progress, error)
+
+	// Save replaces the saved progress.
+	Save(p *Progress) error
+}
+
+// MemoryStore is a Store that keeps progress in memory only.
+type MemoryStore struct {
+	mu       sync.Mutex
+	progress Progress
+}
+
+// Load returns a copy of the saved progress.
+func (s *MemoryStore) Load() (*Progress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &Progress{Blocks: append([]BlockID(nil), s.progress.Blocks...)}, nil
+}
+
+// Save replaces the saved progress with a copy of p.
+func (s *MemoryStore) Save(p *Progress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.progress.Blocks = append([]BlockID(nil), p.Blocks...)
+	return nil
+}
+
+// FileStore is a Store that keeps progress in a JSON file.  Saves are atomic:
+// the new state is written to a temporary file which then replaces the old
+// one, so a crash never leaves a truncated state file behind.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a FileStore that reads and writes path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load reads the progress file.  A missing file yields empty progress.
+func (s *FileStore) Load() (*Progress, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return &Progress{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Progress
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Save atomically replaces the progress file.
+func (s *FileStore) Save(p *Progress) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
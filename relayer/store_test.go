@@ -0,0 +1,48 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package relayer
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func TestFileStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "progress.json"))
+
+	p, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if p.Tip() != nil {
+		t.Fatalf("fresh store has tip %v", p.Tip())
+	}
+
+	for i := int64(0); i < 5; i++ {
+		p.push(BlockID{Height: i, Hash: chainhash.Hash{byte(i), 0xaa}}, 3)
+	}
+	if err := store.Save(p); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Fatalf("Load: got %v, want %v", got, p)
+	}
+	if len(got.Blocks) != 3 || got.Tip().Height != 4 {
+		t.Fatalf("Load: kept %d blocks with tip %v", len(got.Blocks), got.Tip())
+	}
+
+	got.rewind(2)
+	if tip := got.Tip(); tip == nil || tip.Height != 2 {
+		t.Fatalf("rewind: tip %v, want height 2", tip)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package relayer
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Submission is a confirmed, self-verified mirror ready to be relayed.
+type Submission struct {
+	// Block is the mirrored block.
+	Block BlockID
+
+	// ID identifies the mirror and Ref the mirrored block; both are
+	// suitable as deduplication keys.
+	ID  lightmirror.MirrorID
+	Ref lightmirror.BlockRef
+
+	// Mirror is the decoded mirror and Raw its serialized form.
+	Mirror *lightmirror.BtcLightMirrorV2
+	Raw    []byte
+
+	// Candidate, Reward and PowerBlockHash are the delegation parameters
+	// found in the coinbase by ParsePowerParams.  They are zero when the
+	// block carries no CORE marker.
+	Candidate      common.Address
+	Reward         common.Address
+	PowerBlockHash common.Hash
+}
+
+// Delegated reports whether the mirrored coinbase delegates its hash power to
+// a Core candidate.
+func (s *Submission) Delegated() bool {
+	return s.Candidate != (common.Address{})
+}
+
+// Submitter hands mirrors to their destination, typically the Core chain.
+//
+// Submit is called once per block in ascending height order.  Returning an
+// error stops the current relay round; the same block is submitted again on
+// the next round, so implementations should tolerate duplicates.
+type Submitter interface {
+	Submit(ctx context.Context, sub *Submission) error
+}
+
+// ReorgHandler may optionally be implemented by a Submitter that wants to be
+// told when previously submitted blocks were reorganized out of the best
+// chain.  Fork is the last block that is still on the best chain; every
+// submitted block above it is stale and will be replaced.
+type ReorgHandler interface {
+	Reorg(ctx context.Context, fork BlockID) error
+}
+
+// WriterSubmitter writes each submission as a JSON line to an io.Writer.  It
+// is mostly useful for dry runs and for feeding other tools.
+type WriterSubmitter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSubmitter returns a WriterSubmitter writing to w.
+func NewWriterSubmitter(w io.Writer) *WriterSubmitter {
+	return &WriterSubmitter{w: w}
+}
+
+type submissionLine struct {
+	Height    int64  `json:"height"`
+	Hash      string `json:"hash"`
+	ID        string `json:"id"`
+	Mirror    string `json:"mirror"`
+	Candidate string `json:"candidate,omitempty"`
+	Reward    string `json:"reward,omitempty"`
+}
+
+// Submit writes sub as a single JSON line.
+func (s *WriterSubmitter) Submit(ctx context.Context, sub *Submission) error {
+	line := submissionLine{
+		Height: sub.Block.Height,
+		Hash:   sub.Block.Hash.String(),
+		ID:     sub.ID.String(),
+		Mirror: hex.EncodeToString(sub.Raw),
+	}
+	if sub.Delegated() {
+		line.Candidate = sub.Candidate.Hex()
+		line.Reward = sub.Reward.Hex()
+	}
+
+	data, err := json.Marshal(&line)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rounds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Snapshot summarizes the blocks assigned to one round.  It is JSON
+// serializable so reward calculators can store and exchange it.
+type Snapshot struct {
+	Round uint64    `json:"round"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// FirstHeight and LastHeight bound the heights assigned to the round.
+	// With ByTimestamp other rounds may own heights in between.
+	FirstHeight int64 `json:"firstHeight"`
+	LastHeight  int64 `json:"lastHeight"`
+
+	// Blocks counts every block of the round, Delegated only those whose
+	// coinbase carries a delegation marker.
+	Blocks    int `json:"blocks"`
+	Delegated int `json:"delegated"`
+
+	// Straddling counts blocks whose own timestamp lies in another round.
+	Straddling int `json:"straddling"`
+
+	ByCandidate map[common.Address]int `json:"byCandidate"`
+	ByReward    map[common.Address]int `json:"byReward"`
+}
+
+func newSnapshot(schedule Schedule, round uint64, height int64) *Snapshot {
+	return &Snapshot{
+		Round:       round,
+		Start:       schedule.Start(round),
+		End:         schedule.End(round),
+		FirstHeight: height,
+		LastHeight:  height,
+		ByCandidate: make(map[common.Address]int),
+		ByReward:    make(map[common.Address]int),
+	}
+}
+
+func (s *Snapshot) copy() *Snapshot {
+	c := *s
+	c.ByCandidate = make(map[common.Address]int, len(s.ByCandidate))
+	for addr, n := range s.ByCandidate {
+		c.ByCandidate[addr] = n
+	}
+	c.ByReward = make(map[common.Address]int, len(s.ByReward))
+	for addr, n := range s.ByReward {
+		c.ByReward[addr] = n
+	}
+	return &c
+}
+
+// Mismatch is a single difference between two snapshots of a round.
+type Mismatch struct {
+	// Field is "delegated", "candidate" or "reward".
+	Field string `json:"field"`
+
+	// Address is set for per-candidate and per-reward differences.
+	Address common.Address `json:"address,omitempty"`
+
+	Want int `json:"want"`
+	Got  int `json:"got"`
+}
+
+// String describes the mismatch.
+func (m Mismatch) String() string {
+	if m.Field == "delegated" {
+		return fmt.Sprintf("delegated blocks: want %d, got %d", m.Want, m.Got)
+	}
+	return fmt.Sprintf("%s %v: want %d, got %d", m.Field, m.Address.Hex(), m.Want, m.Got)
+}
+
+// Diff compares the delegation counts of s, the expected values, with got,
+// for instance counts read back from the Core chain.  The result is ordered
+// by field and address and is empty when the snapshots agree.
+func (s *Snapshot) Diff(got *Snapshot) []Mismatch {
+	var out []Mismatch
+	if s.Delegated != got.Delegated {
+		out = append(out, Mismatch{Field: "delegated", Want: s.Delegated, Got: got.Delegated})
+	}
+	out = append(out, diffCounts("candidate", s.ByCandidate, got.ByCandidate)...)
+	out = append(out, diffCounts("reward", s.ByReward, got.ByReward)...)
+	return out
+}
+
+func diffCounts(field string, want, got map[common.Address]int) []Mismatch {
+	var out []Mismatch
+	for addr, n := range want {
+		if got[addr] != n {
+			out = append(out, Mismatch{Field: field, Address: addr, Want: n, Got: got[addr]})
+		}
+	}
+	for addr, n := range got {
+		if _, ok := want[addr]; !ok && n != 0 {
+			out = append(out, Mismatch{Field: field, Address: addr, Got: n})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(out[i].Address[:], out[j].Address[:]) < 0
+	})
+	return out
+}
+
+// ErrRollbackTooDeep is returned when a rollback reaches below the blocks an
+// Accountant still remembers.
+var ErrRollbackTooDeep = errors.New("rollback below the remembered blocks")
+
+// entry is what an Accountant remembers about a block to undo it.
+type entry struct {
+	round     uint64
+	straddles bool
+	candidate common.Address
+	reward    common.Address
+
+	// prevLast is the LastHeight of the round before the block, or -1
+	// when the block started the round.
+	prevLast int64
+}
+
+// Accountant builds per-round snapshots from a stream of verified mirrors.
+// It remembers the last maxHistory blocks, as many as its Assigner keeps
+// exact median times for, so that reorganizations up to that depth can be
+// rolled back.
+type Accountant struct {
+	schedule  Schedule
+	assigner  *Assigner
+	first     int64
+	pruned    bool
+	entries   []entry
+	snapshots map[uint64]*Snapshot
+}
+
+// NewAccountant returns an Accountant for schedule and mode.
+func NewAccountant(schedule Schedule, mode Mode) (*Accountant, error) {
+	assigner, err := NewAssigner(schedule, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &Accountant{
+		schedule:  schedule,
+		assigner:  assigner,
+		first:     -1,
+		snapshots: make(map[uint64]*Snapshot),
+	}, nil
+}
+
+// Assigner returns the underlying assigner, e.g. to Prime it.
+func (a *Accountant) Assigner() *Assigner {
+	return a.assigner
+}
+
+// Add accounts the verified mirror of the block at height, which must follow
+// the last added block.
+func (a *Accountant) Add(height int64, mirror *lightmirror.BtcLightMirrorV2) (*Assignment, error) {
+	asg, err := a.assigner.Add(height, &mirror.BtcHeader)
+	if err != nil {
+		return nil, err
+	}
+	if a.first < 0 {
+		a.first = height
+	}
+
+	e := entry{round: asg.Round, straddles: asg.Straddles(), prevLast: -1}
+	e.candidate, e.reward, _ = mirror.ParsePowerParams()
+
+	snap, ok := a.snapshots[asg.Round]
+	if ok {
+		e.prevLast = snap.LastHeight
+	} else {
+		snap = newSnapshot(a.schedule, asg.Round, height)
+		a.snapshots[asg.Round] = snap
+	}
+	snap.LastHeight = height
+	a.apply(snap, &e, 1)
+
+	a.entries = append(a.entries, e)
+	if len(a.entries) > 2*maxHistory {
+		drop := len(a.entries) - maxHistory
+		a.entries = append(a.entries[:0], a.entries[drop:]...)
+		a.first += int64(drop)
+		a.pruned = true
+	}
+
+	return asg, nil
+}
+
+func (a *Accountant) apply(snap *Snapshot, e *entry, delta int) {
+	snap.Blocks += delta
+	if e.straddles {
+		snap.Straddling += delta
+	}
+	if e.candidate == (common.Address{}) {
+		return
+	}
+
+	snap.Delegated += delta
+	snap.ByCandidate[e.candidate] += delta
+	if snap.ByCandidate[e.candidate] == 0 {
+		delete(snap.ByCandidate, e.candidate)
+	}
+	snap.ByReward[e.reward] += delta
+	if snap.ByReward[e.reward] == 0 {
+		delete(snap.ByReward, e.reward)
+	}
+}
+
+// Rollback removes every block above height.  It fails with
+// ErrRollbackTooDeep, leaving the accountant unchanged, when blocks above
+// height were already forgotten.
+func (a *Accountant) Rollback(height int64) error {
+	if a.pruned && height < a.first-1 {
+		return fmt.Errorf("%w: height %d, oldest block %d", ErrRollbackTooDeep,
+			height, a.first)
+	}
+	for len(a.entries) > 0 && a.first+int64(len(a.entries))-1 > height {
+		e := &a.entries[len(a.entries)-1]
+		snap := a.snapshots[e.round]
+		a.apply(snap, e, -1)
+		snap.LastHeight = e.prevLast
+		a.entries = a.entries[:len(a.entries)-1]
+
+		if snap.Blocks == 0 {
+			delete(a.snapshots, e.round)
+		}
+	}
+	if len(a.entries) == 0 && !a.pruned {
+		a.first = -1
+	}
+	a.assigner.Rollback(height)
+	return nil
+}
+
+// Snapshot returns a copy of the snapshot of round, or nil when no block was
+// assigned to it.
+func (a *Accountant) Snapshot(round uint64) *Snapshot {
+	snap, ok := a.snapshots[round]
+	if !ok {
+		return nil
+	}
+	return snap.copy()
+}
+
+// Snapshots returns copies of every snapshot in ascending round order.
+func (a *Accountant) Snapshots() []*Snapshot {
+	out := make([]*Snapshot, 0, len(a.snapshots))
+	for _, snap := range a.snapshots {
+		out = append(out, snap.copy())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Round < out[j].Round })
+	return out
+}
+
+// Settled returns the snapshots of rounds that can no longer gain blocks
+// because the given time, typically the median-time-past of the tip, has
+// moved past their end.
+func (a *Accountant) Settled(now time.Time) []*Snapshot {
+	var out []*Snapshot
+	for _, snap := range a.Snapshots() {
+		if !now.Before(snap.End) {
+			out = append(out, snap)
+		}
+	}
+	return out
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rounds
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	candidateA = common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	candidateB = common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	rewardX    = common.HexToAddress("0x1111111111111111111111111111111111111111")
+)
+
+func testMirror(timestamp time.Time, candidate common.Address) *lightmirror.BtcLightMirrorV2 {
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  []byte{0x01, 0x00},
+	})
+	coinbase.AddTxOut(wire.NewTxOut(50e8, []byte{txscript.OP_TRUE}))
+	if candidate != (common.Address{}) {
+		script := []byte{txscript.OP_RETURN, 45, 'C', 'O', 'R', 'E', 0x01}
+		script = append(script, candidate[:]...)
+		script = append(script, rewardX[:]...)
+		coinbase.AddTxOut(wire.NewTxOut(0, script))
+	}
+	return &lightmirror.BtcLightMirrorV2{
+		BtcHeader:  wire.BlockHeader{Timestamp: timestamp},
+		CoinBaseTx: *coinbase,
+	}
+}
+
+// boundaryChain returns block times around the midnight ending round 0 of an
+// hourly schedule.  Block 9 is stamped before the boundary although block 8
+// is already after it.
+func boundaryChain() []time.Time {
+	base := time.Unix(0, 0)
+	minutes := []int{2, 10, 18, 26, 34, 42, 50, 58, 61, 54, 66, 70, 75, 80, 85, 90, 95}
+	out := make([]time.Time, len(minutes))
+	for i, m := range minutes {
+		out[i] = base.Add(time.Duration(m) * time.Minute)
+	}
+	return out
+}
+
+func TestAssignerModes(t *testing.T) {
+	schedule := Schedule{Length: time.Hour}
+	times := boundaryChain()
+
+	byTime, _ := NewAssigner(schedule, ByTimestamp)
+	byMedian, _ := NewAssigner(schedule, ByMedianTime)
+
+	var prevMedian uint64
+	for height, ts := range times {
+		header := &wire.BlockHeader{Timestamp: ts}
+
+		asg, err := byTime.Add(int64(height), header)
+		if err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+		if asg.Straddles() {
+			t.Errorf("timestamp mode: block %d straddles", height)
+		}
+		if want := uint64(ts.Unix() / 3600); asg.Round != want {
+			t.Errorf("timestamp mode: block %d in round %d, want %d", height, asg.Round, want)
+		}
+
+		asg, err = byMedian.Add(int64(height), header)
+		if err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+		if asg.Round < prevMedian {
+			t.Errorf("median mode: block %d moved back to round %d", height, asg.Round)
+		}
+		prevMedian = asg.Round
+	}
+
+	// Block 9 is stamped at 0:54 after block 8 at 1:01: the raw timestamp
+	// goes back to round 0.
+	asg, _ := byTime.Add(int64(len(times)), &wire.BlockHeader{Timestamp: times[9]})
+	if asg.Round != 0 {
+		t.Fatalf("timestamp mode: got round %d, want 0", asg.Round)
+	}
+
+	if _, err := byTime.Add(100, &wire.BlockHeader{}); err == nil {
+		t.Fatalf("Add: expected error for non-consecutive height")
+	}
+}
+
+func TestAccountant(t *testing.T) {
+	schedule := Schedule{Length: time.Hour}
+	acct, err := NewAccountant(schedule, ByMedianTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	times := boundaryChain()
+	for height, ts := range times {
+		candidate := candidateA
+		if height%3 == 0 {
+			candidate = candidateB
+		}
+		if height%4 == 0 {
+			candidate = common.Address{}
+		}
+		if _, err := acct.Add(int64(height), testMirror(ts, candidate)); err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+
+	snaps := acct.Snapshots()
+	if len(snaps) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(snaps))
+	}
+	total := 0
+	for _, snap := range snaps {
+		total += snap.Blocks
+		if int64(snap.Blocks) != snap.LastHeight-snap.FirstHeight+1 {
+			t.Errorf("round %d: %d blocks over heights %d-%d", snap.Round,
+				snap.Blocks, snap.FirstHeight, snap.LastHeight)
+		}
+	}
+	if total != len(times) {
+		t.Fatalf("snapshots hold %d blocks, want %d", total, len(times))
+	}
+	if snaps[1].Straddling == 0 && snaps[0].Straddling == 0 {
+		t.Errorf("no straddling block detected")
+	}
+
+	// Settled rounds are those that ended before the given time.
+	if settled := acct.Settled(schedule.End(0)); len(settled) != 1 || settled[0].Round != 0 {
+		t.Fatalf("Settled: %v", settled)
+	}
+
+	// JSON round trip keeps the snapshot intact.
+	data, err := json.Marshal(snaps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if diff := snaps[0].Diff(&decoded); len(diff) != 0 {
+		t.Fatalf("decoded snapshot differs: %v", diff)
+	}
+
+	onChain := snaps[1].copy()
+	onChain.Delegated--
+	onChain.ByCandidate[candidateA]--
+	onChain.ByCandidate[common.HexToAddress("0x01")] = 2
+	want := []Mismatch{
+		{Field: "delegated", Want: snaps[1].Delegated, Got: snaps[1].Delegated - 1},
+		{Field: "candidate", Address: common.HexToAddress("0x01"), Want: 0, Got: 2},
+		{Field: "candidate", Address: candidateA, Want: snaps[1].ByCandidate[candidateA],
+			Got: snaps[1].ByCandidate[candidateA] - 1},
+	}
+	if got := snaps[1].Diff(onChain); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Diff: got %v, want %v", got, want)
+	}
+
+	// Rolling back the whole second round removes its snapshot, and
+	// replaying the blocks restores it.
+	before := acct.Snapshot(1)
+	if err := acct.Rollback(before.FirstHeight - 1); err != nil {
+		t.Fatal(err)
+	}
+	if acct.Snapshot(1) != nil {
+		t.Fatalf("Rollback: round 1 survived")
+	}
+	for height := before.FirstHeight; height < int64(len(times)); height++ {
+		candidate := candidateA
+		if height%3 == 0 {
+			candidate = candidateB
+		}
+		if height%4 == 0 {
+			candidate = common.Address{}
+		}
+		if _, err := acct.Add(height, testMirror(times[height], candidate)); err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+	if after := acct.Snapshot(1); !reflect.DeepEqual(after, before) {
+		t.Fatalf("replayed snapshot %+v, want %+v", after, before)
+	}
+}
+
+func TestAccountantRollbackAll(t *testing.T) {
+	schedule := Schedule{Length: time.Hour}
+	acct, err := NewAccountant(schedule, ByTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Unix(0, 0)
+	for height := int64(10); height < 14; height++ {
+		ts := base.Add(time.Duration(height) * time.Minute)
+		if _, err := acct.Add(height, testMirror(ts, candidateA)); err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+
+	// Rolling back past the first block empties the accountant, and
+	// blocks on the other branch start from the fork point.
+	if err := acct.Rollback(7); err != nil {
+		t.Fatal(err)
+	}
+	if snaps := acct.Snapshots(); len(snaps) != 0 {
+		t.Fatalf("Rollback: %d snapshots left", len(snaps))
+	}
+	for height := int64(8); height < 11; height++ {
+		ts := base.Add(time.Duration(height) * time.Minute)
+		if _, err := acct.Add(height, testMirror(ts, candidateB)); err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+
+	snap := acct.Snapshot(0)
+	if snap == nil || snap.FirstHeight != 8 || snap.LastHeight != 10 || snap.Blocks != 3 ||
+		snap.ByCandidate[candidateB] != 3 || snap.ByCandidate[candidateA] != 0 {
+		t.Fatalf("snapshot after rollback %+v", snap)
+	}
+	if err := acct.Rollback(9); err != nil {
+		t.Fatal(err)
+	}
+	if snap := acct.Snapshot(0); snap == nil || snap.LastHeight != 9 || snap.Blocks != 2 {
+		t.Fatalf("snapshot after partial rollback %+v", snap)
+	}
+}
+
+// TestAccountantPruning checks that an accountant following a long chain
+// forgets old blocks but still rolls back recent ones.
+func TestAccountantPruning(t *testing.T) {
+	schedule := Schedule{Length: time.Hour}
+	acct, err := NewAccountant(schedule, ByTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, _ := NewAccountant(schedule, ByTimestamp)
+
+	// Six blocks per round, every other one delegated.
+	const n = 3 * maxHistory
+	base := time.Unix(0, 0)
+	mirror := func(height int64, candidate common.Address) *lightmirror.BtcLightMirrorV2 {
+		if height%2 == 0 {
+			candidate = common.Address{}
+		}
+		return testMirror(base.Add(time.Duration(height)*10*time.Minute), candidate)
+	}
+	for height := int64(0); height < n; height++ {
+		if _, err := acct.Add(height, mirror(height, candidateA)); err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+	if !acct.pruned || len(acct.entries) > 2*maxHistory {
+		t.Fatalf("%d blocks remembered", len(acct.entries))
+	}
+
+	if err := acct.Rollback(acct.first - 2); !errors.Is(err, ErrRollbackTooDeep) {
+		t.Fatalf("deep rollback: got %v, want %v", err, ErrRollbackTooDeep)
+	}
+
+	// A rollback within the remembered blocks and a replay on another
+	// branch give the snapshots of an accountant that saw only the branch.
+	fork := acct.first + 3
+	if err := acct.Rollback(fork); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	for height := int64(0); height < n; height++ {
+		candidate := candidateA
+		if height > fork {
+			candidate = candidateB
+			if _, err := acct.Add(height, mirror(height, candidate)); err != nil {
+				t.Fatalf("Add(%d): %v", height, err)
+			}
+		}
+		if _, err := reference.Add(height, mirror(height, candidate)); err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+	if got, want := acct.Snapshots(), reference.Snapshots(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshots after the reorganization differ")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rounds
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// medianTimeBlocks is the number of blocks, including the block itself, whose
+// timestamps make up the median-time-past.
+const medianTimeBlocks = 11
+
+// maxHistory is the minimum number of timestamps an Assigner remembers.  It
+// bounds memory use and, together with medianTimeBlocks, the deepest rollback
+// after which median times are still exact.
+const maxHistory = 2016 + medianTimeBlocks
+
+// Mode selects which block time decides the round.
+type Mode int
+
+const (
+	// ByTimestamp uses the header timestamp.  Bitcoin timestamps are not
+	// monotonic, so a block may land in an earlier round than its parent.
+	ByTimestamp Mode = iota
+
+	// ByMedianTime uses the median-time-past of the block and its ten
+	// predecessors.  It never decreases along a chain, so rounds are
+	// contiguous ranges of heights, at the cost of lagging the wall clock
+	// by roughly an hour.
+	ByMedianTime
+)
+
+// String returns the name of the mode.
+func (m Mode) String() string {
+	switch m {
+	case ByTimestamp:
+		return "timestamp"
+	case ByMedianTime:
+		return "mediantime"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// Assignment is the round of a single block.
+type Assignment struct {
+	Height int64
+	Round  uint64
+
+	// Time is the time the round was derived from.
+	Time time.Time
+
+	// TimestampRound is the round of the raw header timestamp.  It differs
+	// from Round when the block straddles a boundary, that is when its
+	// timestamp and its median-time-past fall into different rounds.
+	TimestampRound uint64
+}
+
+// Straddles reports whether the block's own timestamp disagrees with the
+// round it was assigned to.
+func (a *Assignment) Straddles() bool {
+	return a.Round != a.TimestampRound
+}
+
+// Assigner assigns consecutive blocks of a chain to rounds.  It remembers the
+// timestamps of recent blocks to compute median-time-past and to roll back
+// after reorganizations.
+type Assigner struct {
+	schedule Schedule
+	mode     Mode
+
+	// height is the height of the last block in timestamps.
+	height     int64
+	timestamps []time.Time
+}
+
+// NewAssigner returns an Assigner for schedule and mode.
+func NewAssigner(schedule Schedule, mode Mode) (*Assigner, error) {
+	if err := schedule.Validate(); err != nil {
+		return nil, err
+	}
+	if mode != ByTimestamp && mode != ByMedianTime {
+		return nil, fmt.Errorf("unknown round mode %v", mode)
+	}
+	return &Assigner{schedule: schedule, mode: mode, height: -1}, nil
+}
+
+// Prime seeds the assigner with the timestamps of the blocks ending at
+// height, oldest first.  An assigner that starts in the middle of the chain
+// needs the ten preceding timestamps to compute exact median times.
+func (a *Assigner) Prime(height int64, timestamps []time.Time) {
+	a.height = height
+	a.timestamps = append(a.timestamps[:0], timestamps...)
+}
+
+// Add assigns the block at height, which must follow the last added block.
+func (a *Assigner) Add(height int64, header *wire.BlockHeader) (*Assignment, error) {
+	if a.height >= 0 && height != a.height+1 {
+		return nil, fmt.Errorf("block %d does not follow block %d", height, a.height)
+	}
+	a.height = height
+	a.timestamps = append(a.timestamps, header.Timestamp)
+	if len(a.timestamps) > 2*maxHistory {
+		a.timestamps = append(a.timestamps[:0], a.timestamps[len(a.timestamps)-maxHistory:]...)
+	}
+
+	asg := &Assignment{
+		Height:         height,
+		Time:           header.Timestamp,
+		TimestampRound: a.schedule.RoundAt(header.Timestamp),
+	}
+	if a.mode == ByMedianTime {
+		asg.Time = a.medianTime()
+	}
+	asg.Round = a.schedule.RoundAt(asg.Time)
+	return asg, nil
+}
+
+// Rollback forgets every block above height.
+func (a *Assigner) Rollback(height int64) {
+	if height >= a.height {
+		return
+	}
+	drop := a.height - height
+	if drop > int64(len(a.timestamps)) {
+		drop = int64(len(a.timestamps))
+	}
+	a.timestamps = a.timestamps[:int64(len(a.timestamps))-drop]
+	a.height = height
+}
+
+// medianTime returns the median of the last medianTimeBlocks timestamps.
+func (a *Assigner) medianTime() time.Time {
+	start := len(a.timestamps) - medianTimeBlocks
+	if start < 0 {
+		start = 0
+	}
+	window := append([]time.Time(nil), a.timestamps[start:]...)
+	sort.Slice(window, func(i, j int) bool { return window[i].Before(window[j]) })
+	return window[len(window)/2]
+}
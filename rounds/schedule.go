@@ -0,0 +1,79 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package rounds maps Bitcoin blocks onto Core's turn-round schedule.  Core
+// settles hash power rewards once per round, by default a UTC day, while a
+// mirror only carries the Bitcoin header timestamp.  A Schedule converts
+// times into round numbers, an Assigner applies it to a chain of headers
+// using either the raw timestamp or the median-time-past, and an Accountant
+// accumulates per-round delegation snapshots that can be diffed against the
+// results recorded on chain.
+package rounds
+
+import (
+	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// DefaultLength is the length of a Core round.
+const DefaultLength = 24 * time.Hour
+
+// Schedule describes how time is divided into rounds.  Round n covers
+// [Offset + n*Length, Offset + (n+1)*Length) measured from the Unix epoch.
+type Schedule struct {
+	// Length is the duration of a round, DefaultLength when zero.
+	Length time.Duration
+
+	// Offset shifts every round boundary away from midnight UTC.
+	Offset time.Duration
+}
+
+// DefaultSchedule is the Core mainnet schedule: rounds are UTC days.
+var DefaultSchedule = Schedule{Length: DefaultLength}
+
+// Validate checks that the schedule can be used.
+func (s Schedule) Validate() error {
+	if s.Length < 0 || s.Length%time.Second != 0 {
+		return errors.New("round length must be a positive whole number of seconds")
+	}
+	if s.Offset%time.Second != 0 {
+		return errors.New("round offset must be a whole number of seconds")
+	}
+	return nil
+}
+
+func (s Schedule) length() int64 {
+	if s.Length == 0 {
+		return int64(DefaultLength / time.Second)
+	}
+	return int64(s.Length / time.Second)
+}
+
+// RoundAt returns the round containing t.  Times before the start of round 0
+// belong to round 0.
+func (s Schedule) RoundAt(t time.Time) uint64 {
+	since := t.Unix() - int64(s.Offset/time.Second)
+	if since < 0 {
+		return 0
+	}
+	return uint64(since / s.length())
+}
+
+// Start returns the first second of round.
+func (s Schedule) Start(round uint64) time.Time {
+	return time.Unix(int64(round)*s.length()+int64(s.Offset/time.Second), 0).UTC()
+}
+
+// End returns the first second after round.
+func (s Schedule) End(round uint64) time.Time {
+	return s.Start(round + 1)
+}
+
+// RoundOf returns the round of the header timestamp.  It has the signature
+// of delegation.RoundFunc.
+func (s Schedule) RoundOf(header *wire.BlockHeader) uint64 {
+	return s.RoundAt(header.Timestamp)
+}
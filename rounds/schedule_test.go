@@ -0,0 +1,63 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rounds
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	tests := []struct {
+		schedule Schedule
+		at       time.Time
+		round    uint64
+		start    time.Time
+	}{
+		{
+			DefaultSchedule,
+			time.Date(2022, 7, 1, 23, 59, 59, 0, time.UTC),
+			19174,
+			time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			DefaultSchedule,
+			time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC),
+			19175,
+			time.Date(2022, 7, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Schedule{Length: time.Hour, Offset: 30 * time.Minute},
+			time.Date(1970, 1, 1, 2, 29, 0, 0, time.UTC),
+			1,
+			time.Date(1970, 1, 1, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			Schedule{Length: time.Hour, Offset: time.Hour},
+			time.Date(1970, 1, 1, 0, 10, 0, 0, time.UTC),
+			0,
+			time.Date(1970, 1, 1, 1, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for i, test := range tests {
+		round := test.schedule.RoundAt(test.at)
+		if round != test.round {
+			t.Errorf("RoundAt #%d: got %d, want %d", i, round, test.round)
+			continue
+		}
+		if start := test.schedule.Start(round); !start.Equal(test.start) {
+			t.Errorf("Start #%d: got %v, want %v", i, start, test.start)
+		}
+		if end := test.schedule.End(round); end.Sub(test.schedule.Start(round)) != test.schedule.Length &&
+			test.schedule.Length != 0 {
+			t.Errorf("End #%d: got %v", i, end)
+		}
+	}
+
+	if err := (Schedule{Length: 1500 * time.Millisecond}).Validate(); err == nil {
+		t.Errorf("Validate: expected error for fractional length")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqlindex
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrSchemaTooNew is returned when opening a database migrated by a newer
+// version of this package.
+var ErrSchemaTooNew = errors.New("database schema is newer than supported")
+
+// migrations upgrade the schema one version at a time.  The schema version is
+// kept in PRAGMA user_version, so migrations[i] takes a database from
+// version i to version i+1.  Released migrations must never change; add a
+// new one instead.
+var migrations = []string{
+	// 1: one row per mirrored block.  Hashes are hex in their usual
+	// display order and addresses lowercase hex, so the database reads
+	// well from any SQLite client.  Candidate, reward and
+	// power_block_hash are NULL when the block is not delegated.
+	`CREATE TABLE blocks (
+		height           INTEGER PRIMARY KEY,
+		hash             TEXT    NOT NULL UNIQUE,
+		mirror_id        TEXT    NOT NULL,
+		timestamp        INTEGER NOT NULL,
+		round            INTEGER NOT NULL,
+		payout_address   TEXT,
+		payout_type      INTEGER NOT NULL,
+		candidate        TEXT,
+		reward           TEXT,
+		power_block_hash TEXT,
+		mirror           BLOB    NOT NULL
+	)`,
+
+	// 2: indexes of the delegation queries.
+	`CREATE INDEX blocks_candidate ON blocks (candidate, height)
+		WHERE candidate IS NOT NULL;
+	CREATE INDEX blocks_reward ON blocks (reward, height)
+		WHERE reward IS NOT NULL;
+	CREATE INDEX blocks_round ON blocks (round, height)`,
+}
+
+// schemaVersion returns the schema version of db.
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// migrate upgrades db to the latest schema, applying every migration in its
+// own transaction.
+func migrate(ctx context.Context, db *sql.DB, migrations []string) error {
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%w: version %d, max %d", ErrSchemaTooNew,
+			version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		// PRAGMA does not take parameters.
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqlindex
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "index.db")
+
+	// A database left at the first schema version is upgraded on open.
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(ctx, db, migrations[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := schemaVersion(ctx, db); err != nil || version != 1 {
+		t.Fatalf("schema version %d, %v", version, err)
+	}
+	db.Close()
+
+	x := openTest(t, path)
+	if version, err := schemaVersion(ctx, x.db); err != nil || version != len(migrations) {
+		t.Errorf("schema version %d after open, want %d (%v)", version, len(migrations), err)
+	}
+	var n int
+	err = x.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'blocks_round'").Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("blocks_round index missing: %d, %v", n, err)
+	}
+	x.Close()
+
+	// Migrating again is a no-op.
+	x = openTest(t, path)
+	x.Close()
+
+	db, err = sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(ctx, path, nil); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("newer schema: got %v, want %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestMigrationFailure(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	broken := append(append([]string{}, migrations...), "CREATE TABLE blocks (x)")
+	if err := migrate(ctx, db, broken); err == nil {
+		t.Fatal("broken migration applied")
+	}
+	// The migrations before the broken one are kept.
+	if version, err := schemaVersion(ctx, db); err != nil || version != len(migrations) {
+		t.Errorf("schema version %d, want %d (%v)", version, len(migrations), err)
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package sqlindex persists mirrored blocks and their delegation in a SQLite
+// database, using a pure Go driver so no cgo toolchain is needed.  Every block
+// keeps its verified BtcLightMirrorV2, the power params found by
+// ParsePowerParams, the payout address of its coinbase and its round, and is
+// indexed for queries by candidate, reward address, round and height.  Like
+// delegation.Index it can be fed by a relayer and rolled back when the Bitcoin
+// chain reorganizes.
+package sqlindex
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/coredao-org/btcpowermirror/delegation"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/ethereum/go-ethereum/common"
+
+	// Register the pure Go "sqlite" driver.
+	_ "modernc.org/sqlite"
+)
+
+var (
+	// ErrUnknownBlock is returned when looking up a block that is not in
+	// the index.
+	ErrUnknownBlock = errors.New("block not in index")
+
+	// ErrHeightTaken is returned when adding a block at a height that
+	// holds another block.  The index must be rolled back first.
+	ErrHeightTaken = errors.New("height holds another block")
+)
+
+// Block is an indexed block.
+type Block struct {
+	Height    int64
+	Hash      chainhash.Hash
+	ID        lightmirror.MirrorID
+	Timestamp time.Time
+	Round     uint64
+
+	// PayoutAddress is the address paid by the first coinbase output when
+	// PayoutType is lightmirror.PUBKEYHASH or WITNESS_V0_KEYHASH.
+	PayoutAddress common.Address
+	PayoutType    int
+
+	// Candidate, Reward and PowerBlockHash are the power params of the
+	// block, zero when it does not delegate.
+	Candidate      common.Address
+	Reward         common.Address
+	PowerBlockHash common.Hash
+}
+
+// Delegated reports whether the block delegates its hash power to a Core
+// candidate.
+func (b *Block) Delegated() bool {
+	return b.Candidate != (common.Address{})
+}
+
+// Index is a SQLite database of mirrored blocks.  It is safe for concurrent
+// use.
+type Index struct {
+	db      *sql.DB
+	roundOf delegation.RoundFunc
+}
+
+// Open opens the database at path, creating it when needed, and migrates it
+// to the latest schema.  Blocks are assigned to rounds with roundOf, or with
+// delegation.UTCDayRound when roundOf is nil.
+func Open(ctx context.Context, path string, roundOf delegation.RoundFunc) (*Index, error) {
+	if roundOf == nil {
+		roundOf = delegation.UTCDayRound
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serializes writers and keeps in-memory
+	// databases alive.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, "PRAGMA journal_mode = WAL"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(ctx, db, migrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Index{db: db, roundOf: roundOf}, nil
+}
+
+// Close closes the database.
+func (x *Index) Close() error {
+	return x.db.Close()
+}
+
+// Tip returns the height of the highest indexed block, or -1.
+func (x *Index) Tip(ctx context.Context) (int64, error) {
+	var tip sql.NullInt64
+	err := x.db.QueryRowContext(ctx, "SELECT MAX(height) FROM blocks").Scan(&tip)
+	if err != nil || !tip.Valid {
+		return -1, err
+	}
+	return tip.Int64, nil
+}
+
+// Add stores the verified mirror of the block at height and returns its
+// record.  Adding a block again is a no-op, so relayed blocks may be
+// submitted more than once.
+func (x *Index) Add(ctx context.Context, height int64, mirror *lightmirror.BtcLightMirrorV2) (*Block, error) {
+	b := &Block{
+		Height:    height,
+		Hash:      mirror.BtcHeader.BlockHash(),
+		ID:        mirror.MirrorID(),
+		Timestamp: mirror.BtcHeader.Timestamp,
+		Round:     x.roundOf(&mirror.BtcHeader),
+	}
+	if len(mirror.CoinBaseTx.TxOut) > 0 {
+		b.PayoutAddress, b.PayoutType = mirror.GetCoinbaseAddress()
+	}
+	b.Candidate, b.Reward, b.PowerBlockHash = mirror.ParsePowerParams()
+
+	var raw bytes.Buffer
+	if err := mirror.Serialize(&raw); err != nil {
+		return nil, err
+	}
+
+	tx, err := x.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	err = tx.QueryRowContext(ctx, "SELECT hash FROM blocks WHERE height = ?",
+		height).Scan(&hash)
+	switch {
+	case err == nil && hash == b.Hash.String():
+		return b, nil
+	case err == nil:
+		return nil, fmt.Errorf("%w: block %v at height %d", ErrHeightTaken,
+			hash, height)
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO blocks (height, hash, mirror_id,
+		timestamp, round, payout_address, payout_type, candidate, reward,
+		power_block_hash, mirror) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		height, b.Hash.String(), b.ID.String(), b.Timestamp.Unix(),
+		int64(b.Round), payoutColumn(b), b.PayoutType,
+		delegationColumn(b, b.Candidate), delegationColumn(b, b.Reward),
+		powerBlockHashColumn(b), raw.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return b, tx.Commit()
+}
+
+// payoutColumn returns the payout_address of b.
+func payoutColumn(b *Block) interface{} {
+	if b.PayoutType == lightmirror.NOT_SUPPORT {
+		return nil
+	}
+	return addressText(b.PayoutAddress)
+}
+
+// delegationColumn returns the delegation column holding addr for b.
+func delegationColumn(b *Block, addr common.Address) interface{} {
+	if !b.Delegated() {
+		return nil
+	}
+	return addressText(addr)
+}
+
+// powerBlockHashColumn returns the power_block_hash of b.
+func powerBlockHashColumn(b *Block) interface{} {
+	if !b.Delegated() || b.PowerBlockHash == (common.Hash{}) {
+		return nil
+	}
+	return b.PowerBlockHash.Hex()
+}
+
+// addressText returns addr as stored, lowercase hex.
+func addressText(addr common.Address) string {
+	return strings.ToLower(addr.Hex())
+}
+
+// Rollback deletes every block above height, typically the fork point of a
+// Bitcoin reorganization, and returns the number of deleted blocks.
+func (x *Index) Rollback(ctx context.Context, height int64) (int64, error) {
+	res, err := x.db.ExecContext(ctx, "DELETE FROM blocks WHERE height > ?", height)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Submit stores a relayed mirror, which lets an Index be used directly as a
+// relayer.Submitter.
+func (x *Index) Submit(ctx context.Context, sub *relayer.Submission) error {
+	_, err := x.Add(ctx, sub.Block.Height, sub.Mirror)
+	return err
+}
+
+// Reorg rolls the index back to the fork point.  It implements
+// relayer.ReorgHandler.
+func (x *Index) Reorg(ctx context.Context, fork relayer.BlockID) error {
+	_, err := x.Rollback(ctx, fork.Height)
+	return err
+}
+
+// blockColumns are the columns scanned by scanBlock.
+const blockColumns = `height, hash, mirror_id, timestamp, round,
+	payout_address, payout_type, candidate, reward, power_block_hash`
+
+// rowScanner is implemented by sql.Row and sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanBlock scans the blockColumns of a row.
+func scanBlock(row rowScanner) (*Block, error) {
+	var (
+		b                                         Block
+		hash, id                                  string
+		timestamp, round                          int64
+		payout, candidate, reward, powerBlockHash sql.NullString
+	)
+	err := row.Scan(&b.Height, &hash, &id, &timestamp, &round, &payout,
+		&b.PayoutType, &candidate, &reward, &powerBlockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chainhash.Decode(&b.Hash, hash); err != nil {
+		return nil, err
+	}
+	if err := b.ID.UnmarshalText([]byte(id)); err != nil {
+		return nil, err
+	}
+	b.Timestamp = time.Unix(timestamp, 0)
+	b.Round = uint64(round)
+	b.PayoutAddress = common.HexToAddress(payout.String)
+	b.Candidate = common.HexToAddress(candidate.String)
+	b.Reward = common.HexToAddress(reward.String)
+	b.PowerBlockHash = common.HexToHash(powerBlockHash.String)
+	return &b, nil
+}
+
+// query returns the blocks selected by the SQL clauses following FROM.
+func (x *Index) query(ctx context.Context, clauses string, args ...interface{}) ([]Block, error) {
+	rows, err := x.db.QueryContext(ctx, "SELECT "+blockColumns+" FROM blocks "+clauses, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []Block
+	for rows.Next() {
+		b, err := scanBlock(rows)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, *b)
+	}
+	return blocks, rows.Err()
+}
+
+// Lookup returns the block with the given hash.
+func (x *Index) Lookup(ctx context.Context, hash chainhash.Hash) (*Block, error) {
+	row := x.db.QueryRowContext(ctx, "SELECT "+blockColumns+
+		" FROM blocks WHERE hash = ?", hash.String())
+	b, err := scanBlock(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownBlock, hash)
+	}
+	return b, err
+}
+
+// Mirror returns the stored mirror of the block with the given hash.
+func (x *Index) Mirror(ctx context.Context, hash chainhash.Hash) (*lightmirror.BtcLightMirrorV2, error) {
+	var raw []byte
+	err := x.db.QueryRowContext(ctx, "SELECT mirror FROM blocks WHERE hash = ?",
+		hash.String()).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownBlock, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var mirror lightmirror.BtcLightMirrorV2
+	if err := mirror.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return &mirror, nil
+}
+
+// Blocks returns the blocks with heights in [from, to], delegated or not.
+func (x *Index) Blocks(ctx context.Context, from, to int64) ([]Block, error) {
+	return x.query(ctx, "WHERE height BETWEEN ? AND ? ORDER BY height", from, to)
+}
+
+// CandidateBlocks returns the delegated blocks of candidate with heights in
+// [from, to], at most the first limit of them unless limit is zero.
+func (x *Index) CandidateBlocks(ctx context.Context, candidate common.Address, from, to int64, limit int) ([]Block, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return x.query(ctx, "WHERE candidate = ? AND height BETWEEN ? AND ? ORDER BY height LIMIT ?",
+		addressText(candidate), from, to, limit)
+}
+
+// RewardBlocks returns the delegated blocks paying reward with heights in
+// [from, to].
+func (x *Index) RewardBlocks(ctx context.Context, reward common.Address, from, to int64) ([]Block, error) {
+	return x.query(ctx, "WHERE reward = ? AND height BETWEEN ? AND ? ORDER BY height",
+		addressText(reward), from, to)
+}
+
+// RoundBlocks returns the blocks of round, delegated or not.
+func (x *Index) RoundBlocks(ctx context.Context, round uint64) ([]Block, error) {
+	return x.query(ctx, "WHERE round = ? ORDER BY height", int64(round))
+}
+
+// Round returns the delegation counts of round, or nil if no delegated block
+// falls into it.
+func (x *Index) Round(ctx context.Context, round uint64) (*delegation.RoundStats, error) {
+	rows, err := x.db.QueryContext(ctx, `SELECT candidate, reward, COUNT(*)
+		FROM blocks WHERE round = ? AND candidate IS NOT NULL
+		GROUP BY candidate, reward`, int64(round))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := &delegation.RoundStats{
+		Round:       round,
+		ByCandidate: make(map[common.Address]int),
+		ByReward:    make(map[common.Address]int),
+	}
+	for rows.Next() {
+		var candidate, reward string
+		var n int
+		if err := rows.Scan(&candidate, &reward, &n); err != nil {
+			return nil, err
+		}
+		stats.Blocks += n
+		stats.ByCandidate[common.HexToAddress(candidate)] += n
+		stats.ByReward[common.HexToAddress(reward)] += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if stats.Blocks == 0 {
+		return nil, nil
+	}
+	return stats, nil
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2021 The powermirror developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sqlindex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredao-org/btcpowermirror/blocksource"
+	"github.com/coredao-org/btcpowermirror/chaingen"
+	"github.com/coredao-org/btcpowermirror/delegation"
+	"github.com/coredao-org/btcpowermirror/lightmirror"
+	"github.com/coredao-org/btcpowermirror/relayer"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const day = 24 * 60 * 60
+
+var (
+	candidateA = common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	candidateB = common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	rewardX    = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	rewardY    = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	payout     = common.HexToAddress("0x3333333333333333333333333333333333333333")
+)
+
+// testMirror mines a block stamped timestamp whose coinbase pays payout with
+// P2WPKH and delegates to candidate, or carries no marker when candidate is
+// the zero address, and returns its mirror.
+func testMirror(t *testing.T, timestamp int64, candidate, reward common.Address) *lightmirror.BtcLightMirrorV2 {
+	t.Helper()
+	tmpl := &chaingen.Template{
+		Payout:    chaingen.P2WPKH(payout),
+		Timestamp: time.Unix(timestamp, 0),
+	}
+	if candidate != (common.Address{}) {
+		tmpl.Markers = [][]byte{chaingen.CoreMarker(candidate, reward)}
+	}
+	mirror, err := blocksource.MirrorFromBlock(chaingen.New(nil).Mine(tmpl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mirror
+}
+
+type testBlock struct {
+	candidate, reward common.Address
+	timestamp         int64
+}
+
+var testBlocks = []testBlock{
+	{candidateA, rewardX, 10*day + 100},
+	{candidateB, rewardX, 10*day + 200},
+	{common.Address{}, common.Address{}, 10*day + 300},
+	{candidateA, rewardY, 11*day + 100},
+	{candidateA, rewardX, 11*day + 200},
+}
+
+func openTest(t *testing.T, path string) *Index {
+	t.Helper()
+	x, err := Open(context.Background(), path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { x.Close() })
+	return x
+}
+
+func fill(t *testing.T, x *Index, blocks []testBlock) {
+	t.Helper()
+	for height, b := range blocks {
+		_, err := x.Add(context.Background(), int64(height),
+			testMirror(t, b.timestamp, b.candidate, b.reward))
+		if err != nil {
+			t.Fatalf("Add(%d): %v", height, err)
+		}
+	}
+}
+
+func heights(blocks []Block) []int64 {
+	hs := []int64{}
+	for _, b := range blocks {
+		hs = append(hs, b.Height)
+	}
+	return hs
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	x := openTest(t, filepath.Join(t.TempDir(), "index.db"))
+
+	if tip, err := x.Tip(ctx); err != nil || tip != -1 {
+		t.Fatalf("empty index: tip %d, %v", tip, err)
+	}
+	fill(t, x, testBlocks)
+	if tip, err := x.Tip(ctx); err != nil || tip != 4 {
+		t.Fatalf("tip %d, %v", tip, err)
+	}
+
+	mirror := testMirror(t, testBlocks[3].timestamp, candidateA, rewardY)
+	b, err := x.Lookup(ctx, mirror.BtcHeader.BlockHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Block{
+		Height:        3,
+		Hash:          mirror.BtcHeader.BlockHash(),
+		ID:            mirror.MirrorID(),
+		Timestamp:     time.Unix(testBlocks[3].timestamp, 0),
+		Round:         11,
+		PayoutAddress: payout,
+		PayoutType:    lightmirror.WITNESS_V0_KEYHASH,
+		Candidate:     candidateA,
+		Reward:        rewardY,
+	}
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("Lookup:\ngot  %+v\nwant %+v", b, want)
+	}
+
+	got, err := x.Mirror(ctx, mirror.BtcHeader.BlockHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotRaw, wantRaw bytes.Buffer
+	got.Serialize(&gotRaw)
+	mirror.Serialize(&wantRaw)
+	if !bytes.Equal(gotRaw.Bytes(), wantRaw.Bytes()) {
+		t.Errorf("stored mirror differs")
+	}
+
+	plain := testMirror(t, testBlocks[2].timestamp, common.Address{}, common.Address{})
+	if b, err := x.Lookup(ctx, plain.BtcHeader.BlockHash()); err != nil || b.Delegated() {
+		t.Errorf("undelegated block: %+v, %v", b, err)
+	}
+	if _, err := x.Lookup(ctx, testMirror(t, 1, candidateA, rewardX).BtcHeader.BlockHash()); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("Lookup of unknown block: %v", err)
+	}
+	if _, err := x.Mirror(ctx, testMirror(t, 1, candidateA, rewardX).BtcHeader.BlockHash()); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("Mirror of unknown block: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		query  func() ([]Block, error)
+		height []int64
+	}{
+		{"Blocks", func() ([]Block, error) { return x.Blocks(ctx, 1, 3) }, []int64{1, 2, 3}},
+		{"CandidateBlocks", func() ([]Block, error) { return x.CandidateBlocks(ctx, candidateA, 0, 4, 0) }, []int64{0, 3, 4}},
+		{"CandidateBlocks limit", func() ([]Block, error) { return x.CandidateBlocks(ctx, candidateA, 0, 4, 2) }, []int64{0, 3}},
+		{"CandidateBlocks range", func() ([]Block, error) { return x.CandidateBlocks(ctx, candidateA, 1, 3, 0) }, []int64{3}},
+		{"RewardBlocks", func() ([]Block, error) { return x.RewardBlocks(ctx, rewardX, 0, 4) }, []int64{0, 1, 4}},
+		{"RoundBlocks", func() ([]Block, error) { return x.RoundBlocks(ctx, 10) }, []int64{0, 1, 2}},
+		{"RoundBlocks empty", func() ([]Block, error) { return x.RoundBlocks(ctx, 12) }, []int64{}},
+	}
+	for _, test := range tests {
+		blocks, err := test.query()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := heights(blocks); !reflect.DeepEqual(got, test.height) {
+			t.Errorf("%s: heights %v, want %v", test.name, got, test.height)
+		}
+	}
+
+	stats, err := x.Round(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStats := &delegation.RoundStats{
+		Round:       10,
+		Blocks:      2,
+		ByCandidate: map[common.Address]int{candidateA: 1, candidateB: 1},
+		ByReward:    map[common.Address]int{rewardX: 2},
+	}
+	if !reflect.DeepEqual(stats, wantStats) {
+		t.Errorf("Round(10): got %+v, want %+v", stats, wantStats)
+	}
+	if stats, err := x.Round(ctx, 12); stats != nil || err != nil {
+		t.Errorf("Round(12): got %+v, %v", stats, err)
+	}
+}
+
+func TestAddAgain(t *testing.T) {
+	ctx := context.Background()
+	x := openTest(t, ":memory:")
+	fill(t, x, testBlocks)
+
+	b := testBlocks[1]
+	if _, err := x.Add(ctx, 1, testMirror(t, b.timestamp, b.candidate, b.reward)); err != nil {
+		t.Errorf("adding a block again: %v", err)
+	}
+	_, err := x.Add(ctx, 1, testMirror(t, b.timestamp+1, b.candidate, b.reward))
+	if !errors.Is(err, ErrHeightTaken) {
+		t.Errorf("adding another block at a taken height: got %v, want %v", err, ErrHeightTaken)
+	}
+}
+
+func TestReorg(t *testing.T) {
+	ctx := context.Background()
+	x := openTest(t, ":memory:")
+	fill(t, x, testBlocks)
+
+	if err := x.Reorg(ctx, relayer.BlockID{Height: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if tip, _ := x.Tip(ctx); tip != 2 {
+		t.Errorf("tip %d after reorg, want 2", tip)
+	}
+	if blocks, _ := x.CandidateBlocks(ctx, candidateA, 0, 10, 0); !reflect.DeepEqual(heights(blocks), []int64{0}) {
+		t.Errorf("candidate blocks %v after reorg", heights(blocks))
+	}
+	if stats, _ := x.Round(ctx, 11); stats != nil {
+		t.Errorf("round 11 survived the reorg: %+v", stats)
+	}
+
+	// The replacement branch takes the freed heights.
+	replacement := testMirror(t, 11*day+500, candidateB, rewardY)
+	err := x.Submit(ctx, &relayer.Submission{
+		Block:  relayer.BlockID{Height: 3, Hash: replacement.BtcHeader.BlockHash()},
+		Mirror: replacement,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks, _ := x.CandidateBlocks(ctx, candidateB, 0, 10, 0); !reflect.DeepEqual(heights(blocks), []int64{1, 3}) {
+		t.Errorf("candidate blocks %v after the new branch", heights(blocks))
+	}
+
+	if n, err := x.Rollback(ctx, -1); err != nil || n != 4 {
+		t.Errorf("rollback of everything deleted %d blocks, %v", n, err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "index.db")
+	x, err := Open(ctx, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, x, testBlocks)
+	x.Close()
+
+	x = openTest(t, path)
+	if tip, err := x.Tip(ctx); err != nil || tip != 4 {
+		t.Errorf("reopened index: tip %d, %v", tip, err)
+	}
+	if blocks, _ := x.RewardBlocks(ctx, rewardY, 0, 4); !reflect.DeepEqual(heights(blocks), []int64{3}) {
+		t.Errorf("reopened index: reward blocks %v", heights(blocks))
+	}
+}
+
+func TestQueryPlans(t *testing.T) {
+	x := openTest(t, ":memory:")
+	queries := map[string]string{
+		"blocks_candidate": "SELECT height FROM blocks WHERE candidate = 'a' AND height BETWEEN 1 AND 2",
+		"blocks_reward":    "SELECT height FROM blocks WHERE reward = 'a' AND height BETWEEN 1 AND 2",
+		"blocks_round":     "SELECT height FROM blocks WHERE round = 3 ORDER BY height",
+	}
+	for index, query := range queries {
+		rows, err := x.db.Query("EXPLAIN QUERY PLAN " + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if !strings.Contains(strings.Join(plan, "\n"), index) {
+			t.Errorf("%s does not use %s: %v", query, index, plan)
+		}
+	}
+}